@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	benchmark_command = app.Command(
+		"benchmark", "Measure read performance of an image.")
+
+	benchmark_command_file_arg = benchmark_command.Arg(
+		"file", "The image file to read",
+	).Required().String()
+
+	benchmark_command_pattern = benchmark_command.Flag(
+		"pattern", "The read pattern",
+	).Default("seq").Enum("seq", "random")
+
+	benchmark_command_block_size = benchmark_command.Flag(
+		"block-size", "Size of each read (e.g. 64K)",
+	).Default("64K").String()
+
+	benchmark_command_duration = benchmark_command.Flag(
+		"duration", "How long to run for",
+	).Default("30s").Duration()
+
+	benchmark_command_grain_table_cache = benchmark_command.Flag(
+		"grain-table-cache", "Number of grain tables to cache per extent",
+	).Int()
+
+	benchmark_command_read_concurrency = benchmark_command.Flag(
+		"read-concurrency", "Number of extents read at once",
+	).Int()
+
+	benchmark_command_max_open = benchmark_command.Flag(
+		"max-open", "Open extent files on demand, keeping at most this many open",
+	).Int()
+
+	benchmark_command_readahead = benchmark_command.Flag(
+		"readahead", "Prefetch this much after sequential reads (e.g. 4M)",
+	).String()
+)
+
+// Number of read latencies sampled for the percentiles.
+const benchmarkLatencySamples = 100000
+
+type benchmarkResult struct {
+	Filename  string        `json:"Filename"`
+	Pattern   string        `json:"Pattern"`
+	BlockSize int64         `json:"BlockSize"`
+	Duration  time.Duration `json:"Duration"`
+
+	Reads      int64   `json:"Reads"`
+	Bytes      int64   `json:"Bytes"`
+	Throughput float64 `json:"Throughput"`
+	IOPS       float64 `json:"IOPS"`
+
+	// Latency percentiles of individual reads.
+	LatencyP50 time.Duration `json:"LatencyP50"`
+	LatencyP90 time.Duration `json:"LatencyP90"`
+	LatencyP99 time.Duration `json:"LatencyP99"`
+	LatencyMax time.Duration `json:"LatencyMax"`
+
+	Metrics parser.Metrics `json:"Metrics"`
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func runBenchmark(reader io.ReaderAt, size, block_size int64,
+	random bool, duration time.Duration) (*benchmarkResult, error) {
+	res := &benchmarkResult{BlockSize: block_size}
+
+	blocks := size / block_size
+	if blocks == 0 {
+		return nil, fmt.Errorf("Image is smaller than the block size")
+	}
+
+	buf := make([]byte, block_size)
+	var latencies []time.Duration
+	var block int64
+
+	start := time.Now()
+	for time.Since(start) < duration {
+		if random {
+			block = rand.Int63n(blocks)
+		}
+
+		read_start := time.Now()
+		n, err := reader.ReadAt(buf, block*block_size)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		latency := time.Since(read_start)
+
+		// Keep a uniform sample of latencies to bound memory use.
+		res.Reads++
+		if len(latencies) < benchmarkLatencySamples {
+			latencies = append(latencies, latency)
+		} else if i := rand.Int63n(res.Reads); i < benchmarkLatencySamples {
+			latencies[i] = latency
+		}
+
+		res.Bytes += int64(n)
+
+		// Sequential reads wrap around at the end of the disk.
+		if !random {
+			block = (block + 1) % blocks
+		}
+	}
+	res.Duration = time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	seconds := res.Duration.Seconds()
+	res.Throughput = float64(res.Bytes) / seconds
+	res.IOPS = float64(res.Reads) / seconds
+	res.LatencyP50 = percentile(latencies, 50)
+	res.LatencyP90 = percentile(latencies, 90)
+	res.LatencyP99 = percentile(latencies, 99)
+	res.LatencyMax = percentile(latencies, 100)
+
+	return res, nil
+}
+
+func doBenchmark() {
+	block_size, err := parseSize(*benchmark_command_block_size)
+	fatalIfError(err, "Block size")
+	if block_size <= 0 {
+		fatalf("Block size must be positive")
+	}
+
+	var opts []parser.Option
+	if *benchmark_command_grain_table_cache > 0 {
+		opts = append(opts,
+			parser.WithGrainTableCache(*benchmark_command_grain_table_cache))
+	}
+
+	if *benchmark_command_read_concurrency > 1 {
+		opts = append(opts,
+			parser.WithReadConcurrency(*benchmark_command_read_concurrency))
+	}
+
+	if *benchmark_command_readahead != "" {
+		readahead, err := parseSize(*benchmark_command_readahead)
+		fatalIfError(err, "Readahead")
+		opts = append(opts, parser.WithReadahead(readahead))
+	}
+
+	if *benchmark_command_max_open > 0 {
+		opts = append(opts, parser.WithLazyOpen(*benchmark_command_max_open))
+	}
+
+	vmdk, err := openVMDK(*benchmark_command_file_arg, opts...)
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	res, err := runBenchmark(vmdk, vmdk.Size(), block_size,
+		*benchmark_command_pattern == "random", *benchmark_command_duration)
+	fatalIfError(err, "Benchmark failed")
+
+	res.Filename = *benchmark_command_file_arg
+	res.Pattern = *benchmark_command_pattern
+	res.Metrics = vmdk.Metrics()
+
+	writeResult(res, func() {
+		fmt.Printf("%v reads of %v in %v (%v)\n", res.Reads,
+			formatBytes(res.BlockSize), res.Duration.Truncate(time.Millisecond),
+			res.Pattern)
+		fmt.Printf("Throughput: %v/s\n", formatBytes(int64(res.Throughput)))
+		fmt.Printf("IOPS:       %.0f\n", res.IOPS)
+		fmt.Printf("Latency:    p50 %v  p90 %v  p99 %v  max %v\n",
+			res.LatencyP50, res.LatencyP90, res.LatencyP99, res.LatencyMax)
+		if *benchmark_command_grain_table_cache > 0 {
+			fmt.Printf("Grain tables: %v hits, %v misses, %v evictions\n",
+				res.Metrics.GrainTableHits, res.Metrics.GrainTableMisses,
+				res.Metrics.GrainTableEvictions)
+		}
+		if *benchmark_command_max_open > 0 {
+			fmt.Printf("Extent files: %v opens, %v reopens\n",
+				res.Metrics.ExtentOpens, res.Metrics.ExtentReopens)
+		}
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case benchmark_command.FullCommand():
+			doBenchmark()
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	carve_command = app.Command(
+		"carve", "Extract a partition to a file.")
+
+	carve_command_file_arg = carve_command.Arg(
+		"file", "The image file to read",
+	).Required().String()
+
+	carve_command_partition = carve_command.Flag(
+		"partition", "The partition number",
+	).Int()
+
+	carve_command_partition_guid = carve_command.Flag(
+		"partition-guid", "The unique GUID of a GPT partition",
+	).String()
+
+	carve_command_output = carve_command.Flag(
+		"output", "Where to write the partition",
+	).Required().String()
+)
+
+type carveResult struct {
+	Partition parser.Partition `json:"Partition"`
+	Output    string           `json:"Output"`
+	SHA256    string           `json:"SHA256"`
+}
+
+// Copy length bytes at offset of the disk to the start of out. Regions
+// that are unallocated or all zero are left as holes in out. The
+// SHA256 of the copied range is returned.
+func carveRange(ctx context.Context, vmdk *parser.VMDKContext,
+	offset, length int64, out *os.File,
+	progress parser.ProgressFunc) ([]byte, error) {
+	hash := sha256.New()
+	buf := make([]byte, 1024*1024)
+	zero := make([]byte, len(buf))
+
+	end := offset + length
+	allocated := vmdk.AllocatedRanges()
+
+	for pos := offset; pos < end; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		to_read := end - pos
+		if to_read > int64(len(buf)) {
+			to_read = int64(len(buf))
+		}
+
+		// Skip over allocated ranges that end before this chunk.
+		for len(allocated) > 0 && allocated[0].End() <= pos {
+			allocated = allocated[1:]
+		}
+
+		if len(allocated) == 0 || allocated[0].Offset >= pos+to_read {
+			hash.Write(zero[:to_read])
+
+		} else {
+			n, err := vmdk.ReadAt(buf[:to_read], pos)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			if int64(n) < to_read {
+				return nil, fmt.Errorf("Short read at %#x", pos+int64(n))
+			}
+
+			hash.Write(buf[:to_read])
+			if !isZero(buf[:to_read]) {
+				_, err = out.WriteAt(buf[:to_read], pos-offset)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		pos += to_read
+		if progress != nil {
+			progress(pos-offset, length)
+		}
+	}
+
+	// Extend the file over any trailing hole.
+	err := out.Truncate(length)
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+func doCarve() {
+	if (*carve_command_partition == 0) == (*carve_command_partition_guid == "") {
+		fatalf("Specify exactly one of --partition or --partition-guid")
+	}
+
+	vmdk, err := openVMDK(*carve_command_file_arg, parser.WithHighResolutionRanges())
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	var partition *parser.Partition
+	if *carve_command_partition_guid != "" {
+		partition, err = vmdk.GetPartitionByGUID(*carve_command_partition_guid)
+	} else {
+		partition, err = vmdk.GetPartition(*carve_command_partition)
+	}
+	if err != nil {
+		fatalWithCode(EXIT_NOT_FOUND, "%v", err)
+	}
+
+	if partition.Start+partition.Size > vmdk.Size() {
+		fatalf("Partition %v (%#x - %#x) extends beyond the end of the disk",
+			partition.Index, partition.Start, partition.Start+partition.Size)
+	}
+
+	out, err := os.Create(*carve_command_output)
+	fatalIfError(err, "Can not create output")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	progress := newProgressReporter("carve")
+	digest, err := carveRange(ctx, vmdk, partition.Start, partition.Size,
+		out, progress.Report)
+	progress.Done()
+	out.Close()
+
+	if errors.Is(err, context.Canceled) {
+		fatalf("Interrupted after %v - %v is incomplete",
+			progress.Summary(), *carve_command_output)
+	}
+	fatalIfError(err, "Carve failed, %v is incomplete", *carve_command_output)
+
+	res := &carveResult{
+		Partition: *partition,
+		Output:    *carve_command_output,
+		SHA256:    fmt.Sprintf("%x", digest),
+	}
+	writeResult(res, func() {
+		fmt.Printf("Partition %v (type %v) at offset %#x, %v bytes -> %v\n",
+			res.Partition.Index, res.Partition.Type, res.Partition.Start,
+			res.Partition.Size, res.Output)
+		fmt.Printf("SHA256: %v\n", res.SHA256)
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case carve_command.FullCommand():
+			doCarve()
+		default:
+			return false
+		}
+		return true
+	})
+}
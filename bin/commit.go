@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	commit_command = app.Command(
+		"commit", "Merge a snapshot into its parent disk in place.")
+
+	commit_command_file_arg = commit_command.Arg(
+		"file", "The snapshot vmdk to merge",
+	).Required().String()
+
+	commit_command_dry_run = commit_command.Flag(
+		"dry-run", "Only report what would change",
+	).Bool()
+
+	commit_command_delete = commit_command.Flag(
+		"delete", "Delete the snapshot files after a successful commit",
+	).Bool()
+
+	commit_command_rename = commit_command.Flag(
+		"rename", "Rename the snapshot files by adding this suffix "+
+			"after a successful commit",
+	).String()
+
+	commit_command_force = commit_command.Flag(
+		"force", "Commit even if other snapshots are based on the parent",
+	).Bool()
+)
+
+type commitResult struct {
+	*parser.CommitResult
+	Snapshot string   `json:"Snapshot"`
+	DryRun   bool     `json:"DryRun"`
+	CID      string   `json:"CID,omitempty"`
+	Removed  []string `json:"Removed,omitempty"`
+	Renamed  []string `json:"Renamed,omitempty"`
+}
+
+// The files making up the snapshot: the descriptor and its extents.
+func snapshotFiles(filename string, vmdk *parser.VMDKContext) []string {
+	res := []string{filename}
+	seen := map[string]bool{filename: true}
+	for _, e := range vmdk.Stats().Extents {
+		if e.Filename == "" {
+			continue
+		}
+
+		path := resolvePath(filepath.Dir(filename), e.Filename)
+		if !seen[path] {
+			seen[path] = true
+			res = append(res, path)
+		}
+	}
+	return res
+}
+
+// Resolve name relative to dir unless it is absolute.
+func resolvePath(dir, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// Other snapshots in the directories of the snapshot and of its parent
+// whose parent is also parent_path.
+func otherChildren(filename, parent_path string) ([]string, error) {
+	parent_st, err := os.Stat(parent_path)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot_st, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	seen := make(map[string]bool)
+	for _, dir := range []string{
+		filepath.Dir(filename), filepath.Dir(parent_path)} {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		candidates, err := filepath.Glob(filepath.Join(dir, "*.vmdk"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, candidate := range candidates {
+			st, err := os.Stat(candidate)
+			if err != nil || os.SameFile(st, snapshot_st) ||
+				os.SameFile(st, parent_st) {
+				continue
+			}
+
+			hint, err := parentHint(candidate, st.Size())
+			if err != nil || hint == "" {
+				continue
+			}
+
+			hint_st, err := os.Stat(resolvePath(dir, hint))
+			if err == nil && os.SameFile(hint_st, parent_st) {
+				res = append(res, candidate)
+			}
+		}
+	}
+	return res, nil
+}
+
+// The parentFileNameHint of the descriptor in filename. Extent files
+// hold no descriptor and fail.
+func parentHint(filename string, size int64) (string, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	descriptor, err := parser.ReadDescriptor(fd, size)
+	if err != nil {
+		return "", err
+	}
+	return parser.ParseConfig(descriptor).ParentFileNameHint, nil
+}
+
+// Check that the snapshot in filename can be merged into its parent.
+// Warnings are returned for problems which do not prevent the commit,
+// an error for those that do. force allows committing into a parent
+// other snapshots are based on.
+func checkCommit(filename string, vmdk *parser.VMDKContext, force bool) (
+	[]string, error) {
+	parent := vmdk.Parent()
+	if parent == nil {
+		return nil, fmt.Errorf("%v is not a snapshot", filename)
+	}
+
+	// Merging into a parent that changed since the snapshot was taken
+	// (or the wrong parent) would corrupt it.
+	warnings := vmdk.ChainWarnings()
+	if len(warnings) > 0 {
+		return warnings, errors.New("Chain is inconsistent - refusing " +
+			"to commit. The parent may have been modified after the " +
+			"snapshot was taken.")
+	}
+
+	// Merging would change the data other snapshots of the parent are
+	// based on.
+	parent_path := resolvePath(filepath.Dir(filename), parent.Filename())
+	children, err := otherChildren(filename, parent_path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		warnings = append(warnings, fmt.Sprintf(
+			"%v is also based on %v", child, parent_path))
+	}
+	if len(children) > 0 && !force {
+		return warnings, fmt.Errorf("Other snapshots are based on %v - "+
+			"refusing to commit. Use --force to commit anyway.", parent_path)
+	}
+
+	return warnings, nil
+}
+
+// Give the disk in filename a new CID. The low 32 bits of the
+// longContentID are the CID, so it is updated as well when present.
+// checkCommit refused chains with an invalid longContentID so one
+// that can not be parsed here is left alone.
+func setCID(filename, cid string) error {
+	_, err := rewriteDescriptor(filename,
+		func(config *parser.VMDKConfig) error {
+			err := config.Set("CID", cid)
+			if err != nil || config.DBBLongContentID == "" {
+				return err
+			}
+
+			long_content_id, err := config.LongContentID()
+			if err != nil {
+				return nil
+			}
+
+			return config.Set("ddb.longContentID",
+				hex.EncodeToString(long_content_id[:12])+cid)
+		})
+	return err
+}
+
+func doCommit() {
+	filename := *commit_command_file_arg
+
+	if *commit_command_delete && *commit_command_rename != "" {
+		fatalf("Only one of --delete and --rename may be given")
+	}
+
+	vmdk, err := openVMDK(filename)
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	parent := vmdk.Parent()
+	if parent == nil {
+		fatalf("%v is not a snapshot", filename)
+	}
+
+	warnings, err := checkCommit(filename, vmdk, *commit_command_force)
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", w)
+	}
+	if err != nil {
+		fatalWithCode(EXIT_FINDINGS, "%v", err)
+	}
+
+	// Extent filenames are relative to the parent's descriptor, which
+	// need not be in the snapshot's directory.
+	parent_path := resolvePath(filepath.Dir(filename), parent.Filename())
+	parent_dir := filepath.Dir(parent_path)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	progress := newProgressReporter("commit")
+	merged, err := vmdk.Commit(ctx, func(extent_filename string) (
+		io.WriterAt, func(), error) {
+		fd, err := os.OpenFile(
+			resolvePath(parent_dir, extent_filename), os.O_RDWR, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fd, func() { fd.Close() }, nil
+	}, *commit_command_dry_run, progress.Report)
+	progress.Done()
+
+	if errors.Is(err, context.Canceled) {
+		fatalf("Interrupted after %v - %v is partially merged",
+			progress.Summary(), parent_path)
+	}
+	fatalIfError(err, "Commit failed")
+
+	res := &commitResult{
+		CommitResult: merged,
+		Snapshot:     filename,
+		DryRun:       *commit_command_dry_run,
+	}
+
+	files := snapshotFiles(filename, vmdk)
+	if !res.DryRun {
+		// The parent's contents changed so it needs a new CID.
+		res.CID = parser.NewCID()
+		err = setCID(parent_path, res.CID)
+		fatalIfError(err, "Can not update the CID of %v", parent_path)
+
+		vmdk.Close()
+		for _, f := range files {
+			switch {
+			case *commit_command_delete:
+				err = os.Remove(f)
+				fatalIfError(err, "Can not delete %v", f)
+				res.Removed = append(res.Removed, f)
+
+			case *commit_command_rename != "":
+				err = os.Rename(f, f+*commit_command_rename)
+				fatalIfError(err, "Can not rename %v", f)
+				res.Renamed = append(res.Renamed, f+*commit_command_rename)
+			}
+		}
+	}
+
+	writeResult(res, func() {
+		verb := "Merged"
+		if res.DryRun {
+			verb = "Would merge"
+			for _, r := range res.Ranges {
+				fmt.Printf("%#010x - %#010x (%v)\n", r.Offset, r.End(),
+					formatBytes(r.Length))
+			}
+		}
+		fmt.Printf("%v %v grains (%v) from %v into %v, %v newly allocated\n",
+			verb, res.Grains, formatBytes(res.Bytes), filename,
+			res.Parent, res.Allocated)
+
+		if res.CID != "" {
+			fmt.Printf("New parent CID: %v\n", res.CID)
+		}
+		for _, f := range res.Removed {
+			fmt.Printf("Deleted %v\n", f)
+		}
+		for _, f := range res.Renamed {
+			fmt.Printf("Renamed to %v\n", f)
+		}
+		if res.DryRun && (*commit_command_delete ||
+			*commit_command_rename != "") {
+			for _, f := range files {
+				fmt.Printf("Would remove %v\n", f)
+			}
+		}
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case commit_command.FullCommand():
+			doCommit()
+		default:
+			return false
+		}
+		return true
+	})
+}
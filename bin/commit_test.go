@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const commitTestDescriptor = `# Disk DescriptorFile
+version=1
+CID=%CID%
+parentCID=%PARENT_CID%
+createType="monolithicFlat"
+%HINT%
+# Extent description
+RW 8 FLAT "%EXTENT%" 0
+`
+
+// Write a flat disk of 4kb to dir, based on the disk at hint if set.
+func writeFlatDisk(t *testing.T, dir, name, cid, hint string) string {
+	os.MkdirAll(dir, 0755)
+
+	parent_cid := "ffffffff"
+	if hint != "" {
+		parent_cid = "11111111"
+		hint = `parentFileNameHint="` + hint + `"`
+	}
+
+	extent := strings.TrimSuffix(name, ".vmdk") + "-flat.vmdk"
+	descriptor := strings.NewReplacer("%CID%", cid,
+		"%PARENT_CID%", parent_cid, "%HINT%", hint,
+		"%EXTENT%", extent).Replace(commitTestDescriptor)
+
+	filename := filepath.Join(dir, name)
+	err := os.WriteFile(filename, []byte(descriptor), 0644)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, extent), make([]byte, 4096), 0644)
+	}
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return filename
+}
+
+func TestCheckCommit(t *testing.T) {
+	// The parent is in a sibling directory of the snapshot.
+	dir := t.TempDir()
+	base := writeFlatDisk(t, filepath.Join(dir, "base"), "base.vmdk",
+		"11111111", "")
+	snapshot := writeFlatDisk(t, filepath.Join(dir, "vm"), "snapshot.vmdk",
+		"22222222", "../base/base.vmdk")
+
+	vmdk, err := openVMDK(snapshot)
+	if err != nil {
+		t.Fatalf("openVMDK: %v", err)
+	}
+	defer vmdk.Close()
+
+	warnings, err := checkCommit(snapshot, vmdk, false)
+	if err != nil || len(warnings) > 0 {
+		t.Fatalf("checkCommit: %v %v", warnings, err)
+	}
+
+	// Another snapshot of the parent, naming it by its absolute path.
+	other := writeFlatDisk(t, filepath.Join(dir, "vm"), "other.vmdk",
+		"33333333", base)
+
+	warnings, err = checkCommit(snapshot, vmdk, false)
+	if err == nil || len(warnings) != 1 ||
+		!strings.Contains(warnings[0], other) {
+		t.Fatalf("Expected a refusal: %v %v", warnings, err)
+	}
+
+	warnings, err = checkCommit(snapshot, vmdk, true)
+	if err != nil || len(warnings) != 1 {
+		t.Fatalf("Expected --force to commit: %v %v", warnings, err)
+	}
+}
+
+func TestSetCID(t *testing.T) {
+	dir := t.TempDir()
+	filename := writeFlatDisk(t, dir, "base.vmdk", "11111111", "")
+
+	descriptor, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	descriptor = append(descriptor,
+		"ddb.longContentID = \"0123456789abcdef0123456711111111\"\n"...)
+	err = os.WriteFile(filename, descriptor, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	err = setCID(filename, "cafebabe")
+	if err != nil {
+		t.Fatalf("setCID: %v", err)
+	}
+
+	vmdk, err := openVMDK(filename)
+	if err != nil {
+		t.Fatalf("openVMDK: %v", err)
+	}
+	defer vmdk.Close()
+
+	if warnings := vmdk.ChainWarnings(); len(warnings) > 0 {
+		t.Fatalf("Unexpected warnings %v", warnings)
+	}
+
+	config := vmdk.Config()
+	if config.CID != "cafebabe" ||
+		config.DBBLongContentID != "0123456789abcdef01234567cafebabe" {
+		t.Fatalf("Unexpected IDs %v %v", config.CID, config.DBBLongContentID)
+	}
+}
+
+func TestSnapshotFilesAbsoluteExtent(t *testing.T) {
+	dir := t.TempDir()
+	extent := filepath.Join(dir, "data", "disk-flat.vmdk")
+	os.MkdirAll(filepath.Dir(extent), 0755)
+	err := os.WriteFile(extent, make([]byte, 4096), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	filename := filepath.Join(dir, "disk.vmdk")
+	descriptor := strings.NewReplacer("%CID%", "11111111",
+		"%PARENT_CID%", "ffffffff", "%HINT%", "",
+		"%EXTENT%", extent).Replace(commitTestDescriptor)
+	err = os.WriteFile(filename, []byte(descriptor), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	vmdk, err := openVMDK(filename)
+	if err != nil {
+		t.Fatalf("openVMDK: %v", err)
+	}
+	defer vmdk.Close()
+
+	files := snapshotFiles(filename, vmdk)
+	if len(files) != 2 || files[0] != filename || files[1] != extent {
+		t.Fatalf("Unexpected files %v", files)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	compact_command = app.Command(
+		"compact", "Rewrite a disk as monolithicSparse without zero grains.")
+
+	compact_command_file_arg = compact_command.Arg(
+		"file", "The vmdk to compact",
+	).Required().String()
+
+	compact_command_output = compact_command.Flag(
+		"output", "Where to write the compacted disk "+
+			"(default <name>-compact.vmdk)",
+	).String()
+
+	compact_command_in_place = compact_command.Flag(
+		"in-place", "Replace the disk with the compacted copy",
+	).Bool()
+
+	compact_command_workers = compact_command.Flag(
+		"workers", "Number of parts of the disk to read and hash at once",
+	).Default("1").Int()
+)
+
+type compactResult struct {
+	Input     string `json:"Input"`
+	Output    string `json:"Output"`
+	InPlace   bool   `json:"InPlace"`
+	SizeIn    int64  `json:"SizeIn"`
+	SizeOut   int64  `json:"SizeOut"`
+	Reclaimed int64  `json:"Reclaimed"`
+	SHA256    string `json:"SHA256"`
+}
+
+// The total size of the files backing the disk.
+func diskFileSize(filename string, vmdk *parser.VMDKContext) (int64, error) {
+	var size int64
+	for _, f := range snapshotFiles(filename, vmdk) {
+		st, err := os.Stat(f)
+		if err != nil {
+			return 0, err
+		}
+		size += st.Size()
+	}
+	return size, nil
+}
+
+// Open a monolithicSparse file whatever name its descriptor uses for
+// the extent.
+func openMonolithic(filename string, opts ...parser.Option) (
+	*parser.VMDKContext, func(), error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+
+	vmdk, err := parser.GetVMDKContext(fd, int(st.Size()),
+		func(string) (io.ReaderAt, func(), error) {
+			return fd, nil, nil
+		}, opts...)
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+
+	return vmdk, func() {
+		vmdk.Close()
+		fd.Close()
+	}, nil
+}
+
+func doCompact() {
+	filename := *compact_command_file_arg
+	in_place := *compact_command_in_place
+
+	if in_place && *compact_command_output != "" {
+		fatalf("Only one of --in-place and --output may be given")
+	}
+
+	vmdk, err := openVMDK(filename,
+		parser.WithExportWorkers(*compact_command_workers))
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	// Compacting a snapshot would merge in the parent.
+	if vmdk.Parent() != nil {
+		fatalf("%v is a snapshot - use commit or flatten instead", filename)
+	}
+
+	files := snapshotFiles(filename, vmdk)
+	if in_place && len(files) > 1 {
+		fatalf("%v uses separate extent files - use --output instead",
+			filename)
+	}
+
+	size_in, err := diskFileSize(filename, vmdk)
+	fatalIfError(err, "Can not stat %v", filename)
+
+	output := *compact_command_output
+	if output == "" {
+		output = strings.TrimSuffix(filename, filepath.Ext(filename)) +
+			"-compact.vmdk"
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	progress := newProgressReporter("compact")
+	digest, err := hashDisk(ctx, vmdk, progress.Report)
+	progress.Done()
+	fatalIfError(err, "Can not hash %v", filename)
+
+	// In place we write a temporary file next to the original so the
+	// final rename is atomic.
+	var out *os.File
+	if in_place {
+		output = filename
+		out, err = os.CreateTemp(filepath.Dir(filename), ".compact-*.vmdk")
+		if err == nil {
+			var st os.FileInfo
+			st, err = os.Stat(filename)
+			if err == nil {
+				err = out.Chmod(st.Mode())
+			}
+			if err != nil {
+				out.Close()
+				os.Remove(out.Name())
+			}
+		}
+	} else {
+		out, err = os.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	fatalIfError(err, "Can not create output")
+
+	written := out.Name()
+	cleanup := func() {
+		out.Close()
+		os.Remove(written)
+	}
+
+	progress = newProgressReporter("compact")
+	err = vmdk.WriteMonolithicSparse(ctx, out, filepath.Base(output),
+		progress.Report)
+	progress.Done()
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		cleanup()
+		if errors.Is(err, context.Canceled) {
+			fatalf("Interrupted after %v - nothing was changed",
+				progress.Summary())
+		}
+		fatalIfError(err, "Compact failed")
+	}
+	out.Close()
+
+	// Never replace or keep a copy whose contents differ.
+	compacted, closer, err := openMonolithic(written,
+		parser.WithExportWorkers(*compact_command_workers))
+	if err == nil {
+		var check []byte
+		check, err = hashDisk(ctx, compacted, nil)
+		closer()
+		if err == nil && !bytes.Equal(check, digest) {
+			err = fmt.Errorf("Content hash %x does not match %x", check, digest)
+		}
+	}
+	if err != nil {
+		os.Remove(written)
+		fatalIfError(err, "Verification of the compacted disk failed, "+
+			"nothing was changed")
+	}
+
+	st, err := os.Stat(written)
+	fatalIfError(err, "Can not stat %v", written)
+
+	if in_place {
+		vmdk.Close()
+		err = os.Rename(written, filename)
+		if err != nil {
+			os.Remove(written)
+		}
+		fatalIfError(err, "Can not replace %v", filename)
+	}
+
+	res := &compactResult{
+		Input:     filename,
+		Output:    output,
+		InPlace:   in_place,
+		SizeIn:    size_in,
+		SizeOut:   st.Size(),
+		Reclaimed: size_in - st.Size(),
+		SHA256:    fmt.Sprintf("%x", digest),
+	}
+	writeResult(res, func() {
+		fmt.Printf("Compacted %v into %v\n", res.Input, res.Output)
+		fmt.Printf("Size: %v -> %v (%v reclaimed)\n",
+			formatBytes(res.SizeIn), formatBytes(res.SizeOut),
+			formatBytes(res.Reclaimed))
+		fmt.Printf("SHA256 (verified): %v\n", res.SHA256)
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case compact_command.FullCommand():
+			doCompact()
+		default:
+			return false
+		}
+		return true
+	})
+}
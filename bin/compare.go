@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	compare_command = app.Command(
+		"compare", "Compare the logical content of two images.")
+
+	compare_command_a = compare_command.Arg(
+		"a", "The first image",
+	).Required().String()
+
+	compare_command_b = compare_command.Arg(
+		"b", "The second image",
+	).Required().String()
+
+	compare_command_block_size = compare_command.Flag(
+		"block-size", "Size of blocks to compare (e.g. 1M)",
+	).Default("1M").String()
+
+	compare_command_max_ranges = compare_command.Flag(
+		"max-ranges", "Maximum number of differing ranges to list",
+	).Default("10").Int()
+)
+
+type compareResult struct {
+	A         string `json:"A"`
+	B         string `json:"B"`
+	SizeA     int64  `json:"SizeA"`
+	SizeB     int64  `json:"SizeB"`
+	Identical bool   `json:"Identical"`
+
+	// Differing byte ranges in the common part of the disks. Only the
+	// first --max-ranges are reported.
+	Ranges         []parser.Range `json:"Ranges"`
+	TotalRanges    int            `json:"TotalRanges"`
+	DifferingBytes int64          `json:"DifferingBytes"`
+}
+
+func (self *compareResult) addDifference(offset int64) {
+	self.DifferingBytes++
+
+	if len(self.Ranges) > 0 {
+		last := &self.Ranges[len(self.Ranges)-1]
+		if last.End() == offset {
+			last.Length++
+			return
+		}
+	}
+
+	self.Ranges = append(self.Ranges, parser.Range{Offset: offset, Length: 1})
+}
+
+// Compare two disks. Regions which are unallocated in both disks are
+// skipped since they read as zeros in both.
+// The comparison stops when ctx is cancelled, returning the
+// differences found so far.
+func compareDisks(ctx context.Context, a, b *parser.VMDKContext,
+	block_size int64, progress parser.ProgressFunc) (
+	*compareResult, error) {
+	res := &compareResult{SizeA: a.Size(), SizeB: b.Size()}
+
+	size := a.Size()
+	if b.Size() < size {
+		size = b.Size()
+	}
+
+	allocated := mergeRanges(append(a.AllocatedRanges(), b.AllocatedRanges()...))
+
+	buf_a := make([]byte, block_size)
+	buf_b := make([]byte, block_size)
+
+	var total, done int64
+	for _, r := range allocated {
+		total += r.Length
+	}
+
+	for _, r := range allocated {
+		end := r.End()
+		if end > size {
+			end = size
+		}
+
+		for offset := r.Offset; offset < end; offset += block_size {
+			select {
+			case <-ctx.Done():
+				return res, ctx.Err()
+			default:
+			}
+
+			to_read := end - offset
+			if to_read > block_size {
+				to_read = block_size
+			}
+
+			n_a, err := a.ReadAt(buf_a[:to_read], offset)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			n_b, err := b.ReadAt(buf_b[:to_read], offset)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			if n_a != int(to_read) || n_b != int(to_read) {
+				return nil, fmt.Errorf("Short read at %#x", offset)
+			}
+
+			for i := int64(0); i < to_read; i++ {
+				if buf_a[i] != buf_b[i] {
+					res.addDifference(offset + i)
+				}
+			}
+
+			done += to_read
+			if progress != nil {
+				progress(done, total)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func mergeRanges(ranges []parser.Range) []parser.Range {
+	var res []parser.Range
+
+	sortRanges(ranges)
+	for _, r := range ranges {
+		if len(res) > 0 && r.Offset <= res[len(res)-1].End() {
+			last := &res[len(res)-1]
+			if r.End() > last.End() {
+				last.Length = r.End() - last.Offset
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+func doCompare() {
+	block_size, err := parseSize(*compare_command_block_size)
+	fatalIfError(err, "Block size")
+	if block_size <= 0 {
+		fatalf("Block size must be positive")
+	}
+
+	a, err := openVMDK(*compare_command_a, parser.WithHighResolutionRanges())
+	fatalIfError(err, "Can not open %v", *compare_command_a)
+	defer a.Close()
+
+	b, err := openVMDK(*compare_command_b, parser.WithHighResolutionRanges())
+	fatalIfError(err, "Can not open %v", *compare_command_b)
+	defer b.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	progress := newProgressReporter("compare")
+	res, err := compareDisks(ctx, a, b, block_size, progress.Report)
+	progress.Done()
+
+	if errors.Is(err, context.Canceled) {
+		fatalf("Interrupted after %v with %v differing bytes found so "+
+			"far - comparison is incomplete", progress.Summary(),
+			res.DifferingBytes)
+	}
+	fatalIfError(err, "Compare failed")
+
+	res.A = *compare_command_a
+	res.B = *compare_command_b
+	res.TotalRanges = len(res.Ranges)
+	res.Identical = res.SizeA == res.SizeB && res.TotalRanges == 0
+	if len(res.Ranges) > *compare_command_max_ranges {
+		res.Ranges = res.Ranges[:*compare_command_max_ranges]
+	}
+
+	writeResult(res, func() {
+		if res.SizeA != res.SizeB {
+			fmt.Printf("Virtual sizes differ: %v is %v bytes, %v is %v bytes\n",
+				res.A, res.SizeA, res.B, res.SizeB)
+		}
+
+		if res.TotalRanges > 0 {
+			fmt.Printf("%v differing bytes in %v ranges:\n",
+				res.DifferingBytes, res.TotalRanges)
+
+			for _, r := range res.Ranges {
+				fmt.Printf("  %#x - %#x (%v bytes)\n", r.Offset, r.End(), r.Length)
+			}
+
+			if res.TotalRanges > len(res.Ranges) {
+				fmt.Printf("  ... %v more\n", res.TotalRanges-len(res.Ranges))
+			}
+		}
+
+		if res.Identical {
+			fmt.Println("Images are identical")
+		} else {
+			fmt.Println("Images differ")
+		}
+	})
+
+	if !res.Identical {
+		os.Exit(EXIT_FINDINGS)
+	}
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case compare_command.FullCommand():
+			doCompare()
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	ntfs_parser "www.velocidex.com/golang/go-ntfs/parser"
+)
+
+var (
+	cp_command = app.Command(
+		"cp", "Extract files from an NTFS partition inside the image.")
+
+	cp_command_file_arg = cp_command.Arg(
+		"file", "The image file to read",
+	).Required().String()
+
+	cp_command_path = cp_command.Arg(
+		"path", "The path in the image (use path:stream for an ADS)",
+	).Required().String()
+
+	cp_command_dest = cp_command.Arg(
+		"dest", "Where to write the file",
+	).Required().String()
+
+	cp_command_partition = cp_command.Flag(
+		"partition", "The partition number (0 for an unpartitioned disk)",
+	).Default("1").Int()
+
+	cp_command_recursive = cp_command.Flag(
+		"recursive", "Copy directories recursively",
+	).Short('r').Bool()
+)
+
+type copiedFile struct {
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+	Size        int64  `json:"Size"`
+}
+
+type cpResult struct {
+	Files []copiedFile `json:"Files"`
+}
+
+// Find the FileInfo describing the stream we are copying.
+func findFileInfo(ntfs *ntfs_parser.NTFSContext,
+	entry *ntfs_parser.MFT_ENTRY, name string) *ntfs_parser.FileInfo {
+	infos := ntfs_parser.Stat(ntfs, entry)
+	for _, info := range infos {
+		if strings.EqualFold(info.Name, name) {
+			return info
+		}
+	}
+
+	if len(infos) > 0 {
+		return infos[0]
+	}
+	return nil
+}
+
+func copyFile(ntfs *ntfs_parser.NTFSContext, src, dest string,
+	info *ntfs_parser.FileInfo, res *cpResult) error {
+	reader, err := ntfs_parser.GetDataForPath(ntfs, src)
+	if err != nil {
+		return err
+	}
+
+	size := ntfs_parser.RangeSize(reader)
+	if info != nil {
+		size = info.Size
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, io.NewSectionReader(reader, 0, size))
+	out.Close()
+	if err != nil {
+		return err
+	}
+
+	if info != nil {
+		// Timestamps are preserved on a best effort basis.
+		os.Chtimes(dest, info.Atime, info.Mtime)
+	}
+
+	printf("%v -> %v (%v bytes)\n", src, dest, size)
+	res.Files = append(res.Files, copiedFile{
+		Source: src, Destination: dest, Size: size})
+	return nil
+}
+
+func copyDirectory(ntfs *ntfs_parser.NTFSContext,
+	dir *ntfs_parser.MFT_ENTRY, src, dest string, res *cpResult) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range ntfs_parser.ListDir(ntfs, dir) {
+		// Alternate data streams are only copied when asked for
+		// explicitly.
+		if info.Name == "." || info.Name == ".." ||
+			strings.Contains(info.Name, ":") {
+			continue
+		}
+
+		child_src := path.Join(src, info.Name)
+		child_dest := filepath.Join(dest, info.Name)
+
+		if !info.IsDir {
+			err := copyFile(ntfs, child_src, child_dest, info, res)
+			if err != nil {
+				return fmt.Errorf("%v: %w", child_src, err)
+			}
+			continue
+		}
+
+		mft_idx, _, _, _, err := ntfs_parser.ParseMFTId(info.MFTId)
+		if err != nil {
+			return err
+		}
+
+		child, err := ntfs.GetMFT(mft_idx)
+		if err != nil {
+			return err
+		}
+
+		err = copyDirectory(ntfs, child, child_src, child_dest, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func doCp() {
+	vmdk, err := openVMDK(*cp_command_file_arg)
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	ntfs, err := openNTFS(vmdk, *cp_command_partition)
+	if err != nil {
+		fatalWithCode(EXIT_UNSUPPORTED_FILESYSTEM,
+			"Can not read filesystem on partition %v: %v",
+			*cp_command_partition, err)
+	}
+
+	root, err := ntfs.GetMFT(5)
+	if err != nil {
+		fatalWithCode(EXIT_UNSUPPORTED_FILESYSTEM,
+			"Can not read root directory: %v", err)
+	}
+
+	src := "/" + strings.Trim(
+		strings.ReplaceAll(*cp_command_path, "\\", "/"), "/")
+	entry, err := root.Open(ntfs, src)
+	if err != nil {
+		fatalWithCode(EXIT_NOT_FOUND, "%v: file not found", src)
+	}
+
+	name := path.Base(src)
+	info := findFileInfo(ntfs, entry, name)
+	res := &cpResult{}
+
+	if info != nil && info.IsDir && !strings.Contains(name, ":") {
+		if !*cp_command_recursive {
+			fatalf("%v is a directory (use -r)", src)
+		}
+
+		err = copyDirectory(ntfs, entry, src, *cp_command_dest, res)
+	} else {
+		err = copyFile(ntfs, src, *cp_command_dest, info, res)
+	}
+	fatalIfError(err, "Copy failed")
+
+	// Each file was reported as it was copied.
+	writeResult(res, func() {})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case cp_command.FullCommand():
+			doCp()
+		default:
+			return false
+		}
+		return true
+	})
+}
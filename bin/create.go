@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	create_command = app.Command(
+		"create", "Create a new disk for testing.")
+
+	create_command_output = create_command.Arg(
+		"output", "The vmdk file to create",
+	).Required().String()
+
+	create_command_type = create_command.Flag(
+		"type", "The type of disk to create",
+	).Default("monolithicSparse").Enum(
+		"monolithicSparse", "monolithicFlat", "streamOptimized")
+
+	create_command_size = create_command.Flag(
+		"size", "The virtual size of the disk (e.g. 1G)",
+	).Required().String()
+
+	create_command_fill = create_command.Flag(
+		"fill-pattern", "Content to write: zero, sector (each sector is "+
+			"labeled with its number) or mbr (an MBR with a FAT32 partition)",
+	).Default("zero").Enum("zero", "sector", "mbr")
+
+	create_command_adapter = create_command.Flag(
+		"adapter-type", "The ddb.adapterType of the disk",
+	).Default("lsilogic").Enum(parser.AdapterTypes...)
+
+	create_command_geometry = create_command.Flag(
+		"geometry", "The disk geometry as cylinders/heads/sectors "+
+			"(default depends on the adapter)",
+	).String()
+
+	create_command_force = create_command.Flag(
+		"force", "Overwrite existing files",
+	).Bool()
+)
+
+const (
+	// The FAT32 partition of the mbr pattern starts at 1MB.
+	SKELETON_PARTITION_START = 2048
+
+	SKELETON_RESERVED_SECTORS    = 32
+	SKELETON_SECTORS_PER_CLUSTER = 8
+)
+
+// Generates the content of a new disk. Sectors not in the sectors map
+// are zero, or labeled with their sector number.
+type patternReader struct {
+	size    int64
+	label   bool
+	sectors map[int64][]byte
+}
+
+func (self *patternReader) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset >= self.size {
+		return 0, io.EOF
+	}
+
+	to_read := int64(len(buf))
+	if to_read > self.size-offset {
+		to_read = self.size - offset
+	}
+
+	for i := int64(0); i < to_read; {
+		sector := (offset + i) / parser.SECTOR_SIZE
+		sector_offset := (offset + i) % parser.SECTOR_SIZE
+
+		data, pres := self.sectors[sector]
+		if !pres {
+			data = make([]byte, parser.SECTOR_SIZE)
+			if self.label {
+				copy(data, fmt.Sprintf("SECTOR %016x\n", sector))
+			}
+		}
+
+		n := int64(copy(buf[i:to_read], data[sector_offset:]))
+		i += n
+	}
+
+	return int(to_read), nil
+}
+
+// Build an MBR with a single FAT32 partition spanning the disk and an
+// empty FAT32 file system skeleton within it.
+func skeletonSectors(size int64) (map[int64][]byte, error) {
+	le := binary.LittleEndian
+	total_sectors := size / parser.SECTOR_SIZE
+	partition_sectors := total_sectors - SKELETON_PARTITION_START
+
+	clusters := partition_sectors / SKELETON_SECTORS_PER_CLUSTER
+	fat_sectors := ((clusters+2)*4 + parser.SECTOR_SIZE - 1) / parser.SECTOR_SIZE
+	data_start := SKELETON_RESERVED_SECTORS + 2*fat_sectors
+
+	if partition_sectors <= data_start+SKELETON_SECTORS_PER_CLUSTER ||
+		partition_sectors > 0xffffffff {
+		return nil, fmt.Errorf("Disk size %v is not suitable for a FAT32 "+
+			"partition", size)
+	}
+
+	mbr := make([]byte, parser.SECTOR_SIZE)
+	entry := mbr[446:]
+	entry[4] = 0x0c // FAT32 (LBA)
+	le.PutUint32(entry[8:], SKELETON_PARTITION_START)
+	le.PutUint32(entry[12:], uint32(partition_sectors))
+	mbr[510] = 0x55
+	mbr[511] = 0xaa
+
+	boot := make([]byte, parser.SECTOR_SIZE)
+	copy(boot, []byte{0xeb, 0x58, 0x90})
+	copy(boot[3:], "MSWIN4.1")
+	le.PutUint16(boot[11:], parser.SECTOR_SIZE)
+	boot[13] = SKELETON_SECTORS_PER_CLUSTER
+	le.PutUint16(boot[14:], SKELETON_RESERVED_SECTORS)
+	boot[16] = 2    // Number of FATs
+	boot[21] = 0xf8 // Fixed disk
+	le.PutUint16(boot[24:], 63)
+	le.PutUint16(boot[26:], 255)
+	le.PutUint32(boot[28:], SKELETON_PARTITION_START)
+	le.PutUint32(boot[32:], uint32(partition_sectors))
+	le.PutUint32(boot[36:], uint32(fat_sectors))
+	le.PutUint32(boot[44:], 2) // Root directory cluster
+	le.PutUint16(boot[48:], 1) // FSInfo sector
+	le.PutUint16(boot[50:], 6) // Backup boot sector
+	boot[64] = 0x80
+	boot[66] = 0x29
+	copy(boot[71:], "NO NAME    FAT32   ")
+	boot[510] = 0x55
+	boot[511] = 0xaa
+
+	fsinfo := make([]byte, parser.SECTOR_SIZE)
+	le.PutUint32(fsinfo[0:], 0x41615252)
+	le.PutUint32(fsinfo[484:], 0x61417272)
+	le.PutUint32(fsinfo[488:], uint32(clusters-1))
+	le.PutUint32(fsinfo[492:], 3)
+	le.PutUint32(fsinfo[508:], 0xaa550000)
+
+	// The first FAT entries are reserved and the root directory is a
+	// single cluster chain.
+	fat := make([]byte, parser.SECTOR_SIZE)
+	le.PutUint32(fat[0:], 0x0ffffff8)
+	le.PutUint32(fat[4:], 0x0fffffff)
+	le.PutUint32(fat[8:], 0x0fffffff)
+
+	start := int64(SKELETON_PARTITION_START)
+	return map[int64][]byte{
+		0:                                 mbr,
+		start:                             boot,
+		start + 1:                         fsinfo,
+		start + 6:                         boot,
+		start + 7:                         fsinfo,
+		start + SKELETON_RESERVED_SECTORS: fat,
+		start + SKELETON_RESERVED_SECTORS + fat_sectors: fat,
+	}, nil
+}
+
+type createResult struct {
+	Type        string `json:"Type"`
+	Output      string `json:"Output"`
+	Size        int64  `json:"Size"`
+	FillPattern string `json:"FillPattern"`
+}
+
+func createFile(filename string) *os.File {
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if !*create_command_force {
+		flags |= os.O_EXCL
+	}
+
+	fd, err := os.OpenFile(filename, flags, 0644)
+	fatalIfError(err, "Can not create %v", filename)
+	return fd
+}
+
+func doCreate() {
+	size, err := parseSize(*create_command_size)
+	fatalIfError(err, "Size")
+
+	// Disks are a whole number of sectors.
+	size = (size + parser.SECTOR_SIZE - 1) / parser.SECTOR_SIZE *
+		parser.SECTOR_SIZE
+	if size == 0 {
+		fatalf("Size must be positive")
+	}
+
+	pattern := &patternReader{
+		size:  size,
+		label: *create_command_fill == "sector",
+	}
+
+	if *create_command_fill == "mbr" {
+		pattern.sectors, err = skeletonSectors(size)
+		fatalIfError(err, "Fill pattern")
+	}
+
+	source := parser.NewFlatContext(pattern, size)
+	err = source.Config().Set("ddb.adapterType", *create_command_adapter)
+	fatalIfError(err, "Set adapter type")
+
+	if *create_command_geometry != "" {
+		parts := strings.Split(*create_command_geometry, "/")
+		if len(parts) != 3 {
+			fatalf("Geometry must be cylinders/heads/sectors")
+		}
+
+		for i, key := range []string{"ddb.geometry.cylinders",
+			"ddb.geometry.heads", "ddb.geometry.sectors"} {
+			err = source.Config().Set(key, parts[i])
+			fatalIfError(err, "Geometry")
+		}
+	}
+
+	// Check before creating any files.
+	err = parser.ValidateGeometry(source.Config(), size/parser.SECTOR_SIZE)
+	fatalIfError(err, "Geometry")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	output := *create_command_output
+	progress := newProgressReporter("create")
+
+	switch *create_command_type {
+	case "monolithicSparse":
+		out := createFile(output)
+		err = source.WriteMonolithicSparse(ctx, out,
+			filepath.Base(output), progress.Report)
+		out.Close()
+
+	case "monolithicFlat":
+		data_filename := strings.TrimSuffix(output, filepath.Ext(output)) +
+			"-flat.vmdk"
+		out := createFile(output)
+		data_out := createFile(data_filename)
+		err = source.WriteMonolithicFlat(ctx, out, data_out,
+			filepath.Base(data_filename), progress.Report)
+		data_out.Close()
+		out.Close()
+
+	case "streamOptimized":
+		out := createFile(output)
+		err = parser.WriteStreamOptimized(source, out)
+		out.Close()
+	}
+	progress.Done()
+
+	if errors.Is(err, context.Canceled) {
+		fatalf("Interrupted after %v - %v is incomplete",
+			progress.Summary(), output)
+	}
+	fatalIfError(err, "Create failed, %v is incomplete", output)
+
+	res := &createResult{
+		Type:        *create_command_type,
+		Output:      output,
+		Size:        size,
+		FillPattern: *create_command_fill,
+	}
+	writeResult(res, func() {
+		fmt.Printf("Created %v disk %v (%v bytes, %v fill)\n",
+			res.Type, res.Output, res.Size, res.FillPattern)
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case create_command.FullCommand():
+			doCreate()
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	descriptor_command = app.Command(
+		"descriptor", "Show the descriptor of an image.")
+
+	descriptor_command_file_arg = descriptor_command.Arg(
+		"file", "The vmdk descriptor or monolithic sparse file",
+	).Required().String()
+
+	descriptor_command_parsed = descriptor_command.Flag(
+		"parsed", "Show the parsed descriptor",
+	).Bool()
+
+	descriptor_command_write = descriptor_command.Flag(
+		"write", "Write the descriptor to this file",
+	).String()
+)
+
+type descriptorResult struct {
+	Filename string             `json:"Filename"`
+	Raw      string             `json:"Raw"`
+	Parsed   *parser.Descriptor `json:"Parsed,omitempty"`
+}
+
+func doDescriptor() {
+	filename := *descriptor_command_file_arg
+
+	fd, err := os.Open(filename)
+	fatalIfError(err, "Can not open %v", filename)
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	fatalIfError(err, "Can not stat %v", filename)
+
+	raw, err := parser.ReadDescriptor(fd, st.Size())
+	fatalIfError(err, "Can not read descriptor")
+
+	if *descriptor_command_write != "" {
+		err = os.WriteFile(*descriptor_command_write, []byte(raw), 0644)
+		fatalIfError(err, "Can not write %v", *descriptor_command_write)
+		printf("Descriptor written to %v\n", *descriptor_command_write)
+	}
+
+	res := &descriptorResult{Filename: filename, Raw: raw}
+	if *descriptor_command_parsed {
+		res.Parsed = parser.ParseDescriptor(raw)
+	}
+
+	writeResult(res, func() {
+		if res.Parsed == nil {
+			if *descriptor_command_write == "" {
+				fmt.Print(res.Raw)
+			}
+			return
+		}
+
+		fmt.Println("Config:")
+		for _, key := range res.Parsed.Config.Keys() {
+			value, _ := res.Parsed.Config.Get(key)
+			fmt.Printf("  %-28v %v\n", key, value)
+		}
+
+		fmt.Println("\nExtents:")
+		for _, e := range res.Parsed.Extents {
+			fmt.Printf("  line %-4d %-2v %12d sectors %-7v %v (offset %v)\n",
+				e.Line, e.Access, e.Sectors, e.Type, e.Filename, e.Offset)
+		}
+
+		if len(res.Parsed.Warnings) > 0 {
+			fmt.Println("\nWarnings:")
+			for _, w := range res.Parsed.Warnings {
+				fmt.Printf("  line %-4d %v\n", w.Line, w.Message)
+			}
+		}
+	})
+
+	if res.Parsed != nil && len(res.Parsed.Warnings) > 0 {
+		os.Exit(EXIT_FINDINGS)
+	}
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case descriptor_command.FullCommand():
+			doDescriptor()
+		default:
+			return false
+		}
+		return true
+	})
+}
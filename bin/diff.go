@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	diff_command = app.Command(
+		"diff", "List the ranges whose logical content changed between two disks.")
+
+	diff_command_a = diff_command.Arg(
+		"a", "The earlier disk",
+	).Required().String()
+
+	diff_command_b = diff_command.Arg(
+		"b", "The later disk",
+	).Required().String()
+
+	diff_command_summary = diff_command.Flag(
+		"summary", "Only report the total number of bytes changed",
+	).Bool()
+)
+
+type diffResult struct {
+	A     string `json:"A"`
+	B     string `json:"B"`
+	SizeA int64  `json:"SizeA"`
+	SizeB int64  `json:"SizeB"`
+
+	// Changed ranges in parser.CHANGED_BLOCK_SIZE units. Left out in
+	// --summary mode.
+	Ranges       []parser.Range `json:"Ranges,omitempty"`
+	TotalRanges  int            `json:"TotalRanges"`
+	ChangedBytes int64          `json:"ChangedBytes"`
+}
+
+// Find what changed in b since a. Space b gained by growing counts as
+// changed.
+func diffDisks(a, b *parser.VMDKContext) (*diffResult, error) {
+	ranges, err := b.ChangedBlocks(a)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &diffResult{
+		SizeA:       a.Size(),
+		SizeB:       b.Size(),
+		Ranges:      ranges,
+		TotalRanges: len(ranges),
+	}
+
+	for _, r := range ranges {
+		res.ChangedBytes += r.Length
+	}
+
+	return res, nil
+}
+
+func doDiff() {
+	a, err := openVMDK(*diff_command_a)
+	fatalIfError(err, "Can not open %v", *diff_command_a)
+	defer a.Close()
+
+	b, err := openVMDK(*diff_command_b)
+	fatalIfError(err, "Can not open %v", *diff_command_b)
+	defer b.Close()
+
+	res, err := diffDisks(a, b)
+	fatalIfError(err, "Diff failed")
+
+	res.A = *diff_command_a
+	res.B = *diff_command_b
+	if *diff_command_summary {
+		res.Ranges = nil
+	}
+
+	writeResult(res, func() {
+		if res.SizeA != res.SizeB {
+			fmt.Printf("Virtual sizes differ: %v is %v bytes, %v is %v bytes\n",
+				res.A, res.SizeA, res.B, res.SizeB)
+		}
+
+		for _, r := range res.Ranges {
+			fmt.Printf("%#x - %#x (%v bytes)\n", r.Offset, r.End(), r.Length)
+		}
+
+		fmt.Printf("%v bytes changed in %v ranges\n",
+			res.ChangedBytes, res.TotalRanges)
+	})
+
+	if res.TotalRanges > 0 || res.SizeA != res.SizeB {
+		os.Exit(EXIT_FINDINGS)
+	}
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case diff_command.FullCommand():
+			doDiff()
+		default:
+			return false
+		}
+		return true
+	})
+}
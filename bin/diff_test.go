@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+// Write a monolithic sparse disk with the given grains to dir.
+func writeDisk(t *testing.T, dir, name string, grains map[int64][]byte) string {
+	sparse, err := parser.NewTestSparseExtent(grains, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	vmdk, err := parser.NewTestContext(sparse)
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+
+	filename := filepath.Join(dir, name)
+	out, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer out.Close()
+
+	err = vmdk.WriteMonolithicSparse(context.Background(), out, name, nil)
+	if err != nil {
+		t.Fatalf("WriteMonolithicSparse: %v", err)
+	}
+	return filename
+}
+
+func TestDiff(t *testing.T) {
+	grain := func(c string) []byte {
+		return bytes.Repeat([]byte(c), parser.TEST_GRAIN_SIZE)
+	}
+
+	// Grain 40 (160kb) changes, which is in the third 64kb block.
+	dir := t.TempDir()
+	a, err := openVMDK(writeDisk(t, dir, "a.vmdk", map[int64][]byte{
+		0: grain("A"), 40: grain("B"),
+	}))
+	if err != nil {
+		t.Fatalf("openVMDK: %v", err)
+	}
+	defer a.Close()
+
+	b, err := openVMDK(writeDisk(t, dir, "b.vmdk", map[int64][]byte{
+		0: grain("A"), 40: grain("C"),
+	}))
+	if err != nil {
+		t.Fatalf("openVMDK: %v", err)
+	}
+	defer b.Close()
+
+	res, err := diffDisks(a, b)
+	if err != nil {
+		t.Fatalf("diffDisks: %v", err)
+	}
+
+	expected := parser.Range{
+		Offset: 2 * parser.CHANGED_BLOCK_SIZE, Length: parser.CHANGED_BLOCK_SIZE}
+	if res.TotalRanges != 1 || res.Ranges[0] != expected ||
+		res.ChangedBytes != parser.CHANGED_BLOCK_SIZE {
+		t.Fatalf("Unexpected diff %+v", res)
+	}
+
+	res, err = diffDisks(a, a)
+	if err != nil || res.TotalRanges != 0 || res.ChangedBytes != 0 {
+		t.Fatalf("Expected no changes: %+v %v", res, err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+// Calculate the SHA256 digest of a file.
+func hashFile(filename string) ([]byte, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, fd)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// Calculate the SHA256 digest of the logical disk.
+func hashDisk(ctx context.Context, vmdk *parser.VMDKContext,
+	progress parser.ProgressFunc) ([]byte, error) {
+	h := sha256.New()
+	_, err := vmdk.Export(ctx, h, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
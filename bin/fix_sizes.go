@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	fix_sizes_command = app.Command(
+		"fix-sizes", "Set the sector counts of flat extents from their files.")
+
+	fix_sizes_command_file_arg = fix_sizes_command.Arg(
+		"file", "The vmdk descriptor to repair",
+	).Required().String()
+)
+
+type fixSizesResult struct {
+	Filename   string                    `json:"Filename"`
+	Changes    []parser.ExtentSizeChange `json:"Changes"`
+	Descriptor string                    `json:"Descriptor"`
+}
+
+// Rewrite the descriptor of filename with the sector counts of its
+// flat extents fixed.
+func fixSizes(filename string) (*fixSizesResult, error) {
+	res := &fixSizesResult{Filename: filename}
+	opener := parser.DirectoryOpener(filepath.Dir(filename))
+
+	descriptor, err := replaceDescriptor(filename,
+		func(descriptor string) (string, error) {
+			fixed, changes, err := parser.FixExtentSizes(descriptor, opener)
+			if err != nil {
+				return "", err
+			}
+			res.Changes = changes
+			return fixed, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	res.Descriptor = descriptor
+	return res, nil
+}
+
+func doFixSizes() {
+	filename := *fix_sizes_command_file_arg
+
+	res, err := fixSizes(filename)
+	fatalIfError(err, "Can not fix %v", filename)
+
+	for _, change := range res.Changes {
+		if change.Truncated {
+			fmt.Fprintf(os.Stderr, "Warning: %v has %v sectors but %v "+
+				"are declared - data may have been lost\n",
+				change.Filename, change.Actual, change.Declared)
+		}
+	}
+
+	writeResult(res, func() {
+		if len(res.Changes) == 0 {
+			fmt.Println("All extent sizes are correct")
+			return
+		}
+
+		for _, change := range res.Changes {
+			fmt.Printf("line %-4d %v: %v -> %v sectors\n", change.Line,
+				change.Filename, change.Declared, change.Actual)
+		}
+		if *verbose_flag {
+			fmt.Println(res.Descriptor)
+		}
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case fix_sizes_command.FullCommand():
+			doFixSizes()
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixSizes(t *testing.T) {
+	dir := t.TempDir()
+	descriptor := filepath.Join(dir, "disk.vmdk")
+	err := os.WriteFile(descriptor, []byte(`# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="twoGbMaxExtentFlat"
+
+# Extent description
+RW 1000 FLAT "disk-f001.vmdk" 0
+RW 4096 FLAT "disk-f002.vmdk" 0
+`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// The first extent grew to 2048 sectors and the second shrank to
+	// 1024.
+	for name, size := range map[string]int{
+		"disk-f001.vmdk": 1024 * 1024,
+		"disk-f002.vmdk": 512 * 1024,
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	res, err := fixSizes(descriptor)
+	if err != nil {
+		t.Fatalf("fixSizes: %v", err)
+	}
+
+	if len(res.Changes) != 2 ||
+		res.Changes[0].Actual != 2048 || res.Changes[0].Truncated ||
+		res.Changes[1].Actual != 1024 || !res.Changes[1].Truncated {
+		t.Fatalf("Unexpected changes %+v", res.Changes)
+	}
+
+	vmdk, err := openVMDK(descriptor)
+	if err != nil {
+		t.Fatalf("openVMDK: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.Size() != 1536*1024 {
+		t.Fatalf("Unexpected size %v", vmdk.Size())
+	}
+
+	// Nothing is left to fix.
+	res, err = fixSizes(descriptor)
+	if err != nil || len(res.Changes) != 0 {
+		t.Fatalf("Expected no changes: %+v %v", res, err)
+	}
+}
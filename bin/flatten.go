@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	flatten_command = app.Command(
+		"flatten", "Merge a snapshot chain into a single disk.")
+
+	flatten_command_file_arg = flatten_command.Arg(
+		"file", "The leaf vmdk of the chain",
+	).Required().String()
+
+	flatten_command_output = flatten_command.Flag(
+		"output", "Where to write the merged disk",
+	).Required().String()
+
+	flatten_command_format = flatten_command.Flag(
+		"format", "The output format",
+	).Default("raw").Enum("raw", "monolithicSparse", "qcow2",
+		"vhd", "vhd-fixed", "vhdx")
+
+	flatten_command_compress = flatten_command.Flag(
+		"compress", "Compress the clusters of qcow2 output",
+	).Bool()
+
+	flatten_command_azure = flatten_command.Flag(
+		"azure", "Round the size of vhd-fixed output up to a whole "+
+			"megabyte as Azure requires",
+	).Bool()
+
+	flatten_command_force = flatten_command.Flag(
+		"force", "Flatten even if the chain is inconsistent",
+	).Bool()
+
+	flatten_command_workers = flatten_command.Flag(
+		"workers", "Number of parts of the disk to read at once",
+	).Default("1").Int()
+
+	flatten_command_extent_workers = flatten_command.Flag(
+		"extent-workers", "Number of extents to read at once, for extent "+
+			"files on independent devices",
+	).Default("1").Int()
+)
+
+type flattenResult struct {
+	Disks    int      `json:"Disks"`
+	Output   string   `json:"Output"`
+	Format   string   `json:"Format"`
+	Size     int64    `json:"Size"`
+	SHA256   string   `json:"SHA256"`
+	Warnings []string `json:"Warnings"`
+}
+
+func doFlatten() {
+	vmdk, err := openVMDK(*flatten_command_file_arg,
+		parser.WithExportWorkers(*flatten_command_workers),
+		parser.WithExtentWorkers(*flatten_command_extent_workers))
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	warnings := vmdk.ChainWarnings()
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", w)
+	}
+
+	if len(warnings) > 0 && !*flatten_command_force {
+		fatalWithCode(EXIT_FINDINGS, "Chain is inconsistent - refusing "+
+			"to flatten without --force. Check the correct descriptor "+
+			"was used.")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	out, err := os.Create(*flatten_command_output)
+	fatalIfError(err, "Can not create output")
+
+	// The raw output is hashed while it is written. Other formats are
+	// only known once written so they are read back.
+	h := sha256.New()
+	progress := newProgressReporter("flatten")
+	switch *flatten_command_format {
+	case "raw":
+		_, err = parser.CopyToFile(ctx, out, vmdk, progress.Report, h)
+
+	case "monolithicSparse":
+		err = vmdk.WriteMonolithicSparse(ctx, out,
+			filepath.Base(*flatten_command_output), progress.Report)
+
+	case "qcow2":
+		err = vmdk.WriteQCOW2(ctx, out, *flatten_command_compress,
+			progress.Report)
+
+	case "vhd":
+		err = vmdk.WriteDynamicVHD(ctx, out, progress.Report)
+
+	case "vhd-fixed":
+		err = vmdk.WriteFixedVHD(ctx, out, *flatten_command_azure,
+			progress.Report)
+
+	case "vhdx":
+		err = vmdk.WriteVHDX(ctx, out, progress.Report)
+	}
+	progress.Done()
+	out.Close()
+
+	if errors.Is(err, context.Canceled) {
+		fatalf("Interrupted after %v - %v is incomplete",
+			progress.Summary(), *flatten_command_output)
+	}
+	fatalIfError(err, "Flatten failed, %v is incomplete",
+		*flatten_command_output)
+
+	digest := h.Sum(nil)
+	if *flatten_command_format != "raw" {
+		digest, err = hashFile(*flatten_command_output)
+		fatalIfError(err, "Can not hash output")
+	}
+
+	res := &flattenResult{
+		Disks:    len(vmdk.Chain()),
+		Output:   *flatten_command_output,
+		Format:   *flatten_command_format,
+		Size:     vmdk.Size(),
+		SHA256:   fmt.Sprintf("%x", digest),
+		Warnings: warnings,
+	}
+	writeResult(res, func() {
+		fmt.Printf("Flattened %v disks into %v (%v)\n",
+			res.Disks, res.Output, res.Format)
+		fmt.Printf("Virtual size: %v\n", res.Size)
+		fmt.Printf("SHA256: %v\n", res.SHA256)
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case flatten_command.FullCommand():
+			doFlatten()
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	hexdump_command = app.Command(
+		"hexdump", "Hex dump a range of the logical disk.")
+
+	hexdump_command_file_arg = hexdump_command.Arg(
+		"file", "The image file to read",
+	).Required().String()
+
+	hexdump_command_offset = hexdump_command.Flag(
+		"offset", "The offset to start at (e.g. 0x1BE, 512, 1M)",
+	).Default("0").String()
+
+	hexdump_command_length = hexdump_command.Flag(
+		"length", "How many bytes to dump (e.g. 256, 4K)",
+	).Default("256").String()
+)
+
+const hexdumpLineSize = 16
+
+type hexdumpLine struct {
+	Offset int64  `json:"Offset"`
+	Hex    string `json:"Hex"`
+	ASCII  string `json:"ASCII"`
+
+	// Where the data comes from when it is not the leaf disk, or
+	// "unallocated" for holes.
+	Source string `json:"Source,omitempty"`
+}
+
+type hexdumpResult struct {
+	Offset int64         `json:"Offset"`
+	Length int64         `json:"Length"`
+	Lines  []hexdumpLine `json:"Lines"`
+}
+
+func overlaps(ranges []parser.Range, start, end int64) bool {
+	for _, r := range ranges {
+		if r.Offset < end && r.End() > start {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe where the data for the range comes from. Data in the leaf
+// disk is not annotated.
+func rangeSource(chain []*parser.VMDKContext, layers [][]parser.Range,
+	start, end int64) string {
+	for i, ranges := range layers {
+		if overlaps(ranges, start, end) {
+			if i == 0 {
+				return ""
+			}
+			return chain[i].Filename()
+		}
+	}
+	return "unallocated"
+}
+
+func formatHexLine(offset int64, data []byte) hexdumpLine {
+	hex := make([]string, 0, hexdumpLineSize)
+	ascii := make([]byte, 0, hexdumpLineSize)
+
+	for _, c := range data {
+		hex = append(hex, fmt.Sprintf("%02x", c))
+		if c >= 0x20 && c < 0x7f {
+			ascii = append(ascii, c)
+		} else {
+			ascii = append(ascii, '.')
+		}
+	}
+
+	return hexdumpLine{
+		Offset: offset,
+		Hex:    strings.Join(hex, " "),
+		ASCII:  string(ascii),
+	}
+}
+
+func doHexdump() {
+	offset, err := parseSize(*hexdump_command_offset)
+	fatalIfError(err, "Offset")
+
+	length, err := parseSize(*hexdump_command_length)
+	fatalIfError(err, "Length")
+
+	vmdk, err := openVMDK(*hexdump_command_file_arg,
+		parser.WithHighResolutionRanges())
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	if offset >= vmdk.Size() {
+		fatalf("Offset %#x is beyond the end of the disk (%#x)",
+			offset, vmdk.Size())
+	}
+
+	if offset+length > vmdk.Size() {
+		length = vmdk.Size() - offset
+	}
+
+	buf := make([]byte, length)
+	n, err := vmdk.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		fatalIfError(err, "Read at %#x", offset)
+	}
+	buf = buf[:n]
+
+	chain := vmdk.Chain()
+	var layers [][]parser.Range
+	for _, layer := range chain {
+		layers = append(layers, layer.LayerAllocatedRanges())
+	}
+
+	res := &hexdumpResult{Offset: offset, Length: int64(n)}
+	for i := 0; i < len(buf); i += hexdumpLineSize {
+		end := i + hexdumpLineSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		line := formatHexLine(offset+int64(i), buf[i:end])
+		line.Source = rangeSource(chain, layers,
+			offset+int64(i), offset+int64(end))
+		res.Lines = append(res.Lines, line)
+	}
+
+	writeResult(res, func() {
+		for _, line := range res.Lines {
+			hex := line.Hex
+			if len(hex) > 24 {
+				// Split the two groups of 8 bytes as hexdump -C does.
+				hex = hex[:23] + " " + hex[23:]
+			}
+
+			annotation := ""
+			if line.Source != "" {
+				annotation = " <" + line.Source + ">"
+			}
+
+			fmt.Printf("%016x  %-49v |%v|%v\n", line.Offset, hex,
+				line.ASCII, annotation)
+		}
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case hexdump_command.FullCommand():
+			doHexdump()
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	ntfs_parser "www.velocidex.com/golang/go-ntfs/parser"
+)
+
+var (
+	ls_command = app.Command(
+		"ls", "List files on an NTFS partition inside the image.")
+
+	ls_command_file_arg = ls_command.Arg(
+		"file", "The image file to inspect",
+	).Required().String()
+
+	ls_command_path = ls_command.Arg(
+		"path", "The directory to list",
+	).Default("/").String()
+
+	ls_command_partition = ls_command.Flag(
+		"partition", "The partition number (0 for an unpartitioned disk)",
+	).Default("1").Int()
+
+	ls_command_recursive = ls_command.Flag(
+		"recursive", "Recurse into subdirectories",
+	).Short('r').Bool()
+)
+
+type lsEntry struct {
+	Path  string    `json:"Path"`
+	IsDir bool      `json:"IsDir"`
+	Size  int64     `json:"Size"`
+	Mtime time.Time `json:"Mtime"`
+	Btime time.Time `json:"Btime"`
+}
+
+func listDirectory(ntfs *ntfs_parser.NTFSContext,
+	dir *ntfs_parser.MFT_ENTRY, dir_path string,
+	seen map[int64]bool, res *[]lsEntry) {
+
+	var subdirs []*ntfs_parser.FileInfo
+
+	for _, info := range ntfs_parser.ListDir(ntfs, dir) {
+		if info.Name == "." || info.Name == ".." {
+			continue
+		}
+
+		name := path.Join(dir_path, info.Name)
+		kind := "-"
+		if info.IsDir {
+			kind = "d"
+			subdirs = append(subdirs, info)
+		}
+
+		*res = append(*res, lsEntry{
+			Path:  name,
+			IsDir: info.IsDir,
+			Size:  info.Size,
+			Mtime: info.Mtime.UTC(),
+			Btime: info.Btime.UTC(),
+		})
+
+		if !*json_flag {
+			fmt.Printf("%v %12d %v %v %v\n", kind, info.Size,
+				info.Mtime.UTC().Format("2006-01-02T15:04:05Z"),
+				info.Btime.UTC().Format("2006-01-02T15:04:05Z"), name)
+		}
+	}
+
+	if !*ls_command_recursive {
+		return
+	}
+
+	for _, info := range subdirs {
+		mft_idx, _, _, _, err := ntfs_parser.ParseMFTId(info.MFTId)
+		if err != nil || seen[mft_idx] {
+			continue
+		}
+		seen[mft_idx] = true
+
+		subdir, err := ntfs.GetMFT(mft_idx)
+		if err != nil {
+			continue
+		}
+
+		listDirectory(ntfs, subdir, path.Join(dir_path, info.Name), seen, res)
+	}
+}
+
+func doLs() {
+	vmdk, err := openVMDK(*ls_command_file_arg)
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	ntfs, err := openNTFS(vmdk, *ls_command_partition)
+	fatalIfError(err, "Can not open partition %v",
+		*ls_command_partition)
+
+	root, err := ntfs.GetMFT(5)
+	fatalIfError(err, "Can not open root directory")
+
+	dir_path := "/" + strings.Trim(
+		strings.ReplaceAll(*ls_command_path, "\\", "/"), "/")
+	dir, err := root.Open(ntfs, dir_path)
+	fatalIfError(err, "Can not open %v", dir_path)
+
+	res := []lsEntry{}
+	listDirectory(ntfs, dir, dir_path, map[int64]bool{5: true}, &res)
+
+	// Entries are printed as they are found.
+	writeResult(res, func() {})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case ls_command.FullCommand():
+			doLs()
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
-	"io"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/Velocidex/go-vmdk/parser"
 	kingpin "github.com/alecthomas/kingpin/v2"
 )
 
@@ -16,6 +22,17 @@ var (
 	verbose_flag = app.Flag(
 		"verbose", "Show verbose information").Bool()
 
+	json_flag = app.Flag(
+		"json", "Write a single JSON document to stdout").Bool()
+
+	max_extents_flag = app.Flag(
+		"max-extents", "Refuse descriptors listing more extents (0 for no limit)",
+	).Default(fmt.Sprintf("%v", parser.DEFAULT_MAX_EXTENTS)).Int()
+
+	disk_flag = app.Flag(
+		"disk", "The OVF disk id of the disk to open in an OVA (default first)",
+	).String()
+
 	command_handlers []CommandHandler
 )
 
@@ -31,6 +48,147 @@ func main() {
 	}
 }
 
-func getReader(reader io.ReaderAt) io.ReaderAt {
-	return reader
+// Open a vmdk file. Extents are resolved relative to the directory of
+// the descriptor. Descriptors given as http or https URLs are read
+// with range requests. A disk in an OVA archive is read in place.
+func openVMDK(filename string, opts ...parser.Option) (
+	*parser.VMDKContext, error) {
+	opts = append([]parser.Option{parser.WithMaxExtents(*max_extents_flag)},
+		opts...)
+
+	if strings.HasPrefix(filename, "http://") ||
+		strings.HasPrefix(filename, "https://") {
+		base, name := path.Split(filename)
+		return parser.GetVMDKContextFromOpener(
+			parser.HTTPOpener(base, nil), name, opts...)
+	}
+
+	if strings.EqualFold(filepath.Ext(filename), ".ova") {
+		return openOVA(filename, opts...)
+	}
+	return parser.GetVMDKContextFromFile(filename, opts...)
+}
+
+// Open the disk selected by --disk in an OVA. The archive stays open
+// until the program exits.
+func openOVA(filename string, opts ...parser.Option) (
+	*parser.VMDKContext, error) {
+	ova, fd, err := loadOVA(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ova.OpenDisk(*disk_flag, opts...)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// Read the table of contents of an OVA. The caller closes the file
+// once done with the archive.
+func loadOVA(filename string) (*parser.OVA, *os.File, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+
+	reader := parser.NewCachingReaderAt(fd,
+		parser.DEFAULT_PAGE_SIZE, parser.DEFAULT_PAGE_COUNT)
+	ova, err := parser.OpenOVA(reader, st.Size())
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	return ova, fd, nil
+}
+
+// Exit codes distinguishing the reasons for failure. These are stable
+// so scripts can rely on them.
+const (
+	// An operational error, e.g. a file could not be read.
+	EXIT_ERROR = 1
+
+	// The command ran but found problems (e.g. images differ or the
+	// chain is inconsistent).
+	EXIT_FINDINGS = 2
+
+	// The disk or filesystem uses a format we do not support.
+	EXIT_UNSUPPORTED = 3
+
+	// The requested file does not exist in the image.
+	EXIT_NOT_FOUND = 4
+
+	EXIT_UNSUPPORTED_FILESYSTEM = EXIT_UNSUPPORTED
+)
+
+// The document written on stdout in --json mode when a command fails.
+type errorResult struct {
+	Error    string `json:"Error"`
+	ExitCode int    `json:"ExitCode"`
+}
+
+func fatalWithCode(code int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "%v: error: %v\n", filepath.Base(os.Args[0]),
+		message)
+
+	if *json_flag {
+		writeJSON(&errorResult{Error: message, ExitCode: code})
+	}
+	os.Exit(code)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fatalWithCode(EXIT_ERROR, format, args...)
+}
+
+// Exit if err is set, choosing the exit code from the type of error.
+func fatalIfError(err error, format string, args ...interface{}) {
+	if err == nil {
+		return
+	}
+
+	fatalWithCode(exitCode(err), "%v: %v", fmt.Sprintf(format, args...), err)
+}
+
+// The exit code for a failure caused by err.
+func exitCode(err error) int {
+	if errors.Is(err, parser.ErrUnsupported) ||
+		errors.Is(err, errUnsupportedFilesystem) {
+		return EXIT_UNSUPPORTED
+	}
+	return EXIT_ERROR
+}
+
+func writeJSON(v interface{}) {
+	serialized, _ := json.MarshalIndent(v, "", " ")
+	fmt.Println(string(serialized))
+}
+
+// Write the result of a command. In --json mode the result is written
+// to stdout as JSON, otherwise human is called to print it.
+func writeResult(v interface{}, human func()) {
+	if *json_flag {
+		writeJSON(v)
+		return
+	}
+	human()
+}
+
+// Print informational text. In --json mode stdout is reserved for the
+// JSON document so the text goes to stderr.
+func printf(format string, args ...interface{}) {
+	if *json_flag {
+		fmt.Fprintf(os.Stderr, format, args...)
+		return
+	}
+	fmt.Printf(format, args...)
 }
@@ -0,0 +1,74 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Velocidex/go-vmdk/vmdkfuse"
+)
+
+var (
+	mount_command = app.Command(
+		"mount", "Mount the image and partitions as read only files via FUSE.")
+
+	mount_command_file_arg = mount_command.Arg(
+		"file", "The image file to mount",
+	).Required().String()
+
+	mount_command_mountpoint = mount_command.Arg(
+		"mountpoint", "Where to mount the image",
+	).Required().String()
+)
+
+type mountResult struct {
+	Filename   string `json:"Filename"`
+	Mountpoint string `json:"Mountpoint"`
+	Size       int64  `json:"Size"`
+}
+
+func doMount() {
+	vmdk, err := openVMDK(*mount_command_file_arg)
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	err = vmdkfuse.Mount(ctx, *mount_command_mountpoint, vmdk,
+		vmdkfuse.WithFsName(*mount_command_file_arg),
+		vmdkfuse.WithErrorLog(log.New(os.Stderr, "", 0)),
+		vmdkfuse.WithOnMount(func() {
+			// The result is written once the mount is ready.
+			res := &mountResult{
+				Filename:   *mount_command_file_arg,
+				Mountpoint: *mount_command_mountpoint,
+				Size:       vmdk.Size(),
+			}
+			writeResult(res, func() {
+				fmt.Printf("Mounted %v on %v, press Ctrl-C to unmount\n",
+					res.Filename, res.Mountpoint)
+			})
+		}))
+	if err != context.Canceled {
+		fatalIfError(err, "Can not mount")
+	}
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case mount_command.FullCommand():
+			doMount()
+		default:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// The outcome for one image when a command is given several.
+type imageResult struct {
+	Filename string      `json:"Filename"`
+	Result   interface{} `json:"Result,omitempty"`
+	Error    string      `json:"Error,omitempty"`
+	ExitCode int         `json:"ExitCode"`
+}
+
+// Process a single image. code is a non zero exit code for images
+// which were processed but have findings.
+type imageFunc func(filename string) (result interface{}, code int, err error)
+
+// Expand glob patterns left alone by the shell (e.g. on Windows). An
+// argument naming an existing file is never expanded.
+func expandArgs(args []string) []string {
+	var res []string
+	for _, arg := range args {
+		_, err := os.Stat(arg)
+		if err == nil || !strings.ContainsAny(arg, "*?[") {
+			res = append(res, arg)
+			continue
+		}
+
+		matches, err := filepath.Glob(arg)
+		if err != nil || len(matches) == 0 {
+			// Let the command report the missing file.
+			res = append(res, arg)
+			continue
+		}
+		res = append(res, matches...)
+	}
+	return res
+}
+
+// Run fn on every image. With a single image the result is written
+// as usual. With several, failures are recorded and processing
+// continues; the results go out as a JSON array or the summary table
+// and the worst exit code is used.
+func forEachImage(args []string, fn imageFunc,
+	human func(result interface{}),
+	header string, row func(result interface{}) string) {
+	filenames := expandArgs(args)
+
+	if len(filenames) == 1 {
+		result, code, err := fn(filenames[0])
+		fatalIfError(err, "%v", filenames[0])
+		writeResult(result, func() { human(result) })
+		if code != 0 {
+			os.Exit(code)
+		}
+		return
+	}
+
+	var results []imageResult
+	exit_code := 0
+	for _, filename := range filenames {
+		result, code, err := fn(filename)
+		res := imageResult{Filename: filename, Result: result, ExitCode: code}
+		if err != nil {
+			res.Result = nil
+			res.Error = err.Error()
+			res.ExitCode = exitCode(err)
+		}
+
+		if res.ExitCode > exit_code {
+			exit_code = res.ExitCode
+		}
+		results = append(results, res)
+	}
+
+	writeResult(results, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "FILE\t%v\n", header)
+		for _, res := range results {
+			if res.Error != "" {
+				fmt.Fprintf(w, "%v\terror: %v\n", res.Filename, res.Error)
+				continue
+			}
+			fmt.Fprintf(w, "%v\t%v\n", res.Filename, row(res.Result))
+		}
+		w.Flush()
+	})
+
+	if exit_code != 0 {
+		os.Exit(exit_code)
+	}
+}
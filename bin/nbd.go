@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/Velocidex/go-vmdk/parser"
+	"github.com/Velocidex/go-vmdk/vmdknbd"
+)
+
+var (
+	nbd_command = app.Command(
+		"nbd", "Serve the image read only over the NBD protocol.")
+
+	nbd_command_file_arg = nbd_command.Arg(
+		"file", "The image file to serve",
+	).Required().String()
+
+	nbd_command_listen = nbd_command.Flag(
+		"listen", "Address to listen on",
+	).Default("127.0.0.1:10809").String()
+
+	nbd_command_export = nbd_command.Flag(
+		"export", "The export name (default any name is accepted)",
+	).String()
+)
+
+type nbdResult struct {
+	Filename string `json:"Filename"`
+	Size     int64  `json:"Size"`
+	Address  string `json:"Address"`
+}
+
+func doNBD() {
+	// Block status requests report holes within sparse extents.
+	vmdk, err := openVMDK(*nbd_command_file_arg,
+		parser.WithHighResolutionRanges())
+	fatalIfError(err, "Can not open vmdk")
+	defer vmdk.Close()
+
+	listener, err := net.Listen("tcp", *nbd_command_listen)
+	fatalIfError(err, "Can not listen")
+
+	// The result is written once we are ready for connections.
+	res := &nbdResult{
+		Filename: *nbd_command_file_arg,
+		Size:     vmdk.Size(),
+		Address:  listener.Addr().String(),
+	}
+	writeResult(res, func() {
+		fmt.Printf("Serving %v (%v bytes) on %v\n",
+			res.Filename, res.Size, res.Address)
+	})
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	err = vmdknbd.Serve(ctx, listener, vmdk,
+		vmdknbd.WithExportName(*nbd_command_export),
+		vmdknbd.WithErrorLog(log.New(os.Stderr, "", 0)))
+	if err != context.Canceled {
+		fatalIfError(err, "Accept")
+	}
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case nbd_command.FullCommand():
+			doNBD()
+		default:
+			return false
+		}
+		return true
+	})
+}
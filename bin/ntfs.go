@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/Velocidex/go-vmdk/parser"
+	ntfs_parser "www.velocidex.com/golang/go-ntfs/parser"
+)
+
+var (
+	errUnsupportedFilesystem = errors.New("unsupported filesystem")
+)
+
+// Open the NTFS filesystem on partition n of the disk. Partition 0
+// means the filesystem starts at the beginning of the disk.
+func openNTFS(vmdk *parser.VMDKContext, n int) (
+	*ntfs_parser.NTFSContext, error) {
+	var reader io.ReaderAt = vmdk
+
+	if n > 0 {
+		partition, _, err := vmdk.PartitionReaderAt(n)
+		if err != nil {
+			return nil, err
+		}
+		reader = partition
+	}
+
+	oem := make([]byte, 8)
+	_, err := reader.ReadAt(oem, 3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if string(oem) != "NTFS    " {
+		return nil, errUnsupportedFilesystem
+	}
+
+	// The NTFS parser expects to be given the volume itself.
+	paged, err := parser.NewPagedReader(reader, 1024, 10000)
+	if err != nil {
+		return nil, err
+	}
+
+	return ntfs_parser.GetNTFSContext(paged, 0)
+}
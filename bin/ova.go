@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	ova_command = app.Command(
+		"ova", "List the disks of an OVA archive.")
+
+	ova_command_file_arg = ova_command.Arg(
+		"file", "The OVA archive",
+	).Required().String()
+)
+
+type ovaResult struct {
+	Filename string             `json:"Filename"`
+	Disks    []parser.OVFDisk   `json:"Disks"`
+	Members  []parser.OVAMember `json:"Members"`
+}
+
+func doOVA() {
+	filename := *ova_command_file_arg
+
+	ova, fd, err := loadOVA(filename)
+	fatalIfError(err, "Can not open %v", filename)
+	defer fd.Close()
+
+	res := &ovaResult{
+		Filename: filename,
+		Disks:    ova.Disks(),
+		Members:  ova.Members(),
+	}
+
+	writeResult(res, func() {
+		fmt.Println("Disks (open one with --disk):")
+		for _, disk := range res.Disks {
+			fmt.Printf("  %-16v %14d bytes  %v\n",
+				disk.ID, disk.Capacity, disk.Filename)
+		}
+
+		if *verbose_flag {
+			fmt.Println("\nMembers:")
+			for _, member := range res.Members {
+				fmt.Printf("  %-32v %14d bytes at %#x\n",
+					member.Name, member.Size, member.Offset)
+			}
+		}
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case ova_command.FullCommand():
+			doOVA()
+		default:
+			return false
+		}
+		return true
+	})
+}
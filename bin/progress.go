@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	progress_flag = app.Flag(
+		"progress", "Show progress of long running commands on stderr").Bool()
+)
+
+const (
+	progressBarWidth = 30
+
+	// When stderr is not a terminal progress is logged less often.
+	progressLogInterval = 10 * time.Second
+)
+
+// Reports progress of long running commands on stderr. On a terminal
+// a single line progress bar is redrawn, otherwise a log line is
+// written periodically. Progress is only shown with --progress but is
+// always tracked so an interrupted command can summarize how far it
+// got.
+type progressReporter struct {
+	name    string
+	enabled bool
+	tty     bool
+
+	start   time.Time
+	last    time.Time
+	printed bool
+
+	done, total int64
+}
+
+func newProgressReporter(name string) *progressReporter {
+	return &progressReporter{
+		name:    name,
+		enabled: *progress_flag,
+		tty:     isTerminal(os.Stderr),
+		start:   time.Now(),
+	}
+}
+
+func isTerminal(fd *os.File) bool {
+	st, err := fd.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+func (self *progressReporter) Report(done, total int64) {
+	self.done = done
+	self.total = total
+
+	if !self.enabled {
+		return
+	}
+
+	interval := time.Second
+	if !self.tty {
+		interval = progressLogInterval
+	}
+
+	now := time.Now()
+	if done < total && now.Sub(self.last) < interval {
+		return
+	}
+	self.last = now
+	self.printed = true
+
+	percent := int64(100)
+	if total > 0 {
+		percent = done * 100 / total
+	}
+
+	elapsed := now.Sub(self.start)
+	rate := float64(done) / elapsed.Seconds()
+	eta := "-"
+	if rate > 0 && done < total {
+		eta = time.Duration(float64(total-done) / rate * float64(time.Second)).
+			Truncate(time.Second).String()
+	}
+
+	if !self.tty {
+		fmt.Fprintf(os.Stderr, "%v: %v / %v (%d%%) %v/s ETA %v\n",
+			self.name, formatBytes(done), formatBytes(total), percent,
+			formatBytes(int64(rate)), eta)
+		return
+	}
+
+	filled := int(percent) * progressBarWidth / 100
+	bar := strings.Repeat("#", filled) +
+		strings.Repeat(".", progressBarWidth-filled)
+
+	fmt.Fprintf(os.Stderr, "\r%v [%v] %3d%% %v / %v %v/s ETA %v\x1b[K",
+		self.name, bar, percent, formatBytes(done), formatBytes(total),
+		formatBytes(int64(rate)), eta)
+}
+
+func (self *progressReporter) Done() {
+	if self.tty && self.printed {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// Summary describes how far the operation got, e.g. after it was
+// interrupted.
+func (self *progressReporter) Summary() string {
+	percent := int64(0)
+	if self.total > 0 {
+		percent = self.done * 100 / self.total
+	}
+
+	return fmt.Sprintf("%v of %v bytes (%d%%) in %v", self.done,
+		self.total, percent, time.Since(self.start).Truncate(time.Second))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	set_command = app.Command(
+		"set", "Change descriptor settings.")
+
+	set_command_file_arg = set_command.Arg(
+		"file", "The vmdk descriptor (or monolithic sparse file) to change",
+	).Required().String()
+
+	set_command_settings = set_command.Arg(
+		"settings", "Settings as key=value",
+	).Required().Strings()
+)
+
+type setResult struct {
+	Filename   string   `json:"Filename"`
+	Settings   []string `json:"Settings"`
+	Descriptor string   `json:"Descriptor"`
+}
+
+// Rewrite the descriptor of filename after update has changed its
+// settings. An embedded descriptor must fit in the space reserved for
+// it. Returns the new descriptor.
+func rewriteDescriptor(filename string,
+	update func(config *parser.VMDKConfig) error) (string, error) {
+	return replaceDescriptor(filename, func(descriptor string) (string, error) {
+		config := parser.ParseConfig(descriptor)
+		err := update(config)
+		if err != nil {
+			return "", err
+		}
+
+		out := &bytes.Buffer{}
+		err = parser.WriteDescriptor(out, descriptor, config)
+		return out.String(), err
+	})
+}
+
+// Replace the descriptor of filename with the text returned by
+// update. The file is not written if the text is unchanged. Files
+// which are not descriptors are refused so a data extent given by
+// mistake is never overwritten.
+func replaceDescriptor(filename string,
+	update func(descriptor string) (string, error)) (string, error) {
+	fd, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	err = parser.Probe(fd)
+	if err != nil {
+		return "", err
+	}
+
+	st, err := fd.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	offset, length, err := parser.FindDescriptor(fd, st.Size())
+	if err != nil {
+		return "", fmt.Errorf("Can not find descriptor: %w", err)
+	}
+
+	// Only the start of a plain descriptor is read so a larger file
+	// would be cut short when written back.
+	if offset == 0 && st.Size() > length {
+		return "", fmt.Errorf("%w: %v is %v bytes which is more than "+
+			"the %v bytes scanned for a descriptor",
+			parser.ErrNotADescriptor, filename, st.Size(), length)
+	}
+
+	descriptor, err := parser.ReadDescriptor(fd, st.Size())
+	if err != nil {
+		return "", fmt.Errorf("Can not read descriptor: %w", err)
+	}
+
+	out, err := update(descriptor)
+	if err != nil || out == descriptor {
+		return out, err
+	}
+
+	// A plain descriptor file is replaced as a whole. Close it first
+	// since some platforms can not rename over an open file.
+	if offset == 0 {
+		fd.Close()
+		return out, replaceFile(filename, st.Mode().Perm(), []byte(out))
+	}
+
+	if int64(len(out)) > length {
+		return "", fmt.Errorf("Descriptor is %v bytes but only %v bytes "+
+			"are reserved in %v", len(out), length, filename)
+	}
+
+	buf := make([]byte, length)
+	copy(buf, out)
+	_, err = fd.WriteAt(buf, offset)
+	return out, err
+}
+
+// Write data to a temporary file next to filename and rename it over
+// filename, so the original is left intact if the write fails.
+func replaceFile(filename string, mode os.FileMode, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename),
+		"."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	close_err := tmp.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+func doSet() {
+	filename := *set_command_file_arg
+
+	descriptor, err := rewriteDescriptor(filename,
+		func(config *parser.VMDKConfig) error {
+			for _, setting := range *set_command_settings {
+				parts := strings.SplitN(setting, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("Setting %q must be key=value", setting)
+				}
+
+				err := config.Set(strings.TrimSpace(parts[0]),
+					strings.TrimSpace(parts[1]))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	fatalIfError(err, "Can not update %v", filename)
+
+	res := &setResult{
+		Filename:   filename,
+		Settings:   *set_command_settings,
+		Descriptor: descriptor,
+	}
+	writeResult(res, func() {
+		if *verbose_flag {
+			fmt.Println(res.Descriptor)
+		}
+	})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case set_command.FullCommand():
+			doSet()
+		default:
+			return false
+		}
+		return true
+	})
+}
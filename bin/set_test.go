@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+func TestSetRefusesNonDescriptors(t *testing.T) {
+	dir := t.TempDir()
+
+	// A raw extent is not a descriptor and must be left alone.
+	flat := filepath.Join(dir, "flat.vmdk")
+	err := os.WriteFile(flat, make([]byte, 1024*1024), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	set_cid := func(config *parser.VMDKConfig) error {
+		return config.Set("CID", "12345678")
+	}
+
+	_, err = rewriteDescriptor(flat, set_cid)
+	if !errors.Is(err, parser.ErrNotADescriptor) {
+		t.Fatalf("Expected ErrNotADescriptor, got %v", err)
+	}
+
+	st, err := os.Stat(flat)
+	if err != nil || st.Size() != 1024*1024 {
+		t.Fatalf("Extent was changed: %v %v", st, err)
+	}
+
+	// A descriptor too large to be read whole is refused as well.
+	large := filepath.Join(dir, "large.vmdk")
+	text := "# Disk DescriptorFile\nCID=11111111\n\n# Extent description\n" +
+		strings.Repeat("RW 8 FLAT \"flat.vmdk\" 0\n", 4000)
+	err = os.WriteFile(large, []byte(text), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	_, err = rewriteDescriptor(large, set_cid)
+	if !errors.Is(err, parser.ErrNotADescriptor) {
+		t.Fatalf("Expected ErrNotADescriptor, got %v", err)
+	}
+
+	data, err := os.ReadFile(large)
+	if err != nil || string(data) != text {
+		t.Fatalf("Descriptor was changed: %v", err)
+	}
+
+	// A small descriptor is replaced and keeps its mode.
+	small := filepath.Join(dir, "small.vmdk")
+	err = os.WriteFile(small, []byte(text[:60]), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	out, err := rewriteDescriptor(small, set_cid)
+	if err != nil || !strings.Contains(out, "CID=12345678") {
+		t.Fatalf("rewriteDescriptor: %v %q", err, out)
+	}
+
+	data, err = os.ReadFile(small)
+	if err != nil || string(data) != out {
+		t.Fatalf("Descriptor not written: %v %q", err, data)
+	}
+
+	st, err = os.Stat(small)
+	if err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected mode %v %v", st, err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Fatalf("Temporary file left behind: %v", entries)
+	}
+}
@@ -1,13 +1,9 @@
 package main
 
 import (
-	"io"
-	"os"
-	"path/filepath"
+	"fmt"
 
 	"github.com/Velocidex/go-vmdk/parser"
-	kingpin "github.com/alecthomas/kingpin/v2"
-	ntfs_parser "www.velocidex.com/golang/go-ntfs/parser"
 )
 
 var (
@@ -15,36 +11,48 @@ var (
 		"info", "Stat a vmdk file.")
 
 	info_command_file_arg = info_command.Arg(
-		"file", "The image file to inspect",
-	).Required().String()
+		"file", "The image files to inspect (glob patterns are expanded)",
+	).Required().Strings()
 )
 
+type infoResult struct {
+	Info     parser.DiskInfo     `json:"Info"`
+	Config   *parser.VMDKConfig  `json:"Config"`
+	Extents  []parser.ExtentStat `json:"Extents"`
+	Warnings []string            `json:"Warnings"`
+}
+
+func getInfo(filename string) (interface{}, int, error) {
+	vmdk, err := openVMDK(filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Can not open vmdk: %w", err)
+	}
+	defer vmdk.Close()
+
+	res := &infoResult{
+		Info:     vmdk.Info(),
+		Config:   vmdk.Config(),
+		Extents:  vmdk.Stats().Extents,
+		Warnings: append(vmdk.Warnings, vmdk.ChainWarnings()...),
+	}
+
+	// Debug output needs the open disk so it is printed here.
+	if !*json_flag && len(*info_command_file_arg) == 1 {
+		vmdk.Debug()
+	}
+	return res, 0, nil
+}
+
 func doInfo() {
-	fd, err := os.Open(*info_command_file_arg)
-	kingpin.FatalIfError(err, "Can not open filesystem")
-
-	reader, _ := ntfs_parser.NewPagedReader(
-		getReader(fd), 1024, 10000)
-
-	st, err := fd.Stat()
-	kingpin.FatalIfError(err, "Can not open filesystem")
-
-	vmdk, err := parser.GetVMDKContext(reader, int(st.Size()),
-		func(filename string) (reader io.ReaderAt, closer func(), err error) {
-			full_path := filepath.Join(
-				filepath.Dir(*info_command_file_arg), filename)
-			fd, err := os.Open(full_path)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			reader, err = ntfs_parser.NewPagedReader(
-				getReader(fd), 1024, 10000)
-			return reader, func() { fd.Close() }, nil
+	forEachImage(*info_command_file_arg, getInfo,
+		func(result interface{}) {},
+		"SIZE\tCREATETYPE\tEXTENTS\tTHIN\tPARENT\tWARNINGS",
+		func(result interface{}) string {
+			res := result.(*infoResult)
+			return fmt.Sprintf("%v\t%v\t%v\t%v\t%v\t%v",
+				res.Info.Size, res.Info.CreateType, res.Info.ExtentCount,
+				res.Info.Thin, res.Info.HasParent, len(res.Warnings))
 		})
-	kingpin.FatalIfError(err, "Can not open filesystem")
-
-	vmdk.Debug()
 }
 
 func init() {
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	stats_command = app.Command(
+		"stats", "Summarize allocation and sizing of a vmdk.")
+
+	stats_command_file_arg = stats_command.Arg(
+		"file", "The image files to inspect (glob patterns are expanded)",
+	).Required().Strings()
+)
+
+type extentSummary struct {
+	parser.ExtentStat
+	Allocated int64 `json:"Allocated"`
+}
+
+type layerSummary struct {
+	Descriptor string          `json:"Descriptor"`
+	Allocated  int64           `json:"Allocated"`
+	Extents    []extentSummary `json:"Extents"`
+}
+
+type statsSummary struct {
+	VirtualSize    int64          `json:"VirtualSize"`
+	OnDiskSize     int64          `json:"OnDiskSize"`
+	Files          []string       `json:"Files"`
+	AllocatedBytes int64          `json:"AllocatedBytes"`
+	ZeroGrainBytes int64          `json:"ZeroGrainBytes"`
+	Layers         []layerSummary `json:"Layers"`
+}
+
+// Count the bytes in the ranges which are all zero. Data is examined in
+// 64kb chunks matching the usual grain size.
+func countZeroBytes(reader io.ReaderAt, ranges []parser.Range) (int64, error) {
+	var res int64
+
+	buf := make([]byte, 64*1024)
+	for _, r := range ranges {
+		for offset := r.Offset; offset < r.End(); offset += int64(len(buf)) {
+			to_read := r.End() - offset
+			if to_read > int64(len(buf)) {
+				to_read = int64(len(buf))
+			}
+
+			n, err := reader.ReadAt(buf[:to_read], offset)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+
+			if isZero(buf[:n]) {
+				res += int64(n)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func sumRanges(ranges []parser.Range, start, end int64) int64 {
+	var res int64
+	for _, r := range ranges {
+		s, e := r.Offset, r.End()
+		if s < start {
+			s = start
+		}
+		if e > end {
+			e = end
+		}
+		if e > s {
+			res += e - s
+		}
+	}
+	return res
+}
+
+func getStats(filename string, vmdk *parser.VMDKContext) (*statsSummary, error) {
+	res := &statsSummary{
+		VirtualSize: vmdk.Size(),
+	}
+
+	dir := filepath.Dir(filename)
+	seen := make(map[string]bool)
+	addFile := func(name string) {
+		if name == "" || seen[name] {
+			return
+		}
+		seen[name] = true
+
+		st, err := os.Stat(filepath.Join(dir, name))
+		if err == nil {
+			res.OnDiskSize += st.Size()
+			res.Files = append(res.Files, name)
+		}
+	}
+
+	for _, layer := range vmdk.Chain() {
+		descriptor := layer.Filename()
+		if descriptor == "" {
+			descriptor = filepath.Base(filename)
+		}
+		addFile(descriptor)
+
+		ranges := layer.LayerAllocatedRanges()
+		summary := layerSummary{
+			Descriptor: descriptor,
+			Allocated:  sumRanges(ranges, 0, layer.Size()),
+		}
+
+		for _, e := range layer.Stats().Extents {
+			addFile(e.Filename)
+			summary.Extents = append(summary.Extents, extentSummary{
+				ExtentStat: e,
+				Allocated: sumRanges(ranges, e.VirtualOffset,
+					e.VirtualOffset+e.Size),
+			})
+		}
+
+		res.Layers = append(res.Layers, summary)
+	}
+
+	allocated := vmdk.AllocatedRanges()
+	res.AllocatedBytes = sumRanges(allocated, 0, vmdk.Size())
+
+	zero_bytes, err := countZeroBytes(vmdk, allocated)
+	if err != nil {
+		return nil, err
+	}
+	res.ZeroGrainBytes = zero_bytes
+
+	return res, nil
+}
+
+func doStats() {
+	forEachImage(*stats_command_file_arg,
+		func(filename string) (interface{}, int, error) {
+			vmdk, err := openVMDK(filename, parser.WithHighResolutionRanges())
+			if err != nil {
+				return nil, 0, fmt.Errorf("Can not open vmdk: %w", err)
+			}
+			defer vmdk.Close()
+
+			stats, err := getStats(filename, vmdk)
+			if err != nil {
+				return nil, 0, fmt.Errorf("Can not calculate stats: %w", err)
+			}
+			return stats, 0, nil
+		},
+		func(result interface{}) {
+			stats := result.(*statsSummary)
+			fmt.Printf("Virtual size:     %v\n", stats.VirtualSize)
+			fmt.Printf("On-disk size:     %v (%v files)\n",
+				stats.OnDiskSize, len(stats.Files))
+			fmt.Printf("Allocated bytes:  %v\n", stats.AllocatedBytes)
+			fmt.Printf("Zero grain bytes: %v\n", stats.ZeroGrainBytes)
+
+			for _, layer := range stats.Layers {
+				fmt.Printf("\nLayer %v: %v bytes allocated\n",
+					layer.Descriptor, layer.Allocated)
+				for _, e := range layer.Extents {
+					fmt.Printf("  %-6v %#12x %12d %12d allocated  %v\n",
+						e.Type, e.VirtualOffset, e.Size, e.Allocated,
+						e.Filename)
+				}
+			}
+		},
+		"VIRTUAL\tON-DISK\tALLOCATED\tZERO\tLAYERS",
+		func(result interface{}) string {
+			stats := result.(*statsSummary)
+			return fmt.Sprintf("%v\t%v\t%v\t%v\t%v",
+				stats.VirtualSize, stats.OnDiskSize, stats.AllocatedBytes,
+				stats.ZeroGrainBytes, len(stats.Layers))
+		})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case stats_command.FullCommand():
+			doStats()
+		default:
+			return false
+		}
+		return true
+	})
+}
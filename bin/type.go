@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+var (
+	type_command = app.Command(
+		"type", "Identify the kind of vmdk file.")
+
+	type_command_file_arg = type_command.Arg(
+		"file", "The files to identify (glob patterns are expanded)",
+	).Required().Strings()
+
+	// Extent files are usually named after their descriptor.
+	extentNameRegex = regexp.MustCompile(
+		`(?i)^(.+?)(-flat|-f\d{3}|-s\d{3}|-delta|-sesparse)\.vmdk$`)
+)
+
+type typeResult struct {
+	Filename string             `json:"Filename"`
+	Format   *parser.FormatInfo `json:"Format"`
+	Config   *parser.VMDKConfig `json:"Config,omitempty"`
+
+	// For extent files without a descriptor, the descriptor that
+	// probably refers to them.
+	LikelyDescriptor string `json:"LikelyDescriptor,omitempty"`
+}
+
+func likelyDescriptor(filename string) string {
+	match := extentNameRegex.FindStringSubmatch(filepath.Base(filename))
+	if len(match) == 0 {
+		return ""
+	}
+	return match[1] + ".vmdk"
+}
+
+// A one line description of the file.
+func (self *typeResult) Description() string {
+	var description string
+	format := self.Format
+	switch format.Format {
+	case parser.FORMAT_DESCRIPTOR:
+		description = "standalone text descriptor"
+	case parser.FORMAT_DATA:
+		description = "flat data extent"
+	default:
+		description = fmt.Sprintf("%v extent, header version %v",
+			format.Format, format.Version)
+		if format.EmbeddedDescriptor {
+			description += ", embedded descriptor"
+		}
+	}
+
+	if !format.HasDescriptor {
+		if self.LikelyDescriptor != "" {
+			description += " - descriptor is probably " +
+				self.LikelyDescriptor
+		} else {
+			description += " - no descriptor in this file"
+		}
+	}
+	return description
+}
+
+func getType(filename string) (interface{}, int, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	format, err := parser.DetectFormat(fd, st.Size())
+	if err != nil {
+		return nil, 0, fmt.Errorf("Can not identify %v: %w", filename, err)
+	}
+
+	res := &typeResult{Filename: filename, Format: format}
+	if format.HasDescriptor {
+		descriptor, err := parser.ReadDescriptor(fd, st.Size())
+		if err != nil {
+			return nil, 0, fmt.Errorf("Can not read descriptor: %w", err)
+		}
+		res.Config = parser.ParseConfig(descriptor)
+	} else {
+		res.LikelyDescriptor = likelyDescriptor(filename)
+	}
+
+	if format.Format == parser.FORMAT_COWD ||
+		format.Format == parser.FORMAT_SESPARSE {
+		return res, EXIT_UNSUPPORTED, nil
+	}
+	return res, 0, nil
+}
+
+func doType() {
+	forEachImage(*type_command_file_arg, getType,
+		func(result interface{}) {
+			res := result.(*typeResult)
+			fmt.Printf("%v: %v\n", res.Filename, res.Description())
+
+			if res.Config != nil {
+				fmt.Printf("createType: %v\n", res.Config.CreateType)
+				fmt.Printf("CID:        %v\n", res.Config.CID)
+				if res.Config.HasParent() {
+					fmt.Printf("Parent:     %v (parentCID %v)\n",
+						res.Config.ParentFileNameHint, res.Config.ParentCID)
+				}
+				if res.Config.ChangeTrackPath != "" {
+					fmt.Printf("CBT file:   %v\n", res.Config.ChangeTrackPath)
+				}
+			}
+		},
+		"TYPE\tCREATETYPE\tCID\tPARENT",
+		func(result interface{}) string {
+			res := result.(*typeResult)
+			if res.Config == nil {
+				return res.Description() + "\t-\t-\t-"
+			}
+			parent := res.Config.ParentFileNameHint
+			if parent == "" {
+				parent = "-"
+			}
+			return fmt.Sprintf("%v\t%v\t%v\t%v", res.Description(),
+				res.Config.CreateType, res.Config.CID, parent)
+		})
+}
+
+func init() {
+	command_handlers = append(command_handlers, func(command string) bool {
+		switch command {
+		case type_command.FullCommand():
+			doType()
+		default:
+			return false
+		}
+		return true
+	})
+}
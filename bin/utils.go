@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+func isZero(buf []byte) bool {
+	for _, c := range buf {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse a size with an optional K, M, G or T suffix (powers of 1024).
+// Hex values with a 0x prefix are accepted.
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	multiplier := int64(1)
+
+	if len(value) > 0 && !strings.HasPrefix(strings.ToLower(value), "0x") {
+		switch strings.ToUpper(value[len(value)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	res, err := strconv.ParseInt(value, 0, 64)
+	if err != nil || res < 0 {
+		return 0, fmt.Errorf("Invalid size %q", value)
+	}
+
+	return res * multiplier, nil
+}
+
+func sortRanges(ranges []parser.Range) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Offset < ranges[j].Offset
+	})
+}
+
+// Format a byte count for humans, e.g. 1.5 GiB.
+func formatBytes(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %v", value, units[unit])
+}
@@ -0,0 +1,136 @@
+package parser
+
+// Implemented by extents with caches which can be filled ahead of
+// reads. Ranges are relative to the start of the extent.
+type warmer interface {
+	warm(offset, length int64)
+}
+
+// Advise hints that the range at offset is about to be read, e.g. by a
+// filesystem parser about to walk its metadata. The caches covering it
+// are filled in the background: grain tables (see WithGrainTableCache
+// and WithMetadataBudget), inflated streamOptimized grains and, with
+// WithReadahead, the data at the start of the range. Caches stay
+// within their limits and Advise does nothing for disks without them.
+// It is safe to call concurrently with reads.
+func (self *VMDKContext) Advise(offset, length int64) {
+	if offset < 0 || length <= 0 || offset >= self.total_size {
+		return
+	}
+
+	if length > self.total_size-offset {
+		length = self.total_size - offset
+	}
+
+	if self.readahead != nil {
+		self.readahead.advise(offset)
+	}
+
+	self.advising.Add(1)
+	go func() {
+		defer self.advising.Done()
+		self.warm(offset, length)
+	}()
+}
+
+// Warm the extents overlapping the range, then the parents which
+// unallocated grains are read from.
+func (self *VMDKContext) warm(offset, length int64) {
+	end := offset + length
+	for _, e := range self.extents {
+		w, ok := e.(warmer)
+		if !ok {
+			continue
+		}
+
+		start := e.VirtualOffset()
+		extent_end := start + e.TotalSize()
+		if start >= end || extent_end <= offset {
+			continue
+		}
+
+		from := offset
+		if from < start {
+			from = start
+		}
+		to := end
+		if to > extent_end {
+			to = extent_end
+		}
+		w.warm(from-start, to-from)
+	}
+
+	if self.parent != nil {
+		self.parent.warm(offset, length)
+	}
+}
+
+// Load the grain tables covering the range.
+func (self *SparseExtent) warm(offset, length int64) {
+	if self.gt_cache == nil {
+		return
+	}
+
+	end := offset + length
+	if end > self.total_size {
+		end = self.total_size
+	}
+
+	coverage := self.grain_table_coverage
+	for gt := offset / coverage; gt*coverage < end; gt++ {
+		gde := self.getGrainDirectoryEntry(gt)
+		if gde != 0 {
+			self.getGrainTableEntry(gde, gt, 0)
+		}
+	}
+}
+
+// Inflate the grains covering the range, stopping once the cache is
+// full so the first grains are not evicted by the last.
+func (self *StreamExtent) warm(offset, length int64) {
+	if self.cache == nil {
+		return
+	}
+
+	var warmed int64
+	end := offset + length
+	for grain := offset / self.grain_size; grain*self.grain_size < end; grain++ {
+		stored, pres := self.grains[grain]
+		if !pres {
+			continue
+		}
+
+		warmed += self.grain_size
+		if warmed > self.cache.max_size {
+			return
+		}
+
+		compressed, err := self.compressedGrain(grain, stored)
+		if err != nil {
+			return
+		}
+
+		_, err = self.getGrain(grain, compressed)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Files are only opened when there is a cache to fill.
+func (self *lazyExtent) warm(offset, length int64) {
+	if self.gt_cache == nil {
+		return
+	}
+
+	handle, err := self.handles.get(self)
+	if err != nil {
+		return
+	}
+	defer self.handles.release(handle)
+
+	w, ok := handle.extent.(warmer)
+	if ok {
+		w.warm(offset, length)
+	}
+}
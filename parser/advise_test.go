@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAdvise(t *testing.T) {
+	// Each layer of the chain has one grain table.
+	vmdk, err := openTestDisk(makeChainFiles(), "snapshot.vmdk",
+		WithGrainTableCache(4))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	vmdk.Advise(0, vmdk.Size())
+	vmdk.advising.Wait()
+
+	if vmdk.Metrics().GrainTableMisses != 2 {
+		t.Fatalf("Unexpected metrics %+v", vmdk.Metrics())
+	}
+
+	// Reads find the tables loaded.
+	buf := make([]byte, vmdk.Size())
+	_, err = vmdk.ReadAt(buf, 0)
+	metrics := vmdk.Metrics()
+	if err != nil || metrics.GrainTableMisses != 2 ||
+		metrics.GrainTableHits == 0 {
+		t.Fatalf("Unexpected metrics %+v (%v)", metrics, err)
+	}
+
+	// Only as many grains as fit in the cache are inflated.
+	data := compressedFixture(8)
+	for _, c := range []struct {
+		cache_size int64
+		misses     int64
+	}{{DEFAULT_GRAIN_CACHE_SIZE, 8}, {2 * 128 * SECTOR_SIZE, 2}} {
+		stream, err := OpenStreamOptimized(bytes.NewReader(data),
+			WithDecompressedGrainCache(c.cache_size))
+		if err != nil {
+			t.Fatalf("OpenStreamOptimized: %v", err)
+		}
+
+		stream.Advise(0, stream.Size())
+		stream.advising.Wait()
+		if stream.Metrics().GrainCacheMisses != c.misses {
+			t.Fatalf("Unexpected metrics %+v", stream.Metrics())
+		}
+
+		_, err = stream.ReadAt(make([]byte, 128*SECTOR_SIZE), 0)
+		if err != nil || stream.Metrics().GrainCacheHits != 1 {
+			t.Fatalf("Unexpected metrics %+v (%v)", stream.Metrics(), err)
+		}
+		stream.Close()
+	}
+
+	// Without caches Advise does nothing and reads are unaffected.
+	plain, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer plain.Close()
+
+	plain.Advise(0, plain.Size())
+	plain.Advise(-1, 10)
+	plain.Advise(plain.Size(), 10)
+
+	other := make([]byte, plain.Size())
+	_, err = plain.ReadAt(other, 0)
+	if err != nil || !bytes.Equal(buf, other) {
+		t.Fatalf("Read differs: %v", err)
+	}
+}
+
+func TestAdviseReadahead(t *testing.T) {
+	vmdk, err := openTestDisk(makeChainFiles(), "base.vmdk",
+		WithReadahead(64*1024))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	vmdk.Advise(4096, 1024)
+	vmdk.readahead.wg.Wait()
+
+	// A random read in the advised range is served from the window.
+	buf := make([]byte, 512)
+	if !vmdk.readahead.read(buf, 4096+512) || buf[0] != 'B' {
+		t.Fatalf("Advised data was not fetched")
+	}
+}
@@ -0,0 +1,164 @@
+package parser
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Open the parent named by the descriptor and link our sparse extents
+// to it so unallocated grains are read from the parent. The parent's
+// own extents and parent are resolved relative to its directory, which
+// need not be ours. Absolute hints, as ESXi writes, are used as is.
+func (self *VMDKContext) openParent(
+	opener Opener, options *options, opts []Option) error {
+	hint := self.config.ParentFileNameHint
+
+	// The parent's name relative to the leaf disk's directory.
+	filename := joinPath(options.dir, hint)
+
+	// Remember every parent on the way up so a loop is detected.
+	key := path.Clean(filename)
+	if options.visited[key] {
+		return fmt.Errorf("%w: %v is its own ancestor", ErrCircularChain,
+			filename)
+	}
+
+	visited := map[string]bool{key: true}
+	for k := range options.visited {
+		visited[k] = true
+	}
+
+	reader, closer, err := options.open(opener, hint)
+	if err != nil {
+		return fmt.Errorf("While opening parent %v: %w", filename, err)
+	}
+
+	parent, err := GetVMDKContext(reader, 64*1024, relativeOpener(opener, hint),
+		append(opts, withVisited(visited), withBudget(options.budget),
+			withHandles(options.handles), withDir(path.Dir(filename)))...)
+	if err != nil {
+		if closer != nil {
+			closer()
+		}
+		return fmt.Errorf("While opening parent %v: %w", filename, err)
+	}
+
+	parent.filename = filename
+	self.parent = parent
+	self.parent_closer = closer
+
+	for _, e := range self.extents {
+		switch t := e.(type) {
+		case *SparseExtent:
+			t.parent = parent
+		case *lazyExtent:
+			t.parent = parent
+		}
+	}
+
+	return nil
+}
+
+// Resolve name relative to dir unless it is absolute.
+func joinPath(dir, name string) string {
+	if dir == "" || dir == "." || path.IsAbs(name) || filepath.IsAbs(name) {
+		return name
+	}
+	return path.Join(dir, name)
+}
+
+// An opener for the files of the disk whose descriptor opener opens as
+// filename. Relative names are resolved against the descriptor's
+// directory.
+func relativeOpener(opener Opener, filename string) Opener {
+	dir := path.Dir(filename)
+	if dir == "." {
+		return opener
+	}
+
+	return func(name string) (io.ReaderAt, func(), error) {
+		return opener(joinPath(dir, name))
+	}
+}
+
+// Parent returns the parent of a snapshot disk or nil.
+func (self *VMDKContext) Parent() *VMDKContext {
+	return self.parent
+}
+
+// Chain returns the disks in the snapshot chain starting with this
+// disk and ending with the base disk.
+func (self *VMDKContext) Chain() []*VMDKContext {
+	var res []*VMDKContext
+	for disk := self; disk != nil; disk = disk.parent {
+		res = append(res, disk)
+	}
+	return res
+}
+
+// Filename returns the name of the descriptor this disk was opened
+// from. This is only known for parent disks opened through the chain,
+// whose name is relative to the leaf disk's directory unless the hint
+// is absolute, and disks opened with GetVMDKContextFromFile.
+func (self *VMDKContext) Filename() string {
+	return self.filename
+}
+
+func (self *VMDKContext) name() string {
+	if self.filename == "" {
+		return "leaf disk"
+	}
+	return self.filename
+}
+
+// ChainWarnings reports consistency problems in the snapshot
+// chain. A parentCID that does not match the parent's CID usually means
+// the parent was modified after the snapshot was taken or the wrong
+// descriptor was used. Disks with both a CID and a longContentID must
+// agree on the content ID.
+func (self *VMDKContext) ChainWarnings() []string {
+	var res []string
+
+	for _, disk := range self.Chain() {
+		config := disk.config
+		if config.CID == "" || config.DBBLongContentID == "" {
+			continue
+		}
+
+		long_content_id, err := config.LongContentID()
+		if err != nil {
+			res = append(res, fmt.Sprintf("%v: %v", disk.name(), err))
+			continue
+		}
+
+		if !strings.EqualFold(hex.EncodeToString(long_content_id[12:]),
+			config.CID) {
+			res = append(res, fmt.Sprintf(
+				"%v: CID %v does not match longContentID %v",
+				disk.name(), config.CID, config.DBBLongContentID))
+		}
+	}
+
+	for child := self; child.parent != nil; child = child.parent {
+		parent := child.parent
+		if !strings.EqualFold(child.config.ParentCID, parent.config.CID) {
+			res = append(res, fmt.Sprintf(
+				"%v: parentCID %v does not match CID %v of parent %v",
+				child.name(), child.config.ParentCID,
+				parent.config.CID, parent.name()))
+		}
+
+		if child.total_size != parent.total_size {
+			res = append(res, fmt.Sprintf(
+				"%v: size %v does not match size %v of parent %v",
+				child.name(), child.total_size,
+				parent.total_size, parent.name()))
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,245 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	baseDescriptor = `# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW 2048 SPARSE "base-data.vmdk"
+`
+
+	snapshotDescriptor = `# Disk DescriptorFile
+version=1
+CID=22222222
+parentCID=11111111
+createType="monolithicSparse"
+parentFileNameHint="base.vmdk"
+
+# Extent description
+RW 2048 SPARSE "snapshot-data.vmdk"
+`
+)
+
+func makeChainFiles() testFiles {
+	return testFiles{
+		"base.vmdk": []byte(baseDescriptor),
+		"base-data.vmdk": buildSparseExtent(1024*1024, map[int64][]byte{
+			0: bytes.Repeat([]byte("B"), testGrainSize),
+			1: bytes.Repeat([]byte("B"), testGrainSize),
+		}),
+		"snapshot.vmdk": []byte(snapshotDescriptor),
+		"snapshot-data.vmdk": buildSparseExtent(1024*1024, map[int64][]byte{
+			1: bytes.Repeat([]byte("S"), testGrainSize),
+		}),
+	}
+}
+
+func TestChain(t *testing.T) {
+	vmdk, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if len(vmdk.Chain()) != 2 || vmdk.Parent() == nil {
+		t.Fatalf("Expected a two disk chain")
+	}
+
+	if warnings := vmdk.ChainWarnings(); len(warnings) > 0 {
+		t.Fatalf("Unexpected warnings %v", warnings)
+	}
+
+	// Grain 0 comes from the base, grain 1 from the snapshot and grain
+	// 2 is not allocated anywhere.
+	buf := make([]byte, 3*testGrainSize)
+	n, err := vmdk.ReadAt(buf, 0)
+	if err != nil || n != len(buf) {
+		t.Fatalf("ReadAt: %v %v", n, err)
+	}
+
+	expected := strings.Repeat("B", testGrainSize) +
+		strings.Repeat("S", testGrainSize) +
+		strings.Repeat("\x00", testGrainSize)
+	if string(buf) != expected {
+		t.Fatalf("Unexpected data read through the chain")
+	}
+}
+
+func TestChainWarnings(t *testing.T) {
+	files := makeChainFiles()
+	files["base.vmdk"] = []byte(strings.Replace(
+		baseDescriptor, "CID=11111111", "CID=33333333", 1))
+
+	vmdk, err := openTestDisk(files, "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	warnings := vmdk.ChainWarnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "parentCID") {
+		t.Fatalf("Expected a stale parentCID warning, got %v", warnings)
+	}
+}
+
+func TestLongContentID(t *testing.T) {
+	files := makeChainFiles()
+	files["base.vmdk"] = []byte(baseDescriptor +
+		`ddb.longContentID = "0123456789abcdef0123456711111111"` + "\n")
+	files["snapshot.vmdk"] = []byte(snapshotDescriptor +
+		`ddb.longContentID = "0123456789abcdef0123456722222222"` + "\n")
+
+	vmdk, err := openTestDisk(files, "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	long_content_id, err := vmdk.Config().LongContentID()
+	if err != nil {
+		t.Fatalf("LongContentID: %v", err)
+	}
+
+	if hex.EncodeToString(long_content_id) != "0123456789abcdef0123456722222222" {
+		t.Fatalf("Unexpected longContentID %x", long_content_id)
+	}
+
+	warnings := vmdk.ChainWarnings()
+	if len(warnings) != 0 {
+		t.Fatalf("Unexpected warnings %v", warnings)
+	}
+
+	// A parent whose longContentID disagrees with its CID.
+	files["base.vmdk"] = []byte(baseDescriptor +
+		`ddb.longContentID = "0123456789abcdef0123456733333333"` + "\n")
+
+	vmdk, err = openTestDisk(files, "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	warnings = vmdk.ChainWarnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "longContentID") {
+		t.Fatalf("Expected a longContentID warning, got %v", warnings)
+	}
+
+	config := ParseConfig(`ddb.longContentID = "not hex"`)
+	_, err = config.LongContentID()
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid longContentID")
+	}
+}
+
+func TestCircularChain(t *testing.T) {
+	files := makeChainFiles()
+
+	// The base disk claims the snapshot as its parent.
+	files["base.vmdk"] = []byte(strings.Replace(baseDescriptor,
+		`createType="monolithicSparse"`,
+		`createType="monolithicSparse"`+"\nparentFileNameHint=\"snapshot.vmdk\"", 1))
+
+	_, err := openTestDisk(files, "snapshot.vmdk")
+	if !errors.Is(err, ErrCircularChain) {
+		t.Fatalf("Expected ErrCircularChain, got %v", err)
+	}
+
+	// A disk which is its own parent.
+	files["self.vmdk"] = []byte(strings.Replace(snapshotDescriptor,
+		"base.vmdk", "self.vmdk", 1))
+	_, err = openTestDisk(files, "self.vmdk")
+	if !errors.Is(err, ErrCircularChain) {
+		t.Fatalf("Expected ErrCircularChain, got %v", err)
+	}
+}
+
+func TestDescriptorOutOfBand(t *testing.T) {
+	// The descriptor is not among the files the opener can reach.
+	files := makeChainFiles()
+	delete(files, "snapshot.vmdk")
+
+	vmdk, err := GetVMDKContextWithDescriptor(
+		[]byte(snapshotDescriptor), files.Open)
+	if err != nil {
+		t.Fatalf("GetVMDKContextWithDescriptor: %v", err)
+	}
+	defer vmdk.Close()
+
+	if len(vmdk.Chain()) != 2 {
+		t.Fatalf("Expected the parent to be opened")
+	}
+
+	buf := make([]byte, 2*testGrainSize)
+	n, err := vmdk.ReadAt(buf, 0)
+	if err != nil || n != len(buf) {
+		t.Fatalf("ReadAt: %v %v", n, err)
+	}
+
+	expected := strings.Repeat("B", testGrainSize) +
+		strings.Repeat("S", testGrainSize)
+	if string(buf) != expected {
+		t.Fatalf("Unexpected data read with an out of band descriptor")
+	}
+}
+
+func TestParentInSiblingDirectory(t *testing.T) {
+	// The snapshot is in vm/ and its parent, with its extent, in base/.
+	dir := t.TempDir()
+	files := makeChainFiles()
+	for name, subdir := range map[string]string{
+		"snapshot.vmdk":      "vm",
+		"snapshot-data.vmdk": "vm",
+		"base.vmdk":          "base",
+		"base-data.vmdk":     "base",
+	} {
+		os.MkdirAll(filepath.Join(dir, subdir), 0755)
+		err := os.WriteFile(filepath.Join(dir, subdir, name), files[name], 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	snapshot := filepath.Join(dir, "vm", "snapshot.vmdk")
+	for _, hint := range []string{
+		"../base/base.vmdk",
+		filepath.Join(dir, "base", "base.vmdk"),
+	} {
+		err := os.WriteFile(snapshot, []byte(strings.Replace(snapshotDescriptor,
+			`"base.vmdk"`, `"`+hint+`"`, 1)), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		vmdk, err := GetVMDKContextFromFile(snapshot)
+		if err != nil {
+			t.Fatalf("GetVMDKContextFromFile with %v: %v", hint, err)
+		}
+
+		if vmdk.Parent() == nil || vmdk.Parent().Filename() != hint {
+			t.Fatalf("Unexpected parent %v", vmdk.Parent().Filename())
+		}
+
+		buf := make([]byte, 2*testGrainSize)
+		_, err = vmdk.ReadAt(buf, 0)
+		vmdk.Close()
+
+		expected := strings.Repeat("B", testGrainSize) +
+			strings.Repeat("S", testGrainSize)
+		if err != nil || string(buf) != expected {
+			t.Fatalf("Unexpected data read through %v: %v", hint, err)
+		}
+	}
+}
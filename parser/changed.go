@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"io"
+)
+
+// Granularity of changed block tracking (64kb).
+const CHANGED_BLOCK_SIZE = WRITER_GRAIN_SECTORS * SECTOR_SIZE
+
+// ChangedBlocks returns the ranges of the logical disk whose content
+// differs from baseline, an earlier state of the same disk. Only blocks
+// allocated in either disk are hashed and compared; ranges are
+// reported in CHANGED_BLOCK_SIZE units. If the disk has grown the new
+// space is reported as changed.
+func (self *VMDKContext) ChangedBlocks(baseline *VMDKContext) ([]Range, error) {
+	size := self.total_size
+	if baseline.total_size < size {
+		size = baseline.total_size
+	}
+
+	allocated := mergeRanges(append(
+		self.allocatedRanges(true), baseline.allocatedRanges(true)...))
+
+	var res []Range
+	buf := make([]byte, CHANGED_BLOCK_SIZE)
+	last_block := int64(-1)
+
+	for _, r := range allocated {
+		end := r.End()
+		if end > size {
+			end = size
+		}
+
+		start := r.Offset / CHANGED_BLOCK_SIZE * CHANGED_BLOCK_SIZE
+		for offset := start; offset < end; offset += CHANGED_BLOCK_SIZE {
+			// Adjacent ranges may share a block.
+			if offset <= last_block {
+				continue
+			}
+			last_block = offset
+
+			length := size - offset
+			if length > CHANGED_BLOCK_SIZE {
+				length = CHANGED_BLOCK_SIZE
+			}
+
+			hash, err := hashBlock(self, buf[:length], offset)
+			if err != nil {
+				return nil, err
+			}
+
+			baseline_hash, err := hashBlock(baseline, buf[:length], offset)
+			if err != nil {
+				return nil, err
+			}
+
+			if hash != baseline_hash {
+				res = appendRange(res, Range{Offset: offset, Length: length})
+			}
+		}
+	}
+
+	if self.total_size > size {
+		res = appendRange(res, Range{
+			Offset: size, Length: self.total_size - size})
+	}
+
+	return res, nil
+}
+
+func hashBlock(reader io.ReaderAt, buf []byte, offset int64) (
+	[sha256.Size]byte, error) {
+	n, err := reader.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return [sha256.Size]byte{}, err
+	}
+
+	if n < len(buf) {
+		return [sha256.Size]byte{}, io.ErrUnexpectedEOF
+	}
+
+	return sha256.Sum256(buf), nil
+}
@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestChangedBlocks(t *testing.T) {
+	grain := func(c string) []byte {
+		return bytes.Repeat([]byte(c), testGrainSize)
+	}
+
+	// The current disk differs in grain 20 and reallocates grain 1
+	// with unchanged data.
+	files := testFiles{
+		"base.vmdk": []byte(baseDescriptor),
+		"base-data.vmdk": buildSparseExtent(1024*1024, map[int64][]byte{
+			0: grain("A"), 1: grain("B"), 20: grain("C"),
+		}),
+		"current.vmdk": []byte(strings.Replace(baseDescriptor,
+			"base-data.vmdk", "current-data.vmdk", 1)),
+		"current-data.vmdk": buildSparseExtent(1024*1024, map[int64][]byte{
+			0: grain("A"), 1: grain("B"), 20: grain("D"),
+		}),
+	}
+
+	baseline, err := openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer baseline.Close()
+
+	current, err := openTestDisk(files, "current.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer current.Close()
+
+	changed, err := current.ChangedBlocks(baseline)
+	if err != nil {
+		t.Fatalf("ChangedBlocks: %v", err)
+	}
+
+	// Grain 20 is at 80kb which is in the second 64kb block.
+	expected := []Range{{Offset: CHANGED_BLOCK_SIZE, Length: CHANGED_BLOCK_SIZE}}
+	if len(changed) != 1 || changed[0] != expected[0] {
+		t.Fatalf("Unexpected changed blocks %+v", changed)
+	}
+
+	changed, err = baseline.ChangedBlocks(baseline)
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("Expected no changes: %+v %v", changed, err)
+	}
+}
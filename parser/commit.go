@@ -0,0 +1,416 @@
+package parser
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Flat extents are rewritten in blocks of this size.
+const COMMIT_BLOCK_SIZE = WRITER_GRAIN_SECTORS * SECTOR_SIZE
+
+// A WriterOpener opens an extent file of the parent disk for writing.
+// The filename is as given in the parent's descriptor, relative to the
+// descriptor's directory.
+type WriterOpener func(filename string) (
+	writer io.WriterAt, closer func(), err error)
+
+// CommitResult describes the data merged into the parent disk.
+type CommitResult struct {
+	// The parent disk the snapshot was merged into.
+	Parent string `json:"Parent"`
+
+	// Parent grains (or blocks of flat extents) that were written.
+	Grains int `json:"Grains"`
+
+	// Grains newly allocated in sparse parent extents.
+	Allocated int `json:"Allocated"`
+
+	Bytes int64 `json:"Bytes"`
+
+	// The ranges of the logical disk held by the snapshot.
+	Ranges []Range `json:"Ranges"`
+}
+
+// Commit merges this snapshot into its parent disk in place. Every
+// block of the parent touched by data in this snapshot is rewritten
+// with the merged contents. With dry_run nothing is written but the
+// result describes what would change. The parent's CID is not updated
+// since it may live in a separate descriptor file.
+func (self *VMDKContext) Commit(ctx context.Context, opener WriterOpener,
+	dry_run bool, progress ProgressFunc) (*CommitResult, error) {
+	parent := self.parent
+	if parent == nil {
+		return nil, errors.New("Disk has no parent to commit into")
+	}
+
+	if self.total_size > parent.total_size {
+		return nil, fmt.Errorf("Snapshot is %v bytes but the parent only %v",
+			self.total_size, parent.total_size)
+	}
+
+	res := &CommitResult{
+		Parent: parent.filename,
+		Ranges: self.layerAllocatedRanges(true),
+	}
+
+	var total int64
+	for _, r := range res.Ranges {
+		total += r.Length
+	}
+
+	// Refuse before anything is written so a parent we can not fully
+	// merge into is left untouched.
+	for _, extent := range parent.extents {
+		err := checkCommitExtent(ctx, extent, res.Ranges)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	var done int64
+	for _, extent := range parent.extents {
+		err := self.commitExtent(ctx, extent, opener, dry_run, res)
+		if err != nil {
+			return res, err
+		}
+
+		for _, r := range intersectRanges(res.Ranges, extent) {
+			done += r.Length
+		}
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+
+	return res, nil
+}
+
+// Check that the ranges can be merged into the extent.
+func checkCommitExtent(ctx context.Context, extent Extent,
+	ranges []Range) error {
+	if len(intersectRanges(ranges, extent)) == 0 {
+		return nil
+	}
+
+	switch t := extent.(type) {
+	case *lazyExtent:
+		handle, err := t.handles.get(t)
+		if err != nil {
+			return fmt.Errorf("While opening %v: %w", t.filename, err)
+		}
+		defer t.handles.release(handle)
+
+		return checkCommitExtent(ctx, handle.extent, ranges)
+
+	case *SparseExtent:
+		return t.checkCommit(ctx, ranges)
+
+	case *FlatExtent:
+		return nil
+
+	default:
+		// A gap between extents can not hold data.
+		return fmt.Errorf("%w: parent has no extent at %#x",
+			ErrUnsupported, extent.VirtualOffset())
+	}
+}
+
+func (self *VMDKContext) commitExtent(ctx context.Context, extent Extent,
+	opener WriterOpener, dry_run bool, res *CommitResult) error {
+	switch t := extent.(type) {
+	case *lazyExtent:
+		if len(intersectRanges(res.Ranges, extent)) == 0 {
+			return nil
+		}
+
+		// Keep the file open until the extent is merged.
+		handle, err := t.handles.get(t)
+		if err != nil {
+			return fmt.Errorf("While opening %v: %w", t.filename, err)
+		}
+		defer t.handles.release(handle)
+
+		return self.commitExtent(ctx, handle.extent, opener, dry_run, res)
+
+	case *SparseExtent:
+		return self.commitSparse(ctx, t, opener, dry_run, res)
+
+	case *FlatExtent:
+		return self.commitFlat(ctx, t, opener, dry_run, res)
+
+	default:
+		// checkCommitExtent refused gaps holding data.
+		return nil
+	}
+}
+
+// The ranges that fall within the extent, relative to the start of
+// the logical disk.
+func intersectRanges(ranges []Range, extent Extent) []Range {
+	var res []Range
+	start := extent.VirtualOffset()
+	end := start + extent.TotalSize()
+	for _, r := range ranges {
+		if r.End() <= start || r.Offset >= end {
+			continue
+		}
+		if r.Offset < start {
+			r.Length -= start - r.Offset
+			r.Offset = start
+		}
+		if r.End() > end {
+			r.Length = end - r.Offset
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// Call fn with the virtual offset of every block in the extent that
+// overlaps the ranges.
+func forEachBlock(ctx context.Context, ranges []Range, extent Extent,
+	block_size int64, fn func(offset int64) error) error {
+	last := int64(-1)
+	start := extent.VirtualOffset()
+	for _, r := range intersectRanges(ranges, extent) {
+		first := start + (r.Offset-start)/block_size*block_size
+		for offset := first; offset < r.End(); offset += block_size {
+			// Adjacent ranges may share a block.
+			if offset <= last {
+				continue
+			}
+			last = offset
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			err := fn(offset)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read the merged contents of a block, clipped to the extent.
+func (self *VMDKContext) readBlock(extent Extent, offset, block_size int64) (
+	[]byte, error) {
+	length := block_size
+	end := extent.VirtualOffset() + extent.TotalSize()
+	if offset+length > end {
+		length = end - offset
+	}
+
+	buf := make([]byte, length)
+	n, err := self.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Anything beyond the end of the snapshot reads as zero.
+	zeroFill(buf[n:])
+	return buf, nil
+}
+
+func (self *VMDKContext) commitFlat(ctx context.Context, extent *FlatExtent,
+	opener WriterOpener, dry_run bool, res *CommitResult) error {
+	if len(intersectRanges(res.Ranges, extent)) == 0 {
+		return nil
+	}
+
+	var writer io.WriterAt
+	if !dry_run {
+		w, closer, err := opener(extent.filename)
+		if err != nil {
+			return fmt.Errorf("While opening %v: %w", extent.filename, err)
+		}
+		defer closer()
+		writer = w
+	}
+
+	return forEachBlock(ctx, res.Ranges, extent, COMMIT_BLOCK_SIZE,
+		func(offset int64) error {
+			buf, err := self.readBlock(extent, offset, COMMIT_BLOCK_SIZE)
+			if err != nil {
+				return err
+			}
+
+			res.Grains++
+			res.Bytes += int64(len(buf))
+			if dry_run {
+				return nil
+			}
+
+			_, err = writer.WriteAt(buf,
+				extent.file_offset+offset-extent.offset)
+			return err
+		})
+}
+
+func (self *VMDKContext) commitSparse(ctx context.Context, extent *SparseExtent,
+	opener WriterOpener, dry_run bool, res *CommitResult) error {
+	if len(intersectRanges(res.Ranges, extent)) == 0 {
+		return nil
+	}
+
+	var writer io.WriterAt
+	if !dry_run {
+		w, closer, err := opener(extent.filename)
+		if err != nil {
+			return fmt.Errorf("While opening %v: %w", extent.filename, err)
+		}
+		defer closer()
+		writer = w
+	}
+
+	grain_sectors := extent.grain_size / SECTOR_SIZE
+	next_sector := extent.nextFreeSector()
+	rgd_offset := int64(extent.header.rgdOffset() * SECTOR_SIZE)
+
+	return forEachBlock(ctx, res.Ranges, extent, extent.grain_size,
+		func(offset int64) error {
+			gt_number, entry, gde := extent.commitEntry(offset)
+			buf, err := self.readBlock(extent, offset, extent.grain_size)
+			if err != nil {
+				return err
+			}
+
+			gte_offset := int64(gde)*SECTOR_SIZE + 4*entry
+			sector := int64(ParseUint32(extent.reader, gte_offset))
+
+			res.Grains++
+			res.Bytes += int64(len(buf))
+
+			// A zeroed grain has no space of its own.
+			if sector == 0 || sector == ZERO_GRAIN_GTE {
+				res.Allocated++
+				sector = next_sector
+				next_sector += grain_sectors
+			}
+
+			if dry_run {
+				return nil
+			}
+
+			// A new grain is always written in full.
+			grain := make([]byte, extent.grain_size)
+			copy(grain, buf)
+			_, err = writer.WriteAt(grain, sector*SECTOR_SIZE)
+			if err != nil {
+				return err
+			}
+
+			if int64(ParseUint32(extent.reader, gte_offset)) == sector {
+				return nil
+			}
+
+			gte := make([]byte, 4)
+			binary.LittleEndian.PutUint32(gte, uint32(sector))
+			_, err = writer.WriteAt(gte, gte_offset)
+			if err != nil {
+				return err
+			}
+
+			// Keep the redundant grain tables in sync.
+			if rgd_offset > 0 {
+				rgde := ParseUint32(extent.reader, rgd_offset+4*gt_number)
+				if rgde != 0 {
+					_, err = writer.WriteAt(gte,
+						int64(rgde)*SECTOR_SIZE+4*entry)
+				}
+			}
+			return err
+		})
+}
+
+// Check the extent can take the grains covering the ranges without
+// allocating grain tables, which would need the metadata rewritten.
+func (self *SparseExtent) checkCommit(ctx context.Context,
+	ranges []Range) error {
+	if self.header.flags()&FLAG_COMPRESSED != 0 {
+		return fmt.Errorf("%w: can not commit into compressed extent %v",
+			ErrUnsupported, self.filename)
+	}
+
+	// The writer opener only opens the grain file.
+	if self.split {
+		return fmt.Errorf("%w: can not commit into split extent %v",
+			ErrUnsupported, self.filename)
+	}
+
+	return forEachBlock(ctx, ranges, self, self.grain_size,
+		func(offset int64) error {
+			gt_number, _, gde := self.commitEntry(offset)
+			if gde == 0 {
+				return fmt.Errorf("%w: grain table %v is not allocated in %v",
+					ErrUnsupported, gt_number, self.filename)
+			}
+			return nil
+		})
+}
+
+// Locate the grain table entry for the grain at the virtual offset.
+func (self *SparseExtent) commitEntry(offset int64) (
+	gt_number, entry int64, gde uint32) {
+	index := offset - self.offset
+	gt_number = index / self.grain_table_coverage
+	entry = (index % self.grain_table_coverage) / self.grain_size
+	gde = ParseUint32(self.reader, self.gde_offset+4*gt_number)
+	return gt_number, entry, gde
+}
+
+// The first sector past all the metadata and grains in the extent
+// file. New grains are appended there.
+func (self *SparseExtent) nextFreeSector() int64 {
+	grain_sectors := self.grain_size / SECTOR_SIZE
+	next := int64(self.header.overHead())
+
+	num_gts := (self.total_size + self.grain_table_coverage - 1) /
+		self.grain_table_coverage
+	num_gtes := int64(self.header.numGTEsPerGT())
+	gt := make([]byte, num_gtes*4)
+
+	for _, gd_offset := range []int64{
+		self.gde_offset, int64(self.header.rgdOffset() * SECTOR_SIZE)} {
+		if gd_offset == 0 {
+			continue
+		}
+
+		for i := int64(0); i < num_gts; i++ {
+			gde := int64(ParseUint32(self.reader, gd_offset+4*i))
+			if gde == 0 {
+				continue
+			}
+
+			end := gde + (num_gtes*4+SECTOR_SIZE-1)/SECTOR_SIZE
+			if end > next {
+				next = end
+			}
+
+			if gd_offset != self.gde_offset {
+				continue
+			}
+
+			_, err := self.reader.ReadAt(gt, gde*SECTOR_SIZE)
+			if err != nil && err != io.EOF {
+				continue
+			}
+
+			for j := int64(0); j < num_gtes; j++ {
+				gte := int64(binary.LittleEndian.Uint32(gt[4*j:]))
+				if gte > ZERO_GRAIN_GTE && gte+grain_sectors > next {
+					next = gte + grain_sectors
+				}
+			}
+		}
+	}
+
+	return next
+}
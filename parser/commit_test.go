@@ -0,0 +1,205 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCommit(t *testing.T) {
+	files := makeChainFiles()
+
+	// Grain 1 overwrites an allocated grain in the base, grain 5 needs
+	// a new grain.
+	files["snapshot-data.vmdk"] = buildSparseExtent(1024*1024, map[int64][]byte{
+		1: bytes.Repeat([]byte("S"), testGrainSize),
+		5: bytes.Repeat([]byte("T"), testGrainSize),
+	})
+
+	vmdk, err := openTestDisk(files, "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	expected := make([]byte, vmdk.Size())
+	vmdk.ReadAt(expected, 0)
+
+	opener := func(filename string) (io.WriterAt, func(), error) {
+		writer := &memWriterAt{buf: append([]byte{}, files[filename]...)}
+		return writer, func() { files[filename] = writer.buf }, nil
+	}
+
+	// A dry run reports the change without writing.
+	original := append([]byte{}, files["base-data.vmdk"]...)
+	res, err := vmdk.Commit(context.Background(), opener, true, nil)
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if res.Grains != 2 || res.Allocated != 1 ||
+		res.Bytes != 2*testGrainSize || res.Parent != "base.vmdk" {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+
+	if !bytes.Equal(files["base-data.vmdk"], original) {
+		t.Fatalf("Dry run modified the parent")
+	}
+
+	_, err = vmdk.Commit(context.Background(), opener, false, nil)
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// The base alone now holds the merged contents.
+	base, err := openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer base.Close()
+
+	merged := make([]byte, base.Size())
+	base.ReadAt(merged, 0)
+	if !bytes.Equal(merged, expected) {
+		t.Fatalf("Committed parent differs from the snapshot")
+	}
+
+	// A disk without a parent can not be committed.
+	_, err = base.Commit(context.Background(), opener, false, nil)
+	if err == nil {
+		t.Fatalf("Expected an error committing a base disk")
+	}
+}
+
+func TestCommitLazy(t *testing.T) {
+	// Extents opened on demand are merged the same way.
+	files := makeChainFiles()
+	vmdk, err := openTestDisk(files, "snapshot.vmdk", WithLazyOpen(1))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	expected := make([]byte, vmdk.Size())
+	vmdk.ReadAt(expected, 0)
+
+	opener := func(filename string) (io.WriterAt, func(), error) {
+		writer := &memWriterAt{buf: append([]byte{}, files[filename]...)}
+		return writer, func() { files[filename] = writer.buf }, nil
+	}
+
+	res, err := vmdk.Commit(context.Background(), opener, false, nil)
+	if err != nil || res.Grains != 1 {
+		t.Fatalf("Commit: %+v %v", res, err)
+	}
+
+	base, err := openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer base.Close()
+
+	merged := make([]byte, base.Size())
+	base.ReadAt(merged, 0)
+	if !bytes.Equal(merged, expected) {
+		t.Fatalf("Committed parent differs from the snapshot")
+	}
+}
+
+func TestCommitRefusesBeforeWriting(t *testing.T) {
+	// 4mb disks have two grain tables. The base's second grain table
+	// is not allocated so grain 600 can not be merged, and grain 1
+	// must not be written either.
+	files := testFiles{
+		"base.vmdk": []byte(strings.Replace(
+			baseDescriptor, "RW 2048", "RW 8192", 1)),
+		"base-data.vmdk": buildSparseExtent(4*1024*1024, map[int64][]byte{
+			0: bytes.Repeat([]byte("B"), testGrainSize),
+		}),
+		"snapshot.vmdk": []byte(strings.Replace(
+			snapshotDescriptor, "RW 2048", "RW 8192", 1)),
+		"snapshot-data.vmdk": buildSparseExtent(4*1024*1024, map[int64][]byte{
+			1:   bytes.Repeat([]byte("S"), testGrainSize),
+			600: bytes.Repeat([]byte("T"), testGrainSize),
+		}),
+	}
+	binary.LittleEndian.PutUint32(files["base-data.vmdk"][SECTOR_SIZE+4:], 0)
+
+	vmdk, err := openTestDisk(files, "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	original := append([]byte{}, files["base-data.vmdk"]...)
+	opened := false
+	opener := func(filename string) (io.WriterAt, func(), error) {
+		opened = true
+		writer := &memWriterAt{buf: append([]byte{}, files[filename]...)}
+		return writer, func() { files[filename] = writer.buf }, nil
+	}
+
+	_, err = vmdk.Commit(context.Background(), opener, false, nil)
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Expected ErrUnsupported, got %v", err)
+	}
+
+	if opened || !bytes.Equal(files["base-data.vmdk"], original) {
+		t.Fatalf("Parent was written before the commit was refused")
+	}
+}
+
+func TestCommitZeroedGrain(t *testing.T) {
+	files := makeChainFiles()
+	files["snapshot-data.vmdk"] = buildSparseExtent(1024*1024, map[int64][]byte{
+		5: bytes.Repeat([]byte("T"), testGrainSize),
+	})
+
+	// Grain 5 of the base is zeroed, so has no space in the file.
+	base_data := files["base-data.vmdk"]
+	binary.LittleEndian.PutUint32(base_data[4:], 2)
+	binary.LittleEndian.PutUint32(base_data[8:], 1|FLAG_ZERO_GRAIN_GTE)
+	binary.LittleEndian.PutUint32(base_data[2*SECTOR_SIZE+5*4:],
+		ZERO_GRAIN_GTE)
+	metadata := append([]byte{}, base_data[:2*SECTOR_SIZE]...)
+
+	vmdk, err := openTestDisk(files, "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	expected := make([]byte, vmdk.Size())
+	vmdk.ReadAt(expected, 0)
+
+	opener := func(filename string) (io.WriterAt, func(), error) {
+		writer := &memWriterAt{buf: append([]byte{}, files[filename]...)}
+		return writer, func() { files[filename] = writer.buf }, nil
+	}
+
+	res, err := vmdk.Commit(context.Background(), opener, false, nil)
+	if err != nil || res.Allocated != 1 {
+		t.Fatalf("Commit: %+v %v", res, err)
+	}
+
+	// The header and grain directory are intact.
+	if !bytes.Equal(files["base-data.vmdk"][:2*SECTOR_SIZE], metadata) {
+		t.Fatalf("Commit overwrote the parent's metadata")
+	}
+
+	base, err := openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer base.Close()
+
+	merged := make([]byte, base.Size())
+	base.ReadAt(merged, 0)
+	if !bytes.Equal(merged, expected) {
+		t.Fatalf("Committed parent differs from the snapshot")
+	}
+}
@@ -0,0 +1,237 @@
+package parser
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ConfigRegex = regexp.MustCompile(`^\s*([A-Za-z0-9_.]+)\s*=\s*"?([^"]*)"?\s*$`)
+	KeyRegex    = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+)
+
+// VMDKConfig holds the key/value settings from the descriptor header
+// and the disk database.
+type VMDKConfig struct {
+	Version            int    `json:"version"`
+	CID                string `json:"CID"`
+	ParentCID          string `json:"parentCID"`
+	CreateType         string `json:"createType"`
+	ParentFileNameHint string `json:"parentFileNameHint,omitempty"`
+	ChangeTrackPath    string `json:"changeTrackPath,omitempty"`
+
+	DBBAdapterType       string `json:"ddb.adapterType,omitempty"`
+	DBBGeometryCylinders int64  `json:"ddb.geometry.cylinders,omitempty"`
+	DBBGeometryHeads     int64  `json:"ddb.geometry.heads,omitempty"`
+	DBBGeometrySectors   int64  `json:"ddb.geometry.sectors,omitempty"`
+	DBBUuid              string `json:"ddb.uuid,omitempty"`
+	DBBLongContentID     string `json:"ddb.longContentID,omitempty"`
+	DBBVirtualHWVersion  string `json:"ddb.virtualHWVersion,omitempty"`
+
+	// All keys in the order they appear in the descriptor.
+	keys   []string
+	values map[string]string
+}
+
+func NewVMDKConfig() *VMDKConfig {
+	return &VMDKConfig{
+		values: make(map[string]string),
+	}
+}
+
+// Get returns the raw value of any descriptor key.
+func (self *VMDKConfig) Get(key string) (string, bool) {
+	value, pres := self.values[key]
+	return value, pres
+}
+
+// Keys returns all the keys present in the descriptor.
+func (self *VMDKConfig) Keys() []string {
+	return append([]string{}, self.keys...)
+}
+
+// ParseConfig parses the key/value settings from descriptor text.
+func ParseConfig(descriptor string) *VMDKConfig {
+	res := NewVMDKConfig()
+	for _, line := range strings.Split(descriptor, "\n") {
+		res.parseLine(line)
+	}
+	return res
+}
+
+// Set changes the value of a descriptor key, adding it if it is not
+// already present. Numeric keys are validated.
+func (self *VMDKConfig) Set(key, value string) error {
+	if !KeyRegex.MatchString(key) {
+		return fmt.Errorf("Invalid key %q", key)
+	}
+
+	if strings.ContainsAny(value, "\"\r\n") {
+		return fmt.Errorf("Invalid value for %v: %q", key, value)
+	}
+
+	switch key {
+	case "version", "ddb.geometry.cylinders", "ddb.geometry.heads",
+		"ddb.geometry.sectors":
+		_, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %v: %q", key, value)
+		}
+
+	case "CID", "parentCID":
+		_, err := NormalizeCID(value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %v: %w", key, err)
+		}
+	}
+
+	if _, pres := self.values[key]; !pres {
+		self.keys = append(self.keys, key)
+	}
+	self.values[key] = value
+	self.set(key, value)
+
+	return nil
+}
+
+// Parse a single descriptor line. Returns false if the line is not a
+// key/value setting.
+func (self *VMDKConfig) parseLine(line string) bool {
+	match := ConfigRegex.FindStringSubmatch(line)
+	if len(match) == 0 {
+		return false
+	}
+
+	key := match[1]
+	value := match[2]
+	if _, pres := self.values[key]; !pres {
+		self.keys = append(self.keys, key)
+	}
+	self.values[key] = value
+	self.set(key, value)
+
+	return true
+}
+
+// Update the typed field corresponding to key.
+func (self *VMDKConfig) set(key, value string) {
+	switch key {
+	case "version":
+		self.Version, _ = strconv.Atoi(value)
+	case "CID":
+		self.CID = strings.ToLower(strings.TrimSpace(value))
+	case "parentCID":
+		self.ParentCID = strings.ToLower(strings.TrimSpace(value))
+	case "createType":
+		self.CreateType = value
+	case "parentFileNameHint":
+		self.ParentFileNameHint = value
+	case "changeTrackPath":
+		self.ChangeTrackPath = value
+	case "ddb.adapterType":
+		self.DBBAdapterType = value
+	case "ddb.geometry.cylinders":
+		self.DBBGeometryCylinders = parseInt(value)
+	case "ddb.geometry.heads":
+		self.DBBGeometryHeads = parseInt(value)
+	case "ddb.geometry.sectors":
+		self.DBBGeometrySectors = parseInt(value)
+	case "ddb.uuid":
+		self.DBBUuid = value
+	case "ddb.longContentID":
+		self.DBBLongContentID = value
+	case "ddb.virtualHWVersion":
+		self.DBBVirtualHWVersion = value
+	}
+}
+
+// NormalizeCID returns a content ID in its canonical form of 8 lower
+// case hex digits. VMware writes it in lower case but upper case and
+// surrounding white space are accepted.
+func NormalizeCID(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) != 8 {
+		return "", fmt.Errorf("%w %q: expected 8 hex digits", ErrInvalidCID, value)
+	}
+
+	_, err := hex.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: not hex", ErrInvalidCID, value)
+	}
+
+	return strings.ToLower(value), nil
+}
+
+// Check the CID and parentCID, when present, are valid.
+func (self *VMDKConfig) checkCIDs() error {
+	for _, key := range []string{"CID", "parentCID"} {
+		value, pres := self.values[key]
+		if !pres {
+			continue
+		}
+
+		_, err := NormalizeCID(value)
+		if err != nil {
+			return fmt.Errorf("Descriptor %v: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// HasParent is true when the descriptor refers to a parent disk.
+func (self *VMDKConfig) HasParent() bool {
+	return self.ParentFileNameHint != "" ||
+		(self.ParentCID != "" && !strings.EqualFold(self.ParentCID, "ffffffff"))
+}
+
+func parseInt(value string) int64 {
+	res, _ := strconv.ParseInt(strings.TrimSpace(value), 0, 64)
+	return res
+}
+
+// UUID parses ddb.uuid. VMware writes it as 16 hex bytes separated by
+// spaces with a dash in the middle, e.g.
+// "60 00 C2 9b 69 2f c9 76-74 c4 07 9e 10 87 3b f9".
+func (self *VMDKConfig) UUID() ([16]byte, error) {
+	var res [16]byte
+
+	if self.DBBUuid == "" {
+		return res, errors.New("No ddb.uuid in descriptor")
+	}
+
+	fields := strings.Fields(strings.Replace(self.DBBUuid, "-", " ", 1))
+	if len(fields) != 16 {
+		return res, fmt.Errorf("Invalid ddb.uuid %q", self.DBBUuid)
+	}
+
+	for i, field := range fields {
+		value, err := strconv.ParseUint(field, 16, 8)
+		if err != nil || len(field) != 2 {
+			return res, fmt.Errorf("Invalid ddb.uuid %q", self.DBBUuid)
+		}
+		res[i] = byte(value)
+	}
+
+	return res, nil
+}
+
+// LongContentID parses ddb.longContentID, the 128 bit counterpart of
+// the CID, written as 32 hex digits. The CID is the low 32 bits of the
+// long content ID.
+func (self *VMDKConfig) LongContentID() ([]byte, error) {
+	if self.DBBLongContentID == "" {
+		return nil, errors.New("No ddb.longContentID in descriptor")
+	}
+
+	res, err := hex.DecodeString(strings.TrimSpace(self.DBBLongContentID))
+	if err != nil || len(res) != 16 {
+		return nil, fmt.Errorf("Invalid ddb.longContentID %q",
+			self.DBBLongContentID)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConfigUUID(t *testing.T) {
+	config := NewVMDKConfig()
+	config.parseLine(`ddb.uuid = "60 00 C2 9b 69 2f c9 76-74 c4 07 9e 10 87 3b f9"`)
+
+	uuid, err := config.UUID()
+	if err != nil {
+		t.Fatalf("UUID: %v", err)
+	}
+
+	expected := [16]byte{0x60, 0x00, 0xc2, 0x9b, 0x69, 0x2f, 0xc9, 0x76,
+		0x74, 0xc4, 0x07, 0x9e, 0x10, 0x87, 0x3b, 0xf9}
+	if uuid != expected {
+		t.Fatalf("Unexpected uuid %x", uuid)
+	}
+
+	for _, bad := range []string{
+		"",
+		"60 00 C2 9b 69 2f c9 76-74 c4 07 9e 10 87 3b",
+		"60 00 C2 9b 69 2f c9 76-74 c4 07 9e 10 87 3b zz",
+		"600 0 C2 9b 69 2f c9 76-74 c4 07 9e 10 87 3b f9",
+	} {
+		config := NewVMDKConfig()
+		config.parseLine(`ddb.uuid = "` + bad + `"`)
+		_, err := config.UUID()
+		if err == nil {
+			t.Fatalf("Expected an error for %q", bad)
+		}
+	}
+}
+
+const ddbDescriptor = `# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW 2048 SPARSE "base-data.vmdk"
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "ide"
+ddb.toolsVersion = "12345"
+`
+
+func TestWriteDescriptor(t *testing.T) {
+	files := makeChainFiles()
+	files["base.vmdk"] = []byte(ddbDescriptor)
+
+	config := ParseConfig(ddbDescriptor)
+	for _, setting := range [][]string{
+		{"ddb.adapterType", "lsilogic"},
+		{"CID", "33333333"},
+		{"ddb.geometry.heads", "255"},
+		{"isNativeSnapshot", "no"},
+	} {
+		err := config.Set(setting[0], setting[1])
+		if err != nil {
+			t.Fatalf("Set %v: %v", setting[0], err)
+		}
+	}
+
+	if config.Set("ddb.geometry.sectors", "many") == nil {
+		t.Fatalf("Expected an error for a non numeric geometry")
+	}
+
+	if config.Set("bad key", "1") == nil {
+		t.Fatalf("Expected an error for an invalid key")
+	}
+
+	out := &bytes.Buffer{}
+	err := WriteDescriptor(out, ddbDescriptor, config)
+	if err != nil {
+		t.Fatalf("WriteDescriptor: %v", err)
+	}
+
+	// Existing lines keep their formatting and new header keys go
+	// before the extent section.
+	for _, expected := range []string{
+		"CID=33333333\nparentCID=ffffffff\n" +
+			"createType=\"monolithicSparse\"\nisNativeSnapshot=\"no\"\n\n",
+		`ddb.adapterType = "lsilogic"`,
+		`ddb.toolsVersion = "12345"`,
+		"ddb.geometry.heads = \"255\"\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Expected %q in descriptor:\n%v", expected, out.String())
+		}
+	}
+
+	files["base.vmdk"] = out.Bytes()
+	vmdk, err := openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	defer vmdk.Close()
+
+	reparsed := vmdk.Config()
+	if reparsed.DBBAdapterType != "lsilogic" || reparsed.CID != "33333333" ||
+		reparsed.DBBGeometryHeads != 255 {
+		t.Fatalf("Settings did not persist: %+v", reparsed)
+	}
+
+	value, _ := reparsed.Get("ddb.toolsVersion")
+	if value != "12345" {
+		t.Fatalf("Unknown key lost: %q", value)
+	}
+
+	if vmdk.Size() != 1024*1024 {
+		t.Fatalf("Unexpected size %v", vmdk.Size())
+	}
+}
@@ -1,52 +1,275 @@
 package parser
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	SPARSE_MAGICNUMBER = 0x564d444b
 	SECTOR_SIZE        = 512
+
+	// The first line of a descriptor.
+	DESCRIPTOR_HEADER = "# Disk DescriptorFile"
+
+	// How much of a file is examined to recognize a descriptor.
+	DESCRIPTOR_PROBE_SIZE = 4096
+
+	// Some editors start the descriptor with a byte order mark.
+	UTF8_BOM = "\xef\xbb\xbf"
+
+	// The most extents a descriptor may list unless set with
+	// WithMaxExtents. A twoGbMaxExtent disk of 8TB has 4096.
+	DEFAULT_MAX_EXTENTS = 4096
+
+	// The number of extent files opened at once unless set with
+	// WithOpenConcurrency.
+	DEFAULT_OPEN_CONCURRENCY = 4
 )
 
 var (
 	StartExtentRegex = regexp.MustCompile("^# Extent description")
-	ExtentRegex      = regexp.MustCompile(`(RW|R) (\d+) ([A-Z]+) "([^"]+)"`)
+	// Disks with changed block tracking name their CBT file in this
+	// section.
+	ChangeTrackingRegex = regexp.MustCompile("^# Change Tracking File")
+	// Deprecated: descriptors are parsed with a tokenizer which also
+	// accepts other access modes, any whitespace between fields and
+	// trailing annotations. This regex is kept as it was for callers
+	// matching extent lines themselves, so it matches neither size
+	// suffixes nor the extent offset.
+	ExtentRegex = regexp.MustCompile(`(RW|R) (\d+) ([A-Z]+) "([^"]+)"`)
+)
+
+var (
+	// ErrUnsupported is wrapped by errors for disks using features
+	// this library does not implement.
+	ErrUnsupported = errors.New("Unsupported")
+
+	// ErrOpenerReturnedNil is returned when an Opener returns neither
+	// a reader nor an error.
+	ErrOpenerReturnedNil = errors.New("Opener returned a nil reader")
+
+	// ErrCircularChain is returned when a disk is its own ancestor.
+	ErrCircularChain = errors.New("Circular parent chain")
+
+	// ErrGrainOutOfBounds is returned when a grain table entry points
+	// past the end of the extent file (see WithGrainBoundsCheck).
+	ErrGrainOutOfBounds = errors.New("Grain out of bounds")
+
+	// ErrInvalidGeometry is returned when the adapter type or geometry
+	// in the disk database do not suit the disk.
+	ErrInvalidGeometry = errors.New("Invalid geometry")
+
+	// ErrNotADescriptor is returned for a file which neither starts
+	// with the descriptor header nor is a sparse extent.
+	ErrNotADescriptor = errors.New("Not a vmdk descriptor")
+
+	// ErrInvalidExtentLine is returned for a descriptor line which
+	// starts like an extent line but can not be parsed.
+	ErrInvalidExtentLine = errors.New("Invalid extent line")
+
+	// ErrTooManyExtents is returned for a descriptor listing more
+	// extents than allowed (see WithMaxExtents).
+	ErrTooManyExtents = errors.New("Too many extents")
+
+	// ErrInvalidGrainSize is returned for a sparse extent whose grain
+	// size is not allowed (see WithStrictGrainSize).
+	ErrInvalidGrainSize = errors.New("Invalid grain size")
+
+	// ErrInvalidCID is returned for a descriptor whose CID or
+	// parentCID is not 8 hex digits (see WithLenientCIDs).
+	ErrInvalidCID = errors.New("Invalid CID")
+
+	// ErrInvalidMagic is returned for an extent file without the
+	// sparse extent magic.
+	ErrInvalidMagic = errors.New("Invalid magic")
+
+	// ErrCorruptStream is returned for a streamOptimized disk whose
+	// markers or header hold impossible values.
+	ErrCorruptStream = errors.New("Corrupt streamOptimized disk")
+
+	// ErrCapacityMismatch is returned when a disk in an OVA is not the
+	// size its OVF descriptor declares (see WithLenientCapacity).
+	ErrCapacityMismatch = errors.New("Capacity mismatch")
 )
 
+// An Opener opens the extent file named in the descriptor. The
+// closer is called when the context is closed. It may be called from
+// several goroutines at once (see WithOpenConcurrency).
+type Opener func(filename string) (
+	reader io.ReaderAt, closer func(), err error)
+
 type VMDKContext struct {
 	profile *VMDKProfile
 	reader  io.ReaderAt
+	config  *VMDKConfig
+	options *options
 
 	extents []Extent
 
 	total_size int64
+
+	// The parent disk of a snapshot (delta) disk.
+	parent        *VMDKContext
+	parent_closer func()
+
+	// The filename this disk was opened from, if known.
+	filename string
+
+	// Open extent files in lazy mode, shared with the parents.
+	handles *handleCache
+
+	// Set when one extent covers the whole disk so reads skip the
+	// extent search.
+	single Extent
+
+	// Prefetches data ahead of sequential reads, if enabled.
+	readahead *readahead
+
+	// Ranges read so far, if enabled.
+	coverage *coverageMap
+
+	// Tracks caches being filled by Advise.
+	advising sync.WaitGroup
+
+	// Recoverable problems found while parsing the descriptor and
+	// opening the extents.
+	Warnings []string
+
+	// Index of the extent the last read was found in. Consecutive
+	// reads usually hit the same extent. Accessed atomically.
+	last_extent int64
+}
+
+func (self *VMDKContext) warn(format string, args ...interface{}) {
+	self.Warnings = append(self.Warnings, fmt.Sprintf(format, args...))
 }
 
 func (self *VMDKContext) Size() int64 {
 	return self.total_size
 }
 
+func (self *VMDKContext) Config() *VMDKConfig {
+	return self.config
+}
+
+// CID returns the content ID from the descriptor in lower case, or ""
+// if there is none.
+func (self *VMDKContext) CID() string {
+	return self.config.CID
+}
+
+// ParentCID returns the parent's content ID from the descriptor in
+// lower case, or "" if there is none.
+func (self *VMDKContext) ParentCID() string {
+	return self.config.ParentCID
+}
+
+// ChangeTrackingFile returns the changed block tracking (CBT) file
+// named by the descriptor, as given there, or "" if there is none. The
+// file itself is not read.
+func (self *VMDKContext) ChangeTrackingFile() string {
+	return self.config.ChangeTrackPath
+}
+
 func (self *VMDKContext) Debug() {
 	for _, i := range self.extents {
 		i.Debug()
 	}
 }
 
+// Close closes the extents and the parent, calling the closers their
+// openers returned. Every closer is called even if one panics, so a
+// bad closer does not leak the files and temporary storage of the
+// others. Panics are recorded in Warnings.
 func (self *VMDKContext) Close() {
+	self.advising.Wait()
+
+	if self.readahead != nil {
+		self.readahead.Close()
+	}
+
+	var errs []error
 	for _, i := range self.extents {
-		i.Close()
+		err := safeClose(i.Close)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if self.handles != nil {
+		errs = append(errs, self.handles.Close()...)
+	}
+
+	if self.parent != nil {
+		self.parent.Close()
+		if self.parent_closer != nil {
+			err := safeClose(self.parent_closer)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for _, err := range errs {
+		self.warn("%v", err)
 	}
 }
 
+// Call closer, returning a panic as an error.
+func safeClose(closer func()) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("Closer panicked: %v", r)
+		}
+	}()
+
+	closer()
+	return nil
+}
+
 func (self *VMDKContext) getExtentForOffset(offset int64) (
 	extent Extent, err error) {
+	// Try the last extent used and the one after it, which
+	// sequential reads move on to.
+	last := atomic.LoadInt64(&self.last_extent)
+	for i := last; i <= last+1 && i < int64(len(self.extents)); i++ {
+		extent = self.extents[i]
+		virtual_offset := extent.VirtualOffset()
+		if virtual_offset <= offset &&
+			offset < virtual_offset+extent.TotalSize() {
+			if i != last {
+				atomic.StoreInt64(&self.last_extent, i)
+			}
+			return extent, nil
+		}
+	}
+
+	n, err := self.searchExtent(offset)
+	if err != nil {
+		return nil, err
+	}
 
+	atomic.StoreInt64(&self.last_extent, int64(n))
+	return self.extents[n], nil
+}
+
+// Find the index of the extent containing offset.
+func (self *VMDKContext) searchExtent(offset int64) (int, error) {
 	n := sort.Search(len(self.extents),
 		func(i int) bool {
 			extent := self.extents[i]
@@ -56,10 +279,10 @@ func (self *VMDKContext) getExtentForOffset(offset int64) (
 		})
 
 	if n < 1 || n > len(self.extents) {
-		return nil, io.EOF
+		return 0, io.EOF
 	}
 
-	extent = self.extents[n-1]
+	extent := self.extents[n-1]
 	virtual_offset := extent.VirtualOffset()
 	extent_size := extent.TotalSize()
 
@@ -67,11 +290,11 @@ func (self *VMDKContext) getExtentForOffset(offset int64) (
 	if virtual_offset > offset ||
 
 		// extent ends before offset
-		virtual_offset+extent_size < offset {
-		return nil, io.EOF
+		virtual_offset+extent_size <= offset {
+		return 0, io.EOF
 	}
 
-	return extent, nil
+	return n - 1, nil
 }
 
 func (self *VMDKContext) normalizeExtents() {
@@ -90,16 +313,42 @@ func (self *VMDKContext) normalizeExtents() {
 		}
 
 		extents = append(extents, e)
-		offset += e.TotalSize()
+		offset = e.VirtualOffset() + e.TotalSize()
 	}
 
 	self.extents = extents
+
+	self.single = nil
+	if len(extents) == 1 && extents[0].VirtualOffset() == 0 &&
+		extents[0].TotalSize() >= self.total_size {
+		self.single = extents[0]
+	}
 }
 
 func (self *VMDKContext) ReadAt(buf []byte, offset int64) (int, error) {
-	i := int64(0)
-	buf_len := int64(len(buf))
+	if self.readahead != nil && self.readahead.read(buf, offset) {
+		if self.coverage != nil {
+			self.coverage.add(offset, int64(len(buf)))
+		}
+		return len(buf), nil
+	}
+
+	n, err := self.readAt(buf, offset)
+	if self.coverage != nil {
+		self.coverage.add(offset, int64(n))
+	}
+
+	if err == nil && n < len(buf) && self.options != nil &&
+		self.options.strict {
+		if offset+int64(n) >= self.total_size {
+			return n, io.EOF
+		}
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
 
+func (self *VMDKContext) readAt(buf []byte, offset int64) (int, error) {
 	// First check the offset is valid for the entire file.
 	if offset > self.total_size || offset < 0 {
 		return 0, io.EOF
@@ -110,15 +359,44 @@ func (self *VMDKContext) ReadAt(buf []byte, offset int64) (int, error) {
 		buf = buf[:available_length]
 	}
 
+	var deadline time.Time
+	if self.options != nil && self.options.read_deadline > 0 {
+		deadline = time.Now().Add(self.options.read_deadline)
+	}
+
+	if self.single == nil && self.options != nil &&
+		self.options.read_concurrency > 1 {
+		return self.readParallel(buf, offset, deadline)
+	}
+
+	return self.readExtents(buf, offset, 0, deadline)
+}
+
+func deadlineError(length, offset int64) error {
+	return fmt.Errorf("%w: read of %v bytes at %#x",
+		os.ErrDeadlineExceeded, length, offset)
+}
+
+// Read buf from each extent in turn, starting i bytes into buf.
+func (self *VMDKContext) readExtents(buf []byte, offset, i int64,
+	deadline time.Time) (int, error) {
+	buf_len := int64(len(buf))
+
 	// Now add partial reads for each extent
 	for i < buf_len {
-		extent, err := self.getExtentForOffset(offset + i)
+		if !deadline.IsZero() && i > 0 && time.Now().After(deadline) {
+			return int(i), deadlineError(buf_len, offset)
+		}
+
+		var err error
+		extent := self.single
+		if extent == nil {
+			extent, err = self.getExtentForOffset(offset + i)
+		}
 		if err != nil {
-			// Missing extent - zero pad it
-			for i := 0; i < len(buf); i++ {
-				buf[i] = 0
-			}
-			return len(buf), nil
+			// Missing extent - zero pad the rest of the buffer
+			zeroFill(buf[i:])
+			return int(buf_len), nil
 		}
 
 		index_in_extent := offset + i - extent.VirtualOffset()
@@ -146,73 +424,356 @@ func (self *VMDKContext) ReadAt(buf []byte, offset int64) (int, error) {
 	return int(i), nil
 }
 
-func GetVMDKContext(
-	reader io.ReaderAt, size int,
-	opener func(filename string) (
-		reader io.ReaderAt, closer func(), err error),
-) (*VMDKContext, error) {
-	profile := NewVMDKProfile()
-	res := &VMDKContext{
-		profile: profile,
-		reader:  reader,
+func (self *VMDKContext) newLazyExtent(opener Opener,
+	extent_type, filename, metadata_filename string,
+	sectors, file_offset int64) (*lazyExtent, error) {
+	if !supportedExtentTypes[extent_type] {
+		return nil, fmt.Errorf("%w extent type %v",
+			ErrUnsupported, extent_type)
+	}
+
+	res := &lazyExtent{
+		handles:           self.handles,
+		opener:            opener,
+		options:           self.options,
+		extent_type:       extent_type,
+		filename:          filename,
+		metadata_filename: metadata_filename,
+		file_offset:       file_offset * SECTOR_SIZE,
+		total_size:        sectors * SECTOR_SIZE,
+		offset:            self.total_size,
+	}
+
+	if extent_type == "SPARSE" {
+		res.gt_cache = self.options.newGrainTableCache()
+	}
+
+	return res, nil
+}
+
+func (self *VMDKContext) startReadahead() {
+	if self.options.readahead > 0 {
+		self.readahead = newReadahead(self.options.readahead,
+			self.total_size, self.readAt)
+	}
+}
+
+// Parse a sector count from an extent line. Size suffixes are only
+// accepted in lenient mode.
+func (self *options) parseSectors(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(0)
+	switch value[len(value)-1] {
+	case 'K', 'k':
+		multiplier = 1 << 10
+	case 'M', 'm':
+		multiplier = 1 << 20
+	case 'G', 'g':
+		multiplier = 1 << 30
+	}
+
+	if multiplier == 0 {
+		return strconv.ParseInt(value, 10, 64)
+	}
+
+	if !self.lenient {
+		return 0, fmt.Errorf("Sector count %q has a size suffix", value)
+	}
+
+	size, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	size *= multiplier
+	if size%SECTOR_SIZE != 0 {
+		return 0, fmt.Errorf("Size %q is not a whole number of sectors", value)
 	}
 
+	return size / SECTOR_SIZE, nil
+}
+
+func GetVMDKContext(
+	reader io.ReaderAt, size int, opener Opener,
+	opts ...Option) (*VMDKContext, error) {
 	if size > 64*1024 {
 		size = 64 * 1024
 	}
 
-	buf := make([]byte, size)
+	return newVMDKContext(reader, io.NewSectionReader(reader, 0, int64(size)),
+		size, opener, opts)
+}
+
+// GetVMDKContextWithDescriptor opens a disk whose descriptor is stored
+// separately from its data, e.g. in a database. Extent and parent
+// files are still opened with opener.
+func GetVMDKContextWithDescriptor(descriptor []byte, opener Opener,
+	opts ...Option) (*VMDKContext, error) {
+	reader := bytes.NewReader(descriptor)
+	return newVMDKContext(reader, reader, len(descriptor), opener, opts)
+}
+
+// A descriptor starts with its header line, possibly after a byte
+// order mark or blank lines. Hand written descriptors often leave out
+// the header so an extent line near the start is also accepted. Sparse
+// extents carry their descriptor after the sparse header.
+func isDescriptorStart(data []byte) bool {
+	if len(data) >= 4 &&
+		binary.LittleEndian.Uint32(data) == SPARSE_MAGICNUMBER {
+		return true
+	}
+
+	return looksLikeDescriptor(
+		strings.TrimPrefix(string(data), UTF8_BOM))
+}
+
+// Probe checks cheaply whether reader holds a descriptor or a sparse
+// extent with one embedded, which GetVMDKContext can open. Other files
+// return ErrNotADescriptor.
+func Probe(reader io.ReaderAt) error {
+	buf := make([]byte, DESCRIPTOR_PROBE_SIZE)
 	n, err := reader.ReadAt(buf, 0)
 	if err != nil && err != io.EOF {
-		return nil, err
+		return err
+	}
+
+	if !isDescriptorStart(buf[:n]) {
+		return ErrNotADescriptor
+	}
+	return nil
+}
+
+// Split the descriptor into lines. Unlike bufio.ScanLines a trailing
+// \r is kept so CRLF line endings can be reported.
+func scanDescriptorLines(data []byte, at_eof bool) (
+	advance int, token []byte, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	// The last line need not be terminated.
+	if at_eof && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func newVMDKContext(reader io.ReaderAt, descriptor io.Reader, size int,
+	opener Opener, opts []Option) (*VMDKContext, error) {
+	options := getOptions(opts)
+	if options.metadata_budget > 0 && options.budget == nil {
+		options.budget = newMetadataBudget(options.metadata_budget)
+	}
+	if options.lazy_max_open > 0 && options.handles == nil {
+		options.handles = newHandleCache(options.lazy_max_open)
 	}
 
+	profile := NewVMDKProfile()
+	res := &VMDKContext{
+		profile:  profile,
+		reader:   reader,
+		config:   NewVMDKConfig(),
+		options:  options,
+		handles:  options.handles,
+		coverage: options.newCoverageMap(),
+	}
+
+	buffered := bufio.NewReader(descriptor)
+	start, _ := buffered.Peek(DESCRIPTOR_PROBE_SIZE)
+	if !isDescriptorStart(start) {
+		return nil, ErrNotADescriptor
+	}
+
+	// A sparse extent cut short inside its header has no descriptor.
+	if len(start) < SECTOR_SIZE &&
+		binary.LittleEndian.Uint32(start) == SPARSE_MAGICNUMBER {
+		return nil, fmt.Errorf("%w: sparse header is truncated to %v bytes",
+			ErrNotADescriptor, len(start))
+	}
+
+	scanner := bufio.NewScanner(buffered)
+	scanner.Split(scanDescriptorLines)
+
+	// A data file given as the descriptor may hold no line breaks at
+	// all, so allow a line as long as the whole descriptor.
+	scanner.Buffer(make([]byte, 0, 4096), size+1)
+
+	var pending []*pendingExtent
 	state := ""
-	for _, line := range strings.Split(string(buf[:n]), "\n") {
+	crlf := false
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+
+		line := scanner.Text()
+		if line_number == 1 {
+			line = strings.TrimPrefix(line, UTF8_BOM)
+		}
+		extent_line, extent_err := parseExtentLine(line)
+		if strings.HasSuffix(line, "\r") && !crlf &&
+			(extent_line != nil || ConfigRegex.MatchString(line)) {
+			crlf = true
+			res.warn("Descriptor has CRLF line endings")
+		}
+
 		if StartExtentRegex.MatchString(line) {
 			state = "Extents"
 			continue
 		}
 
+		if ChangeTrackingRegex.MatchString(line) {
+			state = "ChangeTracking"
+			continue
+		}
+
+		// The section only names the CBT file, its lines are neither
+		// extents nor disk database keys.
+		if state == "ChangeTracking" {
+			if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				res.config.parseLine(line)
+				continue
+			}
+			state = ""
+		}
+
 		if state == "Extents" {
-			match := ExtentRegex.FindStringSubmatch(line)
-			if len(match) > 0 {
-				extent_type := match[3]
-				extent_filename := match[4]
+			if extent_err != nil {
+				res.warn("Line %v: %v", line_number, extent_err)
+			}
+
+			if extent_line != nil {
+				// Refuse before opening yet another file.
+				if options.max_extents > 0 &&
+					len(pending) >= options.max_extents {
+					return nil, fmt.Errorf("%w: more than %v (line %v)",
+						ErrTooManyExtents, options.max_extents, line_number)
+				}
 
-				// Try to open the extent file.
-				reader, closer, err := opener(extent_filename)
+				extent_sectors, err := options.parseSectors(extent_line.sectors)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("While opening %v (line %v): %w",
+						extent_line.filename, line_number, err)
 				}
 
-				switch extent_type {
-				case "SPARSE":
-					extent, err := GetSparseExtent(reader)
-					if err != nil {
-						return nil, fmt.Errorf("While opening %v: %w",
-							extent_filename, err)
-					}
+				extent_file_offset, err := options.parseSectors(extent_line.offset)
+				if err != nil {
+					return nil, fmt.Errorf("While opening %v (line %v): %w",
+						extent_line.filename, line_number, err)
+				}
 
-					extent.offset = res.total_size
-					extent.closer = closer
-					extent.filename = extent_filename
+				pending = append(pending, &pendingExtent{
+					line_number:       line_number,
+					extent_type:       extent_line.extent_type,
+					filename:          extent_line.filename,
+					metadata_filename: extent_line.metadata_filename,
+					sectors:           extent_sectors,
+					file_offset:       extent_file_offset,
+					warning_index:     len(res.Warnings),
+				})
+				continue
+			}
+			state = ""
+		}
 
-					res.total_size += extent.total_size
+		match := ConfigRegex.FindStringSubmatch(line)
+		if len(match) > 0 {
+			key := match[1]
+			if !headerKeys[key] && !strings.HasPrefix(key, "ddb.") {
+				res.warn("Unknown descriptor key %v", key)
+			}
+			if _, pres := res.config.Get(key); pres {
+				res.warn("Duplicate descriptor key %v", key)
+			}
+		}
 
-					res.extents = append(res.extents, extent)
+		res.config.parseLine(line)
+	}
 
-				default:
-					return nil, errors.New("Unsupported extent type " + extent_type)
-				}
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("While reading the descriptor: %w", err)
+	}
 
-			} else {
-				state = ""
-			}
+	err = res.config.checkCIDs()
+	if err != nil {
+		if !options.lenient_cids {
+			return nil, err
 		}
+		res.warn("%v", err)
+	}
+
+	err = res.openExtents(opener, pending)
+	if err != nil {
+		res.Close()
+		return nil, err
 	}
 
 	res.normalizeExtents()
+	res.startReadahead()
+
+	if res.config.ParentFileNameHint != "" {
+		err := res.openParent(opener, options, opts)
+		if err != nil {
+			res.Close()
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// GetVMDKContextFromFile opens the disk described by filename. Extent
+// and parent files are resolved relative to the directory of the
+// descriptor, and every file is read through a caching reader.
+func GetVMDKContextFromFile(
+	filename string, opts ...Option) (*VMDKContext, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	// Only the descriptor is read from this handle.
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := NewCachingReaderAt(fd, DEFAULT_PAGE_SIZE, DEFAULT_PAGE_COUNT)
+	res, err := GetVMDKContext(reader, int(st.Size()),
+		DirectoryOpener(filepath.Dir(filename)), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res.filename = filename
+	return res, nil
+}
+
+// GetVMDKContextFromOpener opens the disk described by filename, which
+// is read through opener like its extent and parent files. This suits
+// disks stored remotely, e.g. with HTTPOpener.
+func GetVMDKContextFromOpener(opener Opener, filename string,
+	opts ...Option) (*VMDKContext, error) {
+	reader, closer, err := getOptions(opts).open(opener, filename)
+	if err != nil {
+		return nil, fmt.Errorf("While opening %v: %w", filename, err)
+	}
+
+	// Only the descriptor is read from this handle.
+	if closer != nil {
+		defer closer()
+	}
+
+	res, err := GetVMDKContext(reader, 64*1024, opener, opts...)
+	if err != nil {
+		return nil, err
+	}
 
+	res.filename = filename
 	return res, nil
 }
@@ -1,9 +1,16 @@
 package parser
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sebdah/goldie"
 )
@@ -76,3 +83,941 @@ func TestFindExtent(t *testing.T) {
 
 	goldie.Assert(t, "TestFindExtent", []byte(strings.Join(golden, "\n")))
 }
+
+func TestReadFromNullIntoFlatExtent(t *testing.T) {
+	data := make([]byte, 400)
+	for i := range data {
+		data[i] = byte(i%250) + 1
+	}
+
+	// The flat data is stored at offset 50 in its backing file.
+	backing := append(make([]byte, 50), data...)
+
+	res := &VMDKContext{
+		total_size: 400,
+		extents: []Extent{
+			&FlatExtent{
+				reader:     bytes.NewReader(backing),
+				total_size: 100, offset: 0, file_offset: 50,
+			},
+			// Gap between 100 and 300
+			&FlatExtent{
+				reader:     bytes.NewReader(backing),
+				total_size: 100, offset: 300, file_offset: 350,
+			},
+		},
+	}
+	res.normalizeExtents()
+
+	// A single read starting in the hole and ending in the flat extent.
+	buf := bytes.Repeat([]byte{0xff}, 20)
+	n, err := res.ReadAt(buf, 290)
+	if err != nil || n != 20 {
+		t.Fatalf("ReadAt: %v %v", n, err)
+	}
+
+	// Offset 299 is the last zero byte, 300 is the first data byte.
+	if !isZero(buf[:10]) {
+		t.Fatalf("Expected zeros before the flat extent: %v", buf[:10])
+	}
+
+	if !bytes.Equal(buf[10:], data[300:310]) {
+		t.Fatalf("Expected flat data at the boundary: %v", buf[10:])
+	}
+
+	// A read past the end of the last extent only zero fills the
+	// remainder without clobbering data already read.
+	res.total_size = 500
+	buf = bytes.Repeat([]byte{0xff}, 20)
+	n, err = res.ReadAt(buf, 390)
+	if err != nil || n != 20 {
+		t.Fatalf("ReadAt: %v %v", n, err)
+	}
+
+	if !bytes.Equal(buf[:10], data[390:400]) || !isZero(buf[10:]) {
+		t.Fatalf("Unexpected data at the end of the extent: %v", buf)
+	}
+}
+
+func TestStrictReads(t *testing.T) {
+	files := testFiles{
+		"test.vmdk": buildSparseExtent(1024*1024, nil),
+	}
+	descriptor := []byte(`# Extent description
+RW 2048 SPARSE "test.vmdk"
+`)
+
+	for _, strict := range []bool{false, true} {
+		var opts []Option
+		if strict {
+			opts = append(opts, WithStrictReads())
+		}
+
+		vmdk, err := GetVMDKContext(bytes.NewReader(descriptor),
+			len(descriptor), files.Open, opts...)
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+
+		// A full read always succeeds.
+		buf := make([]byte, 100)
+		n, err := vmdk.ReadAt(buf, vmdk.Size()-100)
+		if n != 100 || err != nil {
+			t.Fatalf("ReadAt: %v %v", n, err)
+		}
+
+		// A read straddling the end of the disk is short.
+		n, err = vmdk.ReadAt(buf, vmdk.Size()-50)
+		if n != 50 {
+			t.Fatalf("ReadAt: %v %v", n, err)
+		}
+
+		if strict && err != io.EOF {
+			t.Fatalf("Expected io.EOF in strict mode, got %v", err)
+		}
+
+		if !strict && err != nil {
+			t.Fatalf("Expected no error in lenient mode, got %v", err)
+		}
+	}
+}
+
+func TestSuffixedSectorCounts(t *testing.T) {
+	files := testFiles{
+		"disk.vmdk": []byte(`# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 1M FLAT "disk-flat.vmdk" 0
+RW 2048 FLAT "disk-flat.vmdk" 1K
+`),
+		"disk-flat.vmdk": bytes.Repeat([]byte("F"), 2*1024*1024),
+	}
+
+	_, err := openTestDisk(files, "disk.vmdk")
+	if err == nil || !strings.Contains(err.Error(), "size suffix") {
+		t.Fatalf("Expected suffix to be rejected, got %v", err)
+	}
+
+	vmdk, err := openTestDisk(files, "disk.vmdk", WithLenientDescriptors())
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	// 1M bytes followed by 2048 sectors at a 1kb file offset.
+	if vmdk.Size() != 2*1024*1024 {
+		t.Fatalf("Unexpected size %v", vmdk.Size())
+	}
+
+	stats := vmdk.Stats()
+	if len(stats.Extents) != 2 || stats.Extents[1].VirtualOffset != 1024*1024 {
+		t.Fatalf("Unexpected extents %+v", stats.Extents)
+	}
+
+	if vmdk.extents[1].(*FlatExtent).file_offset != 1024 {
+		t.Fatalf("Unexpected file offset")
+	}
+}
+
+// A reader which takes delay to complete every read.
+type slowReader struct {
+	io.ReaderAt
+	delay time.Duration
+}
+
+func (self *slowReader) ReadAt(buf []byte, offset int64) (int, error) {
+	time.Sleep(self.delay)
+	return self.ReaderAt.ReadAt(buf, offset)
+}
+
+func TestReadDeadline(t *testing.T) {
+	descriptor := `# Disk DescriptorFile
+createType="monolithicFlat"
+
+# Extent description
+RW 1 FLAT "a.vmdk" 0
+RW 1 FLAT "b.vmdk" 0
+RW 1 FLAT "c.vmdk" 0
+`
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		return &slowReader{
+			ReaderAt: bytes.NewReader(bytes.Repeat(
+				[]byte(filename[:1]), SECTOR_SIZE)),
+			delay: 50 * time.Millisecond,
+		}, nil, nil
+	}
+
+	open := func(opts ...Option) *VMDKContext {
+		vmdk, err := GetVMDKContext(strings.NewReader(descriptor),
+			len(descriptor), opener, opts...)
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+		return vmdk
+	}
+
+	buf := make([]byte, 3*SECTOR_SIZE)
+
+	// The read gives up after the second extent.
+	vmdk := open(WithReadDeadline(75 * time.Millisecond))
+	n, err := vmdk.ReadAt(buf, 0)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 2*SECTOR_SIZE {
+		t.Fatalf("Expected a deadline error, got %v %v", n, err)
+	}
+
+	vmdk = open()
+	n, err = vmdk.ReadAt(buf, 0)
+	if err != nil || n != len(buf) || buf[len(buf)-1] != 'c' {
+		t.Fatalf("Unexpected read %v %v", n, err)
+	}
+}
+
+func newSingleExtentDisk(t testing.TB) *VMDKContext {
+	grains := map[int64][]byte{}
+	for i := int64(0); i < 64; i += 3 {
+		grains[i] = bytes.Repeat([]byte{byte(i + 1)}, TEST_GRAIN_SIZE)
+	}
+
+	sparse, err := NewTestSparseExtent(grains, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	vmdk, err := NewTestContext(sparse)
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+	return vmdk
+}
+
+func TestSingleExtentFastPath(t *testing.T) {
+	fast := newSingleExtentDisk(t)
+	if fast.single == nil {
+		t.Fatalf("Expected the fast path for a single extent disk")
+	}
+
+	slow := newSingleExtentDisk(t)
+	slow.single = nil
+
+	for _, length := range []int{1, 511, 4096, 10000} {
+		for offset := int64(-1); offset < 300*1024; offset += 1023 {
+			a := make([]byte, length)
+			b := make([]byte, length)
+			n1, err1 := fast.ReadAt(a, offset)
+			n2, err2 := slow.ReadAt(b, offset)
+			if n1 != n2 || err1 != err2 || !bytes.Equal(a, b) {
+				t.Fatalf("Read of %v at %v differs: %v %v vs %v %v",
+					length, offset, n1, err1, n2, err2)
+			}
+		}
+	}
+
+	// A read past the end behaves the same.
+	buf := make([]byte, 100)
+	n, err := fast.ReadAt(buf, fast.Size()-10)
+	if n != 10 || err != nil {
+		t.Fatalf("Unexpected read at end %v %v", n, err)
+	}
+}
+
+func benchmarkSmallReads(b *testing.B, fast bool) {
+	vmdk := newSingleExtentDisk(b)
+	if !fast {
+		vmdk.single = nil
+	}
+
+	buf := make([]byte, SECTOR_SIZE)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vmdk.ReadAt(buf, int64(i%2048)*SECTOR_SIZE)
+	}
+}
+
+func BenchmarkSingleExtentReadAt(b *testing.B) {
+	benchmarkSmallReads(b, true)
+}
+
+func BenchmarkSearchExtentReadAt(b *testing.B) {
+	benchmarkSmallReads(b, false)
+}
+
+// Once the pools are warm, reading sectors allocates nothing.
+func TestReadAtAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops buffers under the race detector")
+	}
+
+	search := newSingleExtentDisk(t)
+	search.single = nil
+
+	stream, err := OpenStreamOptimized(bytes.NewReader(streamFixture()),
+		WithDecompressedGrainCache(0))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	for _, c := range []struct {
+		name string
+		vmdk *VMDKContext
+	}{
+		{"single extent", newSingleExtentDisk(t)},
+		{"extent search", search},
+		{"stream optimized", stream},
+	} {
+		buf := make([]byte, SECTOR_SIZE)
+		i := int64(0)
+		allocs := testing.AllocsPerRun(1000, func() {
+			c.vmdk.ReadAt(buf, i%2048*SECTOR_SIZE)
+			i++
+		})
+		if allocs != 0 {
+			t.Errorf("%v: %v allocations per read", c.name, allocs)
+		}
+	}
+}
+
+func TestReadCloserAt(t *testing.T) {
+	closed := 0
+	files := makeChainFiles()
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		reader, _, err := files.Open(filename)
+		return reader, func() { closed++ }, err
+	}
+
+	data := files["snapshot.vmdk"]
+	vmdk, err := GetVMDKContext(bytes.NewReader(data), len(data), opener)
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+
+	var reader ReadCloserAt = vmdk.ReadCloserAt()
+	section := io.NewSectionReader(reader, 0, vmdk.Size())
+	buf := make([]byte, testGrainSize)
+	_, err = section.ReadAt(buf, testGrainSize)
+	if err != nil || buf[0] != 'S' {
+		t.Fatalf("Unexpected read %v", err)
+	}
+
+	// Closing releases the extent and parent files.
+	err = reader.Close()
+	if err != nil || closed != 3 {
+		t.Fatalf("Expected 3 files closed, got %v (%v)", closed, err)
+	}
+}
+
+// A twoGbMaxExtent style disk with many small flat extents over data.
+func newManyExtentDisk(data []byte) *VMDKContext {
+	for i := range data {
+		data[i] = byte(i / SECTOR_SIZE)
+	}
+
+	res := &VMDKContext{}
+	reader := bytes.NewReader(data)
+	for offset := int64(0); offset < int64(len(data)); offset += 4096 {
+		res.extents = append(res.extents, &FlatExtent{
+			reader:      reader,
+			file_offset: offset,
+			total_size:  4096,
+			offset:      offset,
+		})
+		res.total_size += 4096
+	}
+	res.normalizeExtents()
+	return res
+}
+
+func TestLastExtentHint(t *testing.T) {
+	data := make([]byte, 2000*4096)
+	vmdk := newManyExtentDisk(data)
+	rng := rand.New(rand.NewSource(1))
+
+	// Alternate between sequential and random reads so the hint both
+	// hits and misses.
+	offset := int64(0)
+	for i := 0; i < 10000; i++ {
+		length := 1 + rng.Int63n(10000)
+		if i%3 == 0 {
+			offset = rng.Int63n(vmdk.Size())
+		}
+		if offset+length > vmdk.Size() {
+			offset = 0
+		}
+
+		buf := make([]byte, length)
+		n, err := vmdk.ReadAt(buf, offset)
+		if err != nil || n != len(buf) ||
+			!bytes.Equal(buf, data[offset:offset+length]) {
+			t.Fatalf("ReadAt %v: %v %v", offset, n, err)
+		}
+		offset += length
+	}
+
+	_, err := vmdk.getExtentForOffset(vmdk.Size())
+	if err != io.EOF {
+		t.Fatalf("Expected EOF past the end, got %v", err)
+	}
+}
+
+func benchmarkSequentialReads(b *testing.B, hint bool) {
+	vmdk := newManyExtentDisk(make([]byte, 2000*4096))
+	buf := make([]byte, SECTOR_SIZE)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !hint {
+			// Point the hint at an extent which never matches.
+			vmdk.last_extent = int64(len(vmdk.extents))
+		}
+		vmdk.ReadAt(buf, int64(i*SECTOR_SIZE)%vmdk.Size())
+	}
+}
+
+func BenchmarkManyExtentsHint(b *testing.B) {
+	benchmarkSequentialReads(b, true)
+}
+
+func BenchmarkManyExtentsSearch(b *testing.B) {
+	benchmarkSequentialReads(b, false)
+}
+
+func TestWarnings(t *testing.T) {
+	descriptor := strings.ReplaceAll(`# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="monolithicSparse"
+myTool.setting="1"
+
+# Extent description
+RW 4096 SPARSE "base-data.vmdk"
+RW 16 FLAT "short-flat.vmdk" 0
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "ide"
+ddb.adapterType = "lsilogic"
+`, "\n", "\r\n")
+
+	files := makeChainFiles()
+	files["disk.vmdk"] = []byte(descriptor)
+	files["short-flat.vmdk"] = make([]byte, 10*SECTOR_SIZE)
+
+	vmdk, err := openTestDisk(files, "disk.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	expected := []string{
+		"Descriptor has CRLF line endings",
+		"Unknown descriptor key myTool.setting",
+		"Extent base-data.vmdk is 4096 sectors in the descriptor but 2048 in its header",
+		"Extent short-flat.vmdk needs 8192 bytes but the file has 5120",
+		"Duplicate descriptor key ddb.adapterType",
+	}
+	if strings.Join(vmdk.Warnings, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected warnings:\n%v", strings.Join(vmdk.Warnings, "\n"))
+	}
+
+	// A clean descriptor has no warnings.
+	vmdk, err = openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if len(vmdk.Warnings) > 0 {
+		t.Fatalf("Unexpected warnings %v", vmdk.Warnings)
+	}
+}
+
+func TestRawDeviceMap(t *testing.T) {
+	files := testFiles{
+		"rdm.vmdk": []byte(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="vmfsPassthroughRawDeviceMap"
+
+# Extent description
+RW 2097152 VMFSPASSTHROUGHRDM "rdm-rdmp.vmdk"
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "lsilogic"
+`),
+	}
+
+	vmdk, err := openTestDisk(files, "rdm.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if !vmdk.IsRawDeviceMap() || vmdk.Size() != 1024*1024*1024 {
+		t.Fatalf("Expected a 1GB raw device map")
+	}
+
+	if len(vmdk.Warnings) != 1 {
+		t.Fatalf("Expected a warning, got %v", vmdk.Warnings)
+	}
+
+	// The data is not available.
+	_, err = vmdk.ReadAt(make([]byte, SECTOR_SIZE), 0)
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Expected ErrUnsupported, got %v", err)
+	}
+
+	regular, err := openTestDisk(makeChainFiles(), "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer regular.Close()
+
+	if regular.IsRawDeviceMap() {
+		t.Fatalf("A sparse disk is not a raw device map")
+	}
+}
+
+func BenchmarkHoleRead(b *testing.B) {
+	size := int64(1024 * 1024 * 1024)
+	vmdk := &VMDKContext{
+		total_size: size,
+		extents: []Extent{&NullExtent{
+			SparseExtent: SparseExtent{total_size: size},
+		}},
+	}
+	vmdk.normalizeExtents()
+
+	buf := make([]byte, 64*1024*1024)
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		for offset := int64(0); offset < size; offset += int64(len(buf)) {
+			vmdk.ReadAt(buf, offset)
+		}
+	}
+}
+
+func TestDescriptorLines(t *testing.T) {
+	files := makeChainFiles()
+
+	// The last extent line has no line ending.
+	descriptor := strings.TrimSuffix(baseDescriptor, "\n") +
+		"\nRW 2048 SPARSE \"base-data.vmdk\""
+	vmdk, err := GetVMDKContextWithDescriptor([]byte(descriptor), files.Open)
+	if err != nil {
+		t.Fatalf("GetVMDKContextWithDescriptor: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.Size() != 2*2048*SECTOR_SIZE {
+		t.Fatalf("Unexpected size %v", vmdk.Size())
+	}
+
+	// A data file is not a descriptor.
+	zeros := make([]byte, 64*1024)
+	_, err = GetVMDKContext(bytes.NewReader(zeros), len(zeros), files.Open)
+	if !errors.Is(err, ErrNotADescriptor) {
+		t.Fatalf("Unexpected result for a data file: %v", err)
+	}
+
+	// Errors name the offending line.
+	descriptor = strings.Replace(baseDescriptor, "2048", "2M", 1)
+	_, err = GetVMDKContextWithDescriptor([]byte(descriptor), files.Open)
+	if err == nil || !strings.Contains(err.Error(), "(line 8)") {
+		t.Fatalf("Expected an error on line 8, got %v", err)
+	}
+}
+
+// Open a descriptor listing 5000 flat extents.
+func BenchmarkOpenManyExtents(b *testing.B) {
+	descriptor := &strings.Builder{}
+	descriptor.WriteString(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+`)
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(descriptor, "RW 8 FLAT \"flat-%d.vmdk\" 0\n", i)
+	}
+	data := []byte(descriptor.String())
+
+	reader := bytes.NewReader(make([]byte, 8*SECTOR_SIZE))
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		return reader, nil, nil
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vmdk, err := GetVMDKContextWithDescriptor(data, opener,
+			WithMaxExtents(0))
+		if err != nil {
+			b.Fatalf("GetVMDKContextWithDescriptor: %v", err)
+		}
+		if vmdk.Size() != 5000*8*SECTOR_SIZE {
+			b.Fatalf("Unexpected size %v", vmdk.Size())
+		}
+		vmdk.Close()
+	}
+}
+
+func TestNotADescriptor(t *testing.T) {
+	files := makeChainFiles()
+
+	// Random text which happens to have the odd descriptor key in it.
+	text := []byte("Shopping list\nmilk\neggs\nversion=1\n" +
+		"createType=\"monolithicFlat\"\n")
+	_, err := GetVMDKContext(bytes.NewReader(text), len(text), files.Open)
+	if !errors.Is(err, ErrNotADescriptor) {
+		t.Fatalf("Expected ErrNotADescriptor, got %v", err)
+	}
+
+	_, err = GetVMDKContextWithDescriptor(text, files.Open)
+	if !errors.Is(err, ErrNotADescriptor) {
+		t.Fatalf("Expected ErrNotADescriptor, got %v", err)
+	}
+
+	err = Probe(bytes.NewReader(text))
+	if !errors.Is(err, ErrNotADescriptor) {
+		t.Fatalf("Expected ErrNotADescriptor, got %v", err)
+	}
+
+	// Descriptors and sparse extents are recognized.
+	for _, name := range []string{"base.vmdk", "base-data.vmdk"} {
+		err = Probe(bytes.NewReader(files[name]))
+		if err != nil {
+			t.Fatalf("Probe %v: %v", name, err)
+		}
+	}
+}
+
+func TestMaxExtents(t *testing.T) {
+	descriptor := &strings.Builder{}
+	descriptor.WriteString(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+`)
+	for i := 0; i < DEFAULT_MAX_EXTENTS+1; i++ {
+		fmt.Fprintf(descriptor, "RW 8 FLAT \"flat-%d.vmdk\" 0\n", i)
+	}
+	data := []byte(descriptor.String())
+
+	// No file is opened when the limit is hit.
+	var opens int32
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		atomic.AddInt32(&opens, 1)
+		return bytes.NewReader(make([]byte, 8*SECTOR_SIZE)), nil, nil
+	}
+
+	_, err := GetVMDKContextWithDescriptor(data, opener)
+	if !errors.Is(err, ErrTooManyExtents) ||
+		!strings.Contains(err.Error(), "(line 4104)") {
+		t.Fatalf("Expected ErrTooManyExtents, got %v", err)
+	}
+
+	if opens != 0 {
+		t.Fatalf("%v files opened", opens)
+	}
+
+	// The limit can be raised or removed.
+	for _, max := range []int{DEFAULT_MAX_EXTENTS + 1, 0} {
+		vmdk, err := GetVMDKContextWithDescriptor(data, opener,
+			WithMaxExtents(max))
+		if err != nil {
+			t.Fatalf("GetVMDKContextWithDescriptor: %v", err)
+		}
+		vmdk.Close()
+	}
+}
+
+func TestOpenConcurrency(t *testing.T) {
+	// Extent i is i+1 sectors of the letter i, so any mix up of the
+	// order or offsets shows in the data.
+	descriptor := &strings.Builder{}
+	descriptor.WriteString(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+`)
+	files := testFiles{}
+	var expected []byte
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("flat-%d.vmdk", i)
+		data := bytes.Repeat([]byte{byte('a' + i)}, (i+1)*SECTOR_SIZE)
+		files[name] = data
+		expected = append(expected, data...)
+		fmt.Fprintf(descriptor, "RW %d FLAT \"%s\" 0\n", i+1, name)
+	}
+	data := []byte(descriptor.String())
+
+	// A slow opener recording how many opens overlap.
+	var running, max_running, open int32
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&max_running)
+			if n <= max || atomic.CompareAndSwapInt32(&max_running, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		reader, _, err := files.Open(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		atomic.AddInt32(&open, 1)
+		return reader, func() { atomic.AddInt32(&open, -1) }, nil
+	}
+
+	vmdk, err := GetVMDKContextWithDescriptor(data, opener,
+		WithOpenConcurrency(4))
+	if err != nil {
+		t.Fatalf("GetVMDKContextWithDescriptor: %v", err)
+	}
+
+	buf := make([]byte, vmdk.Size())
+	_, err = vmdk.ReadAt(buf, 0)
+	if err != nil || !bytes.Equal(buf, expected) {
+		t.Fatalf("Unexpected data: %v", err)
+	}
+	vmdk.Close()
+
+	if max_running < 2 || max_running > 4 || open != 0 {
+		t.Fatalf("%v opens at once, %v left open", max_running, open)
+	}
+
+	// The failures of opens running at the same time are all reported.
+	// No more opens start and the files opened are closed.
+	delete(files, "flat-1.vmdk")
+	delete(files, "flat-3.vmdk")
+	_, err = GetVMDKContextWithDescriptor(data, opener,
+		WithOpenConcurrency(4))
+	if err == nil ||
+		!strings.Contains(err.Error(), "flat-1.vmdk (line 9)") ||
+		!strings.Contains(err.Error(), "flat-3.vmdk (line 11)") {
+		t.Fatalf("Expected both missing extents to be reported, got %v", err)
+	}
+
+	if open != 0 {
+		t.Fatalf("%v files left open", open)
+	}
+}
+
+func TestChangeTrackingSection(t *testing.T) {
+	files := makeChainFiles()
+	files["cbt.vmdk"] = []byte(baseDescriptor + `
+# Change Tracking File
+changeTrackPath="base-ctk.vmdk"
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "lsilogic"
+`)
+
+	vmdk, err := openTestDisk(files, "cbt.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.ChangeTrackingFile() != "base-ctk.vmdk" ||
+		len(vmdk.Warnings) != 0 || len(vmdk.extents) != 1 ||
+		vmdk.Config().DBBAdapterType != "lsilogic" {
+		t.Fatalf("Unexpected parse: %q %v", vmdk.ChangeTrackingFile(),
+			vmdk.Warnings)
+	}
+
+	// Disks without change tracking have no CBT file.
+	vmdk, err = openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.ChangeTrackingFile() != "" {
+		t.Fatalf("Unexpected CBT file %q", vmdk.ChangeTrackingFile())
+	}
+}
+
+func TestCIDValidation(t *testing.T) {
+	descriptor := func(cid string) testFiles {
+		return testFiles{
+			"disk.vmdk": []byte(`# Disk DescriptorFile
+version=1
+CID=` + cid + `
+parentCID=FFFFFFFF
+createType="monolithicFlat"
+
+# Extent description
+RW 8 FLAT "disk-flat.vmdk" 0
+`),
+			"disk-flat.vmdk": make([]byte, 8*SECTOR_SIZE),
+		}
+	}
+
+	// Upper case CIDs are normalized, the raw value is kept.
+	vmdk, err := openTestDisk(descriptor("CAFEBABE"), "disk.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	raw, _ := vmdk.Config().Get("CID")
+	if vmdk.CID() != "cafebabe" || vmdk.ParentCID() != "ffffffff" ||
+		raw != "CAFEBABE" || len(vmdk.Warnings) != 0 {
+		t.Fatalf("Unexpected CIDs %q %q %q %v", vmdk.CID(),
+			vmdk.ParentCID(), raw, vmdk.Warnings)
+	}
+
+	for _, cid := range []string{"cafe", "cafebabe1", "cafebabz", ""} {
+		_, err := openTestDisk(descriptor(cid), "disk.vmdk")
+		if !errors.Is(err, ErrInvalidCID) {
+			t.Fatalf("Expected ErrInvalidCID for %q, got %v", cid, err)
+		}
+
+		// Lenient descriptors are about extent lines, not CIDs.
+		_, err = openTestDisk(descriptor(cid), "disk.vmdk",
+			WithLenientDescriptors())
+		if !errors.Is(err, ErrInvalidCID) {
+			t.Fatalf("Expected ErrInvalidCID for %q, got %v", cid, err)
+		}
+
+		// Lenient CIDs only warn.
+		vmdk, err := openTestDisk(descriptor(cid), "disk.vmdk",
+			WithLenientCIDs())
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+		vmdk.Close()
+
+		if len(vmdk.Warnings) != 1 ||
+			!strings.Contains(vmdk.Warnings[0], "Invalid CID") {
+			t.Fatalf("Unexpected warnings %v", vmdk.Warnings)
+		}
+	}
+
+	// Set refuses invalid CIDs.
+	config := NewVMDKConfig()
+	if config.Set("CID", "xyz") == nil || config.Set("CID", "0123abcd") != nil {
+		t.Fatalf("Unexpected Set validation")
+	}
+}
+
+// A descriptor only file is often a few hundred bytes, much less than
+// the size GetVMDKContext scans for.
+func TestSmallDescriptorFile(t *testing.T) {
+	files := makeChainFiles()
+	padding := 200 - len(baseDescriptor) - 3
+	descriptor := []byte(baseDescriptor + "# " +
+		strings.Repeat("x", padding) + "\n")
+	if len(descriptor) != 200 {
+		t.Fatalf("Descriptor is %v bytes", len(descriptor))
+	}
+
+	vmdk, err := GetVMDKContext(bytes.NewReader(descriptor), 64*1024, files.Open)
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.Size() != 1024*1024 || len(vmdk.Warnings) > 0 {
+		t.Fatalf("Unexpected disk of %v bytes: %v", vmdk.Size(), vmdk.Warnings)
+	}
+
+	text, err := ReadDescriptor(bytes.NewReader(descriptor), 64*1024)
+	if err != nil || text != string(descriptor) {
+		t.Fatalf("ReadDescriptor returned %q: %v", text, err)
+	}
+
+	info, err := DetectFormat(bytes.NewReader(descriptor), 64*1024)
+	if err != nil || info.Format != FORMAT_DESCRIPTOR {
+		t.Fatalf("DetectFormat returned %+v: %v", info, err)
+	}
+
+	// Files cut short inside the sparse header fail cleanly.
+	sparse := files["base-data.vmdk"]
+	for _, size := range []int{0, 1, 3, 4, 5, 200, SECTOR_SIZE - 1} {
+		data := sparse[:size]
+		Probe(bytes.NewReader(data))
+		DetectFormat(bytes.NewReader(data), 64*1024)
+		ReadDescriptor(bytes.NewReader(data), 64*1024)
+
+		_, err := GetVMDKContext(bytes.NewReader(data), 64*1024, files.Open)
+		if !errors.Is(err, ErrNotADescriptor) {
+			t.Fatalf("Expected ErrNotADescriptor for %v bytes, got %v",
+				size, err)
+		}
+	}
+}
+
+func TestCloseWithPanickingCloser(t *testing.T) {
+	descriptor := []byte(`# Disk DescriptorFile
+createType="twoGbMaxExtentFlat"
+
+# Extent description
+RW 1 FLAT "a.vmdk" 0
+RW 1 FLAT "b.vmdk" 0
+RW 1 FLAT "c.vmdk" 0
+`)
+
+	for _, lazy := range []bool{false, true} {
+		closed := make(map[string]bool)
+		opener := func(filename string) (io.ReaderAt, func(), error) {
+			return bytes.NewReader(make([]byte, SECTOR_SIZE)), func() {
+				if filename == "b.vmdk" {
+					panic("bad closer")
+				}
+				closed[filename] = true
+			}, nil
+		}
+
+		var opts []Option
+		if lazy {
+			opts = append(opts, WithLazyOpen(10))
+		}
+
+		vmdk, err := GetVMDKContext(bytes.NewReader(descriptor),
+			len(descriptor), opener, opts...)
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+
+		// Lazy extents are opened by reading them.
+		_, err = vmdk.ReadAt(make([]byte, vmdk.Size()), 0)
+		if err != nil {
+			t.Fatalf("ReadAt: %v", err)
+		}
+
+		vmdk.Close()
+		if !closed["a.vmdk"] || !closed["c.vmdk"] {
+			t.Fatalf("Lazy %v: expected the other closers to run: %v",
+				lazy, closed)
+		}
+
+		if len(vmdk.Warnings) != 1 ||
+			!strings.Contains(vmdk.Warnings[0], "bad closer") {
+			t.Fatalf("Lazy %v: expected the panic to be reported: %v",
+				lazy, vmdk.Warnings)
+		}
+	}
+}
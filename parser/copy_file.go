@@ -0,0 +1,75 @@
+package parser
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Zero blocks of this size are left as holes by CopyToFile.
+const holeBlockSize = 64 * 1024
+
+// holeWriter writes sequentially to a file starting at offset, seeking
+// over holes and blocks of zeros instead of writing them.
+type holeWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (self *holeWriter) Write(buf []byte) (int, error) {
+	for i := 0; i < len(buf); i += holeBlockSize {
+		block := buf[i:]
+		if len(block) > holeBlockSize {
+			block = block[:holeBlockSize]
+		}
+
+		if !isZero(block) {
+			_, err := self.file.WriteAt(block, self.offset)
+			if err != nil {
+				return i, err
+			}
+		}
+		self.offset += int64(len(block))
+	}
+	return len(buf), nil
+}
+
+func (self *holeWriter) WriteHole(length int64) error {
+	self.offset += length
+	return nil
+}
+
+// CopyToFile copies the logical disk of src to dst as a sparse file.
+// dst is truncated, only the allocated ranges of src are read and
+// blocks of zeros are skipped, then the file is extended to the disk
+// size so the skipped parts become holes. On filesystems without
+// sparse files the holes read as zeros all the same. The disk is also
+// written to each of tee in the same pass (see ExportSinks), e.g. to
+// hash it.
+//
+// Destinations which are not regular files (e.g. block devices and
+// pipes) or can not be truncated are written in full from their current
+// position, zeros included. The copy stops early with ctx.Err() when
+// ctx is cancelled.
+func CopyToFile(ctx context.Context, dst *os.File, src *VMDKContext,
+	progress ProgressFunc, tee ...io.Writer) (int64, error) {
+	stat, err := dst.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if !stat.Mode().IsRegular() || dst.Truncate(0) != nil {
+		return src.ExportSinks(ctx, append([]io.Writer{dst}, tee...),
+			progress)
+	}
+
+	out := &holeWriter{file: dst}
+	n, err := src.ExportSinks(ctx, append([]io.Writer{out}, tee...),
+		progress)
+	if err != nil {
+		return n, err
+	}
+
+	// Extend the file over any trailing hole.
+	return n, dst.Truncate(src.total_size)
+}
@@ -0,0 +1,27 @@
+package parser
+
+import (
+	"syscall"
+	"testing"
+)
+
+// Check the file occupies at most max_bytes on disk. Filesystems
+// without sparse files are skipped.
+func checkSparse(t *testing.T, filename string, max_bytes int64) {
+	var stat syscall.Stat_t
+	err := syscall.Stat(filename, &stat)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	used := stat.Blocks * 512
+	if used >= stat.Size {
+		t.Logf("%v is not sparse, the filesystem may not support holes",
+			filename)
+		return
+	}
+
+	if used > max_bytes {
+		t.Fatalf("%v uses %v bytes on disk", filename, used)
+	}
+}
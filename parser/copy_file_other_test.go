@@ -0,0 +1,8 @@
+//go:build !linux
+
+package parser
+
+import "testing"
+
+// Block usage is only checked on Linux.
+func checkSparse(t *testing.T, filename string, max_bytes int64) {}
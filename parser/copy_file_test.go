@@ -0,0 +1,83 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A 256MB disk with three grains of data and one allocated grain of
+// zeros.
+func thinTestDisk(t *testing.T) *VMDKContext {
+	sparse, err := NewTestSparseExtent(map[int64][]byte{
+		0:     bytes.Repeat([]byte("A"), TEST_GRAIN_SIZE),
+		1:     make([]byte, TEST_GRAIN_SIZE),
+		1000:  bytes.Repeat([]byte("B"), TEST_GRAIN_SIZE),
+		50000: bytes.Repeat([]byte("C"), TEST_GRAIN_SIZE),
+	}, 256*1024*1024)
+	if err != nil {
+		t.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	vmdk, err := NewTestContext(sparse)
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+	return vmdk
+}
+
+func TestCopyToFile(t *testing.T) {
+	vmdk := thinTestDisk(t)
+	expected, err := vmdk.HashRange(sha256.New(), 0, vmdk.Size())
+	if err != nil {
+		t.Fatalf("HashRange: %v", err)
+	}
+
+	// Old content of the file is discarded.
+	filename := filepath.Join(t.TempDir(), "out.raw")
+	err = os.WriteFile(filename, bytes.Repeat([]byte("X"), 2*1024*1024), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	out, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer out.Close()
+
+	n, err := CopyToFile(context.Background(), out, vmdk, nil)
+	if err != nil || n != vmdk.Size() {
+		t.Fatalf("CopyToFile: %v %v", n, err)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(out, 0, vmdk.Size()+1))
+	if err != nil || !bytes.Equal(h.Sum(nil), expected) {
+		t.Fatalf("Copy differs from the disk: %v", err)
+	}
+
+	checkSparse(t, filename, 1024*1024)
+
+	// A pipe can not have holes so it gets every byte.
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer reader.Close()
+
+	go func() {
+		CopyToFile(context.Background(), writer, vmdk, nil)
+		writer.Close()
+	}()
+
+	h.Reset()
+	_, err = io.Copy(h, reader)
+	if err != nil || !bytes.Equal(h.Sum(nil), expected) {
+		t.Fatalf("Pipe copy differs from the disk: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package parser
+
+import (
+	"errors"
+	"io"
+)
+
+// ReadCost estimates the work of reading length bytes at offset: the
+// number of separate reads from extent files and the bytes they fetch.
+// Grains stored back to back count as one read since ReadAt coalesces
+// them. Compressed grains are fetched whole to be inflated, so they
+// count their compressed size. Holes read through the parent disk count
+// the parent's reads and other holes cost nothing. Grain table lookups
+// and caches are not taken into account.
+func (self *VMDKContext) ReadCost(offset, length int64) (
+	extent_reads int, bytes int64) {
+	if offset < 0 {
+		length += offset
+		offset = 0
+	}
+
+	if length > self.total_size-offset {
+		length = self.total_size - offset
+	}
+
+	end := offset + length
+	for _, e := range self.extents {
+		start := e.VirtualOffset()
+		extent_end := start + e.TotalSize()
+		if start >= end || extent_end <= offset {
+			continue
+		}
+
+		from := offset
+		if from < start {
+			from = start
+		}
+		to := end
+		if to > extent_end {
+			to = extent_end
+		}
+
+		reads, n := self.extentCost(e, from-start, to-from)
+		extent_reads += reads
+		bytes += n
+	}
+	return extent_reads, bytes
+}
+
+// The cost of reading a range relative to the start of the extent.
+func (self *VMDKContext) extentCost(extent Extent, offset, length int64) (
+	int, int64) {
+	switch t := extent.(type) {
+	case *FlatExtent:
+		return 1, length
+
+	case *SparseExtent:
+		return self.sparseCost(t, offset, length)
+
+	case *StreamExtent:
+		reads := 0
+		var bytes int64
+		end := offset + length
+		first := offset / t.grain_size
+		for grain := first; grain*t.grain_size < end; grain++ {
+			stored, pres := t.grains[grain]
+			if pres {
+				reads++
+				bytes += stored.size
+			}
+		}
+		return reads, bytes
+
+	case *lazyExtent:
+		handle, err := t.handles.get(t)
+		if err != nil {
+			return 0, 0
+		}
+		defer t.handles.release(handle)
+
+		return self.extentCost(handle.extent, offset, length)
+	}
+
+	// Null and raw device extents are not read.
+	return 0, 0
+}
+
+func (self *VMDKContext) sparseCost(extent *SparseExtent,
+	offset, length int64) (reads int, bytes int64) {
+	end := offset + length
+
+	// Where the last allocated grain ends in the file, or -1 after a
+	// hole.
+	next := int64(-1)
+	for offset < end {
+		start, grain_length, err := extent.getGrainForOffset(offset)
+		if grain_length > end-offset {
+			grain_length = end - offset
+		}
+
+		switch {
+		case err == nil:
+			if start != next {
+				reads++
+			}
+			bytes += grain_length
+			next = start + grain_length
+
+		case errors.Is(err, io.EOF) && self.parent != nil:
+			parent_reads, parent_bytes := self.parent.ReadCost(
+				extent.offset+offset, grain_length)
+			reads += parent_reads
+			bytes += parent_bytes
+			next = -1
+
+		default:
+			next = -1
+		}
+
+		offset += grain_length
+	}
+	return reads, bytes
+}
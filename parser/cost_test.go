@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadCost(t *testing.T) {
+	grain := func(c string) []byte {
+		return bytes.Repeat([]byte(c), TEST_GRAIN_SIZE)
+	}
+
+	// An 8kb flat extent followed by a sparse extent where grains 0
+	// and 1 are stored together and grain 5 on its own.
+	sparse, err := NewTestSparseExtent(map[int64][]byte{
+		0: grain("A"), 1: grain("B"), 5: grain("C"),
+	}, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	vmdk, err := NewTestContext(
+		NewTestFlatExtent(make([]byte, 2*TEST_GRAIN_SIZE), 0), sparse)
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+
+	for _, c := range []struct {
+		offset, length int64
+		reads          int
+		bytes          int64
+	}{
+		// The second half of the flat extent and the first 8 grains.
+		{TEST_GRAIN_SIZE, 9 * TEST_GRAIN_SIZE, 3, 4 * TEST_GRAIN_SIZE},
+
+		// Part of a grain.
+		{2*TEST_GRAIN_SIZE + 100, 100, 1, 100},
+
+		// Only holes.
+		{10 * TEST_GRAIN_SIZE, 20 * TEST_GRAIN_SIZE, 0, 0},
+
+		// Clipped to the disk.
+		{vmdk.Size() - 100, 1000, 0, 0},
+	} {
+		reads, n := vmdk.ReadCost(c.offset, c.length)
+		if reads != c.reads || n != c.bytes {
+			t.Fatalf("ReadCost(%#x, %#x) = %v reads of %v bytes",
+				c.offset, c.length, reads, n)
+		}
+	}
+
+	// Holes in the snapshot are read from the base: grain 0 from the
+	// base, grain 1 from the snapshot and grain 2 is in neither.
+	chain, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer chain.Close()
+
+	reads, n := chain.ReadCost(0, 3*testGrainSize)
+	if reads != 2 || n != 2*testGrainSize {
+		t.Fatalf("Chain cost: %v reads of %v bytes", reads, n)
+	}
+
+	// Compressed grains cost their compressed size.
+	stream, err := OpenStreamOptimized(bytes.NewReader(compressedFixture(8)))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+	defer stream.Close()
+
+	reads, n = stream.ReadCost(0, stream.Size())
+	if reads != 8 || n == 0 || n >= stream.Size() {
+		t.Fatalf("Stream cost: %v reads of %v bytes", reads, n)
+	}
+}
@@ -0,0 +1,47 @@
+package parser
+
+import "sync"
+
+// coverageMap records the ranges of the disk which were read.
+type coverageMap struct {
+	mu     sync.Mutex
+	ranges []Range
+
+	// Length of ranges when it was last merged.
+	merged int
+}
+
+func (self *coverageMap) add(offset, length int64) {
+	if length <= 0 {
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// Sequential reads extend the last range. Random reads are merged
+	// now and then to keep the list short.
+	self.ranges = appendRange(self.ranges, Range{Offset: offset, Length: length})
+	if len(self.ranges) > 2*self.merged+64 {
+		self.ranges = mergeRanges(self.ranges)
+		self.merged = len(self.ranges)
+	}
+}
+
+func (self *coverageMap) get() []Range {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.ranges = mergeRanges(self.ranges)
+	self.merged = len(self.ranges)
+	return append([]Range{}, self.ranges...)
+}
+
+// CoverageMap returns the sorted, merged ranges of the disk returned by
+// ReadAt so far. This is nil unless the disk was opened WithCoverage.
+func (self *VMDKContext) CoverageMap() []Range {
+	if self.coverage == nil {
+		return nil
+	}
+	return self.coverage.get()
+}
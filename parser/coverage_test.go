@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoverageMap(t *testing.T) {
+	vmdk, err := openTestDisk(makeChainFiles(), "base.vmdk", WithCoverage())
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if len(vmdk.CoverageMap()) != 0 {
+		t.Fatalf("Unexpected coverage before reading")
+	}
+
+	read := func(offset, length int64) {
+		_, err := vmdk.ReadAt(make([]byte, length), offset)
+		if err != nil {
+			t.Fatalf("ReadAt: %v", err)
+		}
+	}
+
+	// Adjacent and overlapping reads merge, and a read past the end
+	// only covers what was returned.
+	read(0, 512)
+	read(4096, 1024)
+	read(512, 512)
+	read(4608, 1024)
+	read(vmdk.Size()-100, 100)
+	vmdk.ReadAt(make([]byte, 100), vmdk.Size()-50)
+
+	expected := []Range{
+		{Offset: 0, Length: 1024},
+		{Offset: 4096, Length: 1536},
+		{Offset: vmdk.Size() - 100, Length: 100},
+	}
+	if !reflect.DeepEqual(vmdk.CoverageMap(), expected) {
+		t.Fatalf("Unexpected coverage %+v", vmdk.CoverageMap())
+	}
+
+	// Without the option nothing is recorded.
+	vmdk, err = openTestDisk(makeChainFiles(), "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	read(0, 512)
+	if vmdk.CoverageMap() != nil {
+		t.Fatalf("Unexpected coverage %+v", vmdk.CoverageMap())
+	}
+}
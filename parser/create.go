@@ -0,0 +1,54 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// NewFlatContext presents a raw image as a disk with a single flat
+// extent. This is useful as the source for the disk writers.
+func NewFlatContext(reader io.ReaderAt, size int64) *VMDKContext {
+	return &VMDKContext{
+		profile: NewVMDKProfile(),
+		reader:  reader,
+		config:  NewVMDKConfig(),
+		options: getOptions(nil),
+		extents: []Extent{&FlatExtent{
+			reader:     reader,
+			total_size: size,
+		}},
+		total_size: size,
+	}
+}
+
+// WriteMonolithicFlat writes the logical disk as a monolithicFlat
+// disk: the descriptor goes to descriptor_out and the raw data to
+// data_out. The descriptor refers to the data by data_filename.
+func (self *VMDKContext) WriteMonolithicFlat(
+	ctx context.Context, descriptor_out io.Writer, data_out io.Writer,
+	data_filename string, progress ProgressFunc) error {
+	capacity := (self.total_size + SECTOR_SIZE - 1) / SECTOR_SIZE
+	descriptor, err := formatDescriptor("monolithicFlat", capacity,
+		[]string{fmt.Sprintf("RW %d FLAT %q 0", capacity, data_filename)},
+		self.config)
+	if err != nil {
+		return err
+	}
+
+	n, err := self.Export(ctx, data_out, progress)
+	if err != nil {
+		return err
+	}
+
+	// The flat extent must cover whole sectors.
+	if n%SECTOR_SIZE != 0 {
+		_, err = data_out.Write(make([]byte, SECTOR_SIZE-n%SECTOR_SIZE))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(descriptor_out, descriptor)
+	return err
+}
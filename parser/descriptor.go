@@ -0,0 +1,357 @@
+package parser
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Keys validated by ValidateGeometry.
+var geometryKeys = []string{
+	"ddb.adapterType",
+	"ddb.geometry.cylinders",
+	"ddb.geometry.heads",
+	"ddb.geometry.sectors",
+}
+
+// Keys which belong in the descriptor header rather than the disk
+// database.
+var headerKeys = map[string]bool{
+	"version":            true,
+	"encoding":           true,
+	"CID":                true,
+	"parentCID":          true,
+	"isNativeSnapshot":   true,
+	"createType":         true,
+	"parentFileNameHint": true,
+	"changeTrackPath":    true,
+}
+
+// Header keys VMware writes without quotes.
+var unquotedKeys = map[string]bool{
+	"version":   true,
+	"CID":       true,
+	"parentCID": true,
+}
+
+// Disk database keys carried over from a source disk into a newly
+// written disk.
+var copiedDDBKeys = []string{
+	"ddb.adapterType",
+	"ddb.geometry.cylinders",
+	"ddb.geometry.heads",
+	"ddb.geometry.sectors",
+	"ddb.virtualHWVersion",
+}
+
+// NewCID returns a fresh random content ID.
+func NewCID() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return fmt.Sprintf("%08x", binary.LittleEndian.Uint32(buf))
+}
+
+// Format a descriptor for a new standalone disk of capacity sectors.
+// The disk database is copied from source if given. A disk with an
+// adapter type but no geometry gets the default geometry.
+func formatDescriptor(create_type string, capacity int64, extents []string,
+	source *VMDKConfig) (string, error) {
+	res := []string{
+		DESCRIPTOR_HEADER,
+		"version=1",
+		"CID=" + NewCID(),
+		"parentCID=ffffffff",
+		fmt.Sprintf("createType=%q", create_type),
+		"",
+		"# Extent description",
+	}
+	res = append(res, extents...)
+	res = append(res, "", "# The Disk Data Base", "#DDB", "")
+
+	ddb := NewVMDKConfig()
+	if source != nil {
+		for _, key := range copiedDDBKeys {
+			value, pres := source.Get(key)
+			if !pres {
+				continue
+			}
+
+			err := ddb.Set(key, value)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if ddb.DBBAdapterType != "" && ddb.DBBGeometryCylinders == 0 &&
+		ddb.DBBGeometryHeads == 0 && ddb.DBBGeometrySectors == 0 {
+		cylinders, heads, sectors := DefaultGeometry(
+			ddb.DBBAdapterType, capacity)
+		ddb.Set("ddb.geometry.cylinders", fmt.Sprintf("%d", cylinders))
+		ddb.Set("ddb.geometry.heads", fmt.Sprintf("%d", heads))
+		ddb.Set("ddb.geometry.sectors", fmt.Sprintf("%d", sectors))
+	}
+
+	err := ValidateGeometry(ddb, capacity)
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range ddb.Keys() {
+		value, _ := ddb.Get(key)
+		res = append(res, fmt.Sprintf("%v = %q", key, value))
+	}
+
+	return strings.Join(res, "\n") + "\n", nil
+}
+
+// WriteDescriptor writes descriptor with the settings from config
+// applied. Changed keys are rewritten in place so comments, extent
+// lines and unknown keys are preserved. Keys not present in the
+// original descriptor are added to the header or the disk database.
+// If the adapter type or geometry change they are checked against the
+// capacity of the extents with ValidateGeometry.
+func WriteDescriptor(out io.Writer, descriptor string,
+	config *VMDKConfig) error {
+	original := ParseConfig(descriptor)
+	for _, key := range geometryKeys {
+		old_value, _ := original.Get(key)
+		new_value, _ := config.Get(key)
+		if old_value == new_value {
+			continue
+		}
+
+		var capacity int64
+		for _, extent := range ParseDescriptor(descriptor).Extents {
+			capacity += extent.Sectors
+		}
+
+		err := ValidateGeometry(config, capacity)
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	seen := make(map[string]bool)
+
+	var lines []string
+	extents_line := -1
+
+	for _, line := range strings.Split(descriptor, "\n") {
+		if StartExtentRegex.MatchString(line) && extents_line < 0 {
+			extents_line = len(lines)
+		}
+
+		match := ConfigRegex.FindStringSubmatchIndex(line)
+		if len(match) > 0 {
+			key := line[match[2]:match[3]]
+			seen[key] = true
+
+			value, pres := config.Get(key)
+			if pres && value != line[match[4]:match[5]] {
+				line = line[:match[4]] + value + line[match[5]:]
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	// Drop the trailing empty line so new keys go before it.
+	trailing_newline := len(lines) > 0 && lines[len(lines)-1] == ""
+	if trailing_newline {
+		lines = lines[:len(lines)-1]
+	}
+
+	var header, ddb []string
+	for _, key := range config.Keys() {
+		if seen[key] {
+			continue
+		}
+
+		value, _ := config.Get(key)
+		if unquotedKeys[key] {
+			header = append(header, fmt.Sprintf("%v=%v", key, value))
+		} else if headerKeys[key] {
+			header = append(header, fmt.Sprintf("%v=%q", key, value))
+		} else {
+			ddb = append(ddb, fmt.Sprintf("%v = %q", key, value))
+		}
+	}
+
+	if len(header) > 0 {
+		// Header keys go before the extent section, skipping back
+		// over the blank separator line.
+		idx := extents_line
+		if idx < 0 {
+			idx = len(lines)
+		}
+		for idx > 0 && strings.TrimSpace(lines[idx-1]) == "" {
+			idx--
+		}
+		lines = append(lines[:idx], append(header, lines[idx:]...)...)
+	}
+
+	lines = append(lines, ddb...)
+
+	result := strings.Join(lines, "\n")
+	if trailing_newline || len(ddb) > 0 {
+		result += "\n"
+	}
+
+	_, err := io.WriteString(out, result)
+	return err
+}
+
+// FindDescriptor locates the descriptor in a vmdk file. A sparse
+// extent may carry an embedded descriptor, in which case its location
+// and reserved size are returned. Otherwise the file is a plain text
+// descriptor.
+func FindDescriptor(reader io.ReaderAt, size int64) (
+	offset int64, length int64, err error) {
+	profile := NewVMDKProfile()
+	header := profile.SparseExtentHeader(reader, 0)
+
+	if header.magicNumber() != SPARSE_MAGICNUMBER {
+		if size > 64*1024 {
+			size = 64 * 1024
+		}
+		return 0, size, nil
+	}
+
+	if header.descriptorOffset() == 0 || header.descriptorSize() == 0 {
+		return 0, 0, errors.New("Sparse extent has no embedded descriptor")
+	}
+
+	return int64(header.descriptorOffset()) * SECTOR_SIZE,
+		int64(header.descriptorSize()) * SECTOR_SIZE, nil
+}
+
+// ReadDescriptor returns the descriptor text of a vmdk file.
+func ReadDescriptor(reader io.ReaderAt, size int64) (string, error) {
+	offset, length, err := FindDescriptor(reader, size)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, length)
+	n, err := reader.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	// Embedded descriptors are padded with zeros.
+	buf = buf[:n]
+	if idx := strings.IndexByte(string(buf), 0); idx >= 0 {
+		buf = buf[:idx]
+	}
+
+	return string(buf), nil
+}
+
+// An extent line from a descriptor.
+type DescriptorExtent struct {
+	Line     int    `json:"Line"`
+	Access   string `json:"Access"`
+	Sectors  int64  `json:"Sectors"`
+	Type     string `json:"Type"`
+	Filename string `json:"Filename"`
+	Offset   int64  `json:"Offset"`
+}
+
+// A problem found in the descriptor text. Lines are numbered from 1.
+type DescriptorWarning struct {
+	Line    int    `json:"Line"`
+	Message string `json:"Message"`
+}
+
+// Descriptor is the structured view of the descriptor text.
+type Descriptor struct {
+	Config   *VMDKConfig         `json:"Config"`
+	Extents  []DescriptorExtent  `json:"Extents"`
+	Warnings []DescriptorWarning `json:"Warnings"`
+}
+
+// ParseDescriptor parses descriptor text without opening any extents,
+// noting lines which are not understood.
+func ParseDescriptor(text string) *Descriptor {
+	res := &Descriptor{Config: NewVMDKConfig()}
+
+	warn := func(line int, format string, args ...interface{}) {
+		res.Warnings = append(res.Warnings, DescriptorWarning{
+			Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	in_extents := false
+	text = strings.TrimPrefix(text, UTF8_BOM)
+	for i, line := range strings.Split(text, "\n") {
+		line_number := i + 1
+		trimmed := strings.TrimSpace(line)
+
+		if StartExtentRegex.MatchString(line) {
+			in_extents = true
+			continue
+		}
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		extent, err := parseExtentLine(line)
+		if err != nil {
+			warn(line_number, "%v", err)
+			continue
+		}
+
+		if extent != nil {
+			if !in_extents {
+				warn(line_number, "Extent outside the extent section")
+			}
+
+			sectors, err := strconv.ParseInt(extent.sectors, 10, 64)
+			if err != nil {
+				warn(line_number, "Invalid sector count %q", extent.sectors)
+			}
+
+			offset := int64(0)
+			if extent.offset != "" {
+				offset, err = strconv.ParseInt(extent.offset, 10, 64)
+				if err != nil {
+					warn(line_number, "Invalid offset %q", extent.offset)
+				}
+			}
+
+			res.Extents = append(res.Extents, DescriptorExtent{
+				Line:     line_number,
+				Access:   extent.access,
+				Sectors:  sectors,
+				Type:     extent.extent_type,
+				Filename: extent.filename,
+				Offset:   offset,
+			})
+			continue
+		}
+		in_extents = false
+
+		match := ConfigRegex.FindStringSubmatch(line)
+		if len(match) > 0 {
+			if _, pres := res.Config.Get(match[1]); pres {
+				warn(line_number, "Duplicate key %v", match[1])
+			}
+			res.Config.parseLine(line)
+			continue
+		}
+
+		warn(line_number, "Unrecognized line %q", trimmed)
+	}
+
+	if len(res.Extents) == 0 {
+		warn(0, "No extents found")
+	}
+
+	return res
+}
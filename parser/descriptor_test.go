@@ -0,0 +1,77 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDescriptor(t *testing.T) {
+	descriptor := ParseDescriptor(`# Disk DescriptorFile
+version=1
+CID=11111111
+CID=22222222
+createType="twoGbMaxExtentFlat"
+
+# Extent description
+RW 2048 FLAT "disk-f001.vmdk" 0
+RW 1M FLAT "disk-f002.vmdk" 0
+garbage here
+
+# The Disk Data Base
+ddb.adapterType = "lsilogic"
+`)
+
+	if descriptor.Config.CID != "22222222" ||
+		descriptor.Config.DBBAdapterType != "lsilogic" {
+		t.Fatalf("Unexpected config %+v", descriptor.Config)
+	}
+
+	if len(descriptor.Extents) != 2 ||
+		descriptor.Extents[0] != (DescriptorExtent{
+			Line: 8, Access: "RW", Sectors: 2048, Type: "FLAT",
+			Filename: "disk-f001.vmdk"}) {
+		t.Fatalf("Unexpected extents %+v", descriptor.Extents)
+	}
+
+	expected := []DescriptorWarning{
+		{Line: 4, Message: "Duplicate key CID"},
+		{Line: 9, Message: `Invalid sector count "1M"`},
+		{Line: 10, Message: `Unrecognized line "garbage here"`},
+	}
+	if len(descriptor.Warnings) != len(expected) {
+		t.Fatalf("Unexpected warnings %+v", descriptor.Warnings)
+	}
+	for i, w := range expected {
+		if descriptor.Warnings[i] != w {
+			t.Fatalf("Unexpected warning %+v, expected %+v",
+				descriptor.Warnings[i], w)
+		}
+	}
+}
+
+func TestDescriptorBOM(t *testing.T) {
+	// The version line is the first line, right after the BOM.
+	descriptor := UTF8_BOM + strings.TrimPrefix(
+		baseDescriptor, "# Disk DescriptorFile\n")
+
+	files := makeChainFiles()
+	files["bom.vmdk"] = []byte(descriptor)
+
+	vmdk, err := openTestDisk(files, "bom.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.config.Version != 1 || len(vmdk.extents) != 1 ||
+		len(vmdk.Warnings) > 0 {
+		t.Fatalf("Unexpected parse: version %v, %v extents, warnings %v",
+			vmdk.config.Version, len(vmdk.extents), vmdk.Warnings)
+	}
+
+	parsed := ParseDescriptor(descriptor)
+	if parsed.Config.Version != 1 || len(parsed.Extents) != 1 ||
+		len(parsed.Warnings) > 0 {
+		t.Fatalf("Unexpected descriptor %+v", parsed)
+	}
+}
@@ -0,0 +1,177 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ProgressFunc is called periodically by long running operations with
+// the number of bytes processed so far and the total.
+type ProgressFunc func(done, total int64)
+
+const copyBufferSize = 1024 * 1024
+
+// Export copies the logical disk to out. The copy stops early with
+// ctx.Err() when ctx is cancelled. See WithExportWorkers and
+// WithExtentWorkers to read several parts of the disk at once.
+func (self *VMDKContext) Export(
+	ctx context.Context, out io.Writer, progress ProgressFunc) (int64, error) {
+	return self.exportRange(ctx, out, 0, self.total_size, progress)
+}
+
+// Copy length bytes of the logical disk starting at offset to out.
+// Progress is reported relative to offset.
+func (self *VMDKContext) exportRange(ctx context.Context, out io.Writer,
+	offset, length int64, progress ProgressFunc) (int64, error) {
+	if self.options != nil {
+		if self.options.extent_workers > 1 && len(self.extents) > 1 {
+			return self.exportExtents(ctx, out, offset, length, progress)
+		}
+
+		if self.options.export_workers > 1 {
+			return self.exportParallel(ctx, out, offset, length, progress)
+		}
+	}
+
+	scratch := getScratch(copyBufferSize)
+	defer putScratch(scratch)
+
+	var done int64
+	for done < length {
+		select {
+		case <-ctx.Done():
+			return done, ctx.Err()
+		default:
+		}
+
+		buf := *scratch
+		if int64(len(buf)) > length-done {
+			buf = buf[:length-done]
+		}
+
+		n, err := self.ReadAt(buf, offset+done)
+		if n > 0 {
+			_, err := out.Write(buf[:n])
+			if err != nil {
+				return done, err
+			}
+			done += int64(n)
+		}
+
+		if err != nil && err != io.EOF {
+			return done, err
+		}
+
+		// No more data available - we cant make more progress.
+		if n == 0 {
+			return done, io.ErrUnexpectedEOF
+		}
+
+		if progress != nil {
+			progress(done, length)
+		}
+	}
+
+	return done, nil
+}
+
+// WriteTo copies the logical disk to out.
+func (self *VMDKContext) WriteTo(out io.Writer) (int64, error) {
+	return self.Export(context.Background(), out, nil)
+}
+
+// CopyVerified copies the logical disk to w while feeding the same data
+// to h, so the copy and its hash take a single pass over the disk.
+func (self *VMDKContext) CopyVerified(w io.Writer, h hash.Hash) (int64, error) {
+	return self.Export(context.Background(), io.MultiWriter(w, h), nil)
+}
+
+// HashRange feeds length bytes of the logical disk starting at offset
+// to h and returns the resulting sum.
+func (self *VMDKContext) HashRange(h hash.Hash, offset, length int64) (
+	[]byte, error) {
+	if offset < 0 || length < 0 || offset+length > self.total_size {
+		return nil, fmt.Errorf("Range %#x+%#x is outside the disk", offset, length)
+	}
+
+	if self.options != nil && (self.options.export_workers > 1 ||
+		self.options.extent_workers > 1) {
+		_, err := self.exportRange(context.Background(), h,
+			offset, length, nil)
+		if err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+
+	scratch := getScratch(copyBufferSize)
+	defer putScratch(scratch)
+
+	_, err := io.CopyBuffer(h, io.NewSectionReader(self, offset, length),
+		*scratch)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Call cb with each block of block_size bytes which overlaps the
+// allocated ranges and is not all zero, in order. The last block is
+// zero padded.
+func (self *VMDKContext) forEachAllocatedBlock(ctx context.Context,
+	block_size int64, progress ProgressFunc,
+	cb func(block int64, data []byte) error) error {
+	buf := make([]byte, block_size)
+
+	// Adjacent ranges may share a block, which is only visited once.
+	next := int64(0)
+	for _, r := range self.allocatedRanges(true) {
+		first := r.Offset / block_size
+		if first < next {
+			first = next
+		}
+
+		for block := first; block*block_size < r.End(); block++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			offset := block * block_size
+			n, err := self.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			zeroFill(buf[n:])
+
+			if !isZero(buf) {
+				err = cb(block, buf)
+				if err != nil {
+					return err
+				}
+			}
+
+			if progress != nil {
+				progress(offset+int64(n), self.total_size)
+			}
+			next = block + 1
+		}
+	}
+
+	if progress != nil {
+		progress(self.total_size, self.total_size)
+	}
+	return nil
+}
+
+func isZero(buf []byte) bool {
+	for _, c := range buf {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
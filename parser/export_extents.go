@@ -0,0 +1,138 @@
+package parser
+
+import (
+	"context"
+	"io"
+)
+
+// Chunks each extent worker reads ahead of the writer.
+const EXTENT_QUEUE_DEPTH = 4
+
+// A part of the disk read from start to end by one worker. chunks is
+// closed once the worker is done or was never started.
+type exportSegment struct {
+	offset int64
+	length int64
+	chunks chan *exportChunk
+}
+
+// Split length bytes at offset at the extent boundaries.
+func (self *VMDKContext) exportSegments(offset, length int64) []*exportSegment {
+	var res []*exportSegment
+	add := func(start, end int64) {
+		if start < offset {
+			start = offset
+		}
+		if end > offset+length {
+			end = offset + length
+		}
+		if start < end {
+			res = append(res, &exportSegment{
+				offset: start,
+				length: end - start,
+				chunks: make(chan *exportChunk, EXTENT_QUEUE_DEPTH),
+			})
+		}
+	}
+
+	end := int64(0)
+	for _, extent := range self.extents {
+		end = extent.VirtualOffset() + extent.TotalSize()
+		add(extent.VirtualOffset(), end)
+	}
+
+	// Past the last extent the disk reads as zeros.
+	add(end, offset+length)
+	return res
+}
+
+// Copy length bytes at offset to out, reading up to extent_workers
+// extents at once. Each extent is read in order by its own worker,
+// which keeps up to EXTENT_QUEUE_DEPTH chunks ahead of the writer, so
+// extent files on independent devices are each read sequentially.
+// Workers start in extent order, so the extent being written always
+// has one.
+func (self *VMDKContext) exportExtents(ctx context.Context, out io.Writer,
+	offset, length int64, progress ProgressFunc) (int64, error) {
+	segments := self.exportSegments(offset, length)
+	sem := make(chan struct{}, self.options.extent_workers)
+	stop := make(chan struct{})
+
+	go func() {
+		for i, segment := range segments {
+			select {
+			case <-stop:
+				for _, s := range segments[i:] {
+					close(s.chunks)
+				}
+				return
+			case sem <- struct{}{}:
+			}
+
+			go func(segment *exportSegment) {
+				defer func() { <-sem }()
+				defer close(segment.chunks)
+
+				end := segment.offset + segment.length
+				for start := segment.offset; start < end; start += copyBufferSize {
+					chunk := &exportChunk{
+						offset: start,
+						length: end - start,
+						buf:    getScratch(copyBufferSize),
+					}
+					if chunk.length > copyBufferSize {
+						chunk.length = copyBufferSize
+					}
+
+					_, chunk.err = io.ReadFull(io.NewSectionReader(
+						self, chunk.offset, chunk.length),
+						(*chunk.buf)[:chunk.length])
+
+					select {
+					case <-stop:
+						putScratch(chunk.buf)
+						return
+					case segment.chunks <- chunk:
+					}
+
+					if chunk.err != nil {
+						return
+					}
+				}
+			}(segment)
+		}
+	}()
+
+	var written int64
+	var err error
+	for _, segment := range segments {
+		for chunk := range segment.chunks {
+			if err == nil {
+				select {
+				case <-ctx.Done():
+					err = ctx.Err()
+				default:
+					err = chunk.err
+				}
+
+				if err == nil {
+					_, err = out.Write((*chunk.buf)[:chunk.length])
+				}
+
+				if err == nil {
+					written += chunk.length
+					if progress != nil {
+						progress(written, length)
+					}
+				} else {
+					// Stop the workers and drain what they queued.
+					close(stop)
+				}
+			}
+
+			putScratch(chunk.buf)
+		}
+	}
+
+	return written, err
+}
@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"context"
+	"io"
+)
+
+// A chunk of the disk read by a worker. done is closed once buf holds
+// the data or err is set.
+type exportChunk struct {
+	offset int64
+	length int64
+	buf    *[]byte
+	err    error
+	done   chan struct{}
+}
+
+// Copy length bytes at offset to out, reading chunks with several
+// workers. Chunks are queued in offset order and written as soon as
+// the oldest one is read, so at most twice the number of workers are
+// held waiting for the writer.
+func (self *VMDKContext) exportParallel(ctx context.Context, out io.Writer,
+	offset, length int64, progress ProgressFunc) (int64, error) {
+	workers := self.options.export_workers
+	pending := make(chan *exportChunk, 2*workers)
+	sem := make(chan struct{}, workers)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(pending)
+
+		for start := offset; start < offset+length; start += copyBufferSize {
+			chunk := &exportChunk{
+				offset: start,
+				length: offset + length - start,
+				buf:    getScratch(copyBufferSize),
+				done:   make(chan struct{}),
+			}
+			if chunk.length > copyBufferSize {
+				chunk.length = copyBufferSize
+			}
+
+			select {
+			case <-stop:
+				putScratch(chunk.buf)
+				return
+			case sem <- struct{}{}:
+			}
+
+			go func() {
+				defer close(chunk.done)
+				defer func() { <-sem }()
+
+				_, chunk.err = io.ReadFull(io.NewSectionReader(
+					self, chunk.offset, chunk.length), (*chunk.buf)[:chunk.length])
+			}()
+
+			select {
+			case <-stop:
+				<-chunk.done
+				putScratch(chunk.buf)
+				return
+			case pending <- chunk:
+			}
+		}
+	}()
+
+	var written int64
+	var err error
+	for chunk := range pending {
+		<-chunk.done
+
+		if err == nil {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			default:
+				err = chunk.err
+			}
+
+			if err == nil {
+				_, err = out.Write((*chunk.buf)[:chunk.length])
+			}
+
+			if err == nil {
+				written += chunk.length
+				if progress != nil {
+					progress(written, length)
+				}
+			} else {
+				// Stop reading and drain what is in flight.
+				close(stop)
+			}
+		}
+
+		putScratch(chunk.buf)
+	}
+
+	return written, err
+}
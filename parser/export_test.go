@@ -0,0 +1,241 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestCopyVerified(t *testing.T) {
+	vmdk, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	out := &bytes.Buffer{}
+	h := sha256.New()
+	n, err := vmdk.CopyVerified(out, h)
+	if err != nil || n != vmdk.Size() || int64(out.Len()) != n {
+		t.Fatalf("CopyVerified: %v %v", n, err)
+	}
+
+	expected := sha256.Sum256(out.Bytes())
+	if !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Fatalf("Hash does not match the data written")
+	}
+
+	sum, err := vmdk.HashRange(sha256.New(), 0, vmdk.Size())
+	if err != nil || !bytes.Equal(sum, expected[:]) {
+		t.Fatalf("HashRange does not match: %x %v", sum, err)
+	}
+
+	// Part of the disk hashes like the same part of the copy.
+	sum, err = vmdk.HashRange(sha256.New(), 1000, 5000)
+	expected = sha256.Sum256(out.Bytes()[1000:6000])
+	if err != nil || !bytes.Equal(sum, expected[:]) {
+		t.Fatalf("HashRange of part of the disk does not match: %v", err)
+	}
+
+	_, err = vmdk.HashRange(sha256.New(), vmdk.Size()-10, 20)
+	if err == nil {
+		t.Fatalf("Expected an error for a range past the end")
+	}
+}
+
+// A stream of count (at most a grain table's worth) compressible but
+// varied grains.
+func compressedFixture(count int64) []byte {
+	rng := rand.New(rand.NewSource(1))
+	grains := map[int64][]byte{}
+	for i := int64(0); i < count; i++ {
+		grain := make([]byte, 128*SECTOR_SIZE)
+		rng.Read(grain)
+		for j := range grain {
+			grain[j] = 'a' + grain[j]&3
+		}
+		grains[i] = grain
+	}
+	return buildStreamOptimized(count*128*SECTOR_SIZE, grains)
+}
+
+func TestExportWorkers(t *testing.T) {
+	data := compressedFixture(80)
+
+	serial, err := OpenStreamOptimized(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	parallel, err := OpenStreamOptimized(bytes.NewReader(data),
+		WithExportWorkers(4))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	expected := sha256.New()
+	_, err = serial.WriteTo(expected)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	actual := sha256.New()
+	n, err := parallel.WriteTo(actual)
+	if err != nil || n != parallel.Size() ||
+		!bytes.Equal(actual.Sum(nil), expected.Sum(nil)) {
+		t.Fatalf("Parallel export differs: %v %v", n, err)
+	}
+
+	// Ranges which do not start or end on a chunk boundary.
+	a, _ := serial.HashRange(sha256.New(), 1000, 3*copyBufferSize+7)
+	b, err := parallel.HashRange(sha256.New(), 1000, 3*copyBufferSize+7)
+	if err != nil || !bytes.Equal(a, b) {
+		t.Fatalf("Parallel HashRange differs: %v", err)
+	}
+
+	// A read error stops the export after the data before it.
+	failing := newExtentsDisk([]io.ReaderAt{
+		bytes.NewReader(make([]byte, 4*copyBufferSize)), failingReader{},
+	}, 4*copyBufferSize, WithExportWorkers(4))
+
+	n, err = failing.WriteTo(io.Discard)
+	if err == nil || n != 4*copyBufferSize {
+		t.Fatalf("Expected an error after the first extent: %v %v", n, err)
+	}
+
+	// So does cancelling.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = parallel.Export(ctx, io.Discard, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the export to be cancelled: %v", err)
+	}
+}
+
+func benchmarkExportWorkers(b *testing.B, workers int) {
+	data := compressedFixture(512)
+	vmdk, err := OpenStreamOptimized(bytes.NewReader(data),
+		WithExportWorkers(workers), WithDecompressedGrainCache(0))
+	if err != nil {
+		b.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	b.SetBytes(vmdk.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := vmdk.HashRange(sha256.New(), 0, vmdk.Size())
+		if err != nil {
+			b.Fatalf("HashRange: %v", err)
+		}
+	}
+}
+
+func BenchmarkExportWorkers(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("%v", workers), func(b *testing.B) {
+			benchmarkExportWorkers(b, workers)
+		})
+	}
+}
+
+func TestExtentWorkers(t *testing.T) {
+	// Extents which do not end on a chunk boundary.
+	extent_size := int64(copyBufferSize*2 + 12345)
+	rng := rand.New(rand.NewSource(1))
+	var readers []io.ReaderAt
+	for i := 0; i < 6; i++ {
+		data := make([]byte, extent_size)
+		rng.Read(data)
+		readers = append(readers, bytes.NewReader(data))
+	}
+
+	serial := newExtentsDisk(readers, extent_size)
+	expected := sha256.New()
+	_, err := serial.WriteTo(expected)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	for _, workers := range []int{2, 3, 8} {
+		parallel := newExtentsDisk(readers, extent_size,
+			WithExtentWorkers(workers))
+
+		actual := sha256.New()
+		n, err := parallel.WriteTo(actual)
+		if err != nil || n != parallel.Size() ||
+			!bytes.Equal(actual.Sum(nil), expected.Sum(nil)) {
+			t.Fatalf("Workers %v: parallel export differs: %v %v",
+				workers, n, err)
+		}
+
+		// A range starting and ending inside extents.
+		a, _ := serial.HashRange(sha256.New(), 1000, 3*extent_size)
+		b, err := parallel.HashRange(sha256.New(), 1000, 3*extent_size)
+		if err != nil || !bytes.Equal(a, b) {
+			t.Fatalf("Workers %v: parallel HashRange differs: %v", workers, err)
+		}
+	}
+
+	// The disk past the last extent reads as zeros.
+	padded := newExtentsDisk(readers[:2], extent_size, WithExtentWorkers(2))
+	padded.total_size += 5000
+	out := &bytes.Buffer{}
+	n, err := padded.WriteTo(out)
+	if err != nil || n != padded.Size() ||
+		!isZero(out.Bytes()[2*extent_size:]) {
+		t.Fatalf("Unexpected padded export: %v %v", n, err)
+	}
+
+	// A read error stops the export after the extents before it, even
+	// with later extents read ahead.
+	failing := newExtentsDisk([]io.ReaderAt{
+		readers[0], readers[1], failingReader{}, readers[3], readers[4],
+	}, extent_size, WithExtentWorkers(4))
+
+	n, err = failing.WriteTo(io.Discard)
+	if err == nil || n != 2*extent_size {
+		t.Fatalf("Expected an error after two extents: %v %v", n, err)
+	}
+
+	// So does cancelling.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = newExtentsDisk(readers, extent_size, WithExtentWorkers(4)).
+		Export(ctx, io.Discard, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the export to be cancelled: %v", err)
+	}
+}
+
+// Extent files on devices which each take a millisecond per read.
+func BenchmarkExtentWorkers(b *testing.B) {
+	extent_size := int64(4 * copyBufferSize)
+	var readers []io.ReaderAt
+	for i := 0; i < 8; i++ {
+		readers = append(readers, &slowReader{
+			ReaderAt: bytes.NewReader(make([]byte, extent_size)),
+			delay:    time.Millisecond,
+		})
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("%v", workers), func(b *testing.B) {
+			vmdk := newExtentsDisk(readers, extent_size,
+				WithExtentWorkers(workers))
+
+			b.SetBytes(vmdk.Size())
+			for i := 0; i < b.N; i++ {
+				_, err := vmdk.WriteTo(io.Discard)
+				if err != nil {
+					b.Fatalf("WriteTo: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The access modes starting an extent line. R is not VMware syntax
+// but has always been accepted for RDONLY.
+var extentAccessModes = map[string]bool{
+	"RW": true, "RDONLY": true, "NOACCESS": true, "R": true,
+}
+
+// An extent line of the descriptor split into its fields, e.g.
+//
+//	RW 16777216 FLAT "disk-flat.vmdk" 0
+//
+// The sector count and offset are kept as text since size suffixes are
+// only valid in lenient mode. The offset is empty if not given. Trailing
+// annotations are dropped.
+//
+// A SPARSE extent may name a second file holding its grain directory
+// and tables, which VMware never writes:
+//
+//	RW 4192256 SPARSE "disk-data.vmdk" "disk-meta.vmdk"
+type extentLine struct {
+	access            string
+	sectors           string
+	extent_type       string
+	filename          string
+	offset            string
+	metadata_filename string
+}
+
+// Parse an extent line. Lines which do not start with an access mode
+// are not extent lines and return nil without an error. This is a lot
+// cheaper than ExtentRegex on descriptors with thousands of extents
+// (see BenchmarkParseExtentLine).
+func parseExtentLine(line string) (*extentLine, error) {
+	access, rest := nextToken(line)
+	if !extentAccessModes[access] {
+		return nil, nil
+	}
+
+	res := &extentLine{access: access}
+	res.sectors, rest = nextToken(rest)
+	if !isSectorCount(res.sectors) {
+		return nil, fmt.Errorf("%w: invalid sector count %q",
+			ErrInvalidExtentLine, res.sectors)
+	}
+
+	res.extent_type, rest = nextToken(rest)
+	if !isExtentType(res.extent_type) {
+		return nil, fmt.Errorf("%w: invalid extent type %q",
+			ErrInvalidExtentLine, res.extent_type)
+	}
+
+	filename, rest, err := quotedString(rest)
+	if err != nil {
+		return nil, err
+	}
+	res.filename = filename
+
+	if strings.HasPrefix(strings.TrimLeft(rest, " \t"), `"`) {
+		if res.extent_type != "SPARSE" {
+			return nil, fmt.Errorf(
+				"%w: only SPARSE extents have a metadata file",
+				ErrInvalidExtentLine)
+		}
+
+		res.metadata_filename, rest, err = quotedString(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Some tools annotate extent lines. Anything after the offset, or
+	// a comment in its place, is ignored.
+	res.offset, _ = nextToken(rest)
+	if strings.HasPrefix(res.offset, "#") {
+		res.offset = ""
+	}
+
+	if res.offset != "" && !isSectorCount(res.offset) {
+		return nil, fmt.Errorf("%w: invalid offset %q",
+			ErrInvalidExtentLine, res.offset)
+	}
+
+	return res, nil
+}
+
+func isDescriptorSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+// Split the next whitespace separated token off line.
+func nextToken(line string) (token, rest string) {
+	start := 0
+	for start < len(line) && isDescriptorSpace(line[start]) {
+		start++
+	}
+
+	end := start
+	for end < len(line) && !isDescriptorSpace(line[end]) {
+		end++
+	}
+	return line[start:end], line[end:]
+}
+
+// Read a non empty double quoted string at the start of line.
+func quotedString(line string) (value, rest string, err error) {
+	line = strings.TrimLeft(line, " \t")
+	if len(line) == 0 || line[0] != '"' {
+		return "", "", fmt.Errorf("%w: expected a quoted filename",
+			ErrInvalidExtentLine)
+	}
+
+	end := strings.IndexByte(line[1:], '"')
+	if end < 0 {
+		return "", "", fmt.Errorf("%w: unterminated filename",
+			ErrInvalidExtentLine)
+	}
+
+	if end == 0 {
+		return "", "", fmt.Errorf("%w: empty filename", ErrInvalidExtentLine)
+	}
+	return line[1 : end+1], line[end+2:], nil
+}
+
+// Digits with an optional size suffix.
+func isSectorCount(value string) bool {
+	digits := strings.TrimRight(value, "KMGkmg")
+	if len(digits) == 0 || len(value)-len(digits) > 1 {
+		return false
+	}
+
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isExtentType(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	for i := 0; i < len(value); i++ {
+		if value[i] < 'A' || value[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseExtentLine(t *testing.T) {
+	for _, c := range []struct {
+		line     string
+		expected *extentLine
+		err      bool
+	}{
+		{`RW 8 FLAT "disk-flat.vmdk" 0`,
+			&extentLine{"RW", "8", "FLAT", "disk-flat.vmdk", "0", ""}, false},
+		{`RDONLY 4192256 SPARSE "disk s001.vmdk"`,
+			&extentLine{"RDONLY", "4192256", "SPARSE", "disk s001.vmdk", "", ""}, false},
+		{"  NOACCESS 2G FLAT  \"a.vmdk\"  16\r",
+			&extentLine{"NOACCESS", "2G", "FLAT", "a.vmdk", "16", ""}, false},
+		{`R 8 VMFS "raw.vmdk"`,
+			&extentLine{"R", "8", "VMFS", "raw.vmdk", "", ""}, false},
+
+		// Trailing annotations.
+		{"RW 8 FLAT \"a.vmdk\" 16 # moved from datastore1 \t",
+			&extentLine{"RW", "8", "FLAT", "a.vmdk", "16", ""}, false},
+		{`RW 8 SPARSE "a.vmdk" # comment`,
+			&extentLine{"RW", "8", "SPARSE", "a.vmdk", "", ""}, false},
+		{`RW 8 SPARSE "a.vmdk"#comment`,
+			&extentLine{"RW", "8", "SPARSE", "a.vmdk", "", ""}, false},
+		{`RW 8 FLAT "a.vmdk" 0 tag=1 other`,
+			&extentLine{"RW", "8", "FLAT", "a.vmdk", "0", ""}, false},
+		{"RW  8\tFLAT \"a b.vmdk\"  16   # annotation",
+			&extentLine{"RW", "8", "FLAT", "a b.vmdk", "16", ""}, false},
+
+		// Split metadata.
+		{`RW 8 SPARSE "data.vmdk" "meta.vmdk"`,
+			&extentLine{"RW", "8", "SPARSE", "data.vmdk", "", "meta.vmdk"}, false},
+		{`RW 8 SPARSE "data.vmdk" "meta.vmdk" # split`,
+			&extentLine{"RW", "8", "SPARSE", "data.vmdk", "", "meta.vmdk"}, false},
+
+		// Not extent lines.
+		{`# Extent description`, nil, false},
+		{`RWX 8 FLAT "a.vmdk"`, nil, false},
+		{`createType="monolithicFlat"`, nil, false},
+		{``, nil, false},
+
+		// Malformed extent lines.
+		{`RW eight FLAT "a.vmdk"`, nil, true},
+		{`RW 8K8 FLAT "a.vmdk"`, nil, true},
+		{`RW 8 flat "a.vmdk"`, nil, true},
+		{`RW 8 FLAT a.vmdk`, nil, true},
+		{`RW 8 FLAT "a.vmdk`, nil, true},
+		{`RW 8 FLAT ""`, nil, true},
+		{`RW 8 FLAT "a.vmdk" x`, nil, true},
+		{`RW 8 FLAT "a.vmdk" "meta.vmdk"`, nil, true},
+		{`RW 8 SPARSE "a.vmdk" "meta.vmdk`, nil, true},
+	} {
+		res, err := parseExtentLine(c.line)
+		if c.err {
+			if !errors.Is(err, ErrInvalidExtentLine) {
+				t.Fatalf("Expected an error for %q, got %v", c.line, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", c.line, err)
+		}
+
+		if (res == nil) != (c.expected == nil) ||
+			(res != nil && *res != *c.expected) {
+			t.Fatalf("Unexpected parse of %q: %+v", c.line, res)
+		}
+	}
+}
+
+// The extent lines of a descriptor with 10000 extents.
+func manyExtentLines() []string {
+	var res []string
+	for i := 0; i < 10000; i++ {
+		res = append(res, fmt.Sprintf(
+			`RW 4192256 SPARSE "disk-s%05d.vmdk"`, i))
+	}
+	return res
+}
+
+// The deprecated regex still matches extent lines as it always did.
+func TestExtentRegex(t *testing.T) {
+	match := ExtentRegex.FindStringSubmatch(`RW 8 FLAT "a b.vmdk" 16`)
+	if len(match) != 5 || match[2] != "8" || match[4] != "a b.vmdk" {
+		t.Fatalf("Unexpected match %q", match)
+	}
+}
+
+func BenchmarkParseExtentLine(b *testing.B) {
+	lines := manyExtentLines()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			extent, _ := parseExtentLine(line)
+			if extent == nil {
+				b.Fatalf("Failed to parse %v", line)
+			}
+		}
+	}
+}
+
+func BenchmarkExtentRegex(b *testing.B) {
+	lines := manyExtentLines()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			if len(ExtentRegex.FindStringSubmatch(line)) == 0 {
+				b.Fatalf("Failed to parse %v", line)
+			}
+		}
+	}
+}
+
+func TestMalformedExtentLineWarning(t *testing.T) {
+	files := makeChainFiles()
+	files["bad.vmdk"] = []byte(strings.Replace(baseDescriptor,
+		`RW 2048 SPARSE "base-data.vmdk"`,
+		"RW 2048 SPARSE \"base-data.vmdk\"\nRW 2048 SPARSE base2.vmdk", 1))
+
+	vmdk, err := openTestDisk(files, "bad.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	expected := "Line 9: Invalid extent line: expected a quoted filename"
+	if len(vmdk.Warnings) != 1 || vmdk.Warnings[0] != expected {
+		t.Fatalf("Unexpected warnings %v", vmdk.Warnings)
+	}
+}
+
+func TestExtentLineComment(t *testing.T) {
+	files := makeChainFiles()
+	files["comment.vmdk"] = []byte(strings.Replace(baseDescriptor,
+		`RW 2048 SPARSE "base-data.vmdk"`,
+		`RW 2048 SPARSE "base-data.vmdk" # copied 2024-01-02`, 1))
+
+	vmdk, err := openTestDisk(files, "comment.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if len(vmdk.Warnings) != 0 || vmdk.Size() != 2048*SECTOR_SIZE {
+		t.Fatalf("Unexpected parse: size %v, warnings %v",
+			vmdk.Size(), vmdk.Warnings)
+	}
+}
@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExtentSizeChange is a FLAT extent whose sector count FixExtentSizes
+// changed. Truncated is set when the file is smaller than declared,
+// so data the descriptor promised is gone.
+type ExtentSizeChange struct {
+	Line      int    `json:"Line"`
+	Filename  string `json:"Filename"`
+	Declared  int64  `json:"Declared"`
+	Actual    int64  `json:"Actual"`
+	Truncated bool   `json:"Truncated,omitempty"`
+}
+
+// FixExtentSizes rewrites the sector count of each FLAT extent in
+// descriptor to match the size of its file, opened with opener. Where
+// several extents share a file only the one at the largest offset is
+// resized, as the others end where the next begins. A trailing partial
+// sector is not counted. Other lines are unchanged.
+func FixExtentSizes(descriptor string, opener Opener) (
+	string, []ExtentSizeChange, error) {
+	options := &options{lenient: true}
+	lines := strings.Split(descriptor, "\n")
+
+	type flatExtent struct {
+		idx     int
+		sectors int64
+		offset  int64
+	}
+
+	// The last extent in each file, in descriptor order.
+	var files []string
+	last := make(map[string]*flatExtent)
+
+	for idx, line := range lines {
+		// Lines which are not valid extents, such as ZERO extents
+		// without a filename, are left alone.
+		extent, err := parseExtentLine(line)
+		if err != nil || extent == nil || extent.extent_type != "FLAT" {
+			continue
+		}
+
+		sectors, err := options.parseSectors(extent.sectors)
+		if err != nil {
+			return "", nil, fmt.Errorf("Line %v: %w", idx+1, err)
+		}
+
+		offset, err := options.parseSectors(extent.offset)
+		if err != nil {
+			return "", nil, fmt.Errorf("Line %v: %w", idx+1, err)
+		}
+
+		current := &flatExtent{idx: idx, sectors: sectors, offset: offset}
+
+		previous, pres := last[extent.filename]
+		if !pres {
+			files = append(files, extent.filename)
+		}
+		if !pres || offset >= previous.offset {
+			last[extent.filename] = current
+		}
+	}
+
+	var changes []ExtentSizeChange
+	for _, filename := range files {
+		extent := last[filename]
+
+		reader, closer, err := opener(filename)
+		if err != nil {
+			return "", nil, fmt.Errorf("While opening %v: %w", filename, err)
+		}
+		size := readerSize(reader)
+		if closer != nil {
+			closer()
+		}
+
+		actual := size/SECTOR_SIZE - extent.offset
+		if actual < 0 {
+			actual = 0
+		}
+		if actual == extent.sectors {
+			continue
+		}
+
+		lines[extent.idx] = replaceSectorCount(lines[extent.idx], actual)
+		changes = append(changes, ExtentSizeChange{
+			Line:      extent.idx + 1,
+			Filename:  filename,
+			Declared:  extent.sectors,
+			Actual:    actual,
+			Truncated: actual < extent.sectors,
+		})
+	}
+
+	return strings.Join(lines, "\n"), changes, nil
+}
+
+// Replace the sector count of an extent line, keeping its spacing.
+func replaceSectorCount(line string, sectors int64) string {
+	_, rest := nextToken(line)
+	start := len(line) - len(rest)
+	for start < len(line) && isDescriptorSpace(line[start]) {
+		start++
+	}
+
+	count, _ := nextToken(line[start:])
+	return line[:start] + fmt.Sprintf("%d", sectors) +
+		line[start+len(count):]
+}
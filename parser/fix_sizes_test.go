@@ -0,0 +1,45 @@
+package parser
+
+import (
+	"testing"
+)
+
+func TestFixExtentSizes(t *testing.T) {
+	files := testFiles{
+		"disk-flat.vmdk": make([]byte, 3*1024*1024+100),
+		"other.vmdk":     make([]byte, 1024*1024),
+	}
+
+	// The first extent of the shared file ends where the second
+	// starts, so only the second is resized. The partial sector at the
+	// end of the file is not counted.
+	fixed, changes, err := FixExtentSizes(`# Extent description
+RW  1M   FLAT "disk-flat.vmdk" 0
+RW  2048 FLAT "disk-flat.vmdk" 2048   # annotated
+RW 2048 FLAT "other.vmdk" 0
+RW 100 ZERO
+`, files.Open)
+	if err != nil {
+		t.Fatalf("FixExtentSizes: %v", err)
+	}
+
+	expected := `# Extent description
+RW  1M   FLAT "disk-flat.vmdk" 0
+RW  4096 FLAT "disk-flat.vmdk" 2048   # annotated
+RW 2048 FLAT "other.vmdk" 0
+RW 100 ZERO
+`
+	if fixed != expected {
+		t.Fatalf("Unexpected descriptor:\n%v", fixed)
+	}
+
+	if len(changes) != 1 || changes[0] != (ExtentSizeChange{
+		Line: 3, Filename: "disk-flat.vmdk", Declared: 2048, Actual: 4096}) {
+		t.Fatalf("Unexpected changes %+v", changes)
+	}
+
+	_, _, err = FixExtentSizes(`RW 2048 FLAT "missing.vmdk" 0`, files.Open)
+	if err == nil {
+		t.Fatalf("Expected an error for a missing extent")
+	}
+}
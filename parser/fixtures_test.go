@@ -0,0 +1,138 @@
+package parser
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const testGrainSize = TEST_GRAIN_SIZE
+
+// A set of in memory files keyed by filename.
+type testFiles map[string][]byte
+
+func (self testFiles) Open(filename string) (io.ReaderAt, func(), error) {
+	data, pres := self[filename]
+	if !pres {
+		return nil, nil, errors.New("file not found: " + filename)
+	}
+	return bytes.NewReader(data), nil, nil
+}
+
+// An in memory io.WriterAt.
+type memWriterAt struct {
+	buf []byte
+}
+
+func (self *memWriterAt) WriteAt(buf []byte, offset int64) (int, error) {
+	end := offset + int64(len(buf))
+	if end > int64(len(self.buf)) {
+		self.buf = append(self.buf, make([]byte, end-int64(len(self.buf)))...)
+	}
+	copy(self.buf[offset:], buf)
+	return len(buf), nil
+}
+
+func openTestDisk(files testFiles, name string, opts ...Option) (
+	*VMDKContext, error) {
+	data := files[name]
+	return GetVMDKContext(bytes.NewReader(data), len(data), files.Open, opts...)
+}
+
+// buildStreamOptimized returns a streamOptimized disk of capacity bytes
+// with 64kb grains and the grain directory at the end.
+func buildStreamOptimized(capacity int64, grains map[int64][]byte) []byte {
+	le := binary.LittleEndian
+	grain_size := int64(128 * SECTOR_SIZE)
+
+	header := make([]byte, SECTOR_SIZE)
+	le.PutUint32(header[0:], SPARSE_MAGICNUMBER)
+	le.PutUint32(header[4:], 3)
+	le.PutUint32(header[8:], 1|FLAG_COMPRESSED|FLAG_MARKERS)
+	le.PutUint64(header[12:], uint64(capacity/SECTOR_SIZE))
+	le.PutUint64(header[20:], 128)
+	le.PutUint64(header[28:], 1)
+	le.PutUint64(header[36:], 1)
+	le.PutUint32(header[44:], 512)
+	le.PutUint64(header[56:], GD_AT_END)
+	le.PutUint64(header[64:], 2)
+	copy(header[73:], "\n \r\n")
+	le.PutUint16(header[77:], COMPRESSION_DEFLATE)
+
+	out := &bytes.Buffer{}
+	out.Write(header)
+
+	descriptor := make([]byte, SECTOR_SIZE)
+	copy(descriptor, fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=cafebabe
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "stream.vmdk"
+`, capacity/SECTOR_SIZE))
+	out.Write(descriptor)
+
+	pad := func() {
+		if out.Len()%SECTOR_SIZE != 0 {
+			out.Write(make([]byte, SECTOR_SIZE-out.Len()%SECTOR_SIZE))
+		}
+	}
+
+	writeMarker := func(sectors int64, marker_type uint32) {
+		marker := make([]byte, SECTOR_SIZE)
+		le.PutUint64(marker, uint64(sectors))
+		le.PutUint32(marker[12:], marker_type)
+		out.Write(marker)
+	}
+
+	var grain_numbers []int64
+	for k := range grains {
+		grain_numbers = append(grain_numbers, k)
+	}
+	sort.Slice(grain_numbers, func(i, j int) bool {
+		return grain_numbers[i] < grain_numbers[j]
+	})
+
+	gt := make([]byte, 4*SECTOR_SIZE)
+	for _, grain := range grain_numbers {
+		le.PutUint32(gt[grain*4:], uint32(out.Len()/SECTOR_SIZE))
+
+		compressed := &bytes.Buffer{}
+		w := zlib.NewWriter(compressed)
+		data := make([]byte, grain_size)
+		copy(data, grains[grain])
+		w.Write(data)
+		w.Close()
+
+		marker := make([]byte, 12)
+		le.PutUint64(marker, uint64(grain*grain_size/SECTOR_SIZE))
+		le.PutUint32(marker[8:], uint32(compressed.Len()))
+		out.Write(marker)
+		out.Write(compressed.Bytes())
+		pad()
+	}
+
+	writeMarker(4, MARKER_GT)
+	gt_sector := out.Len() / SECTOR_SIZE
+	out.Write(gt)
+
+	writeMarker(1, MARKER_GD)
+	gd_sector := out.Len() / SECTOR_SIZE
+	gd := make([]byte, SECTOR_SIZE)
+	le.PutUint32(gd, uint32(gt_sector))
+	out.Write(gd)
+
+	writeMarker(1, MARKER_FOOTER)
+	le.PutUint64(header[56:], uint64(gd_sector))
+	out.Write(header)
+
+	writeMarker(0, MARKER_EOS)
+
+	return out.Bytes()
+}
@@ -0,0 +1,65 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+)
+
+// A FLAT extent stores the data verbatim in the backing file starting
+// at file_offset.
+type FlatExtent struct {
+	reader io.ReaderAt
+
+	// Where the extent data starts in the backing file.
+	file_offset int64
+
+	total_size int64
+
+	// The offset in the logical image where this extent sits.
+	offset   int64
+	filename string
+
+	closer func()
+}
+
+func (self *FlatExtent) Close() {
+	if self.closer != nil {
+		self.closer()
+	}
+}
+
+func (self *FlatExtent) Debug() {
+	fmt.Printf("FLAT extent %v at %#x (%v bytes, file offset %#x)\n",
+		self.filename, self.offset, self.total_size, self.file_offset)
+}
+
+func (self *FlatExtent) TotalSize() int64 {
+	return self.total_size
+}
+
+func (self *FlatExtent) VirtualOffset() int64 {
+	return self.offset
+}
+
+func (self *FlatExtent) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 || offset >= self.total_size {
+		return 0, io.EOF
+	}
+
+	to_read := int64(len(buf))
+	available_length := self.total_size - offset
+	if to_read > available_length {
+		to_read = available_length
+	}
+
+	return self.reader.ReadAt(buf[:to_read], self.file_offset+offset)
+}
+
+func (self *FlatExtent) Stats() ExtentStat {
+	return ExtentStat{
+		Type:          "FLAT",
+		VirtualOffset: self.offset,
+		Size:          self.total_size,
+		Filename:      self.filename,
+	}
+}
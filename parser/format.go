@@ -0,0 +1,102 @@
+package parser
+
+import (
+	"io"
+	"strings"
+)
+
+const (
+	// Magic of ESX hosted sparse (COWD) extents.
+	COWD_MAGICNUMBER = 0x44574f43
+
+	// The low half of the 64 bit magic of seSparse extents.
+	SESPARSE_MAGICNUMBER = 0xcafebabe
+
+	FORMAT_DESCRIPTOR       = "descriptor"
+	FORMAT_SPARSE           = "hostedSparse"
+	FORMAT_STREAM_OPTIMIZED = "streamOptimized"
+	FORMAT_COWD             = "vmfsSparse"
+	FORMAT_SESPARSE         = "seSparse"
+	FORMAT_DATA             = "data"
+)
+
+// FormatInfo describes what kind of file a vmdk file is.
+type FormatInfo struct {
+	// One of the FORMAT_* constants. FORMAT_DATA is a file with no
+	// recognizable structure, usually a flat extent.
+	Format string `json:"Format"`
+
+	// The header version of sparse extents.
+	Version uint32 `json:"Version,omitempty"`
+
+	// Whether the file carries a descriptor, and whether it is
+	// embedded in a sparse extent.
+	HasDescriptor      bool `json:"HasDescriptor"`
+	EmbeddedDescriptor bool `json:"EmbeddedDescriptor"`
+}
+
+// DetectFormat examines the start of a vmdk file to determine whether
+// it is a text descriptor, a sparse extent or raw data.
+func DetectFormat(reader io.ReaderAt, size int64) (*FormatInfo, error) {
+	profile := NewVMDKProfile()
+	header := profile.SparseExtentHeader(reader, 0)
+
+	switch header.magicNumber() {
+	case SPARSE_MAGICNUMBER:
+		res := &FormatInfo{
+			Format:  FORMAT_SPARSE,
+			Version: header.version(),
+		}
+
+		if header.flags()&(FLAG_COMPRESSED|FLAG_MARKERS) ==
+			FLAG_COMPRESSED|FLAG_MARKERS {
+			res.Format = FORMAT_STREAM_OPTIMIZED
+		}
+
+		if header.descriptorOffset() != 0 && header.descriptorSize() != 0 {
+			res.HasDescriptor = true
+			res.EmbeddedDescriptor = true
+		}
+		return res, nil
+
+	case COWD_MAGICNUMBER:
+		return &FormatInfo{
+			Format:  FORMAT_COWD,
+			Version: header.version(),
+		}, nil
+
+	case SESPARSE_MAGICNUMBER:
+		return &FormatInfo{Format: FORMAT_SESPARSE}, nil
+	}
+
+	descriptor, err := ReadDescriptor(reader, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if looksLikeDescriptor(descriptor) {
+		return &FormatInfo{
+			Format:        FORMAT_DESCRIPTOR,
+			HasDescriptor: true,
+		}, nil
+	}
+
+	return &FormatInfo{Format: FORMAT_DATA}, nil
+}
+
+// A descriptor has the standard header comment or at least one extent
+// line.
+func looksLikeDescriptor(text string) bool {
+	if strings.HasPrefix(strings.TrimLeft(text, " \t\r\n"),
+		DESCRIPTOR_HEADER) {
+		return true
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		extent, _ := parseExtentLine(line)
+		if extent != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	sparse_disk := &memWriterAt{}
+	err := NewFlatContext(bytes.NewReader(make([]byte, 4096)), 4096).
+		WriteMonolithicSparse(context.Background(), sparse_disk, "disk.vmdk", nil)
+	if err != nil {
+		t.Fatalf("WriteMonolithicSparse: %v", err)
+	}
+
+	for _, c := range []struct {
+		data     []byte
+		expected FormatInfo
+	}{
+		{[]byte(baseDescriptor), FormatInfo{
+			Format: FORMAT_DESCRIPTOR, HasDescriptor: true}},
+		{sparse_disk.buf, FormatInfo{
+			Format: FORMAT_SPARSE, Version: 1,
+			HasDescriptor: true, EmbeddedDescriptor: true}},
+		{buildSparseExtent(1024*1024, nil), FormatInfo{
+			Format: FORMAT_SPARSE, Version: 1}},
+		{buildStreamOptimized(1024*1024, nil), FormatInfo{
+			Format: FORMAT_STREAM_OPTIMIZED, Version: 3,
+			HasDescriptor: true, EmbeddedDescriptor: true}},
+		{bytes.Repeat([]byte("data"), 1024), FormatInfo{
+			Format: FORMAT_DATA}},
+	} {
+		info, err := DetectFormat(bytes.NewReader(c.data), int64(len(c.data)))
+		if err != nil {
+			t.Fatalf("DetectFormat: %v", err)
+		}
+
+		if *info != c.expected {
+			t.Fatalf("Unexpected format %+v, expected %+v", info, c.expected)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Limits of the CHS geometry recorded in the disk database.
+const (
+	MAX_HEADS             = 255
+	MAX_SECTORS_PER_TRACK = 63
+
+	IDE_MAX_HEADS     = 16
+	IDE_MAX_CYLINDERS = 16383
+)
+
+// The values VMware accepts for ddb.adapterType.
+var AdapterTypes = []string{"ide", "buslogic", "lsilogic", "pvscsi"}
+
+func isAdapterType(adapter string) bool {
+	for _, i := range AdapterTypes {
+		if i == adapter {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultGeometry returns the geometry VMware records for a disk of
+// capacity sectors attached to adapter. IDE disks use 16 heads and cap
+// the cylinder count; SCSI disks use a BIOS style translation.
+func DefaultGeometry(adapter string, capacity int64) (
+	cylinders, heads, sectors int64) {
+	sectors = MAX_SECTORS_PER_TRACK
+
+	switch {
+	case adapter == "ide":
+		heads = IDE_MAX_HEADS
+	case capacity < 1<<30/SECTOR_SIZE:
+		heads, sectors = 64, 32
+	case capacity < 2<<30/SECTOR_SIZE:
+		heads, sectors = 128, 32
+	default:
+		heads = MAX_HEADS
+	}
+
+	cylinders = capacity / (heads * sectors)
+	if adapter == "ide" && cylinders > IDE_MAX_CYLINDERS {
+		cylinders = IDE_MAX_CYLINDERS
+	}
+	return cylinders, heads, sectors
+}
+
+// ValidateGeometry checks the adapter type and geometry in config
+// against a disk of capacity sectors. Each geometry value present must
+// be within the adapter's limits. When all three are present the
+// cylinder count must be the one implied by the capacity.
+func ValidateGeometry(config *VMDKConfig, capacity int64) error {
+	adapter, _ := config.Get("ddb.adapterType")
+	if adapter != "" && !isAdapterType(adapter) {
+		return fmt.Errorf("%w: unknown adapter type %q",
+			ErrInvalidGeometry, adapter)
+	}
+
+	max_heads := int64(MAX_HEADS)
+	max_cylinders := int64(-1)
+	if adapter == "ide" {
+		max_heads = IDE_MAX_HEADS
+		max_cylinders = IDE_MAX_CYLINDERS
+	}
+
+	var values []int64
+	for _, limit := range []struct {
+		key string
+		max int64
+	}{
+		{"ddb.geometry.cylinders", max_cylinders},
+		{"ddb.geometry.heads", max_heads},
+		{"ddb.geometry.sectors", MAX_SECTORS_PER_TRACK},
+	} {
+		value, pres := config.Get(limit.key)
+		if !pres {
+			continue
+		}
+
+		number, err := strconv.ParseInt(value, 0, 64)
+		if err != nil || number <= 0 {
+			return fmt.Errorf("%w: %v must be a positive number, not %q",
+				ErrInvalidGeometry, limit.key, value)
+		}
+
+		if limit.max > 0 && number > limit.max {
+			return fmt.Errorf("%w: %v is %v but at most %v is allowed for %v",
+				ErrInvalidGeometry, limit.key, number, limit.max, adapter)
+		}
+		values = append(values, number)
+	}
+
+	if len(values) < 3 {
+		return nil
+	}
+
+	cylinders, heads, sectors := values[0], values[1], values[2]
+	expected := capacity / (heads * sectors)
+	if max_cylinders > 0 && expected > max_cylinders {
+		expected = max_cylinders
+	}
+
+	if cylinders != expected {
+		return fmt.Errorf("%w: %v/%v/%v covers %v sectors but the disk has %v "+
+			"(expected %v cylinders)", ErrInvalidGeometry, cylinders, heads,
+			sectors, cylinders*heads*sectors, capacity, expected)
+	}
+
+	return nil
+}
+
+// The geometry recorded in the descriptor, which must have heads and
+// sectors. Cylinders may be missing, leaving the cylinder unbounded.
+func (self *VMDKContext) geometry() (cylinders, heads, sectors int64, err error) {
+	cylinders = self.config.DBBGeometryCylinders
+	heads = self.config.DBBGeometryHeads
+	sectors = self.config.DBBGeometrySectors
+	if heads <= 0 || sectors <= 0 || cylinders < 0 {
+		return 0, 0, 0, fmt.Errorf("%w: no geometry in the descriptor",
+			ErrInvalidGeometry)
+	}
+	return cylinders, heads, sectors, nil
+}
+
+// CHS returns the cylinder, head and sector of the sector holding
+// offset, using the geometry in the descriptor. Sectors are numbered
+// from 1 as in CHS addressing. Offsets past the cylinders the geometry
+// describes, e.g. on large IDE disks, have no CHS address.
+func (self *VMDKContext) CHS(offset int64) (
+	cylinder, head, sector int, err error) {
+	cylinders, heads, sectors, err := self.geometry()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if offset < 0 || offset >= self.total_size {
+		return 0, 0, 0, fmt.Errorf("%w: offset %#x is outside the disk",
+			ErrInvalidGeometry, offset)
+	}
+
+	lba := offset / SECTOR_SIZE
+	c := lba / (heads * sectors)
+	if cylinders > 0 && c >= cylinders {
+		return 0, 0, 0, fmt.Errorf(
+			"%w: offset %#x is past cylinder %v of the geometry",
+			ErrInvalidGeometry, offset, cylinders-1)
+	}
+
+	return int(c), int(lba / sectors % heads), int(lba%sectors + 1), nil
+}
+
+// CHSOffset is the inverse of CHS: it returns the offset of the sector
+// at the CHS address.
+func (self *VMDKContext) CHSOffset(cylinder, head, sector int) (int64, error) {
+	cylinders, heads, sectors, err := self.geometry()
+	if err != nil {
+		return 0, err
+	}
+
+	if cylinder < 0 || (cylinders > 0 && int64(cylinder) >= cylinders) ||
+		head < 0 || int64(head) >= heads ||
+		sector < 1 || int64(sector) > sectors {
+		return 0, fmt.Errorf("%w: %v/%v/%v is outside the geometry %v/%v/%v",
+			ErrInvalidGeometry, cylinder, head, sector,
+			cylinders, heads, sectors)
+	}
+
+	lba := (int64(cylinder)*heads+int64(head))*sectors + int64(sector) - 1
+	if lba*SECTOR_SIZE >= self.total_size {
+		return 0, fmt.Errorf("%w: %v/%v/%v is outside the disk",
+			ErrInvalidGeometry, cylinder, head, sector)
+	}
+	return lba * SECTOR_SIZE, nil
+}
@@ -0,0 +1,191 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateGeometry(t *testing.T) {
+	// 8GB and 64GB disks.
+	small := int64(8 << 30 / SECTOR_SIZE)
+	large := int64(64 << 30 / SECTOR_SIZE)
+
+	for _, tc := range []struct {
+		settings string
+		capacity int64
+		valid    bool
+	}{
+		{"ddb.adapterType=lsilogic", small, true},
+		{"ddb.adapterType=lsilogic ddb.geometry.cylinders=1044 " +
+			"ddb.geometry.heads=255 ddb.geometry.sectors=63", small, true},
+		{"ddb.adapterType=ide ddb.geometry.cylinders=16383 " +
+			"ddb.geometry.heads=16 ddb.geometry.sectors=63", small, true},
+
+		// IDE cylinders are capped for large disks.
+		{"ddb.adapterType=ide ddb.geometry.cylinders=16383 " +
+			"ddb.geometry.heads=16 ddb.geometry.sectors=63", large, true},
+
+		// Partial geometry is only checked against the limits.
+		{"ddb.adapterType=pvscsi ddb.geometry.heads=255", small, true},
+
+		{"ddb.adapterType=scsi", small, false},
+		{"ddb.adapterType=ide ddb.geometry.heads=255", small, false},
+		{"ddb.adapterType=ide ddb.geometry.cylinders=20000", small, false},
+		{"ddb.adapterType=buslogic ddb.geometry.sectors=64", small, false},
+		{"ddb.adapterType=buslogic ddb.geometry.heads=0", small, false},
+
+		// The geometry does not match the capacity.
+		{"ddb.adapterType=lsilogic ddb.geometry.cylinders=1044 " +
+			"ddb.geometry.heads=255 ddb.geometry.sectors=63", large, false},
+		{"ddb.adapterType=lsilogic ddb.geometry.cylinders=2000 " +
+			"ddb.geometry.heads=255 ddb.geometry.sectors=63", small, false},
+	} {
+		config := NewVMDKConfig()
+		for _, setting := range strings.Fields(tc.settings) {
+			parts := strings.SplitN(setting, "=", 2)
+			err := config.Set(parts[0], parts[1])
+			if err != nil {
+				t.Fatalf("Set %v: %v", setting, err)
+			}
+		}
+
+		err := ValidateGeometry(config, tc.capacity)
+		if tc.valid && err != nil {
+			t.Fatalf("%v: %v", tc.settings, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidGeometry) {
+			t.Fatalf("%v: expected an invalid geometry, got %v",
+				tc.settings, err)
+		}
+	}
+
+	// The default geometry is always valid.
+	for _, adapter := range AdapterTypes {
+		for _, capacity := range []int64{2048, 3 << 20, small, large} {
+			cylinders, heads, sectors := DefaultGeometry(adapter, capacity)
+			config := NewVMDKConfig()
+			config.Set("ddb.adapterType", adapter)
+			config.Set("ddb.geometry.cylinders", strconv.FormatInt(cylinders, 10))
+			config.Set("ddb.geometry.heads", strconv.FormatInt(heads, 10))
+			config.Set("ddb.geometry.sectors", strconv.FormatInt(sectors, 10))
+
+			err := ValidateGeometry(config, capacity)
+			if err != nil {
+				t.Fatalf("%v %v: %v", adapter, capacity, err)
+			}
+		}
+	}
+}
+
+func TestCreateWithGeometry(t *testing.T) {
+	size := int64(16 * 1024 * 1024)
+	source := NewFlatContext(bytes.NewReader(make([]byte, size)), size)
+	source.Config().Set("ddb.adapterType", "ide")
+
+	descriptor := &bytes.Buffer{}
+	err := source.WriteMonolithicFlat(context.Background(),
+		descriptor, &bytes.Buffer{}, "disk-flat.vmdk", nil)
+	if err != nil {
+		t.Fatalf("WriteMonolithicFlat: %v", err)
+	}
+
+	// 32768 sectors over 16 heads of 63 sectors.
+	config := ParseConfig(descriptor.String())
+	if config.DBBGeometryCylinders != 32 || config.DBBGeometryHeads != 16 ||
+		config.DBBGeometrySectors != 63 {
+		t.Fatalf("Unexpected default geometry: %+v", config)
+	}
+
+	// An explicit geometry which does not fit the disk is refused
+	// before anything is written.
+	source.Config().Set("ddb.geometry.cylinders", "1000")
+	source.Config().Set("ddb.geometry.heads", "16")
+	source.Config().Set("ddb.geometry.sectors", "63")
+
+	data := &bytes.Buffer{}
+	err = source.WriteMonolithicFlat(context.Background(),
+		&bytes.Buffer{}, data, "disk-flat.vmdk", nil)
+	if !errors.Is(err, ErrInvalidGeometry) || data.Len() > 0 {
+		t.Fatalf("Expected an invalid geometry, got %v", err)
+	}
+
+	// The same applies when changing an existing descriptor.
+	config = ParseConfig(descriptor.String())
+	config.Set("ddb.geometry.heads", "255")
+	err = WriteDescriptor(&bytes.Buffer{}, descriptor.String(), config)
+	if !errors.Is(err, ErrInvalidGeometry) {
+		t.Fatalf("Expected an invalid geometry, got %v", err)
+	}
+}
+
+func TestCHS(t *testing.T) {
+	// 2 cylinders of 16 heads and 63 sectors cover 2016 of the 2048
+	// sectors.
+	files := makeChainFiles()
+	files["chs.vmdk"] = []byte(baseDescriptor + `
+ddb.geometry.cylinders = "2"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+`)
+	vmdk, err := openTestDisk(files, "chs.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	for _, tc := range []struct {
+		lba                    int64
+		cylinder, head, sector int
+	}{
+		{0, 0, 0, 1},
+		{62, 0, 0, 63},
+		{63, 0, 1, 1},
+		{1007, 0, 15, 63},
+		{1008, 1, 0, 1},
+		{2015, 1, 15, 63},
+	} {
+		cylinder, head, sector, err := vmdk.CHS(tc.lba*SECTOR_SIZE + 7)
+		if err != nil || cylinder != tc.cylinder || head != tc.head ||
+			sector != tc.sector {
+			t.Fatalf("CHS of sector %v is %v/%v/%v (%v)", tc.lba,
+				cylinder, head, sector, err)
+		}
+
+		offset, err := vmdk.CHSOffset(cylinder, head, sector)
+		if err != nil || offset != tc.lba*SECTOR_SIZE {
+			t.Fatalf("CHSOffset(%v/%v/%v) is %#x (%v)", cylinder, head,
+				sector, offset, err)
+		}
+	}
+
+	// Past the last cylinder or outside the geometry.
+	for _, offset := range []int64{-1, 2016 * SECTOR_SIZE, vmdk.Size()} {
+		_, _, _, err = vmdk.CHS(offset)
+		if !errors.Is(err, ErrInvalidGeometry) {
+			t.Fatalf("Expected ErrInvalidGeometry for %#x, got %v", offset, err)
+		}
+	}
+
+	for _, chs := range [][3]int{{2, 0, 1}, {0, 16, 1}, {0, 0, 0}, {0, 0, 64}} {
+		_, err = vmdk.CHSOffset(chs[0], chs[1], chs[2])
+		if !errors.Is(err, ErrInvalidGeometry) {
+			t.Fatalf("Expected ErrInvalidGeometry for %v, got %v", chs, err)
+		}
+	}
+
+	// Without a geometry there are no CHS addresses.
+	base, err := openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer base.Close()
+
+	_, _, _, err = base.CHS(0)
+	if !errors.Is(err, ErrInvalidGeometry) {
+		t.Fatalf("Expected ErrInvalidGeometry without geometry, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package parser
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Size of the decompressed grain cache unless set with
+// WithDecompressedGrainCache.
+const DEFAULT_GRAIN_CACHE_SIZE = 4 * 1024 * 1024
+
+type grainKey struct {
+	extent Extent
+	grain  int64
+}
+
+type cachedGrain struct {
+	key  grainKey
+	data []byte
+
+	// Set atomically by hits since the grain was last considered for
+	// eviction.
+	referenced int32
+}
+
+// grainCache holds recently inflated grains so that consecutive small
+// reads from the same grain only decompress it once. Extents are read
+// only, so cached grains never go stale. Like grainTableCache, hits
+// only take the read lock and mark the grain referenced, and eviction
+// gives referenced grains a second chance.
+type grainCache struct {
+	mu sync.RWMutex
+
+	// Limit on the total size of the cached grains in bytes.
+	max_size int64
+	size     int64
+
+	// Most recently used grains are at the front.
+	lru   *list.List
+	items map[grainKey]*list.Element
+
+	hits, misses int64
+}
+
+func newGrainCache(max_size int64) *grainCache {
+	return &grainCache{
+		max_size: max_size,
+		lru:      list.New(),
+		items:    make(map[grainKey]*list.Element),
+	}
+}
+
+func (self *grainCache) get(key grainKey) ([]byte, bool) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	element, pres := self.items[key]
+	if !pres {
+		atomic.AddInt64(&self.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddInt64(&self.hits, 1)
+	item := element.Value.(*cachedGrain)
+	atomic.StoreInt32(&item.referenced, 1)
+	return item.data, true
+}
+
+func (self *grainCache) add(key grainKey, data []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if int64(len(data)) > self.max_size {
+		return
+	}
+
+	_, pres := self.items[key]
+	if pres {
+		return
+	}
+
+	self.items[key] = self.lru.PushFront(&cachedGrain{
+		key: key, data: data, referenced: 1})
+	self.size += int64(len(data))
+
+	for self.size > self.max_size {
+		oldest := self.lru.Back()
+		item := oldest.Value.(*cachedGrain)
+		if atomic.SwapInt32(&item.referenced, 0) == 1 {
+			self.lru.MoveToFront(oldest)
+			continue
+		}
+
+		self.lru.Remove(oldest)
+		delete(self.items, item.key)
+		self.size -= int64(len(item.data))
+	}
+}
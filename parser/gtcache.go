@@ -0,0 +1,232 @@
+package parser
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// With a metadata budget the grain directory is loaded in windows of
+// this many entries (2kb, the size of a grain table).
+const GD_WINDOW_ENTRIES = 512
+
+// A grain table, or a window of the grain directory, loaded into
+// memory. Directory windows are kept under negative indexes so they
+// share the LRU with the tables. Entries are kept as read from disk, 4
+// bytes each, and decoded on lookup. seSparse extents, whose entries
+// are 8 bytes, are refused by GetSparseExtent.
+type grainTable struct {
+	cache   *grainTableCache
+	index   int64
+	entries []byte
+
+	// Set atomically by lookups since the table was last considered
+	// for eviction.
+	referenced int32
+}
+
+// metadataBudget bounds the memory used by the grain table caches of
+// every extent in a chain. The caches share one LRU so the least
+// recently used metadata of any extent is evicted first.
+type metadataBudget struct {
+	mu  sync.RWMutex
+	lru *list.List
+
+	limit, used int64
+}
+
+func newMetadataBudget(limit int64) *metadataBudget {
+	return &metadataBudget{
+		lru:   list.New(),
+		limit: limit,
+	}
+}
+
+// grainTableCache keeps the most recently used grain tables of a
+// sparse extent in memory so random reads do not have to re-read them.
+// Without a budget the grain directory is small enough to be kept
+// whole. Lookups always return the on disk values whether or not they
+// end up cached.
+//
+// Hits only take the read lock so concurrent readers do not wait for
+// each other. Rather than moving to the front of the LRU a hit marks
+// the table referenced, and eviction gives referenced tables a second
+// chance.
+type grainTableCache struct {
+	// Shared with the budget if there is one.
+	mu  *sync.RWMutex
+	lru *list.List
+
+	budget *metadataBudget
+	max    int
+
+	tables map[int64]*list.Element
+
+	// The whole grain directory, loaded once.
+	gd      []byte
+	gd_once sync.Once
+
+	// Bytes of metadata held in memory.
+	bytes int64
+
+	hits, misses, evictions int64
+}
+
+func newGrainTableCache(max int, budget *metadataBudget) *grainTableCache {
+	res := &grainTableCache{
+		mu:     &sync.RWMutex{},
+		lru:    list.New(),
+		budget: budget,
+		max:    max,
+		tables: make(map[int64]*list.Element),
+	}
+
+	if budget != nil {
+		res.mu = &budget.mu
+		res.lru = budget.lru
+	}
+	return res
+}
+
+// Read count 4 byte entries at offset. Anything past the end of the
+// file reads as 0.
+func readEntries(extent *SparseExtent, offset, count int64) []byte {
+	res := make([]byte, count*4)
+	n, _ := extent.metadata.ReadAt(res, offset)
+	zeroFill(res[n:])
+	return res
+}
+
+// The entry at index, 0 past the end.
+func entryAt(entries []byte, index int64) uint32 {
+	if index < 0 || index >= int64(len(entries))/4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(entries[index*4:])
+}
+
+func (self *grainTableCache) directoryEntry(
+	extent *SparseExtent, index int64) uint32 {
+	num_gts := (extent.total_size + extent.grain_table_coverage - 1) /
+		extent.grain_table_coverage
+	if index < 0 || index >= num_gts {
+		return 0
+	}
+
+	if self.budget != nil {
+		window := index / GD_WINDOW_ENTRIES
+		entries, _ := self.lookup(-1-window, func() []byte {
+			count := num_gts - window*GD_WINDOW_ENTRIES
+			if count > GD_WINDOW_ENTRIES {
+				count = GD_WINDOW_ENTRIES
+			}
+			return readEntries(extent,
+				extent.gde_offset+window*GD_WINDOW_ENTRIES*4, count)
+		})
+		return entryAt(entries, index%GD_WINDOW_ENTRIES)
+	}
+
+	self.gd_once.Do(func() {
+		self.gd = readEntries(extent, extent.gde_offset, num_gts)
+		atomic.AddInt64(&self.bytes, num_gts*4)
+	})
+	return entryAt(self.gd, index)
+}
+
+func (self *grainTableCache) tableEntry(extent *SparseExtent,
+	gde uint32, index, entry int64) uint32 {
+	entries, hit := self.lookup(index, func() []byte {
+		return readEntries(extent, int64(gde)*SECTOR_SIZE,
+			int64(extent.header.numGTEsPerGT()))
+	})
+
+	if hit {
+		atomic.AddInt64(&self.hits, 1)
+	} else {
+		atomic.AddInt64(&self.misses, 1)
+	}
+
+	return entryAt(entries, entry)
+}
+
+// Return the cached entries under index, or load and cache them.
+func (self *grainTableCache) lookup(index int64,
+	load func() []byte) (entries []byte, hit bool) {
+	self.mu.RLock()
+	element, pres := self.tables[index]
+	if pres {
+		table := element.Value.(*grainTable)
+		atomic.StoreInt32(&table.referenced, 1)
+		self.mu.RUnlock()
+		return table.entries, true
+	}
+	self.mu.RUnlock()
+
+	// Read without the lock so extents sharing a budget do not wait
+	// for each other.
+	entries = load()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// Another reader loaded it in the meantime.
+	element, pres = self.tables[index]
+	if pres {
+		table := element.Value.(*grainTable)
+		atomic.StoreInt32(&table.referenced, 1)
+		return table.entries, false
+	}
+
+	size := int64(len(entries))
+	if self.budget != nil {
+		if size > self.budget.limit {
+			return entries, false
+		}
+		self.budget.used += size
+	}
+
+	// New tables start referenced so they are not the first to go.
+	self.tables[index] = self.lru.PushFront(&grainTable{
+		cache:      self,
+		index:      index,
+		entries:    entries,
+		referenced: 1,
+	})
+	atomic.AddInt64(&self.bytes, size)
+
+	self.evict()
+	return entries, false
+}
+
+// Drop the least recently used metadata until the cache is within its
+// limits. Must be called with the lock held.
+func (self *grainTableCache) evict() {
+	for self.lru.Len() > 0 {
+		if self.budget != nil && self.budget.used <= self.budget.limit {
+			return
+		}
+		if self.budget == nil && self.lru.Len() <= self.max {
+			return
+		}
+
+		oldest := self.lru.Back()
+		table := oldest.Value.(*grainTable)
+
+		// Used since it was last looked at - keep it for now.
+		if atomic.SwapInt32(&table.referenced, 0) == 1 {
+			self.lru.MoveToFront(oldest)
+			continue
+		}
+
+		size := int64(len(table.entries))
+
+		self.lru.Remove(oldest)
+		delete(table.cache.tables, table.index)
+		atomic.AddInt64(&table.cache.bytes, -size)
+		atomic.AddInt64(&table.cache.evictions, 1)
+		if self.budget != nil {
+			self.budget.used -= size
+		}
+	}
+}
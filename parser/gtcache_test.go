@@ -0,0 +1,325 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// A fully allocated sparse extent of any size generated on the fly.
+// Every grain holds its grain number. Reads are counted.
+type syntheticSparse struct {
+	capacity      int64
+	grain_sectors int64
+	gd_sector     int64
+	gt_sector     int64
+	overhead      int64
+	header        []byte
+
+	reads int64
+}
+
+func newSyntheticSparse(capacity int64) *syntheticSparse {
+	return newSyntheticSparseWithGrainSize(capacity, 8)
+}
+
+func newSyntheticSparseWithGrainSize(
+	capacity, grain_sectors int64) *syntheticSparse {
+	coverage := 512 * grain_sectors * SECTOR_SIZE
+	num_gts := (capacity + coverage - 1) / coverage
+	gd_sectors := (num_gts*4 + SECTOR_SIZE - 1) / SECTOR_SIZE
+	res := &syntheticSparse{
+		capacity:      capacity,
+		grain_sectors: grain_sectors,
+		gd_sector:     1,
+		gt_sector:     1 + gd_sectors,
+		overhead:      1 + gd_sectors + num_gts*4,
+	}
+
+	// Reuse the header of a small extent with our size and layout.
+	res.header = buildSparseExtent(TEST_GRAIN_SIZE, nil)[:SECTOR_SIZE]
+	binary.LittleEndian.PutUint64(res.header[12:], uint64(capacity/SECTOR_SIZE))
+	binary.LittleEndian.PutUint64(res.header[20:], uint64(grain_sectors))
+	binary.LittleEndian.PutUint64(res.header[64:], uint64(res.overhead))
+	return res
+}
+
+// The 32 bit word at sector*SECTOR_SIZE + 4*word.
+func (self *syntheticSparse) word(offset int64) uint32 {
+	sector := offset / SECTOR_SIZE
+	switch {
+	case sector < self.gd_sector:
+		return binary.LittleEndian.Uint32(self.header[offset:])
+
+	case sector < self.gt_sector:
+		gt := (offset - self.gd_sector*SECTOR_SIZE) / 4
+		return uint32(self.gt_sector + gt*4)
+
+	case sector < self.overhead:
+		grain := (offset - self.gt_sector*SECTOR_SIZE) / 4
+		return uint32(self.overhead + grain*self.grain_sectors)
+
+	default:
+		return uint32((sector - self.overhead) / self.grain_sectors)
+	}
+}
+
+func (self *syntheticSparse) ReadAt(buf []byte, offset int64) (int, error) {
+	atomic.AddInt64(&self.reads, 1)
+
+	var word [4]byte
+	for i := range buf {
+		pos := offset + int64(i)
+		binary.LittleEndian.PutUint32(word[:], self.word(pos-pos%4))
+		buf[i] = word[pos%4]
+	}
+	return len(buf), nil
+}
+
+func newSyntheticDisk(t testing.TB, reader *syntheticSparse,
+	opts ...Option) *VMDKContext {
+	descriptor := []byte(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW 1 SPARSE "synthetic.vmdk"
+`)
+	vmdk, err := GetVMDKContext(bytes.NewReader(descriptor), len(descriptor),
+		func(filename string) (io.ReaderAt, func(), error) {
+			return reader, nil, nil
+		}, opts...)
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	return vmdk
+}
+
+func TestGrainTableCache(t *testing.T) {
+	capacity := int64(64 * 1024 * 1024)
+	uncached := newSyntheticDisk(t, newSyntheticSparse(capacity))
+	cached := newSyntheticDisk(t, newSyntheticSparse(capacity),
+		WithGrainTableCache(4))
+
+	// Reads agree with and without the cache.
+	a := make([]byte, 3*TEST_GRAIN_SIZE)
+	b := make([]byte, 3*TEST_GRAIN_SIZE)
+	for i := 0; i < 200; i++ {
+		offset := rand.Int63n(capacity - int64(len(a)))
+		uncached.ReadAt(a, offset)
+		cached.ReadAt(b, offset)
+		if !bytes.Equal(a, b) {
+			t.Fatalf("Cached read at %#x differs", offset)
+		}
+	}
+
+	if uncached.Metrics() != (Metrics{}) {
+		t.Fatalf("Unexpected metrics without a cache %+v", uncached.Metrics())
+	}
+
+	// Grain tables cover 2mb. Reading grains of the same table hits
+	// the cache.
+	cached = newSyntheticDisk(t, newSyntheticSparse(capacity),
+		WithGrainTableCache(2))
+	coverage := int64(512 * TEST_GRAIN_SIZE)
+	for _, offset := range []int64{
+		0, TEST_GRAIN_SIZE, coverage, 2 * coverage, 0} {
+		cached.ReadAt(b[:1], offset)
+	}
+
+	metrics := cached.Metrics()
+	if metrics.GrainTableHits != 1 || metrics.GrainTableMisses != 4 ||
+		metrics.GrainTableEvictions != 2 {
+		t.Fatalf("Unexpected metrics %+v", metrics)
+	}
+
+	// Concurrent readers share the cache.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 4)
+			for j := 0; j < 500; j++ {
+				grain := rand.Int63n(capacity / TEST_GRAIN_SIZE)
+				cached.ReadAt(buf, grain*TEST_GRAIN_SIZE)
+				if binary.LittleEndian.Uint32(buf) != uint32(grain) {
+					t.Errorf("Grain %v read %v", grain,
+						binary.LittleEndian.Uint32(buf))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Random 4k reads over a 100gb disk.
+func benchmarkRandomReads(b *testing.B, opts ...Option) {
+	capacity := int64(100) << 30
+	reader := newSyntheticSparse(capacity)
+	vmdk := newSyntheticDisk(b, reader, opts...)
+
+	buf := make([]byte, 4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vmdk.ReadAt(buf, rand.Int63n(capacity/4096)*4096)
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&reader.reads))/float64(b.N),
+		"reads/op")
+}
+
+func BenchmarkRandomReadsNoCache(b *testing.B) {
+	benchmarkRandomReads(b)
+}
+
+func BenchmarkRandomReadsGrainTableCache(b *testing.B) {
+	benchmarkRandomReads(b, WithGrainTableCache(64*1024))
+}
+
+func TestMetadataBudget(t *testing.T) {
+	// The grain directory of a 1tb disk alone is 2mb.
+	capacity := int64(1) << 40
+	budget := int64(64 * 1024)
+	vmdk := newSyntheticDisk(t, newSyntheticSparse(capacity),
+		WithMetadataBudget(budget))
+
+	buf := make([]byte, 4)
+	for i := 0; i < 2000; i++ {
+		grain := rand.Int63n(capacity / TEST_GRAIN_SIZE)
+
+		// Revisit a few grains so some lookups hit the cache.
+		if i%4 == 0 {
+			grain %= 4096
+		}
+
+		_, err := vmdk.ReadAt(buf, grain*TEST_GRAIN_SIZE)
+		if err != nil {
+			t.Fatalf("ReadAt: %v", err)
+		}
+		if binary.LittleEndian.Uint32(buf) != uint32(grain) {
+			t.Fatalf("Grain %v read %v", grain, binary.LittleEndian.Uint32(buf))
+		}
+
+		metrics := vmdk.Metrics()
+		if metrics.MetadataBytes > budget {
+			t.Fatalf("Metadata uses %v bytes", metrics.MetadataBytes)
+		}
+	}
+
+	metrics := vmdk.Metrics()
+	if metrics.GrainTableHits == 0 || metrics.GrainTableEvictions == 0 ||
+		metrics.MetadataBytes == 0 {
+		t.Fatalf("Unexpected metrics %+v", metrics)
+	}
+}
+
+// Random 4kb reads of the first span bytes of the disk from several
+// goroutines at once. Throughput should scale with the readers as
+// long as there are cores for them.
+func benchmarkConcurrentReaders(b *testing.B, vmdk *VMDKContext, span int64) {
+	for _, readers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("readers=%v", readers), func(b *testing.B) {
+			b.SetBytes(4096)
+
+			var next int64
+			var wg sync.WaitGroup
+			for i := 0; i < readers; i++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+
+					rng := rand.New(rand.NewSource(seed))
+					buf := make([]byte, 4096)
+					for atomic.AddInt64(&next, 1) <= int64(b.N) {
+						vmdk.ReadAt(buf, rng.Int63n(span/4096)*4096)
+					}
+				}(int64(i))
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func BenchmarkConcurrentReaders(b *testing.B) {
+	// Every grain of a 16mb sparse extent is allocated and its grain
+	// tables are cached.
+	capacity := int64(16 * 1024 * 1024)
+	grains := map[int64][]byte{}
+	for i := int64(0); i < capacity/TEST_GRAIN_SIZE; i++ {
+		grains[i] = bytes.Repeat([]byte{byte(i)}, TEST_GRAIN_SIZE)
+	}
+	files := testFiles{"test.vmdk": buildSparseExtent(capacity, grains)}
+	descriptor := fmt.Sprintf("# Disk DescriptorFile\n"+
+		"# Extent description\nRW %v SPARSE \"test.vmdk\"\n",
+		capacity/SECTOR_SIZE)
+
+	sparse, err := GetVMDKContext(strings.NewReader(descriptor),
+		len(descriptor), files.Open, WithGrainTableCache(64))
+	if err != nil {
+		b.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer sparse.Close()
+
+	b.Run("sparse", func(b *testing.B) {
+		benchmarkConcurrentReaders(b, sparse, capacity)
+	})
+
+	// All the grains of a streamOptimized disk fit in the grain cache.
+	stream, err := OpenStreamOptimized(bytes.NewReader(compressedFixture(64)),
+		WithDecompressedGrainCache(64*128*SECTOR_SIZE))
+	if err != nil {
+		b.Fatalf("OpenStreamOptimized: %v", err)
+	}
+	defer stream.Close()
+
+	b.Run("stream", func(b *testing.B) {
+		benchmarkConcurrentReaders(b, stream, stream.Size())
+	})
+}
+
+// Memory held and allocated for the grain metadata of a fully allocated
+// monolithicSparse disk of almost 2TB with the usual 64kb grains. Run
+// with -benchtime=1x.
+func BenchmarkMetadataFootprint(b *testing.B) {
+	grain_sectors := int64(128)
+	coverage := 512 * grain_sectors * SECTOR_SIZE
+	capacity := int64(2<<40) - 8*coverage
+	num_gts := capacity / coverage
+
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		vmdk := newSyntheticDisk(b,
+			newSyntheticSparseWithGrainSize(capacity, grain_sectors),
+			WithGrainTableCache(int(num_gts)))
+		for gt := int64(0); gt < num_gts; gt++ {
+			buf := make([]byte, 4)
+			_, err := vmdk.ReadAt(buf, gt*coverage)
+			if err != nil {
+				b.Fatalf("ReadAt: %v", err)
+			}
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		if vmdk.Metrics().MetadataBytes != num_gts*(2048+4) {
+			b.Fatalf("Unexpected metrics %+v", vmdk.Metrics())
+		}
+		vmdk.Close()
+	}
+
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc), "held-bytes")
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc), "alloc-bytes")
+}
@@ -0,0 +1,176 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Remote reads are expensive so HTTPOpener caches larger pages than
+// DirectoryOpener, up to 64mb per file.
+const (
+	HTTP_PAGE_SIZE  = 64 * 1024
+	HTTP_PAGE_COUNT = 1024
+
+	// Transient failures are retried this many times, waiting
+	// HTTP_BACKOFF and then twice as long each time.
+	HTTP_RETRIES = 3
+	HTTP_BACKOFF = 200 * time.Millisecond
+)
+
+// ErrRangeNotSupported is returned when a server answers a range
+// request with the whole file.
+var ErrRangeNotSupported = errors.New("Server does not support range requests")
+
+// HTTPOpener returns an Opener for files below baseURL, e.g. a
+// descriptor's directory in an evidence store. Nothing is downloaded
+// up front: the size of each file comes from a HEAD request and reads
+// are ranged GETs through a page cache, so opening a large image only
+// transfers the metadata it needs. Network errors and 5xx or 429
+// responses are retried with backoff. A nil client uses
+// http.DefaultClient.
+func HTTPOpener(baseURL string, client *http.Client) Opener {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	return func(filename string) (io.ReaderAt, func(), error) {
+		base, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("While parsing %v: %w", baseURL, err)
+		}
+
+		reader := &httpReader{
+			client: client,
+			url:    base.ResolveReference(&url.URL{Path: filename}).String(),
+		}
+
+		err = reader.stat()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return NewCachingReaderAt(reader, HTTP_PAGE_SIZE, HTTP_PAGE_COUNT),
+			nil, nil
+	}
+}
+
+// Reads a remote file with range requests.
+type httpReader struct {
+	client *http.Client
+	url    string
+	size   int64
+}
+
+func (self *httpReader) Size() int64 {
+	return self.size
+}
+
+// Get the size of the file with a HEAD request.
+func (self *httpReader) stat() error {
+	return retryTransient(HTTP_RETRIES, HTTP_BACKOFF, func() (bool, error) {
+		resp, err := self.client.Head(self.url)
+		if err != nil {
+			return true, fmt.Errorf("While opening %v: %w", self.url, err)
+		}
+		resp.Body.Close()
+
+		err = self.checkStatus(resp, http.StatusOK)
+		if err != nil {
+			return isTransientStatus(resp.StatusCode), err
+		}
+
+		if resp.ContentLength < 0 {
+			return false, fmt.Errorf("While opening %v: no Content-Length",
+				self.url)
+		}
+
+		self.size = resp.ContentLength
+		return false, nil
+	})
+}
+
+func (self *httpReader) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 || offset >= self.size {
+		return 0, io.EOF
+	}
+
+	to_read := int64(len(buf))
+	if to_read > self.size-offset {
+		to_read = self.size - offset
+	}
+
+	if to_read == 0 {
+		return 0, nil
+	}
+
+	err := retryTransient(HTTP_RETRIES, HTTP_BACKOFF, func() (bool, error) {
+		req, err := http.NewRequest("GET", self.url, nil)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Range",
+			fmt.Sprintf("bytes=%d-%d", offset, offset+to_read-1))
+
+		resp, err := self.client.Do(req)
+		if err != nil {
+			return true, fmt.Errorf("While reading %v at %#x: %w",
+				self.url, offset, err)
+		}
+		defer resp.Body.Close()
+
+		// A server ignoring the range sends the whole file, which is
+		// only what we asked for if we asked for all of it.
+		if resp.StatusCode == http.StatusOK &&
+			(offset != 0 || to_read != self.size) {
+			return false, fmt.Errorf("%w: %v", ErrRangeNotSupported, self.url)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = self.checkStatus(resp, http.StatusPartialContent)
+			if err != nil {
+				return isTransientStatus(resp.StatusCode), err
+			}
+		}
+
+		_, err = io.ReadFull(resp.Body, buf[:to_read])
+		if err != nil {
+			return true, fmt.Errorf("While reading %v at %#x: %w",
+				self.url, offset, err)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if to_read < int64(len(buf)) {
+		return int(to_read), io.EOF
+	}
+	return int(to_read), nil
+}
+
+// A missing file wraps os.ErrNotExist like other openers.
+func (self *httpReader) checkStatus(resp *http.Response, expected int) error {
+	switch resp.StatusCode {
+	case expected:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("While opening %v: %w", self.url, os.ErrNotExist)
+	default:
+		return fmt.Errorf("While opening %v: %v", self.url, resp.Status)
+	}
+}
+
+func isTransientStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
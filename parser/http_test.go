@@ -0,0 +1,122 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves files with range support, counting the bytes sent.
+func newTestHTTPServer(files testFiles, sent *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, pres := files[strings.TrimPrefix(r.URL.Path, "/disks/")]
+			if !pres {
+				http.NotFound(w, r)
+				return
+			}
+
+			counter := &countingResponseWriter{ResponseWriter: w, sent: sent}
+			http.ServeContent(counter, r, "", time.Time{}, bytes.NewReader(data))
+		}))
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	sent *int64
+}
+
+func (self *countingResponseWriter) Write(buf []byte) (int, error) {
+	atomic.AddInt64(self.sent, int64(len(buf)))
+	return self.ResponseWriter.Write(buf)
+}
+
+func TestHTTPOpener(t *testing.T) {
+	// A large thin disk with data at the start and end.
+	capacity := int64(1024 * 1024 * 1024)
+	last := capacity/testGrainSize - 1
+	files := makeChainFiles()
+	files["base-data.vmdk"] = buildSparseExtent(capacity, map[int64][]byte{
+		0:    bytes.Repeat([]byte("B"), testGrainSize),
+		last: bytes.Repeat([]byte("E"), testGrainSize),
+	})
+	files["base.vmdk"] = []byte(strings.Replace(baseDescriptor,
+		"RW 2048", "RW 2097152", 1))
+
+	var sent int64
+	server := newTestHTTPServer(files, &sent)
+	defer server.Close()
+
+	opener := HTTPOpener(server.URL+"/disks", nil)
+	vmdk, err := GetVMDKContextFromOpener(opener, "base.vmdk",
+		WithGrainBoundsCheck())
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromOpener: %v", err)
+	}
+	defer vmdk.Close()
+
+	for _, c := range []struct {
+		offset   int64
+		expected string
+	}{
+		{0, "B"},
+		{last * testGrainSize, "E"},
+		{capacity / 2, "\x00"},
+	} {
+		buf := make([]byte, testGrainSize)
+		_, err = vmdk.ReadAt(buf, c.offset)
+		if err != nil || !bytes.Equal(buf,
+			bytes.Repeat([]byte(c.expected), testGrainSize)) {
+			t.Fatalf("Unexpected data at %#x: %v", c.offset, err)
+		}
+	}
+
+	// Only some metadata and the grains read were transferred.
+	if atomic.LoadInt64(&sent) > 2*1024*1024 {
+		t.Fatalf("Transferred %v bytes", sent)
+	}
+
+	// Missing files are reported like local ones.
+	_, _, err = opener("missing.vmdk")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestHTTPOpenerErrors(t *testing.T) {
+	data := bytes.Repeat([]byte("X"), 2*HTTP_PAGE_SIZE)
+
+	// The first two requests fail, then the range header is ignored.
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprintf("%v", len(data)))
+			w.Write(data)
+		}))
+	defer server.Close()
+
+	reader, _, err := HTTPOpener(server.URL, nil)("disk.vmdk")
+	if err != nil {
+		t.Fatalf("Expected the HEAD request to be retried: %v", err)
+	}
+
+	if readerSize(reader) != int64(len(data)) {
+		t.Fatalf("Unexpected size %v", readerSize(reader))
+	}
+
+	_, err = reader.ReadAt(make([]byte, 512), HTTP_PAGE_SIZE)
+	if !errors.Is(err, ErrRangeNotSupported) {
+		t.Fatalf("Expected ErrRangeNotSupported, got %v", err)
+	}
+}
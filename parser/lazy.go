@@ -0,0 +1,372 @@
+package parser
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// An open extent file shared by readers. It is closed once evicted
+// and no longer in use.
+type extentHandle struct {
+	owner  *lazyExtent
+	extent Extent
+
+	// Readers using the handle, changed atomically.
+	refs int32
+
+	// Set atomically by readers since the handle was last considered
+	// for eviction.
+	referenced int32
+
+	// Only changed with the write lock held.
+	evicted bool
+}
+
+// handleCache keeps at most max extent files open. The least recently
+// used handle is closed to make room, giving recently referenced ones a
+// second chance as in grainTableCache. Failed opens are not cached so
+// the next read tries again. A single cache is shared by every disk in
+// a snapshot chain so the limit holds for the whole chain.
+type handleCache struct {
+	mu  sync.RWMutex
+	max int
+
+	// Most recently used handles are at the front.
+	lru     *list.List
+	handles map[*lazyExtent]*list.Element
+
+	// Extents being opened.
+	opening map[*lazyExtent]*extentOpen
+
+	// Files opened, opened again after being closed to make room, and
+	// closed to make room.
+	opens     int64
+	reopens   int64
+	evictions int64
+}
+
+func newHandleCache(max int) *handleCache {
+	return &handleCache{
+		max:     max,
+		lru:     list.New(),
+		handles: make(map[*lazyExtent]*list.Element),
+		opening: make(map[*lazyExtent]*extentOpen),
+	}
+}
+
+// An open in progress. err is set before done is closed.
+type extentOpen struct {
+	done chan struct{}
+	err  error
+}
+
+// Get the open extent for owner, opening it if needed. The handle must
+// be released after use. Files are opened without the lock held so a
+// slow open does not stall reads of other extents. Concurrent readers
+// of an extent being opened wait for that open.
+func (self *handleCache) get(owner *lazyExtent) (*extentHandle, error) {
+	self.mu.RLock()
+	element, pres := self.handles[owner]
+	if pres {
+		handle := element.Value.(*extentHandle)
+		atomic.AddInt32(&handle.refs, 1)
+		atomic.StoreInt32(&handle.referenced, 1)
+		self.mu.RUnlock()
+		return handle, nil
+	}
+	self.mu.RUnlock()
+
+	for {
+		self.mu.Lock()
+
+		// Another reader opened it in the meantime.
+		element, pres = self.handles[owner]
+		if pres {
+			handle := element.Value.(*extentHandle)
+			atomic.AddInt32(&handle.refs, 1)
+			atomic.StoreInt32(&handle.referenced, 1)
+			self.mu.Unlock()
+			return handle, nil
+		}
+
+		pending, pres := self.opening[owner]
+		if !pres {
+			break
+		}
+		self.mu.Unlock()
+
+		// The handle may already be evicted once the open completes,
+		// so look again.
+		<-pending.done
+		if pending.err != nil {
+			return nil, pending.err
+		}
+	}
+
+	pending := &extentOpen{done: make(chan struct{})}
+	self.opening[owner] = pending
+	self.mu.Unlock()
+
+	extent, err := owner.open()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	delete(self.opening, owner)
+	pending.err = err
+	close(pending.done)
+
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&self.opens, 1)
+	if owner.opened {
+		atomic.AddInt64(&self.reopens, 1)
+	}
+	owner.opened = true
+
+	handle := &extentHandle{
+		owner: owner, extent: extent, refs: 1, referenced: 1}
+	self.handles[owner] = self.lru.PushFront(handle)
+
+	for self.lru.Len() > self.max {
+		oldest := self.lru.Back()
+		evicted := oldest.Value.(*extentHandle)
+		if atomic.SwapInt32(&evicted.referenced, 0) == 1 {
+			self.lru.MoveToFront(oldest)
+			continue
+		}
+
+		self.lru.Remove(oldest)
+		atomic.AddInt64(&self.evictions, 1)
+
+		delete(self.handles, evicted.owner)
+		evicted.evicted = true
+		if atomic.LoadInt32(&evicted.refs) == 0 {
+			evicted.extent.Close()
+		}
+	}
+
+	return handle, nil
+}
+
+// The last reader of an evicted handle closes it. Eviction holds the
+// write lock so it can not race with this.
+func (self *handleCache) release(handle *extentHandle) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	if atomic.AddInt32(&handle.refs, -1) == 0 && handle.evicted {
+		handle.extent.Close()
+	}
+}
+
+// The number of extent files currently open.
+func (self *handleCache) count() int {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	return self.lru.Len()
+}
+
+// Close all the open handles. Panics closing them are returned.
+func (self *handleCache) Close() []error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	var errs []error
+	for _, element := range self.handles {
+		handle := element.Value.(*extentHandle)
+		handle.evicted = true
+		if atomic.LoadInt32(&handle.refs) == 0 {
+			err := safeClose(handle.extent.Close)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	self.lru.Init()
+	self.handles = make(map[*lazyExtent]*list.Element)
+	return errs
+}
+
+// A lazyExtent opens its file on first use. Its size comes from the
+// descriptor rather than the extent header.
+type lazyExtent struct {
+	handles *handleCache
+	opener  Opener
+	options *options
+
+	extent_type string
+	filename    string
+	file_offset int64
+	total_size  int64
+
+	// Set if the grain directory and tables are in a separate file.
+	metadata_filename string
+
+	// The offset in the logical image where this extent sits.
+	offset int64
+
+	// Unallocated grains are read from the parent disk if present.
+	parent *VMDKContext
+
+	// Kept across reopening the file.
+	gt_cache *grainTableCache
+
+	// Set once the file was opened, under the handle cache lock.
+	opened bool
+
+	// The grain size of a sparse extent once its header was read,
+	// accessed atomically.
+	grain_size int64
+}
+
+func (self *lazyExtent) Close() {}
+
+func (self *lazyExtent) Debug() {
+	fmt.Printf("%v extent %v at %#x (%v bytes, opened on demand)\n",
+		self.extent_type, self.filename, self.offset, self.total_size)
+}
+
+func (self *lazyExtent) TotalSize() int64 {
+	return self.total_size
+}
+
+func (self *lazyExtent) VirtualOffset() int64 {
+	return self.offset
+}
+
+func (self *lazyExtent) Stats() ExtentStat {
+	return ExtentStat{
+		Type:          self.extent_type,
+		VirtualOffset: self.offset,
+		Size:          self.total_size,
+		Filename:      self.filename,
+	}
+}
+
+func (self *lazyExtent) open() (Extent, error) {
+	reader, closer, err := self.options.open(self.opener, self.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch self.extent_type {
+	case "SPARSE":
+		extent, err := openSparseExtent(self.opener, self.options,
+			reader, closer, self.metadata_filename)
+		if err != nil {
+			return nil, err
+		}
+
+		atomic.StoreInt64(&self.grain_size, extent.grain_size)
+		extent.offset = self.offset
+		extent.filename = self.filename
+		extent.gt_cache = self.gt_cache
+		if self.options.grain_bounds_check {
+			extent.file_size = readerSize(reader)
+		}
+		if self.parent != nil {
+			extent.parent = self.parent
+		}
+		return extent, nil
+
+	default:
+		return &FlatExtent{
+			reader:      reader,
+			file_offset: self.file_offset,
+			total_size:  self.total_size,
+			offset:      self.offset,
+			filename:    self.filename,
+			closer:      closer,
+		}, nil
+	}
+}
+
+// The grain size of a sparse extent, opening the file to read its
+// header if it was not opened yet. Other extents and files which can
+// not be opened return 0.
+func (self *lazyExtent) grainSize() int64 {
+	if self.extent_type != "SPARSE" {
+		return 0
+	}
+
+	grain_size := atomic.LoadInt64(&self.grain_size)
+	if grain_size > 0 {
+		return grain_size
+	}
+
+	handle, err := self.handles.get(self)
+	if err != nil {
+		return 0
+	}
+	self.handles.release(handle)
+
+	return atomic.LoadInt64(&self.grain_size)
+}
+
+func (self *lazyExtent) ReadAt(buf []byte, offset int64) (int, error) {
+	handle, err := self.handles.get(self)
+	if err != nil {
+		if !self.options.zero_fill_missing {
+			return 0, fmt.Errorf("While opening %v: %w", self.filename, err)
+		}
+
+		// The extent's data is not available - read it as zeros.
+		to_read := int64(len(buf))
+		if to_read > self.total_size-offset {
+			to_read = self.total_size - offset
+		}
+		zeroFill(buf[:to_read])
+		return int(to_read), nil
+	}
+	defer self.handles.release(handle)
+
+	return handle.extent.ReadAt(buf, offset)
+}
+
+func (self *lazyExtent) allocatedRanges() []Range {
+	whole := []Range{{Offset: 0, Length: self.total_size}}
+
+	handle, err := self.handles.get(self)
+	if err != nil {
+		return whole
+	}
+	defer self.handles.release(handle)
+
+	alloc, ok := handle.extent.(allocator)
+	if !ok {
+		return whole
+	}
+	return alloc.allocatedRanges()
+}
+
+// Prewarm opens every extent file of the chain which is not open yet,
+// so a missing or unreadable file is reported before a long operation
+// starts rather than part way through it. It returns the first failure,
+// also with WithZeroFillMissingExtents. Files beyond the WithLazyOpen
+// limit are closed again least recently used first. Without lazy mode
+// all files are opened with the disk and Prewarm does nothing.
+func (self *VMDKContext) Prewarm() error {
+	for _, e := range self.extents {
+		lazy, ok := e.(*lazyExtent)
+		if !ok {
+			continue
+		}
+
+		handle, err := lazy.handles.get(lazy)
+		if err != nil {
+			return fmt.Errorf("While opening %v: %w", lazy.filename, err)
+		}
+		lazy.handles.release(handle)
+	}
+
+	if self.parent != nil {
+		return self.parent.Prewarm()
+	}
+	return nil
+}
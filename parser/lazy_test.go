@@ -0,0 +1,334 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const lazyDescriptor = `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 1 FLAT "a.vmdk" 0
+RW 1 FLAT "b.vmdk" 0
+`
+
+func TestLazyOpen(t *testing.T) {
+	files := testFiles{
+		"a.vmdk": bytes.Repeat([]byte("A"), SECTOR_SIZE),
+		"b.vmdk": bytes.Repeat([]byte("B"), SECTOR_SIZE),
+	}
+
+	opens := 0
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		opens++
+		return files.Open(filename)
+	}
+
+	open := func(opts ...Option) *VMDKContext {
+		vmdk, err := GetVMDKContext(strings.NewReader(lazyDescriptor),
+			len(lazyDescriptor), opener, opts...)
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+		return vmdk
+	}
+
+	vmdk := open(WithLazyOpen(1))
+	defer vmdk.Close()
+
+	if opens != 0 || vmdk.Size() != 2*SECTOR_SIZE {
+		t.Fatalf("Expected no opens before reading, got %v", opens)
+	}
+
+	buf := make([]byte, SECTOR_SIZE)
+	read := func(vmdk *VMDKContext, offset int64) error {
+		_, err := vmdk.ReadAt(buf, offset)
+		return err
+	}
+
+	// Only one file is kept open so a.vmdk is closed when b.vmdk is
+	// read.
+	if read(vmdk, 0) != nil || buf[0] != 'A' ||
+		read(vmdk, SECTOR_SIZE) != nil || buf[0] != 'B' || opens != 2 {
+		t.Fatalf("Unexpected reads, %v opens", opens)
+	}
+
+	// a.vmdk disappears between reads.
+	a := files["a.vmdk"]
+	delete(files, "a.vmdk")
+
+	err := read(vmdk, 0)
+	if err == nil || !strings.Contains(err.Error(), "a.vmdk") {
+		t.Fatalf("Expected an error reading a missing extent, got %v", err)
+	}
+
+	// The failed open is not remembered.
+	files["a.vmdk"] = a
+	if read(vmdk, 0) != nil || buf[0] != 'A' {
+		t.Fatalf("Extent was not reopened")
+	}
+
+	// With zero fill the missing extent reads as zeros.
+	vmdk = open(WithLazyOpen(1), WithZeroFillMissingExtents())
+	defer vmdk.Close()
+
+	delete(files, "a.vmdk")
+	err = read(vmdk, 0)
+	if err != nil || !bytes.Equal(buf, make([]byte, SECTOR_SIZE)) {
+		t.Fatalf("Expected zeros, got %v", err)
+	}
+
+	files["a.vmdk"] = a
+	if read(vmdk, 0) != nil || buf[0] != 'A' {
+		t.Fatalf("Extent was not reopened")
+	}
+}
+
+func TestLazyOpenChain(t *testing.T) {
+	eager, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer eager.Close()
+
+	lazy, err := openTestDisk(makeChainFiles(), "snapshot.vmdk",
+		WithLazyOpen(1))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer lazy.Close()
+
+	a := make([]byte, eager.Size())
+	b := make([]byte, lazy.Size())
+	eager.ReadAt(a, 0)
+	lazy.ReadAt(b, 0)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("Lazy read differs")
+	}
+
+	_, err = openTestDisk(testFiles{
+		"x.vmdk": []byte(strings.Replace(lazyDescriptor, "FLAT", "VMFS", 1)),
+	}, "x.vmdk", WithLazyOpen(1))
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestLazyOpenReopens(t *testing.T) {
+	files := testFiles{
+		// Both extents share one file at different offsets.
+		"ab.vmdk": append(bytes.Repeat([]byte("A"), SECTOR_SIZE),
+			bytes.Repeat([]byte("B"), SECTOR_SIZE)...),
+	}
+	descriptor := strings.Replace(strings.Replace(lazyDescriptor,
+		`"a.vmdk" 0`, `"ab.vmdk" 0`, 1), `"b.vmdk" 0`, `"ab.vmdk" 1`, 1)
+
+	// Track the files currently open.
+	open := 0
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		reader, _, err := files.Open(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		open++
+		return reader, func() { open-- }, nil
+	}
+
+	vmdk, err := GetVMDKContext(strings.NewReader(descriptor),
+		len(descriptor), opener, WithLazyOpen(1))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+
+	buf := make([]byte, SECTOR_SIZE)
+	for i, expected := range "ABAB" {
+		_, err := vmdk.ReadAt(buf, int64(i%2)*SECTOR_SIZE)
+		if err != nil || buf[0] != byte(expected) || open != 1 {
+			t.Fatalf("Read %v: %q with %v open (%v)", i, buf[0], open, err)
+		}
+	}
+
+	metrics := vmdk.Metrics()
+	if metrics.ExtentOpens != 4 || metrics.ExtentReopens != 2 ||
+		metrics.ExtentEvictions != 3 || metrics.OpenExtents != 1 {
+		t.Fatalf("Unexpected metrics %+v", metrics)
+	}
+
+	vmdk.Close()
+	if open != 0 {
+		t.Fatalf("%v files left open", open)
+	}
+}
+
+func TestLazyOpenConcurrent(t *testing.T) {
+	files := testFiles{
+		"a.vmdk": bytes.Repeat([]byte("A"), SECTOR_SIZE),
+		"b.vmdk": bytes.Repeat([]byte("B"), SECTOR_SIZE),
+	}
+
+	// Opening a.vmdk stalls until released.
+	var opens int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		if filename == "a.vmdk" {
+			if atomic.AddInt32(&opens, 1) == 1 {
+				close(started)
+			}
+			<-release
+		}
+		return files.Open(filename)
+	}
+
+	vmdk, err := GetVMDKContext(strings.NewReader(lazyDescriptor),
+		len(lazyDescriptor), opener, WithLazyOpen(2))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	read := func(offset int64) (byte, error) {
+		buf := make([]byte, SECTOR_SIZE)
+		_, err := vmdk.ReadAt(buf, offset)
+		return buf[0], err
+	}
+
+	_, err = read(SECTOR_SIZE)
+	if err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+
+	// Two readers of a.vmdk share one open.
+	results := make(chan byte, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			b, _ := read(0)
+			results <- b
+		}()
+	}
+	<-started
+
+	// b.vmdk is still readable while a.vmdk is being opened.
+	done := make(chan error)
+	go func() {
+		_, err := read(SECTOR_SIZE)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ReadAt: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Read blocked by a slow open")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if b := <-results; b != 'A' {
+			t.Fatalf("Unexpected read %q", b)
+		}
+	}
+
+	if atomic.LoadInt32(&opens) != 1 || vmdk.Metrics().ExtentOpens != 2 {
+		t.Fatalf("Expected a.vmdk to be opened once, got %v", opens)
+	}
+}
+
+func TestLazyOpenChainLimit(t *testing.T) {
+	// A chain three deep: top -> snapshot -> base.
+	files := makeChainFiles()
+	files["top.vmdk"] = []byte(strings.NewReplacer(
+		"parentCID=11111111", "parentCID=22222222",
+		`parentFileNameHint="base.vmdk"`, `parentFileNameHint="snapshot.vmdk"`,
+		"snapshot-data.vmdk", "top-data.vmdk").Replace(snapshotDescriptor))
+	files["top-data.vmdk"] = buildSparseExtent(1024*1024, map[int64][]byte{
+		2: bytes.Repeat([]byte("T"), testGrainSize),
+	})
+
+	open := 0
+	max_open := 0
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		reader, _, err := files.Open(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Descriptor files stay open and are not counted.
+		if strings.HasSuffix(filename, "-data.vmdk") {
+			open++
+			if open > max_open {
+				max_open = open
+			}
+			return reader, func() { open-- }, nil
+		}
+		return reader, nil, nil
+	}
+
+	data := files["top.vmdk"]
+	vmdk, err := GetVMDKContext(bytes.NewReader(data), len(data), opener,
+		WithLazyOpen(2))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+
+	buf := make([]byte, 3*testGrainSize)
+	_, err = vmdk.ReadAt(buf, 0)
+	if err != nil || buf[0] != 'B' || buf[testGrainSize] != 'S' ||
+		buf[2*testGrainSize] != 'T' {
+		t.Fatalf("Unexpected read: %v", err)
+	}
+
+	// A read falling through to the base holds one file per layer until
+	// it is done, after which the limit holds.
+	if max_open != 3 || open != 2 || vmdk.Metrics().OpenExtents != 2 {
+		t.Fatalf("Expected 2 extents open, got %v (at most %v)",
+			open, max_open)
+	}
+
+	vmdk.Close()
+	if open != 0 {
+		t.Fatalf("%v files left open", open)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	files := makeChainFiles()
+	vmdk, err := openTestDisk(files, "snapshot.vmdk", WithLazyOpen(1))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	// Both layers are opened and all but one closed again.
+	err = vmdk.Prewarm()
+	metrics := vmdk.Metrics()
+	if err != nil || metrics.ExtentOpens != 2 || metrics.OpenExtents != 1 {
+		t.Fatalf("Prewarm: %v %+v", err, metrics)
+	}
+
+	// The parent's extent is missing, even though reads of the
+	// allocated grains of the snapshot still work.
+	delete(files, "base-data.vmdk")
+	vmdk, err = openTestDisk(files, "snapshot.vmdk", WithLazyOpen(1),
+		WithZeroFillMissingExtents())
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	err = vmdk.Prewarm()
+	if err == nil || !strings.Contains(err.Error(), "base-data.vmdk") {
+		t.Fatalf("Expected Prewarm to report the missing extent, got %v", err)
+	}
+}
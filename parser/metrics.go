@@ -0,0 +1,81 @@
+package parser
+
+import "sync/atomic"
+
+// Metrics is a snapshot of the disk's internal counters.
+type Metrics struct {
+	// Grain table lookups served from the cache (see
+	// WithGrainTableCache).
+	GrainTableHits int64 `json:"GrainTableHits"`
+
+	// Grain table lookups which had to read the table.
+	GrainTableMisses int64 `json:"GrainTableMisses"`
+
+	// Grain tables (and grain directory windows) dropped from a full
+	// cache.
+	GrainTableEvictions int64 `json:"GrainTableEvictions"`
+
+	// Bytes of grain directory and grain table entries currently held
+	// in memory (see WithMetadataBudget).
+	MetadataBytes int64 `json:"MetadataBytes"`
+
+	// Reads of compressed grains served from the decompressed grain
+	// cache, and those which had to inflate the grain.
+	GrainCacheHits   int64 `json:"GrainCacheHits"`
+	GrainCacheMisses int64 `json:"GrainCacheMisses"`
+
+	// Extent files opened in lazy mode (see WithLazyOpen), those opened
+	// again after being closed to stay under the limit, and those
+	// closed to make room. Many reopens suggest raising the limit.
+	ExtentOpens     int64 `json:"ExtentOpens"`
+	ExtentReopens   int64 `json:"ExtentReopens"`
+	ExtentEvictions int64 `json:"ExtentEvictions"`
+
+	// Extent files currently open in lazy mode.
+	OpenExtents int64 `json:"OpenExtents"`
+}
+
+func (self *Metrics) addGrainTableCache(cache *grainTableCache) {
+	if cache == nil {
+		return
+	}
+	self.GrainTableHits += atomic.LoadInt64(&cache.hits)
+	self.GrainTableMisses += atomic.LoadInt64(&cache.misses)
+	self.GrainTableEvictions += atomic.LoadInt64(&cache.evictions)
+	self.MetadataBytes += atomic.LoadInt64(&cache.bytes)
+}
+
+// Metrics returns the counters of every disk in the chain.
+func (self *VMDKContext) Metrics() Metrics {
+	res := Metrics{}
+
+	// The chain shares one handle cache.
+	if self.handles != nil {
+		res.ExtentOpens = atomic.LoadInt64(&self.handles.opens)
+		res.ExtentReopens = atomic.LoadInt64(&self.handles.reopens)
+		res.ExtentEvictions = atomic.LoadInt64(&self.handles.evictions)
+		res.OpenExtents = int64(self.handles.count())
+	}
+
+	for _, disk := range self.Chain() {
+		for _, e := range disk.extents {
+			switch t := e.(type) {
+			case *SparseExtent:
+				res.addGrainTableCache(t.gt_cache)
+			case *lazyExtent:
+				res.addGrainTableCache(t.gt_cache)
+			case *StreamExtent:
+				if t.cache != nil {
+					res.GrainCacheHits += atomic.LoadInt64(&t.cache.hits)
+					res.GrainCacheMisses += atomic.LoadInt64(&t.cache.misses)
+				}
+			case *LazyStreamExtent:
+				if t.cache != nil {
+					res.GrainCacheHits += atomic.LoadInt64(&t.cache.hits)
+					res.GrainCacheMisses += atomic.LoadInt64(&t.cache.misses)
+				}
+			}
+		}
+	}
+	return res
+}
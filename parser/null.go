@@ -17,9 +17,7 @@ func (self *NullExtent) ReadAt(buf []byte, offset int64) (int, error) {
 		to_read = available_length
 	}
 
-	for i := int64(0); i < to_read; i++ {
-		buf[i] = 0
-	}
+	zeroFill(buf[:to_read])
 
 	return int(to_read), nil
 }
@@ -32,3 +30,9 @@ func (self *NullExtent) Stats() ExtentStat {
 		Filename:      self.filename,
 	}
 }
+
+// Zero buf. Holes can be large, so this uses clear which compiles to
+// a memclr rather than a loop over every byte.
+func zeroFill(buf []byte) {
+	clear(buf)
+}
@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// ObjectStore is the part of an object store such as S3 or MinIO that
+// is needed to read disks from a bucket. The vmdks3 package implements
+// it with the AWS SDK: Size is a HeadObject call and ReadRange a
+// GetObject call with a Range header.
+type ObjectStore interface {
+	// Size returns the size of the object at key. A missing object
+	// returns an error wrapping os.ErrNotExist.
+	Size(key string) (int64, error)
+
+	// ReadRange reads len(buf) bytes of the object at key from
+	// offset. Reads are never past the size of the object.
+	ReadRange(key string, buf []byte, offset int64) (int, error)
+}
+
+// MissingExtentError is returned when the file of an extent or parent
+// does not exist. WithZeroFillMissingExtents reads such extents as
+// zeros in lazy mode.
+type MissingExtentError struct {
+	Filename string
+	Err      error
+}
+
+func (self *MissingExtentError) Error() string {
+	return fmt.Sprintf("Missing extent %v: %v", self.Filename, self.Err)
+}
+
+func (self *MissingExtentError) Unwrap() error {
+	return self.Err
+}
+
+// ObjectOpener returns an Opener for the objects below prefix in store,
+// usually the directory of the descriptor's key. Filenames in the
+// descriptor are resolved relative to it, so a parent hint of
+// "../base.vmdk" works as on disk. Object sizes are cached, so files
+// reopened in lazy mode only cost ranged reads. Each object is read
+// through a page cache as with HTTPOpener.
+func ObjectOpener(store ObjectStore, prefix string) Opener {
+	var mu sync.Mutex
+	sizes := make(map[string]int64)
+
+	return func(filename string) (io.ReaderAt, func(), error) {
+		key := path.Join(prefix, filename)
+
+		mu.Lock()
+		size, pres := sizes[key]
+		mu.Unlock()
+
+		if !pres {
+			var err error
+			size, err = store.Size(key)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil, &MissingExtentError{Filename: key, Err: err}
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("While opening %v: %w", key, err)
+			}
+
+			mu.Lock()
+			sizes[key] = size
+			mu.Unlock()
+		}
+
+		reader := &objectReader{store: store, key: key, size: size}
+		return NewCachingReaderAt(reader, HTTP_PAGE_SIZE, HTTP_PAGE_COUNT),
+			nil, nil
+	}
+}
+
+type objectReader struct {
+	store ObjectStore
+	key   string
+	size  int64
+}
+
+func (self *objectReader) Size() int64 {
+	return self.size
+}
+
+func (self *objectReader) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 || offset >= self.size {
+		return 0, io.EOF
+	}
+
+	to_read := int64(len(buf))
+	if to_read > self.size-offset {
+		to_read = self.size - offset
+	}
+
+	// The object may have gone since it was opened.
+	n, err := self.store.ReadRange(self.key, buf[:to_read], offset)
+	if errors.Is(err, os.ErrNotExist) {
+		return n, &MissingExtentError{Filename: self.key, Err: err}
+	}
+	if err != nil {
+		return n, fmt.Errorf("While reading %v at %#x: %w",
+			self.key, offset, err)
+	}
+
+	if int64(n) < int64(len(buf)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// An in memory bucket counting the requests made.
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	heads   int
+	gets    int
+}
+
+func (self *fakeObjectStore) Size(key string) (int64, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.heads++
+	data, pres := self.objects[key]
+	if !pres {
+		return 0, fmt.Errorf("NoSuchKey %v: %w", key, os.ErrNotExist)
+	}
+	return int64(len(data)), nil
+}
+
+func (self *fakeObjectStore) ReadRange(
+	key string, buf []byte, offset int64) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.gets++
+	data, pres := self.objects[key]
+	if !pres {
+		return 0, fmt.Errorf("NoSuchKey %v: %w", key, os.ErrNotExist)
+	}
+	return copy(buf, data[offset:]), nil
+}
+
+func TestObjectOpener(t *testing.T) {
+	store := &fakeObjectStore{objects: make(map[string][]byte)}
+	for name, data := range makeChainFiles() {
+		store.objects["cases/1/"+name] = data
+	}
+	store.objects["cases/2/other.vmdk"] = []byte(baseDescriptor)
+
+	expected, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("openTestDisk: %v", err)
+	}
+	defer expected.Close()
+
+	// One handle at a time, so extents are reopened on every switch.
+	opener := ObjectOpener(store, "cases/1")
+	vmdk, err := GetVMDKContextFromOpener(opener, "snapshot.vmdk",
+		WithLazyOpen(1))
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromOpener: %v", err)
+	}
+	defer vmdk.Close()
+
+	a := make([]byte, vmdk.Size())
+	b := make([]byte, expected.Size())
+	for i := 0; i < 3; i++ {
+		_, err = vmdk.ReadAt(a, 0)
+		if err != nil {
+			t.Fatalf("ReadAt: %v", err)
+		}
+	}
+	expected.ReadAt(b, 0)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("Data read from the bucket differs")
+	}
+
+	// Each of the four objects is only sized once.
+	if store.heads != 4 {
+		t.Fatalf("Expected 4 size requests, got %v", store.heads)
+	}
+
+	// Keys resolve relative to the prefix. The extent of
+	// cases/2/other.vmdk is missing.
+	_, _, err = ObjectOpener(store, "cases/2")("base-data.vmdk")
+	var missing *MissingExtentError
+	if !errors.As(err, &missing) || !errors.Is(err, os.ErrNotExist) ||
+		missing.Filename != "cases/2/base-data.vmdk" {
+		t.Fatalf("Expected a MissingExtentError, got %v", err)
+	}
+
+	// It can be read as zeros.
+	zero_filled, err := GetVMDKContextFromOpener(
+		ObjectOpener(store, "cases/2"), "other.vmdk",
+		WithLazyOpen(1), WithZeroFillMissingExtents())
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromOpener: %v", err)
+	}
+	defer zero_filled.Close()
+
+	_, err = zero_filled.ReadAt(a, 0)
+	if err != nil || !isZero(a) {
+		t.Fatalf("Expected zeros for the missing extent: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// An extent line of the descriptor. Extents are only opened once the
+// whole descriptor is read so their files can be opened concurrently.
+type pendingExtent struct {
+	line_number int
+	extent_type string
+	filename    string
+	sectors     int64
+	file_offset int64
+
+	// Set if the grain directory and tables are in a separate file.
+	metadata_filename string
+
+	// The number of descriptor warnings before this line, so the
+	// extent's own warnings keep their place.
+	warning_index int
+	warnings      []string
+
+	// Set once opened.
+	extent    Extent
+	file_size int64
+	err       error
+}
+
+func (self *pendingExtent) warn(format string, args ...interface{}) {
+	self.warnings = append(self.warnings, fmt.Sprintf(format, args...))
+}
+
+// Raw device and lazy extents have no file to open up front.
+func (self *pendingExtent) needsOpen(options *options) bool {
+	return !isRawDeviceExtent(self.extent_type) && options.lazy_max_open <= 0
+}
+
+// Open the extent file and parse its header. The virtual offset is
+// set later, once the sizes of the extents before it are known.
+func (self *pendingExtent) open(opener Opener, options *options) (Extent, error) {
+	if !supportedExtentTypes[self.extent_type] {
+		return nil, fmt.Errorf("%w extent type %v",
+			ErrUnsupported, self.extent_type)
+	}
+
+	reader, closer, err := options.open(opener, self.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.extent_type == "FLAT" {
+		self.file_size = readerSize(reader)
+		return &FlatExtent{
+			reader:      reader,
+			file_offset: self.file_offset * SECTOR_SIZE,
+			total_size:  self.sectors * SECTOR_SIZE,
+			filename:    self.filename,
+			closer:      closer,
+		}, nil
+	}
+
+	extent, err := openSparseExtent(opener, options, reader, closer,
+		self.metadata_filename)
+	if err != nil {
+		return nil, err
+	}
+
+	extent.filename = self.filename
+	extent.gt_cache = options.newGrainTableCache()
+	if options.grain_bounds_check {
+		extent.file_size = readerSize(reader)
+	}
+	return extent, nil
+}
+
+// Parse a sparse extent whose grains are read from reader. If
+// metadata_filename is set the header and grain tables are read from
+// that file instead. On error closer is called, otherwise the extent
+// owns it.
+func openSparseExtent(opener Opener, options *options,
+	reader io.ReaderAt, closer func(),
+	metadata_filename string) (*SparseExtent, error) {
+	metadata := reader
+	close_all := closer
+	if metadata_filename != "" {
+		metadata_reader, metadata_closer, err := options.open(
+			opener, metadata_filename)
+		if err != nil {
+			if closer != nil {
+				closer()
+			}
+			return nil, fmt.Errorf("While opening metadata %v: %w",
+				metadata_filename, err)
+		}
+
+		metadata = metadata_reader
+		close_all = func() {
+			if metadata_closer != nil {
+				metadata_closer()
+			}
+			if closer != nil {
+				closer()
+			}
+		}
+	}
+
+	extent, err := newSplitSparseExtent(metadata, reader, options)
+	if err != nil {
+		if close_all != nil {
+			close_all()
+		}
+		return nil, err
+	}
+
+	extent.closer = close_all
+	extent.metadata_filename = metadata_filename
+	extent.split = metadata_filename != ""
+	return extent, nil
+}
+
+// Open the extents listed in the descriptor, up to open_concurrency at
+// a time, and add them in descriptor order. If any fail the others are
+// closed again and every failure is reported.
+func (self *VMDKContext) openExtents(
+	opener Opener, pending []*pendingExtent) error {
+	workers := self.options.open_concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	var failed int32
+	slots := make(chan struct{}, workers)
+	for _, p := range pending {
+		if !p.needsOpen(self.options) {
+			continue
+		}
+
+		// No point opening more files once one failed.
+		slots <- struct{}{}
+		if atomic.LoadInt32(&failed) != 0 {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(p *pendingExtent) {
+			defer wg.Done()
+			p.extent, p.err = p.open(opener, self.options)
+			if p.err != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+			<-slots
+		}(p)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, p := range pending {
+		if p.err != nil {
+			errs = append(errs, fmt.Errorf("While opening %v (line %v): %w",
+				p.filename, p.line_number, p.err))
+		}
+	}
+	if len(errs) > 0 {
+		closePending(pending)
+		return errors.Join(errs...)
+	}
+
+	for idx, p := range pending {
+		switch extent := p.extent.(type) {
+		case *SparseExtent:
+			extent.offset = self.total_size
+			if extent.total_size != p.sectors*SECTOR_SIZE {
+				p.warn("Extent %v is %v sectors in the descriptor "+
+					"but %v in its header", p.filename,
+					p.sectors, extent.total_size/SECTOR_SIZE)
+			}
+
+		case *FlatExtent:
+			extent.offset = self.total_size
+			if p.file_size < extent.file_offset+extent.total_size {
+				p.warn("Extent %v needs %v bytes but the file "+
+					"has %v", p.filename,
+					extent.file_offset+extent.total_size, p.file_size)
+			}
+
+		case nil:
+			// The mapping file is not needed to describe the
+			// extent.
+			if isRawDeviceExtent(p.extent_type) {
+				p.warn("Extent %v maps a raw device", p.filename)
+				p.extent = &RawDeviceExtent{
+					extent_type: p.extent_type,
+					total_size:  p.sectors * SECTOR_SIZE,
+					offset:      self.total_size,
+					filename:    p.filename,
+				}
+				break
+			}
+
+			lazy, err := self.newLazyExtent(opener, p.extent_type,
+				p.filename, p.metadata_filename, p.sectors, p.file_offset)
+			if err != nil {
+				closePending(pending[idx:])
+				return err
+			}
+			p.extent = lazy
+		}
+
+		self.total_size += p.extent.TotalSize()
+		self.extents = append(self.extents, p.extent)
+	}
+
+	// Report the warnings in descriptor order.
+	var warnings []string
+	next := 0
+	for _, p := range pending {
+		warnings = append(warnings, self.Warnings[next:p.warning_index]...)
+		warnings = append(warnings, p.warnings...)
+		next = p.warning_index
+	}
+	self.Warnings = append(warnings, self.Warnings[next:]...)
+
+	return nil
+}
+
+func closePending(pending []*pendingExtent) {
+	for _, p := range pending {
+		if p.extent != nil {
+			p.extent.Close()
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package parser
+
+import "time"
+
+type options struct {
+	// Number of times a failed opener call is retried before giving
+	// up.
+	retries int
+
+	// Delay before the first retry. It doubles on every subsequent
+	// attempt up to MAX_RETRY_BACKOFF.
+	backoff time.Duration
+
+	// When set, failed reads from the extent files are retried using
+	// the same policy as the opener.
+	resilient bool
+
+	// When set, ReadAt never returns a short read without an error.
+	strict bool
+
+	// When set, sector counts in extent lines may carry a K, M or G
+	// size suffix.
+	lenient bool
+
+	// When set, an invalid CID or parentCID is only a warning.
+	lenient_cids bool
+
+	// When set, a disk in an OVA which is not the size its OVF
+	// declares is only a warning.
+	lenient_capacity bool
+
+	// Grain sizes which are not a power of two are rejected when
+	// strict, and grains smaller than 8 sectors accepted when lenient.
+	strict_grain_size  bool
+	lenient_grain_size bool
+
+	// When set, a single ReadAt gives up once this much time has
+	// passed.
+	read_deadline time.Duration
+
+	// When set, extent files are opened on first use and at most
+	// this many are kept open, shared through handles.
+	lazy_max_open int
+	handles       *handleCache
+
+	// Descriptors listing more extents are refused, 0 for no limit.
+	max_extents int
+
+	// Number of extent files opened at once.
+	open_concurrency int
+
+	// When set, the ranges read are recorded (see CoverageMap).
+	coverage bool
+
+	// When set, extents whose file can not be opened in lazy mode
+	// read as zeros instead of failing.
+	zero_fill_missing bool
+
+	// Number of grain tables cached per sparse extent.
+	grain_table_cache int
+
+	// When set, the grain directories and tables of the whole chain
+	// are held within this many bytes, shared through budget.
+	metadata_budget int64
+	budget          *metadataBudget
+
+	// Size in bytes of the cache of decompressed grains.
+	grain_cache_size int64
+
+	// When set, grain table entries pointing past the end of the
+	// extent file are reported.
+	grain_bounds_check bool
+
+	// When set, OpenStreamOptimized keeps at most spill_threshold
+	// bytes of compressed grains in memory and writes the rest to a
+	// temporary file.
+	temp_storage    TempStorage
+	spill_threshold int64
+
+	// Number of bytes fetched ahead of sequential reads.
+	readahead int64
+
+	// Number of extents read at once by a read spanning several.
+	read_concurrency int
+
+	// Number of chunks read at once by Export and HashRange.
+	export_workers int
+
+	// Number of extents read at once by Export and HashRange.
+	extent_workers int
+
+	// When set, AllocatedRanges reports holes within sparse extents.
+	high_resolution_ranges bool
+
+	// Parents already opened while following a snapshot chain.
+	visited map[string]bool
+
+	// The directory of a parent's descriptor relative to the leaf
+	// disk's.
+	dir string
+}
+
+// Option customizes how GetVMDKContext opens and reads the disk.
+type Option func(self *options)
+
+// WithRetries retries a failing opener up to retries times, sleeping
+// backoff (doubling each time, up to MAX_RETRY_BACKOFF) between
+// attempts. This helps with network backed openers where transient
+// failures are common. Missing files and permission errors are not
+// retried.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(self *options) {
+		self.retries = retries
+		self.backoff = backoff
+	}
+}
+
+// WithResilientReads applies the retry policy to reads from the
+// underlying extent files as well.
+func WithResilientReads() Option {
+	return func(self *options) {
+		self.resilient = true
+	}
+}
+
+// WithStrictReads guarantees that ReadAt either fills the entire
+// buffer or returns an error, as required by io.ReaderAt. Without it a
+// read extending past the end of the disk returns the available bytes
+// and no error.
+func WithStrictReads() Option {
+	return func(self *options) {
+		self.strict = true
+	}
+}
+
+// WithLenientDescriptors accepts hand edited descriptors which give
+// extent sizes with a K, M or G suffix (e.g. "RW 1G FLAT ...") instead
+// of a sector count. The suffixed value is a size in bytes. Without
+// this option such descriptors are rejected.
+func WithLenientDescriptors() Option {
+	return func(self *options) {
+		self.lenient = true
+	}
+}
+
+// WithLenientCIDs reports a CID or parentCID which is not 8 hex digits
+// as a warning rather than ErrInvalidCID, for descriptors written by
+// tools which do not follow the specification.
+func WithLenientCIDs() Option {
+	return func(self *options) {
+		self.lenient_cids = true
+	}
+}
+
+// WithLenientCapacity opens a disk in an OVA whose size differs from
+// the capacity in the OVF descriptor, with a warning, rather than
+// failing with ErrCapacityMismatch.
+func WithLenientCapacity() Option {
+	return func(self *options) {
+		self.lenient_capacity = true
+	}
+}
+
+// WithStrictGrainSize rejects sparse extents whose grain size is not a
+// power of two of at least 8 sectors, as the specification requires,
+// with ErrInvalidGrainSize. By default any grain size of at least 8
+// sectors is read.
+func WithStrictGrainSize() Option {
+	return func(self *options) {
+		self.strict_grain_size = true
+	}
+}
+
+// WithLenientGrainSize reads sparse extents with any grain size of at
+// least one sector, as written by some third party tools. Grain sizes
+// which are not a power of two are a little slower to read.
+func WithLenientGrainSize() Option {
+	return func(self *options) {
+		self.lenient_grain_size = true
+	}
+}
+
+// WithReadDeadline bounds the time a single ReadAt may take. A read
+// spanning several extents or grains stops with an error wrapping
+// os.ErrDeadlineExceeded once the deadline has passed. A read from the
+// underlying file that is already in progress is not interrupted.
+func WithReadDeadline(d time.Duration) Option {
+	return func(self *options) {
+		self.read_deadline = d
+	}
+}
+
+// WithMaxExtents limits the number of extents a descriptor may list
+// (DEFAULT_MAX_EXTENTS by default) so a hostile descriptor can not make
+// us open thousands of files. The limit applies to each disk of a
+// snapshot chain. Larger descriptors fail with ErrTooManyExtents. A
+// limit of 0 removes it.
+func WithMaxExtents(max int) Option {
+	return func(self *options) {
+		self.max_extents = max
+	}
+}
+
+// WithOpenConcurrency opens up to n extent files at once (by default
+// DEFAULT_OPEN_CONCURRENCY), which helps with openers making remote
+// round trips. The opener is then called from several goroutines. The
+// extents keep their descriptor order. If any fail to open the others
+// are closed and all the failures are reported. A value of 1 opens them
+// one after the other. See WithLazyOpen to defer opening instead.
+func WithOpenConcurrency(n int) Option {
+	return func(self *options) {
+		self.open_concurrency = n
+	}
+}
+
+// WithLazyOpen defers opening extent files until they are read and
+// keeps at most max_open of them open across the whole snapshot chain,
+// closing the least recently used ones. This suits disks with many
+// extents, e.g. twoGbMaxExtentSparse, and deep chains. Extent sizes are
+// taken from the descriptor. Closed extents keep their cached grain
+// tables and are reopened through the opener when next read; Metrics
+// counts the reopens to help size max_open. Files in use by a read stay
+// open until it is done, so a read falling through the chain briefly
+// holds one per layer.
+func WithLazyOpen(max_open int) Option {
+	return func(self *options) {
+		self.lazy_max_open = max_open
+	}
+}
+
+// WithZeroFillMissingExtents reads extents whose file can not be
+// opened in lazy mode (e.g. it was deleted) as zeros. By default such
+// reads fail. The open is retried on every read.
+func WithZeroFillMissingExtents() Option {
+	return func(self *options) {
+		self.zero_fill_missing = true
+	}
+}
+
+// WithGrainTableCache keeps up to n recently used grain tables of each
+// sparse extent in memory, along with the grain directory. Random reads
+// then rarely need to re-read metadata, which helps with slow or
+// network backed readers. Each table takes 2kb. See Metrics.
+func WithGrainTableCache(n int) Option {
+	return func(self *options) {
+		self.grain_table_cache = n
+	}
+}
+
+// WithMetadataBudget bounds the memory used for sparse extent metadata
+// across the whole snapshot chain to about size bytes. The grain
+// directory is then loaded in 2kb windows on demand and, like the grain
+// tables, evicted least recently used first. It replaces the count
+// limit of WithGrainTableCache. See Metrics for the current usage.
+func WithMetadataBudget(size int64) Option {
+	return func(self *options) {
+		self.metadata_budget = size
+	}
+}
+
+// WithDecompressedGrainCache sets the number of bytes of decompressed
+// streamOptimized grains kept in memory (DEFAULT_GRAIN_CACHE_SIZE by
+// default). Small sequential reads then inflate each grain once. A size
+// of 0 disables the cache.
+func WithDecompressedGrainCache(size int64) Option {
+	return func(self *options) {
+		self.grain_cache_size = size
+	}
+}
+
+// WithSpill makes OpenStreamOptimized write compressed grains to a
+// temporary file from storage once more than threshold bytes are
+// buffered in memory, so large streams do not exhaust memory. A nil
+// storage uses OSTempStorage{}. The file is removed when the context
+// is closed.
+func WithSpill(threshold int64, storage TempStorage) Option {
+	return func(self *options) {
+		if storage == nil {
+			storage = OSTempStorage{}
+		}
+		self.temp_storage = storage
+		self.spill_threshold = threshold
+	}
+}
+
+// WithGrainBoundsCheck verifies that every grain read from a sparse
+// extent lies within the extent file. A corrupt grain table entry then
+// fails with ErrGrainOutOfBounds naming the grain, rather than reading
+// as a short read or EOF.
+func WithGrainBoundsCheck() Option {
+	return func(self *options) {
+		self.grain_bounds_check = true
+	}
+}
+
+// WithReadahead fetches up to size bytes following sequential reads on
+// a background goroutine, decompressing any grains on the way. Copying
+// or hashing a disk over a high latency reader then makes a few large
+// requests instead of many small ones.
+func WithReadahead(size int64) Option {
+	return func(self *options) {
+		self.readahead = size
+	}
+}
+
+// WithReadConcurrency reads the extents covered by a large ReadAt up
+// to n at a time rather than one after the other. This helps when
+// extents live on different devices or behind a high latency opener.
+func WithReadConcurrency(n int) Option {
+	return func(self *options) {
+		self.read_concurrency = n
+	}
+}
+
+// WithExportWorkers makes Export (and so WriteTo and CopyVerified)
+// and HashRange read up to n 1mb chunks of the disk at once. The data
+// is still written in order, so hashes are unchanged, but decompressing
+// streamOptimized grains uses several CPUs.
+func WithExportWorkers(n int) Option {
+	return func(self *options) {
+		self.export_workers = n
+	}
+}
+
+// WithExtentWorkers makes Export (and so WriteTo and CopyVerified) and
+// HashRange read up to n extents of a multi-extent disk at once, each
+// from start to end. This suits extent files on independent devices,
+// which are each read sequentially. The data is still written in order.
+// Up to n*(EXTENT_QUEUE_DEPTH+1) 1mb chunks are held in memory. It
+// takes precedence over WithExportWorkers on disks with several
+// extents.
+func WithExtentWorkers(n int) Option {
+	return func(self *options) {
+		self.extent_workers = n
+	}
+}
+
+// WithHighResolutionRanges makes AllocatedRanges report allocation at
+// grain granularity by reading every grain table. Without it only the
+// gaps between extents are reported as holes.
+func WithHighResolutionRanges() Option {
+	return func(self *options) {
+		self.high_resolution_ranges = true
+	}
+}
+
+// WithCoverage records which ranges of the disk ReadAt returned, for
+// tests checking that a tool read what it was meant to (see
+// CoverageMap). Parents in the chain record their own coverage.
+func WithCoverage() Option {
+	return func(self *options) {
+		self.coverage = true
+	}
+}
+
+// Carry the parents visited so far to the next parent in the chain.
+func withVisited(visited map[string]bool) Option {
+	return func(self *options) {
+		self.visited = visited
+	}
+}
+
+// Set the directory of the next parent in the chain.
+func withDir(dir string) Option {
+	return func(self *options) {
+		self.dir = dir
+	}
+}
+
+// Share the metadata budget with the next parent in the chain.
+func withBudget(budget *metadataBudget) Option {
+	return func(self *options) {
+		self.budget = budget
+	}
+}
+
+// Share the open extent files with the next parent in the chain.
+func withHandles(handles *handleCache) Option {
+	return func(self *options) {
+		self.handles = handles
+	}
+}
+
+func (self *options) newCoverageMap() *coverageMap {
+	if !self.coverage {
+		return nil
+	}
+	return &coverageMap{}
+}
+
+// The grain table cache for a new sparse extent, if any.
+func (self *options) newGrainTableCache() *grainTableCache {
+	if self.budget == nil && self.grain_table_cache <= 0 {
+		return nil
+	}
+	return newGrainTableCache(self.grain_table_cache, self.budget)
+}
+
+func getOptions(opts []Option) *options {
+	res := &options{
+		grain_cache_size: DEFAULT_GRAIN_CACHE_SIZE,
+		max_extents:      DEFAULT_MAX_EXTENTS,
+		open_concurrency: DEFAULT_OPEN_CONCURRENCY,
+	}
+	for _, o := range opts {
+		o(res)
+	}
+	return res
+}
@@ -0,0 +1,213 @@
+package parser
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// OVAMember is a file stored in an OVA archive. Its data is stored
+// uncompressed at Offset in the archive.
+type OVAMember struct {
+	Name   string `json:"Name"`
+	Offset int64  `json:"Offset"`
+	Size   int64  `json:"Size"`
+}
+
+// OVA is an OVA archive: a tar file holding an OVF descriptor, a
+// manifest and the disks of an appliance, which are usually
+// streamOptimized. Since tar stores each file contiguously, disks are
+// read in place rather than extracted.
+type OVA struct {
+	reader io.ReaderAt
+
+	members map[string]OVAMember
+	names   []string
+
+	// The OVF descriptor, nil if the archive has none.
+	ovf   *OVF
+	disks []OVFDisk
+}
+
+// OpenOVA reads the table of contents of an OVA archive of size
+// bytes. The disks are those listed in the OVF descriptor, or every
+// vmdk file holding a descriptor if the archive has none.
+func OpenOVA(reader io.ReaderAt, size int64) (*OVA, error) {
+	res := &OVA{
+		reader:  reader,
+		members: make(map[string]OVAMember),
+	}
+
+	// tar reads headers a block at a time and seeks over file data, so
+	// after Next the section is positioned at the start of the data.
+	section := io.NewSectionReader(reader, 0, size)
+	tr := tar.NewReader(section)
+	ovf := ""
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("While reading OVA: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		offset, err := section.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(header.Name)
+		res.members[name] = OVAMember{
+			Name: name, Offset: offset, Size: header.Size}
+		res.names = append(res.names, name)
+
+		if ovf == "" && strings.EqualFold(path.Ext(name), ".ovf") {
+			ovf = name
+		}
+	}
+
+	if ovf == "" {
+		opener := res.Opener()
+		for _, name := range res.names {
+			if !strings.EqualFold(path.Ext(name), ".vmdk") {
+				continue
+			}
+
+			// Flat extents are not disks of their own.
+			reader, _, _ := opener(name)
+			if Probe(reader) == nil {
+				res.disks = append(res.disks, OVFDisk{ID: name, Filename: name})
+			}
+		}
+		return res, nil
+	}
+
+	member := res.members[ovf]
+	data := make([]byte, member.Size)
+	_, err := reader.ReadAt(data, member.Offset)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("While reading %v: %w", ovf, err)
+	}
+
+	res.ovf, err = ParseOVF(data)
+	if err != nil {
+		return nil, fmt.Errorf("While parsing %v: %w", ovf, err)
+	}
+	res.disks = res.ovf.Disks
+	return res, nil
+}
+
+// Members returns the files in the archive in archive order.
+func (self *OVA) Members() []OVAMember {
+	var res []OVAMember
+	for _, name := range self.names {
+		res = append(res, self.members[name])
+	}
+	return res
+}
+
+// OVF returns the OVF descriptor of the archive, or nil if it has
+// none.
+func (self *OVA) OVF() *OVF {
+	return self.ovf
+}
+
+// Disks returns the disks of the appliance, as declared in the OVF
+// descriptor. Without one, each disk's id is its filename and its
+// capacity is not known.
+func (self *OVA) Disks() []OVFDisk {
+	return self.disks
+}
+
+// Opener returns an Opener for the files in the archive.
+func (self *OVA) Opener() Opener {
+	return func(filename string) (io.ReaderAt, func(), error) {
+		name := path.Clean(filename)
+		member, pres := self.members[name]
+		if !pres {
+			return nil, nil, &MissingExtentError{
+				Filename: name, Err: os.ErrNotExist}
+		}
+		return io.NewSectionReader(self.reader, member.Offset, member.Size),
+			nil, nil
+	}
+}
+
+// OpenDisk opens the disk with the OVF disk id id, or the first disk if
+// id is empty. streamOptimized disks are opened with
+// OpenStreamOptimizedAt, other disks with GetVMDKContext reading their
+// extents from the archive. A disk whose size differs from the
+// capacity in the OVF descriptor fails with ErrCapacityMismatch, or
+// only warns with WithLenientCapacity.
+func (self *OVA) OpenDisk(id string, opts ...Option) (*VMDKContext, error) {
+	if len(self.disks) == 0 {
+		return nil, errors.New("OVA contains no disks")
+	}
+
+	disk := self.disks[0]
+	if id != "" {
+		found := false
+		for _, d := range self.disks {
+			if d.ID == id {
+				disk, found = d, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("OVA has no disk %v", id)
+		}
+	}
+
+	if disk.Filename == "" {
+		return nil, fmt.Errorf("Disk %v has no file", disk.ID)
+	}
+
+	if self.ovf != nil {
+		file, _ := self.ovf.File(disk.FileRef)
+		if file.Compression != "" {
+			return nil, fmt.Errorf("%w: %v is %v compressed",
+				ErrUnsupported, file.Href, file.Compression)
+		}
+	}
+
+	vmdk, err := self.openDisk(disk.Filename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if disk.Capacity > 0 && vmdk.Size() != disk.Capacity {
+		err := fmt.Errorf("%w: disk %v is %v bytes but the OVF declares %v",
+			ErrCapacityMismatch, disk.ID, vmdk.Size(), disk.Capacity)
+		if !getOptions(opts).lenient_capacity {
+			vmdk.Close()
+			return nil, err
+		}
+		vmdk.warn("%v", err)
+	}
+
+	return vmdk, nil
+}
+
+func (self *OVA) openDisk(filename string, opts []Option) (*VMDKContext, error) {
+	reader, _, err := self.Opener()(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	header := NewVMDKProfile().SparseExtentHeader(reader, 0)
+	if checkStreamHeader(header, getOptions(opts)) == nil {
+		return OpenStreamOptimizedAt(reader, opts...)
+	}
+
+	return GetVMDKContext(reader, int(self.members[filename].Size),
+		self.Opener(), opts...)
+}
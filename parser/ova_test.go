@@ -0,0 +1,177 @@
+package parser
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Build a tar archive of files in order.
+func buildTar(t *testing.T, files ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for i := 0; i < len(files); i += 2 {
+		data := files[i+1].([]byte)
+		err := tw.WriteHeader(&tar.Header{
+			Name: files[i].(string), Mode: 0644, Size: int64(len(data))})
+		if err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+		tw.Write(data)
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+const testOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1">
+  <References>
+    <File ovf:href="appliance-disk1.vmdk" ovf:id="file1" ovf:size="1"/>
+    <File ovf:href="appliance-disk2.vmdk" ovf:id="file2" ovf:size="1"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="1" ovf:capacityAllocationUnits="byte * 2^20"
+        ovf:diskId="vmdisk1" ovf:fileRef="file1"/>
+    <Disk ovf:capacity="2" ovf:capacityAllocationUnits="byte * 2^20"
+        ovf:diskId="vmdisk2" ovf:fileRef="file2"/>
+  </DiskSection>
+</Envelope>
+`
+
+func TestOVA(t *testing.T) {
+	data := buildTar(t,
+		"appliance.ovf", []byte(testOVF),
+		"appliance.mf", []byte("SHA256(appliance.ovf)= 00\n"),
+		"appliance-disk1.vmdk", buildStreamOptimized(1024*1024,
+			map[int64][]byte{0: []byte("first disk")}),
+		"appliance-disk2.vmdk", buildStreamOptimized(2*1024*1024,
+			map[int64][]byte{20: []byte("second disk")}))
+
+	ova, err := OpenOVA(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenOVA: %v", err)
+	}
+
+	if len(ova.Members()) != 4 || ova.Members()[2].Offset%512 != 0 {
+		t.Fatalf("Unexpected members %+v", ova.Members())
+	}
+
+	disks := ova.Disks()
+	if len(disks) != 2 || disks[1].ID != "vmdisk2" ||
+		disks[1].Filename != "appliance-disk2.vmdk" ||
+		disks[1].Capacity != 2*1024*1024 {
+		t.Fatalf("Unexpected disks %+v", disks)
+	}
+
+	vmdk, err := ova.OpenDisk("vmdisk2")
+	if err != nil {
+		t.Fatalf("OpenDisk: %v", err)
+	}
+	defer vmdk.Close()
+
+	buf := make([]byte, 11)
+	_, err = vmdk.ReadAt(buf, 20*128*SECTOR_SIZE)
+	if err != nil || string(buf) != "second disk" ||
+		vmdk.Size() != 2*1024*1024 {
+		t.Fatalf("Unexpected disk: %q %v %v", buf, vmdk.Size(), err)
+	}
+
+	// The first disk is opened by default.
+	first, err := ova.OpenDisk("")
+	if err != nil {
+		t.Fatalf("OpenDisk: %v", err)
+	}
+	defer first.Close()
+
+	_, err = first.ReadAt(buf[:10], 0)
+	if err != nil || string(buf[:10]) != "first disk" {
+		t.Fatalf("Unexpected first disk: %q %v", buf[:10], err)
+	}
+
+	_, err = ova.OpenDisk("vmdisk3")
+	if err == nil {
+		t.Fatalf("Expected an unknown disk to fail")
+	}
+}
+
+func TestOVAWithoutOVF(t *testing.T) {
+	// Without an OVF every vmdk is a disk. Flat extents are read from
+	// the archive too.
+	data := buildTar(t,
+		"disk.vmdk", []byte(`# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 8 FLAT "disk-flat.vmdk" 0
+`),
+		"disk-flat.vmdk", bytes.Repeat([]byte("F"), 4096))
+
+	ova, err := OpenOVA(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenOVA: %v", err)
+	}
+
+	if len(ova.Disks()) != 1 || ova.Disks()[0].ID != "disk.vmdk" {
+		t.Fatalf("Unexpected disks %+v", ova.Disks())
+	}
+
+	vmdk, err := ova.OpenDisk("disk.vmdk")
+	if err != nil {
+		t.Fatalf("OpenDisk: %v", err)
+	}
+	defer vmdk.Close()
+
+	buf := make([]byte, 4096)
+	_, err = vmdk.ReadAt(buf, 0)
+	if err != nil || !bytes.Equal(buf, bytes.Repeat([]byte("F"), 4096)) {
+		t.Fatalf("Unexpected data: %v", err)
+	}
+
+	_, _, err = ova.Opener()("missing.vmdk")
+	missing := &MissingExtentError{}
+	if !errors.As(err, &missing) {
+		t.Fatalf("Expected a missing extent, got %v", err)
+	}
+}
+
+func TestOVACapacityMismatch(t *testing.T) {
+	// The OVF declares 2mb for a 1mb disk.
+	data := buildTar(t,
+		"appliance.ovf", []byte(strings.Replace(testOVF,
+			"appliance-disk2.vmdk", "appliance-disk1.vmdk", 1)),
+		"appliance-disk1.vmdk", buildStreamOptimized(1024*1024,
+			map[int64][]byte{0: []byte("first disk")}))
+
+	ova, err := OpenOVA(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenOVA: %v", err)
+	}
+
+	_, err = ova.OpenDisk("vmdisk2")
+	if !errors.Is(err, ErrCapacityMismatch) {
+		t.Fatalf("Expected a capacity mismatch, got %v", err)
+	}
+
+	// Lenient descriptors are about extent lines, not the OVF.
+	_, err = ova.OpenDisk("vmdisk2", WithLenientDescriptors())
+	if !errors.Is(err, ErrCapacityMismatch) {
+		t.Fatalf("Expected a capacity mismatch, got %v", err)
+	}
+
+	vmdk, err := ova.OpenDisk("vmdisk2", WithLenientCapacity())
+	if err != nil {
+		t.Fatalf("OpenDisk: %v", err)
+	}
+	defer vmdk.Close()
+
+	if len(vmdk.Warnings) != 1 {
+		t.Fatalf("Expected a warning, got %v", vmdk.Warnings)
+	}
+}
@@ -0,0 +1,195 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Allocation units such as "byte * 2^30".
+	ovfPowerUnitsRegex = regexp.MustCompile(`^byte\s*\*\s*(\d+)\s*\^\s*(\d+)$`)
+
+	// Allocation units such as "byte * 1024".
+	ovfMultipleUnitsRegex = regexp.MustCompile(`^byte\s*\*\s*(\d+)$`)
+
+	// Older descriptors name the units.
+	ovfNamedUnits = map[string]int64{
+		"":          1,
+		"byte":      1,
+		"KiloBytes": 1 << 10,
+		"MegaBytes": 1 << 20,
+		"GigaBytes": 1 << 30,
+	}
+)
+
+// OVFFile is a file listed in the References section of an OVF
+// descriptor.
+type OVFFile struct {
+	ID   string `json:"ID"`
+	Href string `json:"Href"`
+
+	// The size of the file, or 0 if not given.
+	Size int64 `json:"Size,omitempty"`
+
+	// Set to e.g. "gzip" for files stored compressed.
+	Compression string `json:"Compression,omitempty"`
+}
+
+// OVFDisk is a disk declared in the DiskSection of an OVF descriptor.
+type OVFDisk struct {
+	ID string `json:"ID"`
+
+	// The file holding the disk and its name. Disks created empty on
+	// import have neither.
+	FileRef  string `json:"FileRef,omitempty"`
+	Filename string `json:"Filename,omitempty"`
+
+	// The capacity in bytes, or 0 if it is given by a property which
+	// is only set on import.
+	Capacity int64 `json:"Capacity"`
+
+	// The bytes of the disk holding data, or 0 if not given.
+	PopulatedSize int64 `json:"PopulatedSize,omitempty"`
+
+	// The format URI, e.g. of the streamOptimized specification.
+	Format string `json:"Format,omitempty"`
+}
+
+// OVF is the part of an OVF descriptor describing the disks of an
+// appliance.
+type OVF struct {
+	Files []OVFFile `json:"Files"`
+	Disks []OVFDisk `json:"Disks"`
+}
+
+type ovfEnvelope struct {
+	Files []struct {
+		ID          string `xml:"id,attr"`
+		Href        string `xml:"href,attr"`
+		Size        string `xml:"size,attr"`
+		Compression string `xml:"compression,attr"`
+	} `xml:"References>File"`
+
+	Disks []struct {
+		DiskID        string `xml:"diskId,attr"`
+		FileRef       string `xml:"fileRef,attr"`
+		Capacity      string `xml:"capacity,attr"`
+		Units         string `xml:"capacityAllocationUnits,attr"`
+		PopulatedSize string `xml:"populatedSize,attr"`
+		Format        string `xml:"format,attr"`
+	} `xml:"DiskSection>Disk"`
+}
+
+// ParseOVF parses the References and DiskSection of an OVF descriptor.
+// Each disk's filename is resolved through References.
+func ParseOVF(data []byte) (*OVF, error) {
+	envelope := &ovfEnvelope{}
+	err := xml.NewDecoder(bytes.NewReader(data)).Decode(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &OVF{}
+	files := make(map[string]OVFFile)
+	for _, f := range envelope.Files {
+		file := OVFFile{
+			ID:          f.ID,
+			Href:        f.Href,
+			Compression: f.Compression,
+		}
+
+		if f.Size != "" {
+			file.Size, err = strconv.ParseInt(f.Size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("File %v: invalid size %q", f.ID, f.Size)
+			}
+		}
+
+		files[file.ID] = file
+		res.Files = append(res.Files, file)
+	}
+
+	for _, d := range envelope.Disks {
+		disk := OVFDisk{ID: d.DiskID, FileRef: d.FileRef, Format: d.Format}
+
+		if d.FileRef != "" {
+			file, pres := files[d.FileRef]
+			if !pres {
+				return nil, fmt.Errorf("Disk %v refers to unknown file %v",
+					d.DiskID, d.FileRef)
+			}
+			disk.Filename = path.Clean(file.Href)
+		}
+
+		units, err := parseAllocationUnits(d.Units)
+		if err != nil {
+			return nil, fmt.Errorf("Disk %v: %w", d.DiskID, err)
+		}
+
+		// The capacity may be a property reference like ${size}.
+		capacity, err := strconv.ParseInt(d.Capacity, 10, 64)
+		if err == nil {
+			if capacity > math.MaxInt64/units {
+				return nil, fmt.Errorf("Disk %v: capacity %v is too large",
+					d.DiskID, d.Capacity)
+			}
+			disk.Capacity = capacity * units
+		}
+
+		if d.PopulatedSize != "" {
+			disk.PopulatedSize, err = strconv.ParseInt(d.PopulatedSize, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Disk %v: invalid populated size %q",
+					d.DiskID, d.PopulatedSize)
+			}
+		}
+
+		res.Disks = append(res.Disks, disk)
+	}
+
+	return res, nil
+}
+
+// The number of bytes in a capacity allocation unit.
+func parseAllocationUnits(units string) (int64, error) {
+	units = strings.TrimSpace(units)
+	if value, pres := ovfNamedUnits[units]; pres {
+		return value, nil
+	}
+
+	match := ovfPowerUnitsRegex.FindStringSubmatch(units)
+	if len(match) > 0 {
+		base, _ := strconv.ParseInt(match[1], 10, 64)
+		exponent, _ := strconv.ParseInt(match[2], 10, 64)
+		value := math.Pow(float64(base), float64(exponent))
+		if base > 0 && value < math.MaxInt64 {
+			return int64(value), nil
+		}
+	}
+
+	match = ovfMultipleUnitsRegex.FindStringSubmatch(units)
+	if len(match) > 0 {
+		value, err := strconv.ParseInt(match[1], 10, 64)
+		if err == nil && value > 0 {
+			return value, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unsupported allocation units %q", units)
+}
+
+// File returns the file with the given id.
+func (self *OVF) File(id string) (OVFFile, bool) {
+	for _, file := range self.Files {
+		if file.ID == id {
+			return file, true
+		}
+	}
+	return OVFFile{}, false
+}
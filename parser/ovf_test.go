@@ -0,0 +1,80 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOVF(t *testing.T) {
+	ovf, err := ParseOVF([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1"
+    xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1">
+  <References>
+    <File ovf:href="disk1.vmdk" ovf:id="file1" ovf:size="68608"/>
+    <File ovf:href="disk2.vmdk.gz" ovf:id="file2" ovf:compression="gzip"/>
+  </References>
+  <DiskSection>
+    <Disk ovf:capacity="16" ovf:capacityAllocationUnits="byte * 2^30"
+        ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:populatedSize="1048576"
+        ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+    <Disk ovf:capacity="100" ovf:capacityAllocationUnits="MegaBytes"
+        ovf:diskId="vmdisk2" ovf:fileRef="file2"/>
+    <Disk ovf:capacity="${data.size}" ovf:diskId="data"/>
+    <Disk ovf:capacity="4096" ovf:diskId="small"/>
+  </DiskSection>
+</Envelope>
+`))
+	if err != nil {
+		t.Fatalf("ParseOVF: %v", err)
+	}
+
+	expected := &OVF{
+		Files: []OVFFile{
+			{ID: "file1", Href: "disk1.vmdk", Size: 68608},
+			{ID: "file2", Href: "disk2.vmdk.gz", Compression: "gzip"},
+		},
+		Disks: []OVFDisk{{
+			ID: "vmdisk1", FileRef: "file1", Filename: "disk1.vmdk",
+			Capacity: 16 << 30, PopulatedSize: 1 << 20,
+			Format: "http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized",
+		}, {
+			ID: "vmdisk2", FileRef: "file2", Filename: "disk2.vmdk.gz",
+			Capacity: 100 << 20,
+		}, {
+			// Set on import.
+			ID: "data",
+		}, {
+			ID: "small", Capacity: 4096,
+		}},
+	}
+	if !reflect.DeepEqual(ovf, expected) {
+		t.Fatalf("Unexpected OVF %+v", ovf)
+	}
+
+	file, pres := ovf.File("file2")
+	if !pres || file.Compression != "gzip" {
+		t.Fatalf("Unexpected file %+v", file)
+	}
+
+	for _, bad := range []string{
+		`<Envelope><DiskSection><Disk diskId="a" fileRef="missing"/></DiskSection></Envelope>`,
+		`<Envelope><DiskSection><Disk diskId="a" capacity="1" capacityAllocationUnits="percent"/></DiskSection></Envelope>`,
+		`<Envelope><DiskSection><Disk diskId="a" capacity="1" capacityAllocationUnits="byte * 2^70"/></DiskSection></Envelope>`,
+		`<Envelope><References><File id="f" size="big"/></References></Envelope>`,
+		`not xml`,
+	} {
+		_, err := ParseOVF([]byte(bad))
+		if err == nil {
+			t.Fatalf("Expected an error for %v", bad)
+		}
+	}
+
+	// Units of a plain multiple.
+	ovf, err = ParseOVF([]byte(strings.Replace(`<Envelope><DiskSection>
+<Disk diskId="a" capacity="3" capacityAllocationUnits="byte * 1024"/>
+</DiskSection></Envelope>`, "\n", "", -1)))
+	if err != nil || ovf.Disks[0].Capacity != 3072 {
+		t.Fatalf("Unexpected OVF %+v %v", ovf, err)
+	}
+}
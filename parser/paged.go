@@ -0,0 +1,195 @@
+package parser
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The cache used by GetVMDKContextFromFile and DirectoryOpener for
+// each file. Metadata reads are small and scattered so small pages do
+// best (see BenchmarkMetadataAccess). Reads of a page or more are data
+// and bypass the cache (see BenchmarkDataThroughput).
+const (
+	DEFAULT_PAGE_SIZE  = 1024
+	DEFAULT_PAGE_COUNT = 10000
+)
+
+// A cached page of the underlying reader.
+type page struct {
+	offset int64
+	data   []byte
+}
+
+// A page being read from the underlying reader. done is closed once
+// data or err is set.
+type pageFill struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// PagedReader caches fixed size pages of an underlying reader. Once
+// the cache is full the least recently used page is evicted. It is
+// safe for concurrent use: the lock is not held while reading, and
+// readers of a page being read wait for it rather than read it again.
+type PagedReader struct {
+	mu sync.Mutex
+
+	reader    io.ReaderAt
+	page_size int64
+	max_pages int
+
+	// Most recently used pages are at the front.
+	lru   *list.List
+	pages map[int64]*list.Element
+
+	// Pages being read, by offset.
+	filling map[int64]*pageFill
+}
+
+// NewPagedReader wraps reader with a cache of up to max_pages pages
+// of page_size bytes each.
+func NewPagedReader(reader io.ReaderAt, page_size, max_pages int) (
+	*PagedReader, error) {
+	if page_size <= 0 {
+		return nil, errors.New("Page size must be positive")
+	}
+
+	if max_pages <= 0 {
+		return nil, errors.New("Page count must be positive")
+	}
+
+	return &PagedReader{
+		reader:    reader,
+		page_size: int64(page_size),
+		max_pages: max_pages,
+		lru:       list.New(),
+		pages:     make(map[int64]*list.Element),
+		filling:   make(map[int64]*pageFill),
+	}, nil
+}
+
+// NewCachingReaderAt wraps reader with an LRU cache of pages pages of
+// page_size bytes. Values which are not positive use the defaults.
+// Reads at the end of the file return the available bytes and io.EOF.
+func NewCachingReaderAt(reader io.ReaderAt, page_size, pages int) *PagedReader {
+	if page_size <= 0 {
+		page_size = DEFAULT_PAGE_SIZE
+	}
+	if pages <= 0 {
+		pages = DEFAULT_PAGE_COUNT
+	}
+
+	res, _ := NewPagedReader(reader, page_size, pages)
+	return res
+}
+
+// DirectoryOpener returns an Opener for files in dir. Absolute
+// filenames are opened as is. Each file is read through a caching
+// reader and closed with the context.
+func DirectoryOpener(dir string) Opener {
+	return func(filename string) (io.ReaderAt, func(), error) {
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+
+		fd, err := os.Open(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reader := NewCachingReaderAt(fd, DEFAULT_PAGE_SIZE, DEFAULT_PAGE_COUNT)
+		return reader, func() { fd.Close() }, nil
+	}
+}
+
+func (self *PagedReader) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, io.EOF
+	}
+
+	// Large reads are rarely repeated, and splitting them into pages
+	// would turn one request into many.
+	if int64(len(buf)) >= self.page_size {
+		return self.reader.ReadAt(buf, offset)
+	}
+
+	n := 0
+	for n < len(buf) {
+		current := offset + int64(n)
+		page_offset := current - current%self.page_size
+
+		data, err := self.getPage(page_offset)
+		if err != nil {
+			return n, err
+		}
+
+		index_in_page := current - page_offset
+		if index_in_page >= int64(len(data)) {
+			return n, io.EOF
+		}
+
+		n += copy(buf[n:], data[index_in_page:])
+
+		// A short page is the end of the file.
+		if int64(len(data)) < self.page_size && n < len(buf) {
+			return n, io.EOF
+		}
+	}
+
+	return n, nil
+}
+
+// Fetch a page from the cache or the underlying reader. Pages are
+// never changed once read so the data may be used without the lock.
+func (self *PagedReader) getPage(offset int64) ([]byte, error) {
+	self.mu.Lock()
+	element, pres := self.pages[offset]
+	if pres {
+		self.lru.MoveToFront(element)
+		self.mu.Unlock()
+		return element.Value.(*page).data, nil
+	}
+
+	fill, pres := self.filling[offset]
+	if pres {
+		self.mu.Unlock()
+		<-fill.done
+		return fill.data, fill.err
+	}
+
+	fill = &pageFill{done: make(chan struct{})}
+	self.filling[offset] = fill
+	self.mu.Unlock()
+
+	data := make([]byte, self.page_size)
+	n, err := self.reader.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		fill.err = err
+	} else {
+		fill.data = data[:n]
+	}
+
+	self.mu.Lock()
+	delete(self.filling, offset)
+
+	// Failed reads are not cached so the next read tries again.
+	if fill.err == nil {
+		p := &page{offset: offset, data: fill.data}
+		self.pages[offset] = self.lru.PushFront(p)
+
+		for self.lru.Len() > self.max_pages {
+			oldest := self.lru.Back()
+			self.lru.Remove(oldest)
+			delete(self.pages, oldest.Value.(*page).offset)
+		}
+	}
+	self.mu.Unlock()
+
+	close(fill.done)
+	return fill.data, fill.err
+}
@@ -0,0 +1,393 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Counts reads reaching the underlying reader.
+type countingReader struct {
+	mu     sync.Mutex
+	reader io.ReaderAt
+	reads  int
+	bytes  int64
+}
+
+func (self *countingReader) ReadAt(buf []byte, offset int64) (int, error) {
+	self.mu.Lock()
+	self.reads++
+	self.bytes += int64(len(buf))
+	self.mu.Unlock()
+	return self.reader.ReadAt(buf, offset)
+}
+
+func TestPagedReader(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	counter := &countingReader{reader: bytes.NewReader(data)}
+	reader, err := NewPagedReader(counter, 64, 4)
+	if err != nil {
+		t.Fatalf("NewPagedReader: %v", err)
+	}
+
+	// A read spanning pages and a short read at the end of the file.
+	buf := make([]byte, 100)
+	n, err := reader.ReadAt(buf[:40], 110)
+	if err != nil || n != 40 || !bytes.Equal(buf[:n], data[110:150]) {
+		t.Fatalf("Read at 110: %v %v", n, err)
+	}
+
+	n, err = reader.ReadAt(buf[:40], 980)
+	if err != io.EOF || n != 20 || !bytes.Equal(buf[:n], data[980:]) {
+		t.Fatalf("Read at 980: %v %v", n, err)
+	}
+
+	// Reads of a page or more go straight to the reader.
+	reads := counter.reads
+	n, err = reader.ReadAt(buf, 950)
+	if err != io.EOF || n != 50 || !bytes.Equal(buf[:n], data[950:]) ||
+		counter.reads != reads+1 || len(reader.pages) != 3 {
+		t.Fatalf("Read at 950: %v %v", n, err)
+	}
+
+	// Cached pages are not read again.
+	reads = counter.reads
+	reader.ReadAt(buf[:10], 130)
+	if counter.reads != reads {
+		t.Fatalf("Cached page was read again")
+	}
+
+	// Reading more pages than the cache holds evicts the oldest.
+	for offset := int64(0); offset < 1000; offset += 64 {
+		reader.ReadAt(buf[:1], offset)
+	}
+	if len(reader.pages) != 4 || reader.lru.Len() != 4 {
+		t.Fatalf("Expected 4 cached pages, got %v", len(reader.pages))
+	}
+
+	reads = counter.reads
+	reader.ReadAt(buf[:1], 0)
+	if counter.reads != reads+1 {
+		t.Fatalf("Evicted page was not read again")
+	}
+
+	// Concurrent readers see consistent data.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 37)
+			for offset := int64(i); offset+37 <= 1000; offset += 13 {
+				_, err := reader.ReadAt(buf, offset)
+				if err != nil || !bytes.Equal(buf, data[offset:offset+37]) {
+					t.Errorf("Concurrent read at %v: %v", offset, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, err = NewPagedReader(counter, 0, 4)
+	if err == nil {
+		t.Fatalf("Expected an error for a zero page size")
+	}
+}
+
+// Blocks each read until another is in progress, or fails after a
+// while.
+type gateReader struct {
+	io.ReaderAt
+	entered chan struct{}
+}
+
+func (self *gateReader) ReadAt(buf []byte, offset int64) (int, error) {
+	select {
+	case self.entered <- struct{}{}:
+	case <-self.entered:
+	case <-time.After(5 * time.Second):
+		return 0, errors.New("reads were serialized")
+	}
+	return self.ReaderAt.ReadAt(buf, offset)
+}
+
+func TestPagedReaderConcurrentFill(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	// Two pages are read from the underlying reader at once.
+	reader, _ := NewPagedReader(&gateReader{
+		ReaderAt: bytes.NewReader(data),
+		entered:  make(chan struct{}),
+	}, 64, 4)
+
+	var wg sync.WaitGroup
+	for _, offset := range []int64{0, 512} {
+		wg.Add(1)
+		go func(offset int64) {
+			defer wg.Done()
+			buf := make([]byte, 10)
+			_, err := reader.ReadAt(buf, offset)
+			if err != nil || !bytes.Equal(buf, data[offset:offset+10]) {
+				t.Errorf("Read at %v: %v", offset, err)
+			}
+		}(offset)
+	}
+	wg.Wait()
+
+	// Readers of a page being read wait for it.
+	counter := &countingReader{reader: &slowReader{
+		ReaderAt: bytes.NewReader(data), delay: 20 * time.Millisecond}}
+	reader, _ = NewPagedReader(counter, 64, 4)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			buf := make([]byte, 10)
+			_, err := reader.ReadAt(buf, 100+i)
+			if err != nil || !bytes.Equal(buf, data[100+i:110+i]) {
+				t.Errorf("Read at %v: %v", 100+i, err)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	if counter.reads != 1 {
+		t.Fatalf("Expected one read of the page, got %v", counter.reads)
+	}
+}
+
+func TestGetVMDKContextFromFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range makeChainFiles() {
+		err := os.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	vmdk, err := GetVMDKContextFromFile(filepath.Join(dir, "snapshot.vmdk"))
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromFile: %v", err)
+	}
+	defer vmdk.Close()
+
+	expected, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("openTestDisk: %v", err)
+	}
+	defer expected.Close()
+
+	if vmdk.Size() != expected.Size() {
+		t.Fatalf("Size %v, expected %v", vmdk.Size(), expected.Size())
+	}
+
+	a := make([]byte, vmdk.Size())
+	b := make([]byte, expected.Size())
+	vmdk.ReadAt(a, 0)
+	expected.ReadAt(b, 0)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("Data read from file differs")
+	}
+
+	if vmdk.Parent() == nil {
+		t.Fatalf("Parent was not opened")
+	}
+}
+
+// Write a monolithicSparse disk of capacity bytes to dir, with every
+// stride'th grain allocated.
+func writeSparseFixture(b *testing.B, dir string, capacity, stride int64) string {
+	grains := map[int64][]byte{}
+	for i := int64(0); i < capacity/TEST_GRAIN_SIZE; i += stride {
+		grains[i] = bytes.Repeat([]byte{byte(i)}, TEST_GRAIN_SIZE)
+	}
+
+	sparse, err := NewTestSparseExtent(grains, capacity)
+	if err != nil {
+		b.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	vmdk, err := NewTestContext(sparse)
+	if err != nil {
+		b.Fatalf("NewTestContext: %v", err)
+	}
+
+	filename := filepath.Join(dir, "fixture.vmdk")
+	out, err := os.Create(filename)
+	if err != nil {
+		b.Fatalf("Create: %v", err)
+	}
+	defer out.Close()
+
+	err = vmdk.WriteMonolithicSparse(context.Background(), out,
+		"fixture.vmdk", nil)
+	if err != nil {
+		b.Fatalf("WriteMonolithicSparse: %v", err)
+	}
+	return filename
+}
+
+// Open the disk, walk its metadata and do small random reads, which
+// is mostly metadata access.
+func benchmarkMetadata(b *testing.B, filename string,
+	wrap func(fd *os.File) io.ReaderAt) {
+	rng := rand.New(rand.NewSource(1))
+	buf := make([]byte, SECTOR_SIZE)
+
+	for i := 0; i < b.N; i++ {
+		var files []*os.File
+		opener := func(name string) (io.ReaderAt, func(), error) {
+			fd, err := os.Open(filepath.Join(filepath.Dir(filename), name))
+			if err != nil {
+				return nil, nil, err
+			}
+			files = append(files, fd)
+			return wrap(fd), nil, nil
+		}
+
+		reader, _, _ := opener(filepath.Base(filename))
+		vmdk, err := GetVMDKContext(reader, 64*1024, opener)
+		if err != nil {
+			b.Fatalf("GetVMDKContext: %v", err)
+		}
+
+		vmdk.allocatedRanges(true)
+		for j := 0; j < 1000; j++ {
+			vmdk.ReadAt(buf, rng.Int63n(vmdk.Size()/SECTOR_SIZE)*SECTOR_SIZE)
+		}
+
+		for _, fd := range files {
+			fd.Close()
+		}
+	}
+}
+
+func BenchmarkMetadataAccess(b *testing.B) {
+	filename := writeSparseFixture(b, b.TempDir(), 256*1024*1024, 61)
+
+	b.Run("os.File", func(b *testing.B) {
+		benchmarkMetadata(b, filename, func(fd *os.File) io.ReaderAt {
+			return fd
+		})
+	})
+
+	for _, page_size := range []int{512, 1024, 4096, 16384, 65536} {
+		b.Run(fmt.Sprintf("page=%v", page_size), func(b *testing.B) {
+			benchmarkMetadata(b, filename, func(fd *os.File) io.ReaderAt {
+				return NewCachingReaderAt(fd, page_size,
+					DEFAULT_PAGE_COUNT*DEFAULT_PAGE_SIZE/page_size)
+			})
+		})
+	}
+}
+
+// Read a disk with every grain allocated in 1mb requests, as an export
+// does. Data reads bypass the page cache so reading through
+// GetVMDKContextFromFile keeps up with reading the files directly.
+func BenchmarkDataThroughput(b *testing.B) {
+	filename := writeSparseFixture(b, b.TempDir(), 64*1024*1024, 1)
+
+	direct := func() (*VMDKContext, error) {
+		opener := func(name string) (io.ReaderAt, func(), error) {
+			fd, err := os.Open(filepath.Join(filepath.Dir(filename), name))
+			if err != nil {
+				return nil, nil, err
+			}
+			return fd, func() { fd.Close() }, nil
+		}
+		return GetVMDKContextFromOpener(opener, filepath.Base(filename))
+	}
+
+	for _, c := range []struct {
+		name string
+		open func() (*VMDKContext, error)
+	}{
+		{"os.File", direct},
+		{"GetVMDKContextFromFile", func() (*VMDKContext, error) {
+			return GetVMDKContextFromFile(filename)
+		}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			vmdk, err := c.open()
+			if err != nil {
+				b.Fatalf("open: %v", err)
+			}
+			defer vmdk.Close()
+
+			buf := make([]byte, 1024*1024)
+			b.SetBytes(vmdk.Size())
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for offset := int64(0); offset < vmdk.Size(); offset += int64(len(buf)) {
+					_, err := vmdk.ReadAt(buf, offset)
+					if err != nil && err != io.EOF {
+						b.Fatalf("ReadAt: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Open errors wrap the opener's error so callers can find the cause.
+func TestOpenErrorsWrapped(t *testing.T) {
+	dir := t.TempDir()
+	files := makeChainFiles()
+	files["split.vmdk"] = []byte(strings.Replace(baseDescriptor,
+		`"base-data.vmdk"`, `"snapshot-data.vmdk" "missing-meta.vmdk"`, 1))
+	files["bad-magic.vmdk"] = []byte(strings.Replace(baseDescriptor,
+		"base-data.vmdk", "base.vmdk", 1))
+	delete(files, "base-data.vmdk")
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	// The parent of snapshot.vmdk is missing its extent.
+	for _, name := range []string{"base.vmdk", "split.vmdk", "snapshot.vmdk"} {
+		_, err := GetVMDKContextFromFile(filepath.Join(dir, name))
+		var path_err *os.PathError
+		if !errors.As(err, &path_err) || !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected a *os.PathError opening %v, got %v", name, err)
+		}
+	}
+
+	// Lazy extents report the error on first read.
+	vmdk, err := GetVMDKContextFromFile(filepath.Join(dir, "base.vmdk"),
+		WithLazyOpen(1))
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromFile: %v", err)
+	}
+	defer vmdk.Close()
+
+	var path_err *os.PathError
+	_, err = vmdk.ReadAt(make([]byte, SECTOR_SIZE), 0)
+	if !errors.As(err, &path_err) {
+		t.Fatalf("Expected a *os.PathError reading, got %v", err)
+	}
+
+	_, err = GetVMDKContextFromFile(filepath.Join(dir, "bad-magic.vmdk"))
+	if !errors.Is(err, ErrInvalidMagic) {
+		t.Fatalf("Expected ErrInvalidMagic, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// The part of a read which falls within one extent.
+type subRead struct {
+	extent Extent
+	buf    []byte
+
+	// Where the read starts within the extent.
+	offset int64
+
+	n   int
+	err error
+}
+
+// Read buf with the part in each extent fetched concurrently. The
+// result is the same as reading the extents in turn: on error the
+// bytes before the first failing extent are reported.
+func (self *VMDKContext) readParallel(buf []byte, offset int64,
+	deadline time.Time) (int, error) {
+	buf_len := int64(len(buf))
+
+	var reads []*subRead
+	i := int64(0)
+	for i < buf_len {
+		extent, err := self.getExtentForOffset(offset + i)
+		if err != nil {
+			// Missing extent - zero pad the rest of the buffer
+			zeroFill(buf[i:])
+			break
+		}
+
+		index_in_extent := offset + i - extent.VirtualOffset()
+		to_read := buf_len - i
+		if to_read > extent.TotalSize()-index_in_extent {
+			to_read = extent.TotalSize() - index_in_extent
+		}
+
+		reads = append(reads, &subRead{
+			extent: extent,
+			buf:    buf[i : i+to_read],
+			offset: index_in_extent,
+		})
+		i += to_read
+	}
+
+	if len(reads) < 2 {
+		return self.readExtents(buf, offset, 0, deadline)
+	}
+
+	// Start the reads in order, no more than read_concurrency at a
+	// time.
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, self.options.read_concurrency)
+	started := 0
+	for idx, r := range reads {
+		if !deadline.IsZero() && idx > 0 && time.Now().After(deadline) {
+			break
+		}
+
+		slots <- struct{}{}
+		started++
+		wg.Add(1)
+		go func(r *subRead) {
+			defer wg.Done()
+			r.n, r.err = r.extent.ReadAt(r.buf, r.offset)
+			<-slots
+		}(r)
+	}
+	wg.Wait()
+
+	i = 0
+	for _, r := range reads[:started] {
+		if r.err != nil && r.err != io.EOF {
+			return int(i), r.err
+		}
+
+		// No more data available - we cant make more progress.
+		if r.n == 0 {
+			return int(i), nil
+		}
+
+		// A short read is finished one extent at a time.
+		if r.n < len(r.buf) {
+			return self.readExtents(buf, offset, i+int64(r.n), deadline)
+		}
+		i += int64(r.n)
+	}
+
+	if started < len(reads) {
+		return int(i), deadlineError(buf_len, offset)
+	}
+
+	return int(buf_len), nil
+}
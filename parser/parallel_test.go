@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// A reader which always fails.
+type failingReader struct{}
+
+func (self failingReader) ReadAt(buf []byte, offset int64) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+// A disk made of extents of size bytes, each read through reader.
+func newExtentsDisk(readers []io.ReaderAt, size int64,
+	opts ...Option) *VMDKContext {
+	res := &VMDKContext{options: getOptions(opts)}
+	for _, reader := range readers {
+		res.extents = append(res.extents, &FlatExtent{
+			reader:     reader,
+			total_size: size,
+			offset:     res.total_size,
+		})
+		res.total_size += size
+	}
+	res.normalizeExtents()
+	return res
+}
+
+func TestReadConcurrency(t *testing.T) {
+	data := make([]byte, 2000*4096)
+	serial := newManyExtentDisk(data)
+	parallel := newManyExtentDisk(data)
+	parallel.options = getOptions([]Option{WithReadConcurrency(4)})
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		offset := rng.Int63n(serial.Size())
+		length := 1 + rng.Int63n(100000)
+
+		a := make([]byte, length)
+		b := make([]byte, length)
+		n1, err1 := serial.ReadAt(a, offset)
+		n2, err2 := parallel.ReadAt(b, offset)
+		if n1 != n2 || err1 != err2 || !bytes.Equal(a, b) {
+			t.Fatalf("Read of %v at %v differs: %v %v vs %v %v",
+				length, offset, n1, err1, n2, err2)
+		}
+	}
+
+	// The bytes before the first failing extent are reported.
+	readers := []io.ReaderAt{
+		bytes.NewReader(make([]byte, 4096)),
+		bytes.NewReader(make([]byte, 4096)),
+		failingReader{},
+		bytes.NewReader(make([]byte, 4096)),
+		failingReader{},
+	}
+	for _, concurrency := range []int{1, 2, 8} {
+		vmdk := newExtentsDisk(readers, 4096, WithReadConcurrency(concurrency))
+		n, err := vmdk.ReadAt(make([]byte, vmdk.Size()), 1000)
+		if n != 2*4096-1000 || err == nil {
+			t.Fatalf("Concurrency %v: expected an error after %v bytes, "+
+				"got %v %v", concurrency, 2*4096-1000, n, err)
+		}
+	}
+
+	// A short extent is finished one extent at a time.
+	readers = []io.ReaderAt{
+		bytes.NewReader(bytes.Repeat([]byte("A"), 4096)),
+		bytes.NewReader(bytes.Repeat([]byte("B"), 1000)),
+		bytes.NewReader(bytes.Repeat([]byte("C"), 4096)),
+	}
+	vmdk := newExtentsDisk(readers, 4096, WithReadConcurrency(3))
+	buf := make([]byte, vmdk.Size())
+	n, err := vmdk.ReadAt(buf, 0)
+	if n != 5096 || err != nil {
+		t.Fatalf("Expected a short read, got %v %v", n, err)
+	}
+}
+
+func BenchmarkReadConcurrency(b *testing.B) {
+	extent_size := int64(64 * 1024)
+	var readers []io.ReaderAt
+	for i := 0; i < 8; i++ {
+		readers = append(readers, &slowReader{
+			ReaderAt: bytes.NewReader(make([]byte, extent_size)),
+			delay:    time.Millisecond,
+		})
+	}
+
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency=%v", concurrency), func(b *testing.B) {
+			vmdk := newExtentsDisk(readers, extent_size,
+				WithReadConcurrency(concurrency))
+			buf := make([]byte, vmdk.Size())
+
+			b.SetBytes(vmdk.Size())
+			for i := 0; i < b.N; i++ {
+				vmdk.ReadAt(buf, 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package parser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	ErrNoPartitionTable = errors.New("No partition table found")
+)
+
+const (
+	MBR_PROTECTIVE_GPT = 0xee
+
+	// Extended partitions contain a chain of logical partitions.
+	MBR_EXTENDED       = 0x05
+	MBR_EXTENDED_LBA   = 0x0f
+	MBR_EXTENDED_LINUX = 0x85
+
+	// Upper bound on the length of an extended partition chain.
+	MAX_LOGICAL_PARTITIONS = 128
+
+	// The number of the first logical partition.
+	FIRST_LOGICAL_PARTITION = 5
+
+	// GPT entries are 128 bytes in practice. Larger ones are allowed
+	// up to these bounds so a corrupt header can not make us allocate
+	// gigabytes for the table.
+	MAX_GPT_ENTRY_SIZE = 4096
+	MAX_GPT_TABLE_SIZE = 1024 * 1024
+)
+
+type Partition struct {
+	// Partitions are numbered like Linux does: primary partitions and
+	// GPT entries by their slot in the table from 1, and logical
+	// partitions from 5 in chain order.
+	Index int `json:"Index"`
+
+	// The MBR partition type (e.g. 0x07) or the GPT type GUID.
+	Type string `json:"Type"`
+
+	// Byte offset and size of the partition.
+	Start int64 `json:"Start"`
+	Size  int64 `json:"Size"`
+
+	// GPT only.
+	Name string `json:"Name,omitempty"`
+	GUID string `json:"GUID,omitempty"`
+
+	// A logical partition within an MBR extended partition.
+	Logical bool `json:"Logical,omitempty"`
+}
+
+// Partitions parses the MBR or GPT partition table at the start of
+// the disk.
+func (self *VMDKContext) Partitions() ([]Partition, error) {
+	return GetPartitions(self)
+}
+
+func GetPartitions(reader io.ReaderAt) ([]Partition, error) {
+	mbr := make([]byte, SECTOR_SIZE)
+	n, err := reader.ReadAt(mbr, 0)
+	if n < SECTOR_SIZE {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, ErrNoPartitionTable
+	}
+
+	var res []Partition
+	var extended []int64
+
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+i*16 : 446+(i+1)*16]
+		part_type := entry[4]
+		if part_type == 0 {
+			continue
+		}
+
+		if part_type == MBR_PROTECTIVE_GPT {
+			return getGPTPartitions(reader)
+		}
+
+		start := int64(binary.LittleEndian.Uint32(entry[8:]))
+		res = append(res, Partition{
+			Index: i + 1,
+			Type:  fmt.Sprintf("0x%02x", part_type),
+			Start: start * SECTOR_SIZE,
+			Size:  int64(binary.LittleEndian.Uint32(entry[12:])) * SECTOR_SIZE,
+		})
+
+		if isExtended(part_type) {
+			extended = append(extended, start)
+		}
+	}
+
+	// Logical partitions are numbered after the four primary slots.
+	index := FIRST_LOGICAL_PARTITION
+	for _, start := range extended {
+		logical, err := getLogicalPartitions(reader, start)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range logical {
+			p.Index = index
+			index++
+			res = append(res, p)
+		}
+	}
+
+	return res, nil
+}
+
+func isExtended(part_type byte) bool {
+	return part_type == MBR_EXTENDED || part_type == MBR_EXTENDED_LBA ||
+		part_type == MBR_EXTENDED_LINUX
+}
+
+// Walk the chain of extended boot records (EBR) in the extended
+// partition starting at sector extended_start. Each EBR describes one
+// logical partition relative to the EBR and links to the next EBR
+// relative to the start of the extended partition.
+func getLogicalPartitions(reader io.ReaderAt, extended_start int64) (
+	[]Partition, error) {
+	var res []Partition
+
+	ebr := make([]byte, SECTOR_SIZE)
+	ebr_sector := extended_start
+	seen := make(map[int64]bool)
+
+	for len(res) < MAX_LOGICAL_PARTITIONS && !seen[ebr_sector] {
+		seen[ebr_sector] = true
+
+		n, err := reader.ReadAt(ebr, ebr_sector*SECTOR_SIZE)
+		if n < SECTOR_SIZE {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("While reading EBR at sector %v: %w",
+				ebr_sector, err)
+		}
+
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return nil, fmt.Errorf("Invalid EBR at sector %v", ebr_sector)
+		}
+
+		le := binary.LittleEndian
+		entry := ebr[446:462]
+		if entry[4] != 0 {
+			res = append(res, Partition{
+				Type: fmt.Sprintf("0x%02x", entry[4]),
+				Start: (ebr_sector + int64(le.Uint32(entry[8:]))) *
+					SECTOR_SIZE,
+				Size:    int64(le.Uint32(entry[12:])) * SECTOR_SIZE,
+				Logical: true,
+			})
+		}
+
+		next := ebr[462:478]
+		if !isExtended(next[4]) {
+			break
+		}
+		ebr_sector = extended_start + int64(le.Uint32(next[8:]))
+	}
+
+	return res, nil
+}
+
+func getGPTPartitions(reader io.ReaderAt) ([]Partition, error) {
+	header := make([]byte, SECTOR_SIZE)
+	_, err := reader.ReadAt(header, SECTOR_SIZE)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if string(header[:8]) != "EFI PART" {
+		return nil, errors.New("Invalid GPT header")
+	}
+
+	le := binary.LittleEndian
+	entries_lba := int64(le.Uint64(header[72:]))
+	entry_count := int64(le.Uint32(header[80:]))
+	entry_size := int64(le.Uint32(header[84:]))
+
+	if entry_size < 128 || entry_size > MAX_GPT_ENTRY_SIZE ||
+		entry_size%8 != 0 || entry_count > 1024 ||
+		entry_count*entry_size > MAX_GPT_TABLE_SIZE {
+		return nil, errors.New("Invalid GPT header")
+	}
+
+	entries := make([]byte, entry_count*entry_size)
+	_, err = reader.ReadAt(entries, entries_lba*SECTOR_SIZE)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var res []Partition
+	for i := int64(0); i < entry_count; i++ {
+		entry := entries[i*entry_size : (i+1)*entry_size]
+		if isZero(entry[:16]) {
+			continue
+		}
+
+		first_lba := le.Uint64(entry[32:])
+		last_lba := le.Uint64(entry[40:])
+		if last_lba < first_lba || last_lba >= math.MaxInt64/SECTOR_SIZE {
+			return nil, fmt.Errorf("Invalid GPT entry %v: LBAs %v to %v",
+				i+1, first_lba, last_lba)
+		}
+
+		res = append(res, Partition{
+			Index: int(i) + 1,
+			Type:  formatGUID(entry[:16]),
+			GUID:  formatGUID(entry[16:32]),
+			Start: int64(first_lba) * SECTOR_SIZE,
+			Size:  int64(last_lba-first_lba+1) * SECTOR_SIZE,
+			Name:  decodeUTF16(entry[56:128]),
+		})
+	}
+
+	return res, nil
+}
+
+// Format a mixed endian GUID as stored on disk.
+func formatGUID(buf []byte) string {
+	le := binary.LittleEndian
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		le.Uint32(buf[0:]), le.Uint16(buf[4:]), le.Uint16(buf[6:]),
+		buf[8:10], buf[10:16])
+}
+
+func decodeUTF16(buf []byte) string {
+	var u16 []uint16
+	for i := 0; i+1 < len(buf); i += 2 {
+		c := binary.LittleEndian.Uint16(buf[i:])
+		if c == 0 {
+			break
+		}
+		u16 = append(u16, c)
+	}
+	return string(utf16.Decode(u16))
+}
+
+// GetPartitionByGUID returns the GPT partition with the given unique
+// partition GUID.
+func (self *VMDKContext) GetPartitionByGUID(guid string) (*Partition, error) {
+	partitions, err := self.Partitions()
+	if err != nil {
+		return nil, err
+	}
+
+	guid = strings.Trim(guid, "{}")
+	for _, p := range partitions {
+		if p.GUID != "" && strings.EqualFold(p.GUID, guid) {
+			return &p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Partition %v not found", guid)
+}
+
+// GetPartition returns partition n, numbered as in Partition.Index.
+func (self *VMDKContext) GetPartition(n int) (*Partition, error) {
+	partitions, err := self.Partitions()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range partitions {
+		if p.Index == n {
+			return &p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Partition %v not found", n)
+}
+
+// PartitionReaderAt returns a reader over partition n (numbered as in
+// Partition.Index) and its size, suitable for handing to a filesystem parser. Offset
+// 0 of the reader is the start of the partition. Partitions extending
+// past the end of the disk are truncated.
+func (self *VMDKContext) PartitionReaderAt(n int) (io.ReaderAt, int64, error) {
+	partition, err := self.GetPartition(n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if partition.Start >= self.total_size {
+		return nil, 0, fmt.Errorf(
+			"Partition %v starts beyond the end of the disk", n)
+	}
+
+	size := partition.Size
+	if partition.Start+size > self.total_size {
+		size = self.total_size - partition.Start
+	}
+
+	return io.NewSectionReader(self, partition.Start, size), size, nil
+}
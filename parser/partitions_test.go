@@ -0,0 +1,267 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"unicode/utf16"
+)
+
+func buildMBR(entries ...[3]uint32) []byte {
+	mbr := make([]byte, SECTOR_SIZE)
+	for i, e := range entries {
+		entry := mbr[446+i*16:]
+		entry[4] = byte(e[0])
+		binary.LittleEndian.PutUint32(entry[8:], e[1])
+		binary.LittleEndian.PutUint32(entry[12:], e[2])
+	}
+	mbr[510] = 0x55
+	mbr[511] = 0xaa
+	return mbr
+}
+
+func TestMBRPartitions(t *testing.T) {
+	disk := buildMBR([3]uint32{0x07, 2048, 4096}, [3]uint32{0x83, 8192, 100})
+
+	partitions, err := GetPartitions(bytes.NewReader(disk))
+	if err != nil {
+		t.Fatalf("GetPartitions: %v", err)
+	}
+
+	if len(partitions) != 2 ||
+		partitions[0] != (Partition{Index: 1, Type: "0x07",
+			Start: 2048 * SECTOR_SIZE, Size: 4096 * SECTOR_SIZE}) ||
+		partitions[1].Type != "0x83" ||
+		partitions[1].Start != 8192*SECTOR_SIZE {
+		t.Fatalf("Unexpected partitions %+v", partitions)
+	}
+
+	_, err = GetPartitions(bytes.NewReader(make([]byte, SECTOR_SIZE)))
+	if err != ErrNoPartitionTable {
+		t.Fatalf("Expected ErrNoPartitionTable, got %v", err)
+	}
+}
+
+func TestGPTPartitions(t *testing.T) {
+	disk := make([]byte, 34*SECTOR_SIZE)
+	copy(disk, buildMBR([3]uint32{MBR_PROTECTIVE_GPT, 1, 0xffffffff}))
+
+	le := binary.LittleEndian
+	header := disk[SECTOR_SIZE:]
+	copy(header, "EFI PART")
+	le.PutUint64(header[72:], 2)
+	le.PutUint32(header[80:], 128)
+	le.PutUint32(header[84:], 128)
+
+	// Basic data partition.
+	entry := disk[2*SECTOR_SIZE:]
+	copy(entry, []byte{0xa2, 0xa0, 0xd0, 0xeb, 0xe5, 0xb9, 0x33, 0x44,
+		0x87, 0xc0, 0x68, 0xb6, 0xb7, 0x26, 0x99, 0xc7})
+	entry[16] = 1
+	le.PutUint64(entry[32:], 2048)
+	le.PutUint64(entry[40:], 4095)
+	for i, c := range utf16.Encode([]rune("data")) {
+		le.PutUint16(entry[56+i*2:], c)
+	}
+
+	partitions, err := GetPartitions(bytes.NewReader(disk))
+	if err != nil {
+		t.Fatalf("GetPartitions: %v", err)
+	}
+
+	expected := Partition{
+		Index: 1,
+		Type:  "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7",
+		GUID:  "00000001-0000-0000-0000-000000000000",
+		Start: 2048 * SECTOR_SIZE,
+		Size:  2048 * SECTOR_SIZE,
+		Name:  "data",
+	}
+	if len(partitions) != 1 || partitions[0] != expected {
+		t.Fatalf("Unexpected partitions %+v", partitions)
+	}
+
+	vmdk := NewFlatContext(bytes.NewReader(disk), int64(len(disk)))
+	partition, err := vmdk.GetPartitionByGUID(
+		"{00000001-0000-0000-0000-000000000000}")
+	if err != nil || *partition != expected {
+		t.Fatalf("Unexpected partition %+v: %v", partition, err)
+	}
+
+	_, err = vmdk.GetPartitionByGUID("00000002-0000-0000-0000-000000000000")
+	if err == nil {
+		t.Fatalf("Expected an error for a missing GUID")
+	}
+}
+
+// Partitions are numbered by their slot, so an empty first slot does
+// not renumber the rest.
+func TestPartitionNumbering(t *testing.T) {
+	disk := buildMBR([3]uint32{}, [3]uint32{0x07, 2048, 4096},
+		[3]uint32{}, [3]uint32{0x83, 8192, 100})
+
+	partitions, err := GetPartitions(bytes.NewReader(disk))
+	if err != nil {
+		t.Fatalf("GetPartitions: %v", err)
+	}
+
+	if len(partitions) != 2 || partitions[0].Index != 2 ||
+		partitions[1].Index != 4 {
+		t.Fatalf("Unexpected partitions %+v", partitions)
+	}
+
+	vmdk := NewFlatContext(bytes.NewReader(disk), int64(len(disk)))
+	_, err = vmdk.GetPartition(1)
+	if err == nil {
+		t.Fatalf("Expected an error for the empty first slot")
+	}
+
+	// GPT entries are numbered by their index in the table.
+	gpt := make([]byte, 8*SECTOR_SIZE)
+	copy(gpt, buildMBR([3]uint32{MBR_PROTECTIVE_GPT, 1, 0xffffffff}))
+
+	le := binary.LittleEndian
+	header := gpt[SECTOR_SIZE:]
+	copy(header, "EFI PART")
+	le.PutUint64(header[72:], 2)
+	le.PutUint32(header[80:], 4)
+	le.PutUint32(header[84:], 128)
+
+	entry := gpt[2*SECTOR_SIZE+2*128:]
+	entry[0] = 1
+	le.PutUint64(entry[32:], 2048)
+	le.PutUint64(entry[40:], 4095)
+
+	partitions, err = GetPartitions(bytes.NewReader(gpt))
+	if err != nil || len(partitions) != 1 || partitions[0].Index != 3 {
+		t.Fatalf("Unexpected partitions %+v: %v", partitions, err)
+	}
+}
+
+func TestCorruptGPT(t *testing.T) {
+	build := func(patch func(header, entry []byte)) []byte {
+		disk := make([]byte, 8*SECTOR_SIZE)
+		copy(disk, buildMBR([3]uint32{MBR_PROTECTIVE_GPT, 1, 0xffffffff}))
+
+		le := binary.LittleEndian
+		header := disk[SECTOR_SIZE:]
+		copy(header, "EFI PART")
+		le.PutUint64(header[72:], 2)
+		le.PutUint32(header[80:], 4)
+		le.PutUint32(header[84:], 128)
+
+		entry := disk[2*SECTOR_SIZE:]
+		entry[0] = 1
+		le.PutUint64(entry[32:], 2048)
+		le.PutUint64(entry[40:], 4095)
+
+		patch(header, entry)
+		return disk
+	}
+
+	le := binary.LittleEndian
+	for name, patch := range map[string]func(header, entry []byte){
+		"huge entries": func(header, entry []byte) {
+			le.PutUint32(header[84:], 0xfffffff0)
+		},
+		"unaligned entries": func(header, entry []byte) {
+			le.PutUint32(header[84:], 130)
+		},
+		"huge table": func(header, entry []byte) {
+			le.PutUint32(header[80:], 1024)
+			le.PutUint32(header[84:], 4096)
+		},
+		"reversed LBAs": func(header, entry []byte) {
+			le.PutUint64(entry[40:], 100)
+		},
+		"LBA overflows": func(header, entry []byte) {
+			le.PutUint64(entry[40:], 1<<62)
+		},
+	} {
+		_, err := GetPartitions(bytes.NewReader(build(patch)))
+		if err == nil {
+			t.Fatalf("%v: Expected an error", name)
+		}
+	}
+}
+
+func TestLogicalPartitions(t *testing.T) {
+	disk := make([]byte, 64*SECTOR_SIZE)
+	copy(disk, buildMBR([3]uint32{0x07, 8, 8}, [3]uint32{0x0f, 20, 40}))
+
+	// EBRs link to the next EBR relative to the extended partition.
+	copy(disk[20*SECTOR_SIZE:], buildMBR(
+		[3]uint32{0x83, 2, 4}, [3]uint32{0x05, 10, 20}))
+	copy(disk[30*SECTOR_SIZE:], buildMBR([3]uint32{0x07, 2, 6}))
+
+	partitions, err := GetPartitions(bytes.NewReader(disk))
+	if err != nil {
+		t.Fatalf("GetPartitions: %v", err)
+	}
+
+	expected := []Partition{
+		{Index: 1, Type: "0x07", Start: 8 * SECTOR_SIZE, Size: 8 * SECTOR_SIZE},
+		{Index: 2, Type: "0x0f", Start: 20 * SECTOR_SIZE, Size: 40 * SECTOR_SIZE},
+		{Index: 5, Type: "0x83", Start: 22 * SECTOR_SIZE, Size: 4 * SECTOR_SIZE,
+			Logical: true},
+		{Index: 6, Type: "0x07", Start: 32 * SECTOR_SIZE, Size: 6 * SECTOR_SIZE,
+			Logical: true},
+	}
+	if len(partitions) != len(expected) {
+		t.Fatalf("Unexpected partitions %+v", partitions)
+	}
+	for i, p := range expected {
+		if partitions[i] != p {
+			t.Fatalf("Unexpected partition %+v, expected %+v", partitions[i], p)
+		}
+	}
+
+	// A chain which loops back on itself terminates.
+	copy(disk[30*SECTOR_SIZE:], buildMBR(
+		[3]uint32{0x07, 2, 6}, [3]uint32{0x05, 0, 40}))
+	partitions, err = GetPartitions(bytes.NewReader(disk))
+	if err != nil || len(partitions) != 4 {
+		t.Fatalf("Unexpected partitions %+v: %v", partitions, err)
+	}
+}
+
+func TestPartitionReaderAt(t *testing.T) {
+	disk := make([]byte, 64*SECTOR_SIZE)
+	copy(disk, buildMBR([3]uint32{0x07, 8, 16}, [3]uint32{0x83, 60, 100}))
+	copy(disk[8*SECTOR_SIZE:], "PARTITION 1")
+
+	vmdk := NewFlatContext(bytes.NewReader(disk), int64(len(disk)))
+
+	reader, size, err := vmdk.PartitionReaderAt(1)
+	if err != nil {
+		t.Fatalf("PartitionReaderAt: %v", err)
+	}
+
+	if size != 16*SECTOR_SIZE {
+		t.Fatalf("Unexpected size %v", size)
+	}
+
+	buf := make([]byte, 11)
+	_, err = reader.ReadAt(buf, 0)
+	if err != nil || string(buf) != "PARTITION 1" {
+		t.Fatalf("Unexpected data at partition offset 0: %q %v", buf, err)
+	}
+
+	// Reads are confined to the partition.
+	n, err := reader.ReadAt(buf, size-4)
+	if n != 4 || err != io.EOF {
+		t.Fatalf("Expected a short read at the end, got %v %v", n, err)
+	}
+
+	// The second partition is truncated to the end of the disk.
+	_, size, err = vmdk.PartitionReaderAt(2)
+	if err != nil || size != 4*SECTOR_SIZE {
+		t.Fatalf("Unexpected size %v: %v", size, err)
+	}
+
+	_, _, err = vmdk.PartitionReaderAt(3)
+	if err == nil {
+		t.Fatalf("Expected an error for a missing partition")
+	}
+}
@@ -0,0 +1,78 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// PhysicalOffset reports where the byte at the virtual offset is
+// stored: the extent file and the byte offset within it. For holes
+// allocated is false. Holes in a snapshot are resolved through the
+// parent disk, so the result names the file the data is actually read
+// from.
+func (self *VMDKContext) PhysicalOffset(virtual int64) (
+	filename string, physical int64, allocated bool, err error) {
+	if virtual < 0 || virtual >= self.total_size {
+		return "", 0, false, io.EOF
+	}
+
+	extent, err := self.getExtentForOffset(virtual)
+	if err != nil {
+		return "", 0, false, nil
+	}
+
+	filename, physical, allocated, err = physicalOffset(
+		extent, virtual-extent.VirtualOffset())
+
+	// A zeroed grain hides the parent's data.
+	if err == errZeroGrain {
+		return filename, 0, false, nil
+	}
+	if err != nil || allocated || self.parent == nil {
+		return filename, physical, allocated, err
+	}
+
+	if _, ok := extent.(*NullExtent); ok {
+		return filename, physical, allocated, err
+	}
+	return self.parent.PhysicalOffset(virtual)
+}
+
+// Resolve an offset relative to the start of the extent.
+func physicalOffset(extent Extent, offset int64) (
+	filename string, physical int64, allocated bool, err error) {
+	switch t := extent.(type) {
+	case *NullExtent:
+		return "", 0, false, nil
+
+	case *FlatExtent:
+		return t.filename, t.file_offset + offset, true, nil
+
+	case *SparseExtent:
+		start, _, err := t.getGrainForOffset(offset)
+		if errors.Is(err, io.EOF) {
+			return t.filename, 0, false, nil
+		}
+		if err != nil {
+			// Includes errZeroGrain which the caller handles.
+			return t.filename, 0, false, err
+		}
+		return t.filename, start, true, nil
+
+	case *lazyExtent:
+		handle, err := t.handles.get(t)
+		if err != nil {
+			return t.filename, 0, false, fmt.Errorf(
+				"While opening %v: %w", t.filename, err)
+		}
+		defer t.handles.release(handle)
+
+		return physicalOffset(handle.extent, offset)
+
+	default:
+		// Compressed grains have no byte for byte location.
+		return "", 0, false, fmt.Errorf(
+			"%w: no physical offset for %T", ErrUnsupported, extent)
+	}
+}
@@ -0,0 +1,68 @@
+package parser
+
+import (
+	"testing"
+)
+
+func TestPhysicalOffset(t *testing.T) {
+	files := makeChainFiles()
+	files["flat.vmdk"] = []byte(`# Disk DescriptorFile
+version=1
+CID=33333333
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 2048 FLAT "flat-data.vmdk" 8
+`)
+	files["flat-data.vmdk"] = make([]byte, 2056*SECTOR_SIZE)
+
+	flat, err := openTestDisk(files, "flat.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer flat.Close()
+
+	filename, physical, allocated, err := flat.PhysicalOffset(0x1234)
+	if err != nil || filename != "flat-data.vmdk" ||
+		physical != 8*SECTOR_SIZE+0x1234 || !allocated {
+		t.Fatalf("Flat: %v %#x %v %v", filename, physical, allocated, err)
+	}
+
+	snapshot, err := openTestDisk(files, "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer snapshot.Close()
+
+	// The test extents keep their grains after 6 sectors of metadata.
+	grains := int64(6 * SECTOR_SIZE)
+
+	for _, tc := range []struct {
+		virtual   int64
+		filename  string
+		physical  int64
+		allocated bool
+	}{
+		// Allocated in the snapshot.
+		{testGrainSize + 10, "snapshot-data.vmdk", grains + 10, true},
+
+		// A hole in the snapshot read from the base.
+		{5, "base-data.vmdk", grains + 5, true},
+
+		// Not allocated anywhere.
+		{2*testGrainSize + 1, "base-data.vmdk", 0, false},
+	} {
+		filename, physical, allocated, err := snapshot.PhysicalOffset(tc.virtual)
+		if err != nil || filename != tc.filename ||
+			physical != tc.physical || allocated != tc.allocated {
+			t.Fatalf("%#x: %v %#x %v %v", tc.virtual,
+				filename, physical, allocated, err)
+		}
+	}
+
+	_, _, _, err = snapshot.PhysicalOffset(snapshot.Size())
+	if err == nil {
+		t.Fatalf("Expected an error past the end of the disk")
+	}
+}
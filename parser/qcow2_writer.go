@@ -0,0 +1,303 @@
+package parser
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	QCOW2_MAGIC        = 0x514649fb
+	QCOW2_VERSION      = 3
+	QCOW2_HEADER_SIZE  = 104
+	QCOW2_CLUSTER_BITS = 16
+	QCOW2_CLUSTER_SIZE = 1 << QCOW2_CLUSTER_BITS
+
+	// 16 bit refcounts.
+	QCOW2_REFCOUNT_ORDER = 4
+
+	// L1 and L2 entries for clusters with a refcount of exactly one.
+	QCOW2_COPIED = 1 << 63
+
+	// L2 entries for compressed clusters hold the offset of the data
+	// in the low bits and the number of additional sectors it takes
+	// above them.
+	QCOW2_COMPRESSED            = 1 << 62
+	QCOW2_COMPRESSED_SIZE_SHIFT = 62 - (QCOW2_CLUSTER_BITS - 8)
+
+	// qemu inflates compressed clusters with a 4kb window.
+	QCOW2_DEFLATE_WINDOW = 4096
+)
+
+// Writes a QCOW2 v3 image. Data clusters are appended as they are
+// written and each L2 table once all the clusters it covers are done,
+// so only one L2 table is held in memory. The L1 table sits after the
+// header and the refcount structures are written at the end.
+type qcow2Writer struct {
+	out      io.WriterAt
+	size     int64
+	compress bool
+
+	l1 []uint64
+
+	// The L2 table being filled and its index in the L1 table.
+	l2       []uint64
+	l2_index int64
+	l2_used  bool
+
+	// The end of the data written so far. Compressed clusters are
+	// packed byte aligned, everything else is on a cluster boundary.
+	end int64
+
+	// The refcount of each host cluster.
+	refcounts []uint16
+
+	compressed bytes.Buffer
+}
+
+func newQCOW2Writer(out io.WriterAt, size int64, compress bool) *qcow2Writer {
+	clusters := (size + QCOW2_CLUSTER_SIZE - 1) / QCOW2_CLUSTER_SIZE
+	l2_entries := int64(QCOW2_CLUSTER_SIZE / 8)
+	l1_size := (clusters + l2_entries - 1) / l2_entries
+	l1_clusters := (l1_size*8 + QCOW2_CLUSTER_SIZE - 1) / QCOW2_CLUSTER_SIZE
+
+	self := &qcow2Writer{
+		out:      out,
+		size:     size,
+		compress: compress,
+		l1:       make([]uint64, l1_size),
+		l2:       make([]uint64, l2_entries),
+	}
+
+	// The header cluster then the L1 table.
+	self.end = (1 + l1_clusters) * QCOW2_CLUSTER_SIZE
+	self.addRefs(0, self.end)
+	return self
+}
+
+// Count a reference to each host cluster in the range.
+func (self *qcow2Writer) addRefs(offset, length int64) {
+	last := (offset + length - 1) / QCOW2_CLUSTER_SIZE
+	for int64(len(self.refcounts)) <= last {
+		self.refcounts = append(self.refcounts, 0)
+	}
+
+	for i := offset / QCOW2_CLUSTER_SIZE; i <= last; i++ {
+		self.refcounts[i]++
+	}
+}
+
+// Allocate a whole host cluster.
+func (self *qcow2Writer) allocCluster() int64 {
+	offset := (self.end + QCOW2_CLUSTER_SIZE - 1) /
+		QCOW2_CLUSTER_SIZE * QCOW2_CLUSTER_SIZE
+	self.end = offset + QCOW2_CLUSTER_SIZE
+	self.addRefs(offset, QCOW2_CLUSTER_SIZE)
+	return offset
+}
+
+// Write a cluster of the virtual disk. Clusters must be written in
+// order.
+func (self *qcow2Writer) writeCluster(cluster int64, data []byte) error {
+	l2_entries := int64(len(self.l2))
+	if cluster/l2_entries != self.l2_index {
+		err := self.flushL2()
+		if err != nil {
+			return err
+		}
+		self.l2_index = cluster / l2_entries
+	}
+	self.l2_used = true
+
+	if self.compress {
+		compressed, err := self.deflate(data)
+		if err != nil {
+			return err
+		}
+
+		// Only keep the compressed form if it saves a sector.
+		if len(compressed) <= QCOW2_CLUSTER_SIZE-SECTOR_SIZE {
+			offset := self.end
+			_, err = self.out.WriteAt(compressed, offset)
+			if err != nil {
+				return err
+			}
+			self.end += int64(len(compressed))
+			self.addRefs(offset, int64(len(compressed)))
+
+			sectors := (offset+int64(len(compressed))-1)/SECTOR_SIZE -
+				offset/SECTOR_SIZE
+			self.l2[cluster%l2_entries] = QCOW2_COMPRESSED |
+				uint64(sectors)<<QCOW2_COMPRESSED_SIZE_SHIFT | uint64(offset)
+			return nil
+		}
+	}
+
+	offset := self.allocCluster()
+	_, err := self.out.WriteAt(data, offset)
+	if err != nil {
+		return err
+	}
+
+	self.l2[cluster%l2_entries] = QCOW2_COPIED | uint64(offset)
+	return nil
+}
+
+// Compress a cluster as raw deflate which qemu can inflate with its
+// 4kb window. Each 4kb of input is compressed separately and flushed
+// to a byte boundary, so no match refers back further than that.
+func (self *qcow2Writer) deflate(data []byte) ([]byte, error) {
+	self.compressed.Reset()
+	for i := 0; i < len(data); i += QCOW2_DEFLATE_WINDOW {
+		w, err := flate.NewWriter(&self.compressed, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = w.Write(data[i : i+QCOW2_DEFLATE_WINDOW])
+		if err != nil {
+			return nil, err
+		}
+
+		err = w.Flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// An empty final stored block ends the stream.
+	self.compressed.Write([]byte{1, 0, 0, 0xff, 0xff})
+	return self.compressed.Bytes(), nil
+}
+
+// Write the current L2 table if it has any entries.
+func (self *qcow2Writer) flushL2() error {
+	if !self.l2_used {
+		return nil
+	}
+
+	table := make([]byte, QCOW2_CLUSTER_SIZE)
+	for i, entry := range self.l2 {
+		binary.BigEndian.PutUint64(table[i*8:], entry)
+		self.l2[i] = 0
+	}
+
+	offset := self.allocCluster()
+	_, err := self.out.WriteAt(table, offset)
+	if err != nil {
+		return err
+	}
+
+	self.l1[self.l2_index] = QCOW2_COPIED | uint64(offset)
+	self.l2_used = false
+	return nil
+}
+
+// Write the last L2 table, the L1 table, the refcount structures and
+// the header.
+func (self *qcow2Writer) close() error {
+	err := self.flushL2()
+	if err != nil {
+		return err
+	}
+
+	l1 := make([]byte, (int64(len(self.l1))*8+QCOW2_CLUSTER_SIZE-1)/
+		QCOW2_CLUSTER_SIZE*QCOW2_CLUSTER_SIZE)
+	for i, entry := range self.l1 {
+		binary.BigEndian.PutUint64(l1[i*8:], entry)
+	}
+
+	// An empty disk has no L1 table.
+	if len(l1) > 0 {
+		_, err = self.out.WriteAt(l1, QCOW2_CLUSTER_SIZE)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The refcount table and blocks go at the end and need
+	// refcounts themselves, so grow them until they cover everything.
+	per_block := int64(QCOW2_CLUSTER_SIZE / 2)
+	start := (self.end + QCOW2_CLUSTER_SIZE - 1) / QCOW2_CLUSTER_SIZE
+	var table_clusters, blocks int64
+	for {
+		total := start + table_clusters + blocks
+		needed_blocks := (total + per_block - 1) / per_block
+		needed_table := (needed_blocks*8 + QCOW2_CLUSTER_SIZE - 1) /
+			QCOW2_CLUSTER_SIZE
+		if needed_blocks == blocks && needed_table == table_clusters {
+			break
+		}
+		blocks, table_clusters = needed_blocks, needed_table
+	}
+
+	table_offset := start * QCOW2_CLUSTER_SIZE
+	blocks_offset := table_offset + table_clusters*QCOW2_CLUSTER_SIZE
+	self.addRefs(table_offset, (table_clusters+blocks)*QCOW2_CLUSTER_SIZE)
+
+	table := make([]byte, table_clusters*QCOW2_CLUSTER_SIZE)
+	block := make([]byte, QCOW2_CLUSTER_SIZE)
+	for i := int64(0); i < blocks; i++ {
+		for j := range block {
+			block[j] = 0
+		}
+
+		for j := int64(0); j < per_block; j++ {
+			cluster := i*per_block + j
+			if cluster >= int64(len(self.refcounts)) {
+				break
+			}
+			binary.BigEndian.PutUint16(block[j*2:], self.refcounts[cluster])
+		}
+
+		offset := blocks_offset + i*QCOW2_CLUSTER_SIZE
+		_, err = self.out.WriteAt(block, offset)
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(table[i*8:], uint64(offset))
+	}
+
+	_, err = self.out.WriteAt(table, table_offset)
+	if err != nil {
+		return err
+	}
+
+	be := binary.BigEndian
+	header := make([]byte, QCOW2_CLUSTER_SIZE)
+	be.PutUint32(header[0:], QCOW2_MAGIC)
+	be.PutUint32(header[4:], QCOW2_VERSION)
+	be.PutUint32(header[20:], QCOW2_CLUSTER_BITS)
+	be.PutUint64(header[24:], uint64(self.size))
+	be.PutUint32(header[36:], uint32(len(self.l1)))
+	be.PutUint64(header[40:], QCOW2_CLUSTER_SIZE)
+	be.PutUint64(header[48:], uint64(table_offset))
+	be.PutUint32(header[56:], uint32(table_clusters))
+	be.PutUint32(header[96:], QCOW2_REFCOUNT_ORDER)
+	be.PutUint32(header[100:], QCOW2_HEADER_SIZE)
+
+	// The header is followed by the end of header extensions marker,
+	// which is all zeros.
+	_, err = self.out.WriteAt(header, 0)
+	return err
+}
+
+// WriteQCOW2 writes the logical disk as a QCOW2 v3 image with 64kb
+// clusters. Only clusters overlapping the allocated ranges of the chain
+// are read, and those that are all zero are not stored, so thin disks
+// stay thin. With compress each cluster is stored deflate compressed
+// when that makes it smaller.
+func (self *VMDKContext) WriteQCOW2(
+	ctx context.Context, out io.WriterAt, compress bool,
+	progress ProgressFunc) error {
+	writer := newQCOW2Writer(out, self.total_size, compress)
+	err := self.forEachAllocatedBlock(ctx, QCOW2_CLUSTER_SIZE, progress,
+		writer.writeCluster)
+	if err != nil {
+		return err
+	}
+
+	return writer.close()
+}
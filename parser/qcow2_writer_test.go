@@ -0,0 +1,237 @@
+package parser
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// A 1gb disk whose allocated clusters span three L2 tables, with a
+// partial last cluster.
+func qcow2TestDisk(t *testing.T) *VMDKContext {
+	random := make([]byte, 16*TEST_GRAIN_SIZE)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	grains := map[int64][]byte{
+		0:           []byte("first grain"),
+		8191*16 + 3: bytes.Repeat([]byte("A"), TEST_GRAIN_SIZE),
+		8192 * 16:   []byte("second L2 table"),
+		9600 * 16:   []byte("at 600mb"),
+		262146:      []byte("last grain"),
+	}
+	for i := int64(0); i < 16; i++ {
+		grains[16+i] = random[i*TEST_GRAIN_SIZE : (i+1)*TEST_GRAIN_SIZE]
+	}
+
+	sparse, err := NewTestSparseExtent(
+		grains, 1024*1024*1024+3*TEST_GRAIN_SIZE)
+	if err != nil {
+		t.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	vmdk, err := NewTestContext(sparse)
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+	return vmdk
+}
+
+// Reads back a QCOW2 image the way qemu-img check does: every host
+// cluster must be referenced exactly as often as its refcount says.
+type qcow2Reader struct {
+	t    *testing.T
+	data []byte
+
+	size      int64
+	l1        []uint64
+	refcounts map[int64]int
+
+	compressed int
+}
+
+func newQCOW2Reader(t *testing.T, data []byte) *qcow2Reader {
+	be := binary.BigEndian
+	if be.Uint32(data) != QCOW2_MAGIC || be.Uint32(data[4:]) != 3 ||
+		be.Uint32(data[20:]) != QCOW2_CLUSTER_BITS ||
+		be.Uint32(data[96:]) != QCOW2_REFCOUNT_ORDER ||
+		be.Uint32(data[100:]) != QCOW2_HEADER_SIZE {
+		t.Fatalf("Invalid header %x", data[:QCOW2_HEADER_SIZE])
+	}
+
+	self := &qcow2Reader{
+		t:         t,
+		data:      data,
+		size:      int64(be.Uint64(data[24:])),
+		refcounts: make(map[int64]int),
+	}
+
+	l1_offset := int64(be.Uint64(data[40:]))
+	for i := int64(0); i < int64(be.Uint32(data[36:])); i++ {
+		self.l1 = append(self.l1, be.Uint64(data[l1_offset+i*8:]))
+	}
+
+	// Count the references to each cluster.
+	self.ref(0, QCOW2_CLUSTER_SIZE)
+	self.ref(l1_offset, int64(len(self.l1))*8)
+
+	table_offset := int64(be.Uint64(data[48:]))
+	table_clusters := int64(be.Uint32(data[56:]))
+	self.ref(table_offset, table_clusters*QCOW2_CLUSTER_SIZE)
+
+	var blocks []int64
+	for i := int64(0); i < table_clusters*QCOW2_CLUSTER_SIZE/8; i++ {
+		block := int64(be.Uint64(data[table_offset+i*8:]))
+		if block != 0 {
+			self.ref(block, QCOW2_CLUSTER_SIZE)
+			blocks = append(blocks, block)
+		}
+	}
+
+	for _, l1e := range self.l1 {
+		if l1e == 0 {
+			continue
+		}
+		if l1e&QCOW2_COPIED == 0 {
+			t.Fatalf("L1 entry without the copied flag %#x", l1e)
+		}
+		l2_offset := int64(l1e &^ QCOW2_COPIED)
+		self.ref(l2_offset, QCOW2_CLUSTER_SIZE)
+
+		for i := int64(0); i < QCOW2_CLUSTER_SIZE/8; i++ {
+			l2e := be.Uint64(data[l2_offset+i*8:])
+			switch {
+			case l2e == 0:
+			case l2e&QCOW2_COMPRESSED != 0:
+				offset, length := self.compressedExtent(l2e)
+				self.ref(offset, length)
+				self.compressed++
+			default:
+				self.ref(int64(l2e&^QCOW2_COPIED), QCOW2_CLUSTER_SIZE)
+			}
+		}
+	}
+
+	// Compare with the stored refcounts.
+	if int64(len(data))%QCOW2_CLUSTER_SIZE != 0 {
+		t.Fatalf("Image size %v is not a whole number of clusters", len(data))
+	}
+	for cluster := int64(0); cluster*QCOW2_CLUSTER_SIZE < int64(len(data)); cluster++ {
+		block := cluster / (QCOW2_CLUSTER_SIZE / 2)
+		stored := 0
+		if block < int64(len(blocks)) {
+			stored = int(be.Uint16(data[blocks[block]+
+				cluster%(QCOW2_CLUSTER_SIZE/2)*2:]))
+		}
+		if stored != self.refcounts[cluster] {
+			t.Fatalf("Cluster %v has refcount %v but %v references",
+				cluster, stored, self.refcounts[cluster])
+		}
+	}
+	return self
+}
+
+func (self *qcow2Reader) ref(offset, length int64) {
+	if length == 0 {
+		return
+	}
+	if offset+length > int64(len(self.data)) {
+		self.t.Fatalf("Reference to %#x past the end of the image", offset)
+	}
+	for c := offset / QCOW2_CLUSTER_SIZE; c <= (offset+length-1)/QCOW2_CLUSTER_SIZE; c++ {
+		self.refcounts[c]++
+	}
+}
+
+// The bytes qemu reads for a compressed cluster.
+func (self *qcow2Reader) compressedExtent(l2e uint64) (int64, int64) {
+	mask := uint64(1)<<QCOW2_COMPRESSED_SIZE_SHIFT - 1
+	offset := int64(l2e & mask)
+	sectors := int64(l2e&^QCOW2_COMPRESSED) >> QCOW2_COMPRESSED_SIZE_SHIFT
+	return offset, (sectors+1)*SECTOR_SIZE - offset%SECTOR_SIZE
+}
+
+// Read a cluster of the virtual disk, nil if it is not allocated.
+func (self *qcow2Reader) cluster(cluster int64) []byte {
+	l2_entries := int64(QCOW2_CLUSTER_SIZE / 8)
+	l1e := self.l1[cluster/l2_entries]
+	if l1e == 0 {
+		return nil
+	}
+
+	l2_offset := int64(l1e &^ QCOW2_COPIED)
+	l2e := binary.BigEndian.Uint64(
+		self.data[l2_offset+cluster%l2_entries*8:])
+	if l2e == 0 {
+		return nil
+	}
+
+	if l2e&QCOW2_COMPRESSED == 0 {
+		offset := int64(l2e &^ QCOW2_COPIED)
+		return self.data[offset : offset+QCOW2_CLUSTER_SIZE]
+	}
+
+	offset, length := self.compressedExtent(l2e)
+	res := make([]byte, QCOW2_CLUSTER_SIZE)
+	_, err := io.ReadFull(flate.NewReader(
+		bytes.NewReader(self.data[offset:offset+length])), res)
+	if err != nil {
+		self.t.Fatalf("Inflating cluster %v: %v", cluster, err)
+	}
+	return res
+}
+
+func TestWriteQCOW2(t *testing.T) {
+	vmdk := qcow2TestDisk(t)
+
+	for _, compress := range []bool{false, true} {
+		out := &memWriterAt{}
+		err := vmdk.WriteQCOW2(context.Background(), out, compress, nil)
+		if err != nil {
+			t.Fatalf("WriteQCOW2: %v", err)
+		}
+
+		image := newQCOW2Reader(t, out.buf)
+		if image.size != vmdk.Size() || len(image.l1) != 3 {
+			t.Fatalf("Unexpected size %v and L1 size %v",
+				image.size, len(image.l1))
+		}
+
+		expected := make([]byte, QCOW2_CLUSTER_SIZE)
+		var allocated []int64
+		for cluster := int64(0); cluster*QCOW2_CLUSTER_SIZE < vmdk.Size(); cluster++ {
+			n, _ := vmdk.ReadAt(expected, cluster*QCOW2_CLUSTER_SIZE)
+			zeroFill(expected[n:])
+
+			actual := image.cluster(cluster)
+			if actual == nil {
+				if !isZero(expected) {
+					t.Fatalf("Cluster %v is missing", cluster)
+				}
+				continue
+			}
+
+			allocated = append(allocated, cluster)
+			if !bytes.Equal(actual, expected) {
+				t.Fatalf("Cluster %v differs", cluster)
+			}
+		}
+
+		// Only the clusters holding data are stored.
+		if len(allocated) != 6 {
+			t.Fatalf("Unexpected allocated clusters %v", allocated)
+		}
+
+		// The random cluster does not compress.
+		if compress && image.compressed != 5 {
+			t.Fatalf("Expected 5 compressed clusters, got %v",
+				image.compressed)
+		}
+		if !compress && image.compressed != 0 {
+			t.Fatalf("Unexpected compressed clusters")
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package parser
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// A range of bytes in the logical disk. IsSparse marks the holes
+// reported by Ranges, which read as zeros.
+type Range struct {
+	Offset   int64 `json:"Offset"`
+	Length   int64 `json:"Length"`
+	IsSparse bool  `json:"IsSparse,omitempty"`
+}
+
+func (self Range) End() int64 {
+	return self.Offset + self.Length
+}
+
+// Implemented by extents that know which parts of them are backed by
+// data. Ranges are relative to the start of the extent.
+type allocator interface {
+	allocatedRanges() []Range
+}
+
+// Sort ranges and merge overlapping or adjacent ones.
+func mergeRanges(ranges []Range) []Range {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Offset < ranges[j].Offset
+	})
+
+	var res []Range
+	for _, r := range ranges {
+		if r.Length <= 0 {
+			continue
+		}
+
+		if len(res) > 0 && r.Offset <= res[len(res)-1].End() {
+			last := &res[len(res)-1]
+			if r.End() > last.End() {
+				last.Length = r.End() - last.Offset
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// Append a range, merging it with the last range if adjacent.
+func appendRange(ranges []Range, r Range) []Range {
+	if len(ranges) > 0 && ranges[len(ranges)-1].End() == r.Offset {
+		ranges[len(ranges)-1].Length += r.Length
+		return ranges
+	}
+	return append(ranges, r)
+}
+
+func (self *FlatExtent) allocatedRanges() []Range {
+	return []Range{{Offset: 0, Length: self.total_size}}
+}
+
+func (self *NullExtent) allocatedRanges() []Range {
+	return nil
+}
+
+func (self *SparseExtent) allocatedRanges() []Range {
+	var res []Range
+
+	num_gts := (self.total_size + self.grain_table_coverage - 1) /
+		self.grain_table_coverage
+	entries_per_gt := self.grain_table_coverage / self.grain_size
+	gt := make([]byte, entries_per_gt*4)
+
+	for i := int64(0); i < num_gts; i++ {
+		gde := ParseUint32(self.metadata, self.gde_offset+4*i)
+		if gde == 0 {
+			continue
+		}
+
+		n, err := self.metadata.ReadAt(gt, int64(gde)*SECTOR_SIZE)
+		if err != nil && err != io.EOF {
+			continue
+		}
+
+		for j := int64(0); j < int64(n)/4; j++ {
+			if binary.LittleEndian.Uint32(gt[j*4:]) == 0 {
+				continue
+			}
+
+			offset := i*self.grain_table_coverage + j*self.grain_size
+			length := self.grain_size
+			if offset >= self.total_size {
+				break
+			}
+			if offset+length > self.total_size {
+				length = self.total_size - offset
+			}
+			res = appendRange(res, Range{Offset: offset, Length: length})
+		}
+	}
+
+	return res
+}
+
+func (self *StreamExtent) allocatedRanges() []Range {
+	return streamRanges(self.grains, self.grain_size, self.total_size)
+}
+
+// Only known once the whole file is scanned. If that fails the entire
+// extent is reported so reads surface the error.
+func (self *LazyStreamExtent) allocatedRanges() []Range {
+	err := self.scanAll()
+	if err != nil {
+		return []Range{{Offset: 0, Length: self.total_size}}
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return streamRanges(self.grains, self.grain_size, self.total_size)
+}
+
+func streamRanges(grains map[int64]streamGrain,
+	grain_size, total_size int64) []Range {
+	var res []Range
+	for grain := range grains {
+		offset := grain * grain_size
+		length := grain_size
+		if offset+length > total_size {
+			length = total_size - offset
+		}
+		res = append(res, Range{Offset: offset, Length: length})
+	}
+	return mergeRanges(res)
+}
+
+// LayerAllocatedRanges returns the ranges of the logical disk that are
+// backed by data in this disk alone, ignoring any parent. Holes within
+// sparse extents are only reported with WithHighResolutionRanges.
+func (self *VMDKContext) LayerAllocatedRanges() []Range {
+	return self.layerAllocatedRanges(self.highResolutionRanges())
+}
+
+func (self *VMDKContext) highResolutionRanges() bool {
+	return self.options != nil && self.options.high_resolution_ranges
+}
+
+func (self *VMDKContext) layerAllocatedRanges(high_resolution bool) []Range {
+	var res []Range
+	for _, e := range self.extents {
+		alloc, ok := e.(allocator)
+		_, is_hole := e.(*NullExtent)
+		if !ok || (!high_resolution && !is_hole) {
+			// Assume extents we know nothing about are fully
+			// allocated.
+			res = append(res, Range{
+				Offset: e.VirtualOffset(), Length: e.TotalSize()})
+			continue
+		}
+
+		for _, r := range alloc.allocatedRanges() {
+			r.Offset += e.VirtualOffset()
+			res = append(res, r)
+		}
+	}
+	return mergeRanges(res)
+}
+
+// AllocatedRanges returns the ranges of the logical disk that are
+// backed by data in any disk of the snapshot chain. Reads outside these
+// ranges return zeros. By default whole extents are reported, which is
+// fast even for huge disks; WithHighResolutionRanges reports each
+// allocated grain of sparse extents instead.
+func (self *VMDKContext) AllocatedRanges() []Range {
+	return self.allocatedRanges(self.highResolutionRanges())
+}
+
+func (self *VMDKContext) allocatedRanges(high_resolution bool) []Range {
+	var res []Range
+	for _, disk := range self.Chain() {
+		for _, r := range disk.layerAllocatedRanges(high_resolution) {
+			if r.Offset >= self.total_size {
+				continue
+			}
+			if r.End() > self.total_size {
+				r.Length = self.total_size - r.Offset
+			}
+			res = append(res, r)
+		}
+	}
+	return mergeRanges(res)
+}
+
+// Ranges returns ranges covering the whole logical disk in order, with
+// the holes between the allocated ranges marked sparse. This is the
+// range reader shape Velociraptor uploaders use (as in go-ntfs and
+// go-ewf) to skip unallocated data. Holes within sparse extents are
+// only found with WithHighResolutionRanges.
+func (self *VMDKContext) Ranges() []Range {
+	var res []Range
+	var offset int64
+	for _, r := range self.AllocatedRanges() {
+		if r.Offset > offset {
+			res = append(res, Range{
+				Offset: offset, Length: r.Offset - offset, IsSparse: true})
+		}
+		res = append(res, r)
+		offset = r.End()
+	}
+
+	if offset < self.total_size {
+		res = append(res, Range{
+			Offset: offset, Length: self.total_size - offset, IsSparse: true})
+	}
+	return res
+}
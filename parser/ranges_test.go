@@ -0,0 +1,145 @@
+package parser
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAllocatedRanges(t *testing.T) {
+	vmdk, err := openTestDisk(makeChainFiles(), "snapshot.vmdk",
+		WithHighResolutionRanges())
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	// The snapshot only has grain 1.
+	expected := []Range{{Offset: testGrainSize, Length: testGrainSize}}
+	if ranges := vmdk.LayerAllocatedRanges(); !reflect.DeepEqual(
+		ranges, expected) {
+		t.Fatalf("Unexpected layer ranges %v", ranges)
+	}
+
+	// The base has grains 0 and 1, which merge into one range.
+	expected = []Range{{Offset: 0, Length: 2 * testGrainSize}}
+	if ranges := vmdk.AllocatedRanges(); !reflect.DeepEqual(
+		ranges, expected) {
+		t.Fatalf("Unexpected ranges %v", ranges)
+	}
+}
+
+func TestRangeResolution(t *testing.T) {
+	files := makeChainFiles()
+	files["gap.vmdk"] = []byte(`# Disk DescriptorFile
+createType="monolithicSparse"
+
+# Extent description
+RW 2048 SPARSE "base-data.vmdk"
+RW 2048 ZERO "gap"
+`)
+	low, err := openTestDisk(files, "base.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer low.Close()
+
+	high, err := openTestDisk(files, "base.vmdk", WithHighResolutionRanges())
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer high.Close()
+
+	// The whole sparse extent is reported by default.
+	expected := []Range{{Offset: 0, Length: 1024 * 1024}}
+	if ranges := low.AllocatedRanges(); !reflect.DeepEqual(ranges, expected) {
+		t.Fatalf("Unexpected extent resolution ranges %v", ranges)
+	}
+
+	// Only grains 0 and 1 are allocated.
+	expected = []Range{{Offset: 0, Length: 2 * testGrainSize}}
+	if ranges := high.AllocatedRanges(); !reflect.DeepEqual(ranges, expected) {
+		t.Fatalf("Unexpected grain resolution ranges %v", ranges)
+	}
+}
+
+// The shape of Velociraptor's range readers.
+var _ interface {
+	io.ReaderAt
+	Ranges() []Range
+} = &VMDKContext{}
+
+func TestRanges(t *testing.T) {
+	// The snapshot's data without its parent.
+	files := makeChainFiles()
+	files["middle.vmdk"] = []byte(strings.Replace(baseDescriptor,
+		"base-data.vmdk", "snapshot-data.vmdk", 1))
+
+	for _, c := range []struct {
+		name     string
+		opts     []Option
+		expected []Range
+	}{
+		{"snapshot.vmdk", []Option{WithHighResolutionRanges()}, []Range{
+			{Offset: 0, Length: 2 * testGrainSize},
+			{Offset: 2 * testGrainSize, Length: 1024*1024 - 2*testGrainSize,
+				IsSparse: true},
+		}},
+		{"snapshot.vmdk", nil, []Range{{Offset: 0, Length: 1024 * 1024}}},
+		{"middle.vmdk", []Option{WithHighResolutionRanges()}, []Range{
+			{Offset: 0, Length: testGrainSize, IsSparse: true},
+			{Offset: testGrainSize, Length: testGrainSize},
+			{Offset: 2 * testGrainSize, Length: 1024*1024 - 2*testGrainSize,
+				IsSparse: true},
+		}},
+	} {
+		vmdk, err := openTestDisk(files, c.name, c.opts...)
+		if err != nil {
+			t.Fatalf("GetVMDKContext(%v): %v", c.name, err)
+		}
+		defer vmdk.Close()
+
+		ranges := vmdk.Ranges()
+		if !reflect.DeepEqual(ranges, c.expected) {
+			t.Fatalf("Unexpected ranges for %v: %v", c.name, ranges)
+		}
+
+		// The ranges tile the disk with no gaps or overlaps, and
+		// sparse ones read as zeros.
+		var offset int64
+		for _, r := range ranges {
+			if r.Offset != offset || r.Length <= 0 {
+				t.Fatalf("Range %v does not follow %#x", r, offset)
+			}
+			offset = r.End()
+
+			if r.IsSparse {
+				buf := make([]byte, r.Length)
+				_, err = vmdk.ReadAt(buf, r.Offset)
+				if err != nil || !isZero(buf) {
+					t.Fatalf("Sparse range %v is not zero: %v", r, err)
+				}
+			}
+		}
+
+		if offset != vmdk.Size() {
+			t.Fatalf("Ranges end at %#x, not %#x", offset, vmdk.Size())
+		}
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	ranges := mergeRanges([]Range{
+		{Offset: 100, Length: 10},
+		{Offset: 0, Length: 10},
+		{Offset: 105, Length: 20},
+		{Offset: 10, Length: 5},
+		{Offset: 200, Length: 0},
+	})
+
+	expected := []Range{{Offset: 0, Length: 15}, {Offset: 100, Length: 25}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Fatalf("Unexpected ranges %v", ranges)
+	}
+}
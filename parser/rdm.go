@@ -0,0 +1,72 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A raw device mapping extent. The descriptor points at a mapping file
+// on VMFS and the data lives on a physical device, so it can not be
+// read.
+type RawDeviceExtent struct {
+	extent_type string
+	total_size  int64
+
+	// The offset in the logical image where this extent sits.
+	offset   int64
+	filename string
+}
+
+func isRawDeviceExtent(extent_type string) bool {
+	switch extent_type {
+	case "VMFSRDM", "VMFSPASSTHROUGHRDM":
+		return true
+	}
+	return false
+}
+
+func (self *RawDeviceExtent) Close() {}
+
+func (self *RawDeviceExtent) Debug() {
+	fmt.Printf("%v extent %v at %#x (%v bytes, raw device)\n",
+		self.extent_type, self.filename, self.offset, self.total_size)
+}
+
+func (self *RawDeviceExtent) TotalSize() int64 {
+	return self.total_size
+}
+
+func (self *RawDeviceExtent) VirtualOffset() int64 {
+	return self.offset
+}
+
+func (self *RawDeviceExtent) Stats() ExtentStat {
+	return ExtentStat{
+		Type:          self.extent_type,
+		VirtualOffset: self.offset,
+		Size:          self.total_size,
+		Filename:      self.filename,
+	}
+}
+
+func (self *RawDeviceExtent) ReadAt(buf []byte, offset int64) (int, error) {
+	return 0, fmt.Errorf("%w: %v maps a raw device which is not available",
+		ErrUnsupported, self.filename)
+}
+
+// IsRawDeviceMap reports whether the disk is a raw device mapping. Its
+// data lives on a physical device rather than in the extent files, so
+// reads from the mapped extents fail.
+func (self *VMDKContext) IsRawDeviceMap() bool {
+	if strings.Contains(strings.ToLower(self.config.CreateType),
+		"rawdevicemap") {
+		return true
+	}
+
+	for _, extent := range self.extents {
+		if _, ok := extent.(*RawDeviceExtent); ok {
+			return true
+		}
+	}
+	return false
+}
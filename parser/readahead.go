@@ -0,0 +1,158 @@
+package parser
+
+import (
+	"io"
+	"sync"
+)
+
+// A prefetch of the next part of the disk running in the background.
+type prefetch struct {
+	offset int64
+	data   []byte
+	done   chan struct{}
+}
+
+// readahead detects sequential reads and fetches the data following
+// them in the background, so the underlying storage sees large
+// requests instead of many small ones. Only one prefetch runs at a
+// time.
+type readahead struct {
+	mu sync.Mutex
+
+	size  int64
+	fetch func(buf []byte, offset int64) (int, error)
+
+	// Nothing is fetched past the end of the disk.
+	disk_size int64
+
+	// Where the next read starts if access is sequential.
+	next int64
+
+	// Data already fetched, starting at window_offset.
+	window_offset int64
+	window        []byte
+
+	pending *prefetch
+	wg      sync.WaitGroup
+}
+
+func newReadahead(size, disk_size int64,
+	fetch func(buf []byte, offset int64) (int, error)) *readahead {
+	return &readahead{
+		size:      size,
+		fetch:     fetch,
+		disk_size: disk_size,
+	}
+}
+
+// Fill buf from the fetched data if it is all available. Returns false
+// if the caller needs to read it itself.
+func (self *readahead) read(buf []byte, offset int64) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	end := offset + int64(len(buf))
+	sequential := offset == self.next
+	self.next = end
+
+	// The data is on its way - wait for it rather than read it twice.
+	pending := self.pending
+	if pending != nil && offset >= pending.offset &&
+		offset < pending.offset+int64(len(pending.data)) {
+		self.mu.Unlock()
+		<-pending.done
+		self.mu.Lock()
+	}
+
+	window_end := self.window_offset + int64(len(self.window))
+	hit := offset >= self.window_offset && end <= window_end
+	if hit {
+		copy(buf, self.window[offset-self.window_offset:])
+	}
+
+	// Fetch more once the reader is half way through the window.
+	if sequential && self.pending == nil && end > window_end-self.size/2 {
+		start := window_end
+		if !hit {
+			start = end
+		}
+		if start < self.disk_size {
+			self.start(start)
+		}
+	}
+
+	return hit
+}
+
+// Fetch the data at offset ahead of reads announced by Advise, unless
+// it is already fetched or another prefetch is running.
+func (self *readahead) advise(offset int64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	window_end := self.window_offset + int64(len(self.window))
+	if self.pending != nil ||
+		(offset >= self.window_offset && offset < window_end) {
+		return
+	}
+	self.start(offset)
+}
+
+// Start fetching size bytes at offset. Must be called with the lock
+// held.
+func (self *readahead) start(offset int64) {
+	p := &prefetch{
+		offset: offset,
+		data:   make([]byte, self.size),
+		done:   make(chan struct{}),
+	}
+	self.pending = p
+
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		defer close(p.done)
+
+		// Errors are left for the reader to find when it reads the
+		// data itself.
+		n, err := self.fetch(p.data, p.offset)
+
+		self.mu.Lock()
+		defer self.mu.Unlock()
+
+		self.pending = nil
+		if err != nil && err != io.EOF {
+			return
+		}
+		self.add(p.offset, p.data[:n])
+	}()
+}
+
+// Add fetched data to the window, dropping what was already read.
+// Must be called with the lock held.
+func (self *readahead) add(offset int64, data []byte) {
+	window_end := self.window_offset + int64(len(self.window))
+	if offset != window_end {
+		self.window_offset = offset
+		self.window = data
+		return
+	}
+
+	keep := self.next - self.window_offset
+	if keep < 0 {
+		keep = 0
+	}
+	if keep > int64(len(self.window)) {
+		keep = int64(len(self.window))
+	}
+
+	window := make([]byte, 0, int64(len(self.window))-keep+int64(len(data)))
+	window = append(window, self.window[keep:]...)
+	self.window = append(window, data...)
+	self.window_offset += keep
+}
+
+// Wait for any running prefetch to finish.
+func (self *readahead) Close() {
+	self.wg.Wait()
+}
@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReadahead(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i / SECTOR_SIZE)
+	}
+
+	descriptor := `# Disk DescriptorFile
+createType="monolithicFlat"
+
+# Extent description
+RW 2048 FLAT "flat.vmdk" 0
+`
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		return &slowReader{
+			ReaderAt: bytes.NewReader(data),
+			delay:    2 * time.Millisecond,
+		}, nil, nil
+	}
+
+	// Read the whole disk sequentially in small blocks.
+	copyDisk := func(opts ...Option) time.Duration {
+		vmdk, err := GetVMDKContext(bytes.NewReader([]byte(descriptor)),
+			len(descriptor), opener, opts...)
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+		defer vmdk.Close()
+
+		start := time.Now()
+		buf := make([]byte, 4096)
+		out := &bytes.Buffer{}
+		for offset := int64(0); offset < vmdk.Size(); offset += int64(len(buf)) {
+			n, err := vmdk.ReadAt(buf, offset)
+			if err != nil || n != len(buf) {
+				t.Fatalf("ReadAt %#x: %v %v", offset, n, err)
+			}
+			out.Write(buf)
+		}
+
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("Unexpected data read")
+		}
+		return time.Since(start)
+	}
+
+	plain := copyDisk()
+	prefetched := copyDisk(WithReadahead(256 * 1024))
+	if prefetched*4 > plain {
+		t.Fatalf("Readahead took %v, expected much less than %v",
+			prefetched, plain)
+	}
+
+	// Random reads still return the right data.
+	vmdk, err := GetVMDKContext(bytes.NewReader([]byte(descriptor)),
+		len(descriptor), opener, WithReadahead(64*1024))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	buf := make([]byte, SECTOR_SIZE)
+	for _, offset := range []int64{0, SECTOR_SIZE, 100 * SECTOR_SIZE,
+		2 * SECTOR_SIZE, 3 * SECTOR_SIZE, 2047 * SECTOR_SIZE} {
+		n, err := vmdk.ReadAt(buf, offset)
+		if err != nil || n != len(buf) ||
+			!bytes.Equal(buf, data[offset:offset+SECTOR_SIZE]) {
+			t.Fatalf("ReadAt %#x: %v %v", offset, n, err)
+		}
+	}
+}
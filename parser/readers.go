@@ -1,6 +1,9 @@
 package parser
 
-import "io"
+import (
+	"io"
+	"os"
+)
 
 type Extent interface {
 	io.ReaderAt
@@ -11,3 +14,69 @@ type Extent interface {
 	Close()
 	Debug()
 }
+
+// ReadCloserAt is satisfied by values that can be read at arbitrary
+// offsets and closed.
+type ReadCloserAt interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Adapts the context to io.Closer.
+type diskReader struct {
+	*VMDKContext
+}
+
+func (self diskReader) Close() error {
+	self.VMDKContext.Close()
+	return nil
+}
+
+// ReadCloserAt returns the disk as a single value which reads the
+// logical disk and closes all of its files.
+func (self *VMDKContext) ReadCloserAt() ReadCloserAt {
+	return diskReader{self}
+}
+
+// Determine the size of the data behind reader. Readers which do not
+// report it are probed.
+func readerSize(reader io.ReaderAt) int64 {
+	switch t := reader.(type) {
+	case *PagedReader:
+		return readerSize(t.reader)
+	case interface{ Size() int64 }:
+		return t.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		st, err := t.Stat()
+		if err == nil {
+			return st.Size()
+		}
+	}
+
+	// Find the first offset which can not be read.
+	buf := make([]byte, 1)
+	readable := func(offset int64) bool {
+		n, _ := reader.ReadAt(buf, offset)
+		return n == 1
+	}
+
+	if !readable(0) {
+		return 0
+	}
+
+	high := int64(1)
+	for readable(high) {
+		high *= 2
+	}
+
+	low := high / 2
+	for low+1 < high {
+		mid := (low + high) / 2
+		if readable(mid) {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return high
+}
@@ -0,0 +1,90 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The backoff between retries doubles up to this limit.
+const MAX_RETRY_BACKOFF = 10 * time.Second
+
+// Retry fn according to the retry policy. Errors retrying can not fix,
+// like a missing file, are returned at once. The last error is
+// returned if all attempts fail.
+func (self *options) retry(fn func() error) error {
+	return retryTransient(self.retries, self.backoff,
+		func() (bool, error) {
+			err := fn()
+			return !isPermanentError(err), err
+		})
+}
+
+// A missing or unreadable file will not appear on a retry.
+func isPermanentError(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission)
+}
+
+// Call fn until it succeeds, it reports a permanent error or the
+// retries are used up, sleeping backoff before the first retry and
+// twice as long each time after up to MAX_RETRY_BACKOFF.
+func retryTransient(retries int, backoff time.Duration,
+	fn func() (transient bool, err error)) error {
+	for attempt := 0; ; attempt++ {
+		transient, err := fn()
+		if err == nil || !transient || attempt >= retries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > MAX_RETRY_BACKOFF {
+			backoff = MAX_RETRY_BACKOFF
+		}
+	}
+}
+
+func (self *options) open(opener Opener, filename string) (
+	reader io.ReaderAt, closer func(), err error) {
+
+	err = self.retry(func() error {
+		reader, closer, err = opener(filename)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reader == nil {
+		if closer != nil {
+			closer()
+		}
+		return nil, nil, fmt.Errorf("%w for %v", ErrOpenerReturnedNil, filename)
+	}
+
+	if self.resilient {
+		reader = &retryReader{reader: reader, options: self}
+	}
+
+	return reader, closer, nil
+}
+
+// A reader which retries failed reads. EOF is not considered a
+// failure.
+type retryReader struct {
+	reader  io.ReaderAt
+	options *options
+}
+
+func (self *retryReader) ReadAt(buf []byte, offset int64) (n int, err error) {
+	self.options.retry(func() error {
+		n, err = self.reader.ReadAt(buf, offset)
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	})
+	return n, err
+}
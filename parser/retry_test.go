@@ -0,0 +1,140 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const retryDescriptor = `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW 2048 SPARSE "test.vmdk"
+`
+
+func TestOpenerRetries(t *testing.T) {
+	files := testFiles{
+		"test.vmdk": buildSparseExtent(1024*1024, map[int64][]byte{
+			0: bytes.Repeat([]byte("A"), testGrainSize),
+		}),
+	}
+
+	failures := 0
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		if failures < 2 {
+			failures++
+			return nil, nil, errors.New("transient failure")
+		}
+		return files.Open(filename)
+	}
+
+	// Without retries the first failure aborts the parse.
+	_, err := GetVMDKContext(
+		bytes.NewReader([]byte(retryDescriptor)), len(retryDescriptor), opener)
+	if err == nil {
+		t.Fatalf("Expected the opener failure to propagate")
+	}
+
+	failures = 0
+	vmdk, err := GetVMDKContext(
+		bytes.NewReader([]byte(retryDescriptor)), len(retryDescriptor), opener,
+		WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+
+	if failures != 2 {
+		t.Fatalf("Expected 2 failures, got %v", failures)
+	}
+
+	buf := make([]byte, 4)
+	n, err := vmdk.ReadAt(buf, 0)
+	if err != nil || string(buf[:n]) != "AAAA" {
+		t.Fatalf("Unexpected read %q: %v", buf[:n], err)
+	}
+}
+
+func TestPermanentErrorsNotRetried(t *testing.T) {
+	for _, failure := range []error{
+		os.ErrNotExist,
+		os.ErrPermission,
+		&MissingExtentError{Filename: "test.vmdk", Err: os.ErrNotExist},
+	} {
+		calls := 0
+		opener := func(filename string) (io.ReaderAt, func(), error) {
+			calls++
+			return nil, nil, failure
+		}
+
+		// A retry would sleep for an hour.
+		_, err := GetVMDKContext(
+			bytes.NewReader([]byte(retryDescriptor)), len(retryDescriptor),
+			opener, WithRetries(3, time.Hour))
+		if !errors.Is(err, failure) || calls != 1 {
+			t.Fatalf("%v: expected one call, got %v (%v)", failure, calls, err)
+		}
+	}
+}
+
+type flakyReader struct {
+	reader   io.ReaderAt
+	failures int
+}
+
+func (self *flakyReader) ReadAt(buf []byte, offset int64) (int, error) {
+	if self.failures > 0 {
+		self.failures--
+		return 0, errors.New("transient read failure")
+	}
+	return self.reader.ReadAt(buf, offset)
+}
+
+func TestResilientReads(t *testing.T) {
+	flaky := &flakyReader{
+		reader: bytes.NewReader([]byte("hello world")),
+	}
+	options := getOptions([]Option{
+		WithRetries(2, time.Millisecond), WithResilientReads()})
+
+	reader, _, err := options.open(func(filename string) (
+		io.ReaderAt, func(), error) {
+		return flaky, nil, nil
+	}, "test.vmdk")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	flaky.failures = 2
+	buf := make([]byte, 5)
+	n, err := reader.ReadAt(buf, 6)
+	if err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("Unexpected read %q: %v", buf[:n], err)
+	}
+
+	flaky.failures = 3
+	_, err = reader.ReadAt(buf, 6)
+	if err == nil {
+		t.Fatalf("Expected read to fail after exhausting retries")
+	}
+}
+
+func TestOpenerReturnedNil(t *testing.T) {
+	opener := func(filename string) (io.ReaderAt, func(), error) {
+		return nil, nil, nil
+	}
+
+	_, err := GetVMDKContext(
+		bytes.NewReader([]byte(retryDescriptor)), len(retryDescriptor), opener)
+	if !errors.Is(err, ErrOpenerReturnedNil) ||
+		!strings.Contains(err.Error(), "test.vmdk") {
+		t.Fatalf("Expected ErrOpenerReturnedNil, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Pools of scratch buffers keyed by size, so the read paths do not
+// allocate a new buffer for every call. Buffers must not be returned
+// to callers since they are reused once put back.
+var scratchPools sync.Map
+
+func scratchPool(size int64) *sync.Pool {
+	pool, pres := scratchPools.Load(size)
+	if !pres {
+		pool, _ = scratchPools.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		})
+	}
+	return pool.(*sync.Pool)
+}
+
+func getScratch(size int64) *[]byte {
+	return scratchPool(size).Get().(*[]byte)
+}
+
+func putScratch(buf *[]byte) {
+	scratchPool(int64(len(*buf))).Put(buf)
+}
+
+// Read a little endian uint32 without allocating. Returns 0 if it can
+// not be read.
+func readUint32(reader io.ReaderAt, offset int64) uint32 {
+	buf := getScratch(4)
+	defer putScratch(buf)
+
+	_, err := reader.ReadAt(*buf, offset)
+	if err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(*buf)
+}
+
+// A deflate reader with its input, reused between grains.
+type inflater struct {
+	source bytes.Reader
+	reader io.ReadCloser
+}
+
+var inflaters sync.Pool
+
+// Decompress a grain into grain. Short grains are padded with zeros.
+//
+// Grains are zlib streams. Reading stops at the grain size so the
+// checksum at the end is never reached anyway - the deflate data
+// is read directly since resetting a zlib reader allocates.
+func inflateGrain(compressed []byte, grain []byte) error {
+	if len(compressed) < 2 || compressed[0]&0x0f != 8 ||
+		compressed[1]&0x20 != 0 ||
+		(uint16(compressed[0])<<8|uint16(compressed[1]))%31 != 0 {
+		return zlib.ErrHeader
+	}
+
+	inf, _ := inflaters.Get().(*inflater)
+	if inf == nil {
+		inf = &inflater{}
+	}
+	defer inflaters.Put(inf)
+
+	inf.source.Reset(compressed[2:])
+	if inf.reader == nil {
+		inf.reader = flate.NewReader(&inf.source)
+	} else {
+		err := inf.reader.(flate.Resetter).Reset(&inf.source, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := io.ReadFull(inf.reader, grain)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	zeroFill(grain[n:])
+	return nil
+}
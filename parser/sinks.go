@@ -0,0 +1,125 @@
+package parser
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+var (
+	zeros     []byte
+	zerosOnce sync.Once
+)
+
+// A buffer of zeros shared by all exports. It must not be written to.
+func getZeros() []byte {
+	zerosOnce.Do(func() {
+		zeros = make([]byte, copyBufferSize)
+	})
+	return zeros
+}
+
+// A HoleWriter is a sink for ExportSinks which can skip over a hole
+// instead of being sent its zeros, e.g. a sparse file.
+type HoleWriter interface {
+	io.Writer
+	WriteHole(length int64) error
+}
+
+// ExportSinks copies the logical disk to every sink in a single pass,
+// e.g. to write a raw copy and hash it at the same time. Only the
+// allocated ranges are read. Holes are skipped by sinks implementing
+// HoleWriter and sent as zeros to the others, so every sink sees the
+// whole disk. Progress, cancellation and WithExportWorkers apply as for
+// Export.
+func (self *VMDKContext) ExportSinks(ctx context.Context, sinks []io.Writer,
+	progress ProgressFunc) (int64, error) {
+	out := io.MultiWriter(sinks...)
+	ranges := append(self.allocatedRanges(true),
+		Range{Offset: self.total_size})
+
+	var offset int64
+	for _, r := range ranges {
+		if r.Offset > offset {
+			err := self.writeHole(ctx, sinks, offset, r.Offset-offset,
+				progress)
+			if err != nil {
+				return offset, err
+			}
+			offset = r.Offset
+		}
+
+		if r.Length == 0 {
+			continue
+		}
+
+		var range_progress ProgressFunc
+		if progress != nil {
+			range_progress = func(done, total int64) {
+				progress(r.Offset+done, self.total_size)
+			}
+		}
+
+		n, err := self.exportRange(ctx, out, r.Offset, r.Length,
+			range_progress)
+		offset += n
+		if err != nil {
+			return offset, err
+		}
+	}
+
+	return offset, nil
+}
+
+// Send a hole of length bytes at offset to the sinks.
+func (self *VMDKContext) writeHole(ctx context.Context, sinks []io.Writer,
+	offset, length int64, progress ProgressFunc) error {
+	var zero_sinks []io.Writer
+	for _, sink := range sinks {
+		hole_writer, ok := sink.(HoleWriter)
+		if !ok {
+			zero_sinks = append(zero_sinks, sink)
+			continue
+		}
+
+		err := hole_writer.WriteHole(length)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(zero_sinks) == 0 {
+		if progress != nil {
+			progress(offset+length, self.total_size)
+		}
+		return nil
+	}
+
+	buf := getZeros()
+	var done int64
+	for done < length {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		to_write := length - done
+		if to_write > int64(len(buf)) {
+			to_write = int64(len(buf))
+		}
+
+		for _, sink := range zero_sinks {
+			_, err := sink.Write(buf[:to_write])
+			if err != nil {
+				return err
+			}
+		}
+		done += to_write
+
+		if progress != nil {
+			progress(offset+done, self.total_size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A HoleWriter recording the holes it was sent.
+type holeRecorder struct {
+	bytes.Buffer
+	holes []int64
+}
+
+func (self *holeRecorder) WriteHole(length int64) error {
+	self.holes = append(self.holes, length)
+	return nil
+}
+
+func TestExportSinks(t *testing.T) {
+	vmdk := thinTestDisk(t)
+
+	expected := make([]byte, vmdk.Size())
+	_, err := vmdk.ReadAt(expected, 0)
+	if err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+
+	h := sha256.New()
+	raw := &bytes.Buffer{}
+	holes := &holeRecorder{}
+
+	var last int64
+	n, err := vmdk.ExportSinks(context.Background(),
+		[]io.Writer{h, raw, holes}, func(done, total int64) {
+			if done < last || total != vmdk.Size() {
+				t.Fatalf("Unexpected progress %v of %v", done, total)
+			}
+			last = done
+		})
+	if err != nil || n != vmdk.Size() || last != vmdk.Size() {
+		t.Fatalf("ExportSinks: %v %v", n, err)
+	}
+
+	// Plain sinks get every byte, hole writers only the data.
+	sum := sha256.Sum256(expected)
+	if !bytes.Equal(h.Sum(nil), sum[:]) || !bytes.Equal(raw.Bytes(), expected) {
+		t.Fatalf("Sinks differ from the disk")
+	}
+
+	var hole_bytes int64
+	for _, length := range holes.holes {
+		hole_bytes += length
+	}
+	if len(holes.holes) != 3 ||
+		hole_bytes+int64(holes.Len()) != vmdk.Size() {
+		t.Fatalf("Unexpected holes %v", holes.holes)
+	}
+
+	// Cancelling stops the pass.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = vmdk.ExportSinks(ctx, []io.Writer{io.Discard}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancellation, got %v", err)
+	}
+}
+
+func TestCopyToFileTee(t *testing.T) {
+	vmdk := thinTestDisk(t)
+	expected, err := vmdk.HashRange(sha256.New(), 0, vmdk.Size())
+	if err != nil {
+		t.Fatalf("HashRange: %v", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "out.raw")
+	out, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer out.Close()
+
+	// The hash is computed while the file is written.
+	h := sha256.New()
+	_, err = CopyToFile(context.Background(), out, vmdk, nil, h)
+	if err != nil || !bytes.Equal(h.Sum(nil), expected) {
+		t.Fatalf("CopyToFile: %v", err)
+	}
+
+	checkSparse(t, filename, 1024*1024)
+}
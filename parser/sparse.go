@@ -4,17 +4,50 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/bits"
 )
 
+const (
+	// The highest hosted sparse header version we can read. Versions 2
+	// and 3 may set FLAG_ZERO_GRAIN_GTE, otherwise their grain tables
+	// are read like version 1.
+	MAX_SPARSE_VERSION = 3
+
+	// Set in the header flags when a grain table entry of
+	// ZERO_GRAIN_GTE marks a grain which reads as zeros, even in a
+	// snapshot whose parent has data there.
+	FLAG_ZERO_GRAIN_GTE = 1 << 2
+	ZERO_GRAIN_GTE      = 1
+
+	// The largest grain size in sectors (32mb). VMware uses 128 and
+	// larger grains would need huge buffers to read or inflate.
+	MAX_GRAIN_SECTORS = 1 << 16
+)
+
+// Returned by getGrainForOffset for a zeroed grain. Unlike io.EOF for
+// an unallocated grain it must not be read from the parent.
+var errZeroGrain = errors.New("Zeroed grain")
+
 type SparseExtent struct {
 	profile *VMDKProfile
 	reader  io.ReaderAt
 
+	// The header, grain directory and grain tables are usually in the
+	// same file as the grains but may be split into a separate one.
+	metadata          io.ReaderAt
+	metadata_filename string
+	split             bool
+
 	header *SparseExtentHeader
 
 	// Size of grains in bytes
 	grain_size int64
 
+	// log2 of grain_size and grain_table_coverage when the grain size
+	// is a power of two, else 0 and the slower division is used.
+	grain_shift uint
+	table_shift uint
+
 	// Coverage of each grain table in bytes
 	grain_table_coverage int64
 
@@ -26,6 +59,18 @@ type SparseExtent struct {
 	offset   int64
 	filename string
 
+	// Unallocated grains are read from the parent disk if present.
+	parent io.ReaderAt
+
+	// Recently used grain tables, if enabled.
+	gt_cache *grainTableCache
+
+	// Size of the extent file when grain bounds are checked, else 0.
+	file_size int64
+
+	// Set when a grain table entry of ZERO_GRAIN_GTE is a zeroed grain.
+	zero_grains bool
+
 	closer func()
 }
 
@@ -47,68 +92,232 @@ func (self *SparseExtent) VirtualOffset() int64 {
 	return self.offset
 }
 
+// CleanShutdown reports whether the extent was closed cleanly. An
+// extent left open by a crashed writer may have inconsistent grain
+// tables.
+func (self *SparseExtent) CleanShutdown() bool {
+	return self.header.uncleanShutdown() == 0
+}
+
 func (self *SparseExtent) ReadAt(buf []byte, offset int64) (int, error) {
-	start, available_length, err := self.getGrainForOffset(offset)
-	if err != nil {
-		return 0, nil
+	if offset < 0 || offset >= self.total_size {
+		return 0, io.EOF
 	}
 
+	start, available_length, err := self.getGrainForOffset(offset)
+
 	to_read := int64(len(buf))
 	if to_read > available_length {
 		to_read = available_length
 	}
 
+	if to_read > self.total_size-offset {
+		to_read = self.total_size - offset
+	}
+
+	if errors.Is(err, ErrGrainOutOfBounds) {
+		return 0, err
+	}
+
+	if err == errZeroGrain {
+		zeroFill(buf[:to_read])
+		return int(to_read), nil
+	}
+
+	// Grain is not allocated in this extent.
+	if err != nil {
+		if self.parent != nil {
+			return self.parent.ReadAt(buf[:to_read], self.offset+offset)
+		}
+
+		zeroFill(buf[:to_read])
+		return int(to_read), nil
+	}
+
+	// Grains written sequentially are usually stored one after the
+	// other, so extend the read over the following grains while they
+	// are contiguous in the file.
+	for to_read < int64(len(buf)) && offset+to_read < self.total_size {
+		next, length, err := self.getGrainForOffset(offset + to_read)
+		if err != nil || next != start+to_read {
+			break
+		}
+		to_read += length
+	}
+
+	if to_read > int64(len(buf)) {
+		to_read = int64(len(buf))
+	}
+
+	if to_read > self.total_size-offset {
+		to_read = self.total_size - offset
+	}
+
 	return self.reader.ReadAt(buf[:to_read], start)
 }
 
 func (self *SparseExtent) getGrainForOffset(offset int64) (
 	start, length int64, err error) {
 
-	grain_table_number := offset / self.grain_table_coverage
-	grain_directory_entry := ParseUint32(
-		self.reader, self.gde_offset+4*grain_table_number)
+	var offset_within_grain, grain_table_number, grain_entry_number int64
+	if self.grain_shift > 0 {
+		offset_within_grain = offset & (self.grain_size - 1)
+		grain_table_number = offset >> self.table_shift
+		grain_entry_number = (offset & (self.grain_table_coverage - 1)) >>
+			self.grain_shift
+	} else {
+		offset_within_grain = offset % self.grain_size
+		grain_table_number = offset / self.grain_table_coverage
+		grain_entry_number = (offset % self.grain_table_coverage) /
+			self.grain_size
+	}
+	length = self.grain_size - offset_within_grain
+
+	grain_directory_entry := self.getGrainDirectoryEntry(grain_table_number)
 	if grain_directory_entry == 0 {
-		return 0, 0, io.EOF
+		return 0, length, io.EOF
 	}
 
-	grain_entry_number := (offset % self.grain_table_coverage) / self.grain_size
-	grain_table_entry := ParseUint32(self.reader,
-		int64(grain_directory_entry*SECTOR_SIZE)+4*grain_entry_number)
+	grain_table_entry := self.getGrainTableEntry(grain_directory_entry,
+		grain_table_number, grain_entry_number)
+
+	// An entry of 0 means the grain is not allocated.
+	if grain_table_entry == 0 {
+		return 0, length, io.EOF
+	}
+
+	if grain_table_entry == ZERO_GRAIN_GTE && self.zero_grains {
+		return 0, length, errZeroGrain
+	}
 
 	grain_start := int64(grain_table_entry) * SECTOR_SIZE
-	offset_within_grain := offset % self.grain_size
+	if self.file_size > 0 && grain_start+self.grain_size > self.file_size {
+		return 0, length, fmt.Errorf("%w: grain %v of %v at %#x",
+			ErrGrainOutOfBounds, offset/self.grain_size, self.filename,
+			grain_start)
+	}
+
+	return grain_start + offset_within_grain, length, nil
+}
+
+func (self *SparseExtent) getGrainDirectoryEntry(index int64) uint32 {
+	if self.gt_cache != nil {
+		return self.gt_cache.directoryEntry(self, index)
+	}
+	return readUint32(self.metadata, self.gde_offset+4*index)
+}
+
+func (self *SparseExtent) getGrainTableEntry(
+	gde uint32, index, entry int64) uint32 {
+	if self.gt_cache != nil {
+		return self.gt_cache.tableEntry(self, gde, index, entry)
+	}
+	return readUint32(self.metadata, int64(gde)*SECTOR_SIZE+4*entry)
+}
+
+// GetSparseExtent parses the header of a hosted sparse extent. Only the
+// grain size options apply.
+func GetSparseExtent(reader io.ReaderAt, opts ...Option) (*SparseExtent, error) {
+	return newSparseExtent(reader, getOptions(opts))
+}
+
+// GetSplitSparseExtent parses a hosted sparse extent whose header,
+// grain directory and grain tables are read from metadata while the
+// grain table entries point at grains in data.
+func GetSplitSparseExtent(metadata, data io.ReaderAt,
+	opts ...Option) (*SparseExtent, error) {
+	return newSplitSparseExtent(metadata, data, getOptions(opts))
+}
 
-	return grain_start + offset_within_grain, self.grain_size - offset_within_grain, nil
+func newSparseExtent(reader io.ReaderAt, options *options) (*SparseExtent, error) {
+	return newSplitSparseExtent(reader, reader, options)
 }
 
-func GetSparseExtent(reader io.ReaderAt) (*SparseExtent, error) {
+func newSplitSparseExtent(metadata, data io.ReaderAt,
+	options *options) (*SparseExtent, error) {
 	profile := NewVMDKProfile()
 	res := &SparseExtent{
-		profile: profile,
-		reader:  reader,
-		header:  profile.SparseExtentHeader(reader, 0),
+		profile:  profile,
+		reader:   data,
+		metadata: metadata,
+		header:   profile.SparseExtentHeader(metadata, 0),
+	}
+
+	// seSparse extents have 64 bit grain table entries and a
+	// different layout altogether.
+	if res.header.magicNumber() == SESPARSE_MAGICNUMBER {
+		return nil, fmt.Errorf("%w: seSparse extent", ErrUnsupported)
 	}
 
 	if res.header.magicNumber() != SPARSE_MAGICNUMBER {
-		return nil, errors.New("Invalid magic")
+		return nil, ErrInvalidMagic
 	}
 
-	if res.header.version() != 1 {
-		return nil, errors.New("Unsupported version")
+	// All hosted sparse versions use 32 bit grain table entries
+	// holding a sector number.
+	version := res.header.version()
+	if version < 1 || version > MAX_SPARSE_VERSION {
+		return nil, fmt.Errorf("%w version %v", ErrUnsupported, version)
 	}
 
-	if res.header.grainSize() < 8 {
-		return nil, errors.New("Grain size invalid")
+	// Compressed grains are preceded by a marker so the grain table
+	// entries do not point at the data.
+	if res.header.flags()&FLAG_COMPRESSED != 0 {
+		return nil, fmt.Errorf(
+			"%w: compressed extent - use OpenStreamOptimized", ErrUnsupported)
+	}
+
+	err := checkGrainSize(res.header.grainSize(), options)
+	if err != nil {
+		return nil, err
 	}
 
 	if res.header.numGTEsPerGT() != 512 {
-		return nil, errors.New("numGTEsPerGT must be 512")
+		return nil, fmt.Errorf("%w: numGTEsPerGT must be 512", ErrUnsupported)
 	}
 
 	res.grain_size = int64(res.header.grainSize() * SECTOR_SIZE)
 	res.grain_table_coverage = int64(res.header.numGTEsPerGT()) * res.grain_size
+	if isPowerOfTwo(res.grain_size) {
+		res.grain_shift = uint(bits.TrailingZeros64(uint64(res.grain_size)))
+		res.table_shift = uint(bits.TrailingZeros64(
+			uint64(res.grain_table_coverage)))
+	}
 	res.gde_offset = int64(res.header.gdOffset() * SECTOR_SIZE)
+	res.zero_grains = res.header.flags()&FLAG_ZERO_GRAIN_GTE != 0
+	// The logical size is the declared capacity. Thin disks only
+	// store some of the grains; the rest read as zeros.
 	res.total_size = int64(res.header.capacity() * SECTOR_SIZE)
 
 	return res, nil
 }
+
+// The grain size in sectors must be at least 8 unless lenient, at most
+// MAX_GRAIN_SECTORS, and a power of two when strict.
+func checkGrainSize(sectors uint64, options *options) error {
+	min_sectors := uint64(8)
+	if options.lenient_grain_size {
+		min_sectors = 1
+	}
+
+	if sectors < min_sectors {
+		return fmt.Errorf("%w: %v sectors", ErrInvalidGrainSize, sectors)
+	}
+
+	// Also keeps the grain size and grain table coverage in bytes
+	// from overflowing.
+	if sectors > MAX_GRAIN_SECTORS {
+		return fmt.Errorf("%w: %v sectors is more than %v",
+			ErrInvalidGrainSize, sectors, MAX_GRAIN_SECTORS)
+	}
+
+	if options.strict_grain_size && !isPowerOfTwo(int64(sectors)) {
+		return fmt.Errorf("%w: %v sectors is not a power of two",
+			ErrInvalidGrainSize, sectors)
+	}
+	return nil
+}
+
+func isPowerOfTwo(value int64) bool {
+	return value > 0 && value&(value-1) == 0
+}
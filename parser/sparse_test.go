@@ -0,0 +1,431 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A thin disk's size comes from the header capacity, not from the
+// grains present in the file.
+func TestSparseCapacityExceedsAllocation(t *testing.T) {
+	capacity := int64(8 * 1024 * 1024)
+	data := buildSparseExtent(capacity, map[int64][]byte{
+		0: bytes.Repeat([]byte("A"), testGrainSize),
+	})
+
+	// Cut the file after the first grain table so the grain
+	// directory refers to tables beyond the end of the file.
+	data = data[:6*SECTOR_SIZE]
+
+	extent, err := GetSparseExtent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("GetSparseExtent: %v", err)
+	}
+
+	if extent.TotalSize() != capacity {
+		t.Fatalf("Unexpected size %v", extent.TotalSize())
+	}
+
+	buf := bytes.Repeat([]byte("X"), testGrainSize)
+	for _, offset := range []int64{
+		testGrainSize, capacity / 2, capacity - testGrainSize} {
+		n, err := extent.ReadAt(buf, offset)
+		if err != nil || n != len(buf) || !isZero(buf) {
+			t.Fatalf("Expected zeros at %#x, got %v %v", offset, n, err)
+		}
+	}
+
+	_, err = extent.ReadAt(buf, capacity)
+	if err != io.EOF {
+		t.Fatalf("Expected EOF past the capacity, got %v", err)
+	}
+}
+
+func TestCleanShutdown(t *testing.T) {
+	data := buildSparseExtent(1024*1024, nil)
+
+	extent, err := GetSparseExtent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("GetSparseExtent: %v", err)
+	}
+	if !extent.CleanShutdown() {
+		t.Fatalf("Expected a clean shutdown")
+	}
+
+	// Set the uncleanShutdown byte.
+	data[72] = 1
+	extent, err = GetSparseExtent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("GetSparseExtent: %v", err)
+	}
+	if extent.CleanShutdown() {
+		t.Fatalf("Expected an unclean shutdown")
+	}
+}
+
+func TestSparseVersions(t *testing.T) {
+	grain := bytes.Repeat([]byte("V"), testGrainSize)
+	for _, version := range []uint32{1, 2, 3} {
+		data := buildSparseExtent(1024*1024, map[int64][]byte{3: grain})
+		binary.LittleEndian.PutUint32(data[4:], version)
+
+		extent, err := GetSparseExtent(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Version %v: %v", version, err)
+		}
+
+		buf := make([]byte, testGrainSize)
+		_, err = extent.ReadAt(buf, 3*testGrainSize)
+		if err != nil || !bytes.Equal(buf, grain) {
+			t.Fatalf("Version %v: unexpected read %v", version, err)
+		}
+	}
+
+	for name, patch := range map[string]func(data []byte){
+		"version 4": func(data []byte) {
+			binary.LittleEndian.PutUint32(data[4:], 4)
+		},
+		"compressed": func(data []byte) {
+			binary.LittleEndian.PutUint32(data[8:], 1|FLAG_COMPRESSED)
+		},
+		"seSparse": func(data []byte) {
+			binary.LittleEndian.PutUint64(data[0:], SESPARSE_MAGICNUMBER)
+		},
+	} {
+		data := buildSparseExtent(1024*1024, nil)
+		patch(data)
+
+		_, err := GetSparseExtent(bytes.NewReader(data))
+		if !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("%v: expected ErrUnsupported, got %v", name, err)
+		}
+	}
+}
+
+// Version 2 and 3 extents may mark a grain as zeroed with a grain
+// table entry of 1. It reads as zeros rather than from sector 1, and
+// hides the parent's data.
+func TestZeroedGrainGTE(t *testing.T) {
+	parent := bytes.Repeat([]byte("P"), 1024*1024)
+	grain := bytes.Repeat([]byte("V"), testGrainSize)
+
+	for _, version := range []uint32{2, 3} {
+		data := buildSparseExtent(1024*1024, map[int64][]byte{3: grain})
+		binary.LittleEndian.PutUint32(data[4:], version)
+		binary.LittleEndian.PutUint32(data[8:], 1|FLAG_ZERO_GRAIN_GTE)
+
+		// Mark grain 5 as zeroed. The first grain table starts at
+		// sector 2.
+		binary.LittleEndian.PutUint32(data[2*SECTOR_SIZE+5*4:],
+			ZERO_GRAIN_GTE)
+
+		extent, err := GetSparseExtent(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Version %v: %v", version, err)
+		}
+		extent.parent = bytes.NewReader(parent)
+
+		buf := make([]byte, testGrainSize)
+		for grain_number, expected := range map[int64][]byte{
+			3: grain,
+			5: make([]byte, testGrainSize),
+			6: parent[:testGrainSize],
+		} {
+			_, err = extent.ReadAt(buf, grain_number*testGrainSize)
+			if err != nil || !bytes.Equal(buf, expected) {
+				t.Fatalf("Version %v: unexpected grain %v %q (%v)",
+					version, grain_number, buf[:16], err)
+			}
+		}
+
+		_, _, allocated, err := physicalOffset(extent, 5*testGrainSize)
+		if err != errZeroGrain || allocated {
+			t.Fatalf("Version %v: zeroed grain is allocated %v (%v)",
+				version, allocated, err)
+		}
+	}
+
+	// Without the flag the entry is an ordinary sector number.
+	data := buildSparseExtent(1024*1024, nil)
+	binary.LittleEndian.PutUint32(data[2*SECTOR_SIZE+5*4:], ZERO_GRAIN_GTE)
+	extent, err := GetSparseExtent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("GetSparseExtent: %v", err)
+	}
+
+	buf := make([]byte, SECTOR_SIZE)
+	_, err = extent.ReadAt(buf, 5*testGrainSize)
+	if err != nil || !bytes.Equal(buf, data[SECTOR_SIZE:2*SECTOR_SIZE]) {
+		t.Fatalf("Unexpected read of sector 1: %v", err)
+	}
+}
+
+func TestGrainOutOfBounds(t *testing.T) {
+	files := testFiles{
+		"test.vmdk": []byte(retryDescriptor),
+		"test-data.vmdk": buildSparseExtent(1024*1024, map[int64][]byte{
+			0: bytes.Repeat([]byte("A"), testGrainSize),
+			1: bytes.Repeat([]byte("B"), testGrainSize),
+		}),
+	}
+	files["test.vmdk"] = bytes.Replace(files["test.vmdk"],
+		[]byte(`"test.vmdk"`), []byte(`"test-data.vmdk"`), 1)
+
+	// Point grain 1 past the end of the file. The first grain table
+	// starts at sector 2.
+	data := files["test-data.vmdk"]
+	binary.LittleEndian.PutUint32(data[2*SECTOR_SIZE+4:],
+		uint32(len(data)/SECTOR_SIZE+100))
+
+	buf := make([]byte, testGrainSize)
+	for _, reader := range []func(data []byte) io.ReaderAt{
+		func(data []byte) io.ReaderAt { return bytes.NewReader(data) },
+
+		// A reader which does not know its size.
+		func(data []byte) io.ReaderAt {
+			return struct{ io.ReaderAt }{bytes.NewReader(data)}
+		},
+	} {
+		opener := func(filename string) (io.ReaderAt, func(), error) {
+			return reader(files[filename]), nil, nil
+		}
+
+		descriptor := files["test.vmdk"]
+		vmdk, err := GetVMDKContext(bytes.NewReader(descriptor),
+			len(descriptor), opener, WithGrainBoundsCheck())
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+
+		_, err = vmdk.ReadAt(buf, 0)
+		if err != nil || buf[0] != 'A' {
+			t.Fatalf("Unexpected read of grain 0: %v", err)
+		}
+
+		_, err = vmdk.ReadAt(buf, testGrainSize)
+		if !errors.Is(err, ErrGrainOutOfBounds) ||
+			!strings.Contains(err.Error(), "grain 1 ") {
+			t.Fatalf("Expected ErrGrainOutOfBounds, got %v", err)
+		}
+	}
+
+	// Without the check the read does not fail.
+	vmdk, err := openTestDisk(files, "test.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	_, err = vmdk.ReadAt(buf, testGrainSize)
+	if errors.Is(err, ErrGrainOutOfBounds) {
+		t.Fatalf("Unexpected bounds check")
+	}
+}
+
+// Records the size of each read reaching the underlying reader.
+type recordingReader struct {
+	reader io.ReaderAt
+	sizes  []int
+}
+
+func (self *recordingReader) ReadAt(buf []byte, offset int64) (int, error) {
+	self.sizes = append(self.sizes, len(buf))
+	return self.reader.ReadAt(buf, offset)
+}
+
+func TestSparseCoalescedReads(t *testing.T) {
+	capacity := int64(1024 * 1024)
+	grains := map[int64][]byte{}
+	for _, i := range []int64{0, 1, 2, 3, 4, 5, 6, 7, 10, 11, 12, 13, 14, 15} {
+		grains[i] = bytes.Repeat([]byte{byte(i)}, testGrainSize)
+	}
+	data := buildSparseExtent(capacity, grains)
+
+	// Swap the grain table entries of grains 14 and 15 so they are
+	// not stored in order. The grain table starts at sector 2.
+	gt := data[2*SECTOR_SIZE:]
+	e14 := binary.LittleEndian.Uint32(gt[14*4:])
+	e15 := binary.LittleEndian.Uint32(gt[15*4:])
+	binary.LittleEndian.PutUint32(gt[14*4:], e15)
+	binary.LittleEndian.PutUint32(gt[15*4:], e14)
+
+	reader := &recordingReader{reader: bytes.NewReader(data)}
+	extent, err := GetSparseExtent(reader)
+	if err != nil {
+		t.Fatalf("GetSparseExtent: %v", err)
+	}
+
+	reader.sizes = nil
+	buf := make([]byte, 16*testGrainSize)
+	for n := 0; n < len(buf); {
+		read, err := extent.ReadAt(buf[n:], int64(n))
+		if err != nil {
+			t.Fatalf("ReadAt %#x: %v", n, err)
+		}
+		n += read
+	}
+
+	expected := make([]byte, len(buf))
+	for i, grain := range grains {
+		copy(expected[i*testGrainSize:], grain)
+	}
+	copy(expected[14*testGrainSize:], grains[15])
+	copy(expected[15*testGrainSize:], grains[14])
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("Coalesced read returned the wrong data")
+	}
+
+	// Grain table entries are read 4 bytes at a time; the rest are
+	// data reads, split at the hole and where grains are out of order.
+	var data_reads []int
+	for _, size := range reader.sizes {
+		if size > 4 {
+			data_reads = append(data_reads, size/testGrainSize)
+		}
+	}
+	if !reflect.DeepEqual(data_reads, []int{8, 4, 1, 1}) {
+		t.Fatalf("Unexpected data reads in grains %v", data_reads)
+	}
+}
+
+func TestGrainSizeModes(t *testing.T) {
+	// 12 sectors (6kb) is not a power of two and 4 sectors is below
+	// the minimum.
+	for _, c := range []struct {
+		sectors int64
+		opts    []Option
+		err     bool
+	}{
+		{12, nil, false},
+		{12, []Option{WithLenientGrainSize()}, false},
+		{12, []Option{WithStrictGrainSize()}, true},
+		{16, []Option{WithStrictGrainSize()}, false},
+		{4, nil, true},
+		{4, []Option{WithLenientGrainSize()}, false},
+		{4, []Option{WithStrictGrainSize()}, true},
+	} {
+		grain_size := c.sectors * SECTOR_SIZE
+		capacity := int64(8 * 1024 * 1024)
+
+		// Grain 600 is in the second grain table.
+		grains := map[int64][]byte{
+			0:   bytes.Repeat([]byte("A"), int(grain_size)),
+			1:   bytes.Repeat([]byte("B"), int(grain_size)),
+			600: bytes.Repeat([]byte("C"), int(grain_size)),
+		}
+		data := buildSparseExtentWithGrainSize(capacity, c.sectors, grains)
+
+		extent, err := GetSparseExtent(bytes.NewReader(data), c.opts...)
+		if c.err {
+			if !errors.Is(err, ErrInvalidGrainSize) {
+				t.Fatalf("Expected ErrInvalidGrainSize for %v sectors, got %v",
+					c.sectors, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("GetSparseExtent(%v sectors): %v", c.sectors, err)
+		}
+
+		expected := make([]byte, capacity)
+		for grain, data := range grains {
+			copy(expected[grain*grain_size:], data)
+		}
+
+		// Reads at odd offsets cross grain boundaries.
+		buf := make([]byte, 5000)
+		for offset := int64(0); offset < capacity; offset += int64(len(buf)) {
+			n, err := extent.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				t.Fatalf("ReadAt(%#x): %v", offset, err)
+			}
+			if !bytes.Equal(buf[:n], expected[offset:offset+int64(n)]) {
+				t.Fatalf("Unexpected data at %#x with %v sector grains",
+					offset, c.sectors)
+			}
+		}
+	}
+}
+
+func TestGrainSizeTooLarge(t *testing.T) {
+	// 1<<55 sectors overflows the grain size in bytes to 0.
+	for _, sectors := range []uint64{MAX_GRAIN_SECTORS * 2, 1 << 55} {
+		data := buildSparseExtent(1024*1024, nil)
+		binary.LittleEndian.PutUint64(data[20:], sectors)
+
+		_, err := GetSparseExtent(bytes.NewReader(data), WithLenientGrainSize())
+		if !errors.Is(err, ErrInvalidGrainSize) {
+			t.Fatalf("Expected ErrInvalidGrainSize for %v sectors, got %v",
+				sectors, err)
+		}
+	}
+}
+
+// Split a sparse extent into a file with the header and grain tables
+// and one with only the grains, so reads fail unless each comes from
+// the right file.
+func splitSparseExtent(data []byte) (metadata, grains []byte) {
+	overhead := int64(binary.LittleEndian.Uint64(data[64:])) * SECTOR_SIZE
+	grains = make([]byte, len(data))
+	copy(grains[overhead:], data[overhead:])
+	return data[:overhead], grains
+}
+
+func TestSplitMetadata(t *testing.T) {
+	expected := make([]byte, 1024*1024)
+	copy(expected, bytes.Repeat([]byte("B"), 2*testGrainSize))
+
+	metadata, grains := splitSparseExtent(makeChainFiles()["base-data.vmdk"])
+	extent, err := GetSplitSparseExtent(
+		bytes.NewReader(metadata), bytes.NewReader(grains))
+	if err != nil {
+		t.Fatalf("GetSplitSparseExtent: %v", err)
+	}
+
+	buf := make([]byte, len(expected))
+	_, err = extent.ReadAt(buf, 0)
+	if err != nil || !bytes.Equal(buf, expected) {
+		t.Fatalf("Unexpected extent data: %v", err)
+	}
+
+	files := testFiles{
+		"split.vmdk": []byte(strings.Replace(baseDescriptor,
+			`"base-data.vmdk"`, `"data.vmdk" "meta.vmdk"`, 1)),
+		"data.vmdk": grains,
+		"meta.vmdk": metadata,
+	}
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithLazyOpen(1)},
+		{WithGrainBoundsCheck()},
+	} {
+		vmdk, err := openTestDisk(files, "split.vmdk",
+			append(opts, WithHighResolutionRanges())...)
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+
+		buf := make([]byte, vmdk.Size())
+		_, err = vmdk.ReadAt(buf, 0)
+		if err != nil || !bytes.Equal(buf, expected) {
+			t.Fatalf("Unexpected disk data: %v", err)
+		}
+
+		ranges := vmdk.AllocatedRanges()
+		if len(ranges) != 1 || ranges[0].Length != 2*testGrainSize {
+			t.Fatalf("Unexpected allocated ranges %v", ranges)
+		}
+		vmdk.Close()
+	}
+
+	// The metadata file is opened with the extent.
+	delete(files, "meta.vmdk")
+	_, err = openTestDisk(files, "split.vmdk")
+	if err == nil || !strings.Contains(err.Error(), "meta.vmdk") {
+		t.Fatalf("Expected an error opening the metadata, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package parser
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Grain size used when writing sparse extents (64kb).
+	WRITER_GRAIN_SECTORS = 128
+
+	// Space reserved for the embedded descriptor.
+	WRITER_DESCRIPTOR_SECTORS = 20
+)
+
+// Writes a hosted sparse extent. Grains are appended after the
+// metadata as they are written, and the grain directory and tables
+// are written at the end.
+type sparseWriter struct {
+	out io.WriterAt
+
+	// Capacity in sectors.
+	capacity      int64
+	grain_sectors int64
+
+	gd_sector int64
+	gt_sector int64
+	overhead  int64
+
+	// All the grain table entries.
+	gtes []uint32
+
+	next_sector int64
+}
+
+func newSparseWriter(out io.WriterAt, size int64) *sparseWriter {
+	capacity := (size + SECTOR_SIZE - 1) / SECTOR_SIZE
+	num_grains := (capacity + WRITER_GRAIN_SECTORS - 1) / WRITER_GRAIN_SECTORS
+	num_gts := (num_grains + 511) / 512
+
+	gd_sector := int64(1 + WRITER_DESCRIPTOR_SECTORS)
+	gd_sectors := (num_gts*4 + SECTOR_SIZE - 1) / SECTOR_SIZE
+	gt_sector := gd_sector + gd_sectors
+
+	// Grain data starts on a grain boundary after the grain tables.
+	overhead := gt_sector + num_gts*4
+	overhead = (overhead + WRITER_GRAIN_SECTORS - 1) /
+		WRITER_GRAIN_SECTORS * WRITER_GRAIN_SECTORS
+
+	return &sparseWriter{
+		out:           out,
+		capacity:      capacity,
+		grain_sectors: WRITER_GRAIN_SECTORS,
+		gd_sector:     gd_sector,
+		gt_sector:     gt_sector,
+		overhead:      overhead,
+		gtes:          make([]uint32, num_gts*512),
+		next_sector:   overhead,
+	}
+}
+
+func (self *sparseWriter) grainSize() int64 {
+	return self.grain_sectors * SECTOR_SIZE
+}
+
+func (self *sparseWriter) writeGrain(grain int64, data []byte) error {
+	if grain < 0 || grain >= int64(len(self.gtes)) {
+		return fmt.Errorf("Grain %v out of range", grain)
+	}
+
+	_, err := self.out.WriteAt(data, self.next_sector*SECTOR_SIZE)
+	if err != nil {
+		return err
+	}
+
+	self.gtes[grain] = uint32(self.next_sector)
+	self.next_sector += self.grain_sectors
+	return nil
+}
+
+// Write the header, descriptor and grain metadata.
+func (self *sparseWriter) close(descriptor string) error {
+	if len(descriptor) > WRITER_DESCRIPTOR_SECTORS*SECTOR_SIZE {
+		return errors.New("Descriptor too large")
+	}
+
+	le := binary.LittleEndian
+	header := make([]byte, SECTOR_SIZE)
+	le.PutUint32(header[0:], SPARSE_MAGICNUMBER)
+	le.PutUint32(header[4:], 1)
+	le.PutUint32(header[8:], 1)
+	le.PutUint64(header[12:], uint64(self.capacity))
+	le.PutUint64(header[20:], uint64(self.grain_sectors))
+	le.PutUint64(header[28:], 1)
+	le.PutUint64(header[36:], WRITER_DESCRIPTOR_SECTORS)
+	le.PutUint32(header[44:], 512)
+	le.PutUint64(header[56:], uint64(self.gd_sector))
+	le.PutUint64(header[64:], uint64(self.overhead))
+	copy(header[73:], "\n \r\n")
+
+	metadata := make([]byte, (self.overhead-1)*SECTOR_SIZE)
+	copy(metadata, descriptor)
+
+	num_gts := int64(len(self.gtes)) / 512
+	gd := metadata[(self.gd_sector-1)*SECTOR_SIZE:]
+	gt := metadata[(self.gt_sector-1)*SECTOR_SIZE:]
+	for i := int64(0); i < num_gts; i++ {
+		le.PutUint32(gd[i*4:], uint32(self.gt_sector+i*4))
+	}
+	for i, gte := range self.gtes {
+		le.PutUint32(gt[i*4:], gte)
+	}
+
+	_, err := self.out.WriteAt(header, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.out.WriteAt(metadata, SECTOR_SIZE)
+	return err
+}
+
+// WriteMonolithicSparse writes the logical disk as a monolithicSparse
+// disk with an embedded descriptor. Grains that are all zero are not
+// stored. The descriptor refers to the extent by filename.
+func (self *VMDKContext) WriteMonolithicSparse(
+	ctx context.Context, out io.WriterAt, filename string,
+	progress ProgressFunc) error {
+	writer := newSparseWriter(out, self.total_size)
+	descriptor, err := formatDescriptor("monolithicSparse", writer.capacity,
+		[]string{fmt.Sprintf("RW %d SPARSE %q", writer.capacity, filename)},
+		self.config)
+	if err != nil {
+		return err
+	}
+
+	grain_size := writer.grainSize()
+	buf := make([]byte, grain_size)
+
+	for offset := int64(0); offset < self.total_size; offset += grain_size {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		n, err := self.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// The last grain may be partial.
+		zeroFill(buf[n:])
+
+		if !isZero(buf) {
+			err = writer.writeGrain(offset/grain_size, buf)
+			if err != nil {
+				return err
+			}
+		}
+
+		if progress != nil {
+			progress(offset+int64(n), self.total_size)
+		}
+	}
+
+	return writer.close(descriptor)
+}
@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestWriteMonolithicSparse(t *testing.T) {
+	vmdk, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	expected := &bytes.Buffer{}
+	_, err = vmdk.WriteTo(expected)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	out := &memWriterAt{}
+	err = vmdk.WriteMonolithicSparse(
+		context.Background(), out, "flat.vmdk", nil)
+	if err != nil {
+		t.Fatalf("WriteMonolithicSparse: %v", err)
+	}
+
+	// The flattened disk only stores the two allocated grains, packed
+	// into a single 64kb grain.
+	files := testFiles{"flat.vmdk": out.buf}
+	flat, err := openTestDisk(files, "flat.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+
+	if flat.Parent() != nil || flat.Info().CreateType != "monolithicSparse" {
+		t.Fatalf("Unexpected flattened disk %+v", flat.Info())
+	}
+
+	actual := &bytes.Buffer{}
+	_, err = flat.WriteTo(actual)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+		t.Fatalf("Flattened disk content differs")
+	}
+}
+
+func TestExportCancel(t *testing.T) {
+	vmdk, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n, err := vmdk.Export(ctx, &bytes.Buffer{}, nil)
+	if err != context.Canceled || n != 0 {
+		t.Fatalf("Expected cancellation, got %v %v", n, err)
+	}
+}
+
+func TestWriteMonolithicFlat(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	source := NewFlatContext(bytes.NewReader(data), int64(len(data)))
+
+	descriptor := &bytes.Buffer{}
+	flat := &bytes.Buffer{}
+	err := source.WriteMonolithicFlat(context.Background(),
+		descriptor, flat, "disk-flat.vmdk", nil)
+	if err != nil {
+		t.Fatalf("WriteMonolithicFlat: %v", err)
+	}
+
+	files := testFiles{
+		"disk.vmdk":      descriptor.Bytes(),
+		"disk-flat.vmdk": flat.Bytes(),
+	}
+	vmdk, err := openTestDisk(files, "disk.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.Info().CreateType != "monolithicFlat" ||
+		vmdk.Size() != int64(len(data)) {
+		t.Fatalf("Unexpected disk %+v", vmdk.Info())
+	}
+
+	actual := &bytes.Buffer{}
+	_, err = vmdk.WriteTo(actual)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	if !bytes.Equal(data, actual.Bytes()) {
+		t.Fatalf("Flat disk content differs")
+	}
+}
@@ -0,0 +1,95 @@
+package parser
+
+import (
+	"io"
+	"os"
+)
+
+// TempStorage creates the temporary files used for data which would
+// otherwise be held in memory, such as the grains buffered by
+// OpenStreamOptimized (see WithSpill). Embedders can implement it to
+// control where such data lands.
+type TempStorage interface {
+	Create() (TempFile, error)
+}
+
+// TempFile is written sequentially and read back at random. Remove
+// closes and deletes it.
+type TempFile interface {
+	io.Writer
+	io.ReaderAt
+	Remove() error
+}
+
+// OSTempStorage creates temporary files in Dir, or in the default
+// directory for temporary files if Dir is empty.
+type OSTempStorage struct {
+	Dir string
+}
+
+func (self OSTempStorage) Create() (TempFile, error) {
+	fd, err := os.CreateTemp(self.Dir, "vmdk-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	return &osTempFile{File: fd}, nil
+}
+
+type osTempFile struct {
+	*os.File
+}
+
+func (self *osTempFile) Remove() error {
+	self.File.Close()
+	return os.Remove(self.File.Name())
+}
+
+// A compressed grain of a stream. It is held in data, or in the spill
+// file at offset if data is nil.
+type streamGrain struct {
+	data   []byte
+	offset int64
+	size   int64
+}
+
+// Moves compressed grains to a temporary file once more than
+// threshold bytes are held in memory.
+type spill struct {
+	storage   TempStorage
+	threshold int64
+
+	in_memory int64
+	file      TempFile
+	size      int64
+}
+
+func (self *spill) add(data []byte) (streamGrain, error) {
+	if self.in_memory+int64(len(data)) <= self.threshold {
+		self.in_memory += int64(len(data))
+		return streamGrain{data: data, size: int64(len(data))}, nil
+	}
+
+	if self.file == nil {
+		file, err := self.storage.Create()
+		if err != nil {
+			return streamGrain{}, err
+		}
+		self.file = file
+	}
+
+	_, err := self.file.Write(data)
+	if err != nil {
+		return streamGrain{}, err
+	}
+
+	res := streamGrain{offset: self.size, size: int64(len(data))}
+	self.size += int64(len(data))
+	return res, nil
+}
+
+func (self *spill) Close() {
+	if self.file != nil {
+		self.file.Remove()
+		self.file = nil
+	}
+}
@@ -32,3 +32,65 @@ func (self *VMDKContext) Stats() VMDKStats {
 
 	return res
 }
+
+// DiskInfo summarizes the disk in one call.
+type DiskInfo struct {
+	Size        int64  `json:"Size"`
+	Sectors     int64  `json:"Sectors"`
+	CreateType  string `json:"CreateType"`
+	ExtentCount int    `json:"ExtentCount"`
+	Thin        bool   `json:"Thin"`
+	HasParent   bool   `json:"HasParent"`
+	GrainSize   int64  `json:"GrainSize"`
+
+	// The data lives on a raw device rather than in the extents.
+	RawDeviceMap bool `json:"RawDeviceMap,omitempty"`
+}
+
+func (self *VMDKContext) Info() DiskInfo {
+	res := DiskInfo{
+		Size:       self.total_size,
+		Sectors:    self.total_size / SECTOR_SIZE,
+		CreateType: self.config.CreateType,
+		HasParent:  self.config.HasParent(),
+
+		RawDeviceMap: self.IsRawDeviceMap(),
+	}
+
+	for _, e := range self.extents {
+		switch t := e.(type) {
+		case *NullExtent:
+			// Padding is not a real extent.
+			continue
+
+		case *SparseExtent:
+			res.Thin = true
+			if res.GrainSize == 0 {
+				res.GrainSize = t.grain_size
+			}
+
+		case *StreamExtent:
+			res.Thin = true
+			if res.GrainSize == 0 {
+				res.GrainSize = t.grain_size
+			}
+
+		case *LazyStreamExtent:
+			res.Thin = true
+			if res.GrainSize == 0 {
+				res.GrainSize = t.grain_size
+			}
+
+		case *lazyExtent:
+			if t.extent_type == "SPARSE" {
+				res.Thin = true
+				if res.GrainSize == 0 {
+					res.GrainSize = t.grainSize()
+				}
+			}
+		}
+		res.ExtentCount++
+	}
+
+	return res
+}
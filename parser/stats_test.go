@@ -0,0 +1,72 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+const mixedDescriptor = `# Disk DescriptorFile
+version=1
+CID=7a3c5e21
+parentCID=ffffffff
+createType="twoGbMaxExtentSparse"
+
+# Extent description
+RW 2048 FLAT "test-f001.vmdk" 0
+RW 4096 SPARSE "test-s002.vmdk"
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "lsilogic"
+ddb.geometry.cylinders = "3"
+`
+
+func TestInfo(t *testing.T) {
+	files := testFiles{
+		"test-f001.vmdk": make([]byte, 2048*SECTOR_SIZE),
+		"test-s002.vmdk": buildSparseExtent(4096*SECTOR_SIZE, nil),
+	}
+
+	expected := DiskInfo{
+		Size:        6144 * SECTOR_SIZE,
+		Sectors:     6144,
+		CreateType:  "twoGbMaxExtentSparse",
+		ExtentCount: 2,
+		Thin:        true,
+		HasParent:   false,
+		GrainSize:   testGrainSize,
+	}
+
+	// Extents opened on demand are described the same way.
+	for _, opts := range [][]Option{nil, {WithLazyOpen(1)}} {
+		vmdk, err := GetVMDKContext(bytes.NewReader([]byte(mixedDescriptor)),
+			len(mixedDescriptor), files.Open, opts...)
+		if err != nil {
+			t.Fatalf("GetVMDKContext: %v", err)
+		}
+
+		info := vmdk.Info()
+		if info != expected {
+			t.Fatalf("Info() = %+v, expected %+v", info, expected)
+		}
+		vmdk.Close()
+	}
+
+	vmdk, err := GetVMDKContext(bytes.NewReader([]byte(mixedDescriptor)),
+		len(mixedDescriptor), files.Open)
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+
+	if vmdk.Config().DBBAdapterType != "lsilogic" ||
+		vmdk.Config().DBBGeometryCylinders != 3 {
+		t.Fatalf("DDB not parsed: %+v", vmdk.Config())
+	}
+
+	// A child disk names its parent.
+	vmdk.config.parseLine(`parentCID=7a3c5e20`)
+	if !vmdk.Info().HasParent {
+		t.Fatalf("Expected HasParent to be set")
+	}
+}
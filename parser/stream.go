@@ -0,0 +1,425 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+const (
+	// The gdOffset in the header of a streamOptimized disk when the
+	// grain directory is located at the end of the file.
+	GD_AT_END = 0xffffffffffffffff
+
+	FLAG_COMPRESSED = 1 << 16
+	FLAG_MARKERS    = 1 << 17
+
+	COMPRESSION_DEFLATE = 1
+
+	MARKER_EOS    = 0
+	MARKER_GT     = 1
+	MARKER_GD     = 2
+	MARKER_FOOTER = 3
+
+	// The largest descriptor embedded in a streamOptimized disk. Real
+	// disks reserve a few sectors for it.
+	MAX_EMBEDDED_DESCRIPTOR_SIZE = 64 * 1024
+)
+
+// A streamOptimized extent read from a non seekable stream. The
+// compressed grains are held in memory, or in a temporary file (see
+// WithSpill), and inflated on demand.
+type StreamExtent struct {
+	// Compressed grain data keyed by grain number.
+	grains map[int64]streamGrain
+
+	// Holds the grains which did not fit in memory, may be nil.
+	spill *spill
+
+	grain_size int64
+	total_size int64
+
+	// The offset in the logical image where this extent sits.
+	offset   int64
+	filename string
+
+	// Recently inflated grains, may be nil.
+	cache *grainCache
+}
+
+func (self *StreamExtent) Close() {
+	if self.spill != nil {
+		self.spill.Close()
+	}
+}
+
+func (self *StreamExtent) Debug() {
+	fmt.Printf("STREAM extent %v at %#x (%v bytes, %v grains)\n",
+		self.filename, self.offset, self.total_size, len(self.grains))
+}
+
+func (self *StreamExtent) TotalSize() int64 {
+	return self.total_size
+}
+
+func (self *StreamExtent) VirtualOffset() int64 {
+	return self.offset
+}
+
+func (self *StreamExtent) Stats() ExtentStat {
+	return ExtentStat{
+		Type:          "STREAM",
+		VirtualOffset: self.offset,
+		Size:          self.total_size,
+		Filename:      self.filename,
+	}
+}
+
+func (self *StreamExtent) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 || offset >= self.total_size {
+		return 0, io.EOF
+	}
+
+	offset_within_grain := offset % self.grain_size
+	to_read := int64(len(buf))
+	if to_read > self.grain_size-offset_within_grain {
+		to_read = self.grain_size - offset_within_grain
+	}
+
+	if to_read > self.total_size-offset {
+		to_read = self.total_size - offset
+	}
+
+	grain_number := offset / self.grain_size
+	stored, pres := self.grains[grain_number]
+	if !pres {
+		zeroFill(buf[:to_read])
+		return int(to_read), nil
+	}
+
+	compressed, err := self.compressedGrain(grain_number, stored)
+	if err != nil {
+		return 0, err
+	}
+
+	err = copyGrain(self.cache, grainKey{extent: self, grain: grain_number},
+		compressed, self.grain_size, buf[:to_read], offset_within_grain)
+	if err != nil {
+		return 0, err
+	}
+	return int(to_read), nil
+}
+
+// Get the compressed data of a grain, from the spill file if needed.
+func (self *StreamExtent) compressedGrain(
+	grain_number int64, stored streamGrain) ([]byte, error) {
+	if stored.data != nil {
+		return stored.data, nil
+	}
+
+	compressed := make([]byte, stored.size)
+	_, err := self.spill.file.ReadAt(compressed, stored.offset)
+	if err != nil {
+		return nil, fmt.Errorf("While reading spilled grain %v: %w",
+			grain_number, err)
+	}
+	return compressed, nil
+}
+
+// Get an inflated grain through the cache.
+func (self *StreamExtent) getGrain(
+	grain_number int64, compressed []byte) ([]byte, error) {
+	return inflateCached(self.cache,
+		grainKey{extent: self, grain: grain_number},
+		compressed, self.grain_size)
+}
+
+func inflateCached(cache *grainCache, key grainKey,
+	compressed []byte, grain_size int64) ([]byte, error) {
+	grain, pres := cache.get(key)
+	if pres {
+		return grain, nil
+	}
+
+	grain = make([]byte, grain_size)
+	err := inflateGrain(compressed, grain)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.add(key, grain)
+	return grain, nil
+}
+
+// Inflate a grain and copy out the part of it at offset_within_grain,
+// through the cache if there is one.
+func copyGrain(cache *grainCache, key grainKey, compressed []byte,
+	grain_size int64, buf []byte, offset_within_grain int64) error {
+	var grain []byte
+	var err error
+	if cache == nil {
+		// The grain is only needed until it is copied out.
+		scratch := getScratch(grain_size)
+		defer putScratch(scratch)
+
+		grain = *scratch
+		err = inflateGrain(compressed, grain)
+	} else {
+		grain, err = inflateCached(cache, key, compressed, grain_size)
+	}
+	if err != nil {
+		return err
+	}
+
+	copy(buf, grain[offset_within_grain:])
+	return nil
+}
+
+// Tracks the position in a forward only stream.
+type streamReader struct {
+	reader io.Reader
+	pos    int64
+}
+
+func (self *streamReader) read(size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(self.reader, buf)
+	self.pos += int64(n)
+	return buf, err
+}
+
+func (self *streamReader) skipTo(pos int64) error {
+	if pos < self.pos {
+		return fmt.Errorf("Can not seek backwards to %#x in stream", pos)
+	}
+
+	n, err := io.CopyN(io.Discard, self.reader, pos-self.pos)
+	self.pos += n
+	return err
+}
+
+// OpenStreamOptimized reads a streamOptimized disk from a forward only
+// stream such as a pipe. The entire stream is consumed up to the end
+// of stream marker, and the compressed grains are buffered in memory
+// unless WithSpill is given.
+//
+// Since each grain marker records the grain's location the grain
+// directory is never consulted, so disks with the grain directory at
+// the end of the stream (GD_AT_END) are supported. Recently inflated
+// grains are cached (see WithDecompressedGrainCache).
+func OpenStreamOptimized(r io.Reader, opts ...Option) (*VMDKContext, error) {
+	options := getOptions(opts)
+	stream := &streamReader{reader: r}
+
+	header_data, err := stream.read(SECTOR_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := NewVMDKProfile()
+	header := profile.SparseExtentHeader(bytes.NewReader(header_data), 0)
+	err = checkStreamHeader(header, options)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &VMDKContext{
+		profile:  profile,
+		config:   NewVMDKConfig(),
+		options:  options,
+		coverage: options.newCoverageMap(),
+	}
+
+	// Parse the embedded descriptor.
+	if header.descriptorOffset() > 0 {
+		err = stream.skipTo(int64(header.descriptorOffset()) * SECTOR_SIZE)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := embeddedDescriptorSize(header)
+		if err != nil {
+			return nil, err
+		}
+
+		descriptor, err := stream.read(size)
+		if err != nil {
+			return nil, err
+		}
+
+		res.config.parseEmbedded(descriptor)
+	}
+
+	extent := &StreamExtent{
+		grains:     make(map[int64]streamGrain),
+		grain_size: int64(header.grainSize()) * SECTOR_SIZE,
+		total_size: int64(header.capacity()) * SECTOR_SIZE,
+	}
+
+	if options.temp_storage != nil {
+		extent.spill = &spill{
+			storage:   options.temp_storage,
+			threshold: options.spill_threshold,
+		}
+	}
+
+	if options.grain_cache_size > 0 {
+		extent.cache = newGrainCache(options.grain_cache_size)
+	}
+
+	err = stream.skipTo(int64(header.overHead()) * SECTOR_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	err = extent.readGrains(stream)
+	if err != nil {
+		extent.Close()
+		return nil, err
+	}
+
+	res.extents = append(res.extents, extent)
+	res.total_size = extent.total_size
+	res.startReadahead()
+	return res, nil
+}
+
+// Check the header is of a streamOptimized disk we can read.
+func checkStreamHeader(header *SparseExtentHeader, options *options) error {
+	if header.magicNumber() != SPARSE_MAGICNUMBER {
+		return ErrInvalidMagic
+	}
+
+	if header.flags()&(FLAG_COMPRESSED|FLAG_MARKERS) !=
+		FLAG_COMPRESSED|FLAG_MARKERS {
+		return errors.New("Not a streamOptimized disk")
+	}
+
+	if header.compressAlgorithm() != COMPRESSION_DEFLATE {
+		return fmt.Errorf("%w compression algorithm %v",
+			ErrUnsupported, header.compressAlgorithm())
+	}
+
+	return checkGrainSize(header.grainSize(), options)
+}
+
+// The size in bytes of the descriptor embedded in a streamOptimized
+// disk, which is read whole.
+func embeddedDescriptorSize(header *SparseExtentHeader) (int64, error) {
+	sectors := header.descriptorSize()
+	if sectors > MAX_EMBEDDED_DESCRIPTOR_SIZE/SECTOR_SIZE {
+		return 0, fmt.Errorf("%w: descriptor of %v sectors is too large",
+			ErrCorruptStream, sectors)
+	}
+	return int64(sectors) * SECTOR_SIZE, nil
+}
+
+// The largest a grain of grain_size bytes may be once deflated, as
+// given by zlib's compressBound().
+func deflateBound(grain_size int64) int64 {
+	return grain_size + grain_size>>12 + grain_size>>14 +
+		grain_size>>25 + 13
+}
+
+// Check the value and size of a marker at pos. A grain marker's value
+// is the sector of the grain and its size the compressed length, while
+// a metadata marker's value is the number of sectors which follow.
+func checkMarker(value, size, grain_size, pos int64) error {
+	if value < 0 || value > math.MaxInt64/SECTOR_SIZE {
+		return fmt.Errorf("%w: marker at %#x has invalid value %#x",
+			ErrCorruptStream, pos, uint64(value))
+	}
+
+	if size > deflateBound(grain_size) {
+		return fmt.Errorf("%w: grain marker at %#x has size %v which is "+
+			"more than a compressed grain of %v bytes can be",
+			ErrCorruptStream, pos, size, grain_size)
+	}
+	return nil
+}
+
+// Parse a descriptor embedded in a sparse extent, which is padded
+// with zeros.
+func (self *VMDKConfig) parseEmbedded(descriptor []byte) {
+	for _, line := range strings.Split(
+		string(bytes.TrimRight(descriptor, "\x00")), "\n") {
+		self.parseLine(line)
+	}
+}
+
+// Read grains from the stream up to the end of stream marker.
+func (self *StreamExtent) readGrains(stream *streamReader) error {
+	for {
+		marker, err := stream.read(SECTOR_SIZE)
+		if err != nil {
+			return fmt.Errorf("While reading marker at %#x: %w",
+				stream.pos, err)
+		}
+
+		value := int64(binary.LittleEndian.Uint64(marker))
+		size := int64(binary.LittleEndian.Uint32(marker[8:]))
+		err = checkMarker(value, size, self.grain_size, stream.pos-SECTOR_SIZE)
+		if err != nil {
+			return err
+		}
+
+		// A grain marker: value is the LBA of the grain and the
+		// compressed data follows.
+		if size > 0 {
+			data := make([]byte, 0, size)
+			data = append(data, marker[12:]...)
+			if size > int64(len(data)) {
+				// Grain data is padded to a sector boundary.
+				remaining := size - int64(len(data))
+				padded := (remaining + SECTOR_SIZE - 1) /
+					SECTOR_SIZE * SECTOR_SIZE
+				rest, err := stream.read(padded)
+				if err != nil {
+					return err
+				}
+				data = append(data, rest...)
+			}
+
+			grain := value * SECTOR_SIZE / self.grain_size
+			if self.spill == nil {
+				self.grains[grain] = streamGrain{data: data[:size], size: size}
+				continue
+			}
+
+			stored, err := self.spill.add(data[:size])
+			if err != nil {
+				return fmt.Errorf("While spilling grain %v: %w", grain, err)
+			}
+			self.grains[grain] = stored
+			continue
+		}
+
+		// A metadata marker: value is the number of sectors that
+		// follow.
+		switch binary.LittleEndian.Uint32(marker[12:]) {
+		case MARKER_EOS:
+			return nil
+
+		case MARKER_GT, MARKER_GD, MARKER_FOOTER:
+			// The metadata is not needed since grain markers give
+			// the location of each grain.
+			if value > (math.MaxInt64-stream.pos)/SECTOR_SIZE {
+				return fmt.Errorf("%w: metadata marker at %#x has "+
+					"invalid size %v", ErrCorruptStream,
+					stream.pos-SECTOR_SIZE, value)
+			}
+
+			err := stream.skipTo(stream.pos + value*SECTOR_SIZE)
+			if err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("Unknown marker at %#x", stream.pos)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// The part of a marker we need: the value, the size and for metadata
+// markers the type.
+const MARKER_HEADER_SIZE = 16
+
+// A streamOptimized extent read through an io.ReaderAt. Rather than
+// parsing the whole file up front the markers are scanned from the
+// start only as far as reads need, remembering where each grain passed
+// is stored.
+type LazyStreamExtent struct {
+	reader io.ReaderAt
+
+	// Protects the fields below.
+	mu sync.Mutex
+
+	// The location of the compressed grains found so far, keyed by
+	// grain number.
+	grains map[int64]streamGrain
+
+	// The file offset of the next marker to scan.
+	next int64
+
+	// The size of the file, which markers may not point past.
+	size int64
+
+	// Set once the end of stream marker is reached, after which a
+	// grain missing from grains is unallocated.
+	complete bool
+
+	// Bytes read while scanning markers, updated atomically.
+	scanned int64
+
+	grain_size int64
+	total_size int64
+
+	// The offset in the logical image where this extent sits.
+	offset   int64
+	filename string
+
+	// Recently inflated grains, may be nil.
+	cache *grainCache
+}
+
+// OpenStreamOptimizedAt opens a streamOptimized disk through an
+// io.ReaderAt without parsing the whole file. The grain markers are
+// scanned lazily, so reading e.g. the first sector of a large disk only
+// touches the start of the file. This suits quick inspection of large
+// or remote disks.
+//
+// The locations of grains are only known once the scan has passed
+// them, so reading an unallocated grain, or AllocatedRanges, scans the
+// rest of the file once. Metadata such as the grain tables is skipped
+// and never read.
+func OpenStreamOptimizedAt(
+	reader io.ReaderAt, opts ...Option) (*VMDKContext, error) {
+	options := getOptions(opts)
+
+	header_data := make([]byte, SECTOR_SIZE)
+	_, err := reader.ReadAt(header_data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("While reading header: %w", err)
+	}
+
+	profile := NewVMDKProfile()
+	header := profile.SparseExtentHeader(bytes.NewReader(header_data), 0)
+	err = checkStreamHeader(header, options)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &VMDKContext{
+		profile:  profile,
+		config:   NewVMDKConfig(),
+		options:  options,
+		coverage: options.newCoverageMap(),
+	}
+
+	if header.descriptorOffset() > 0 {
+		size, err := embeddedDescriptorSize(header)
+		if err != nil {
+			return nil, err
+		}
+
+		descriptor := make([]byte, size)
+		_, err = reader.ReadAt(descriptor,
+			int64(header.descriptorOffset())*SECTOR_SIZE)
+		if err != nil {
+			return nil, fmt.Errorf("While reading descriptor: %w", err)
+		}
+		res.config.parseEmbedded(descriptor)
+	}
+
+	extent := &LazyStreamExtent{
+		reader:     reader,
+		grains:     make(map[int64]streamGrain),
+		next:       int64(header.overHead()) * SECTOR_SIZE,
+		size:       readerSize(reader),
+		grain_size: int64(header.grainSize()) * SECTOR_SIZE,
+		total_size: int64(header.capacity()) * SECTOR_SIZE,
+	}
+
+	if options.grain_cache_size > 0 {
+		extent.cache = newGrainCache(options.grain_cache_size)
+	}
+
+	res.extents = append(res.extents, extent)
+	res.total_size = extent.total_size
+	res.startReadahead()
+	return res, nil
+}
+
+func (self *LazyStreamExtent) Close() {}
+
+func (self *LazyStreamExtent) Debug() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	fmt.Printf("STREAM extent %v at %#x (%v bytes, %v grains found)\n",
+		self.filename, self.offset, self.total_size, len(self.grains))
+}
+
+func (self *LazyStreamExtent) TotalSize() int64 {
+	return self.total_size
+}
+
+func (self *LazyStreamExtent) VirtualOffset() int64 {
+	return self.offset
+}
+
+func (self *LazyStreamExtent) Stats() ExtentStat {
+	return ExtentStat{
+		Type:          "STREAM",
+		VirtualOffset: self.offset,
+		Size:          self.total_size,
+		Filename:      self.filename,
+	}
+}
+
+// Scanned returns the number of bytes read so far while looking for
+// grains.
+func (self *LazyStreamExtent) Scanned() int64 {
+	return atomic.LoadInt64(&self.scanned)
+}
+
+func (self *LazyStreamExtent) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 || offset >= self.total_size {
+		return 0, io.EOF
+	}
+
+	offset_within_grain := offset % self.grain_size
+	to_read := int64(len(buf))
+	if to_read > self.grain_size-offset_within_grain {
+		to_read = self.grain_size - offset_within_grain
+	}
+
+	if to_read > self.total_size-offset {
+		to_read = self.total_size - offset
+	}
+
+	grain_number := offset / self.grain_size
+	stored, pres, err := self.findGrain(grain_number)
+	if err != nil {
+		return 0, err
+	}
+
+	if !pres {
+		zeroFill(buf[:to_read])
+		return int(to_read), nil
+	}
+
+	compressed := make([]byte, stored.size)
+	_, err = self.reader.ReadAt(compressed, stored.offset)
+	if err != nil {
+		return 0, fmt.Errorf("While reading grain %v: %w", grain_number, err)
+	}
+
+	err = copyGrain(self.cache, grainKey{extent: self, grain: grain_number},
+		compressed, self.grain_size, buf[:to_read], offset_within_grain)
+	if err != nil {
+		return 0, err
+	}
+	return int(to_read), nil
+}
+
+// Find where a grain is stored, scanning further markers if it has not
+// been seen yet.
+func (self *LazyStreamExtent) findGrain(
+	grain_number int64) (streamGrain, bool, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for {
+		stored, pres := self.grains[grain_number]
+		if pres {
+			return stored, true, nil
+		}
+
+		if self.complete {
+			return streamGrain{}, false, nil
+		}
+
+		err := self.scanMarker()
+		if err != nil {
+			return streamGrain{}, false, err
+		}
+	}
+}
+
+// Scan the next marker. Only the start of each marker is read, the
+// grain data and metadata following it are skipped.
+func (self *LazyStreamExtent) scanMarker() error {
+	marker := make([]byte, MARKER_HEADER_SIZE)
+	n, err := self.reader.ReadAt(marker, self.next)
+	atomic.AddInt64(&self.scanned, int64(n))
+	if err != nil && n < MARKER_HEADER_SIZE {
+		return fmt.Errorf("While reading marker at %#x: %w", self.next, err)
+	}
+
+	value := int64(binary.LittleEndian.Uint64(marker))
+	size := int64(binary.LittleEndian.Uint32(marker[8:]))
+	err = checkMarker(value, size, self.grain_size, self.next)
+	if err != nil {
+		return err
+	}
+
+	// A grain marker: value is the LBA of the grain and the
+	// compressed data follows, padded to a sector boundary.
+	if size > 0 {
+		grain := value * SECTOR_SIZE / self.grain_size
+		self.grains[grain] = streamGrain{offset: self.next + 12, size: size}
+		return self.advance(
+			(12 + size + SECTOR_SIZE - 1) / SECTOR_SIZE * SECTOR_SIZE)
+	}
+
+	// A metadata marker: value is the number of sectors that follow.
+	switch binary.LittleEndian.Uint32(marker[12:]) {
+	case MARKER_EOS:
+		self.complete = true
+
+	case MARKER_GT, MARKER_GD, MARKER_FOOTER:
+		if value >= self.size/SECTOR_SIZE {
+			return fmt.Errorf("%w: metadata marker at %#x has size %v "+
+				"past the end of the file", ErrCorruptStream, self.next, value)
+		}
+		return self.advance(SECTOR_SIZE + value*SECTOR_SIZE)
+
+	default:
+		return fmt.Errorf("Unknown marker at %#x", self.next)
+	}
+	return nil
+}
+
+// Move to the next marker length bytes on. The scan must always move
+// forward and stay within the file, or a corrupt marker could make it
+// loop forever.
+func (self *LazyStreamExtent) advance(length int64) error {
+	next := self.next + length
+	if next <= self.next || next >= self.size {
+		return fmt.Errorf("%w: marker at %#x points to %#x outside the "+
+			"file of %#x bytes", ErrCorruptStream, self.next, next, self.size)
+	}
+	self.next = next
+	return nil
+}
+
+// Scan all the remaining markers.
+func (self *LazyStreamExtent) scanAll() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for !self.complete {
+		err := self.scanMarker()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestOpenStreamOptimized(t *testing.T) {
+	grains := map[int64][]byte{
+		0: bytes.Repeat([]byte("A"), 128*SECTOR_SIZE),
+		3: []byte("hello world"),
+	}
+	data := buildStreamOptimized(1024*1024, grains)
+
+	// Hide the io.ReaderAt interface so only forward reads are possible.
+	stream := struct{ io.Reader }{bytes.NewReader(data)}
+
+	vmdk, err := OpenStreamOptimized(stream)
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	info := vmdk.Info()
+	if info.Size != 1024*1024 || info.CreateType != "streamOptimized" ||
+		info.GrainSize != 128*SECTOR_SIZE {
+		t.Fatalf("Unexpected info %+v", info)
+	}
+
+	expected := make([]byte, 1024*1024)
+	copy(expected, grains[0])
+	copy(expected[3*128*SECTOR_SIZE:], grains[3])
+
+	actual := &bytes.Buffer{}
+	_, err = vmdk.WriteTo(actual)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	if !bytes.Equal(actual.Bytes(), expected) {
+		t.Fatalf("Unexpected disk content")
+	}
+
+	// A truncated stream is an error.
+	_, err = OpenStreamOptimized(bytes.NewReader(data[:len(data)-SECTOR_SIZE]))
+	if err == nil {
+		t.Fatalf("Expected an error for a truncated stream")
+	}
+}
+
+func TestWriteStreamOptimized(t *testing.T) {
+	vmdk, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer vmdk.Close()
+
+	expected := &bytes.Buffer{}
+	_, err = vmdk.WriteTo(expected)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	stream := &bytes.Buffer{}
+	err = WriteStreamOptimized(vmdk, stream)
+	if err != nil {
+		t.Fatalf("WriteStreamOptimized: %v", err)
+	}
+
+	// Only the single non zero 64kb grain is stored.
+	if stream.Len() > 64*1024 {
+		t.Fatalf("Stream is unexpectedly large: %v bytes", stream.Len())
+	}
+
+	roundtrip, err := OpenStreamOptimized(stream)
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	if roundtrip.Info().CreateType != "streamOptimized" {
+		t.Fatalf("Unexpected info %+v", roundtrip.Info())
+	}
+
+	actual := &bytes.Buffer{}
+	_, err = roundtrip.WriteTo(actual)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+		t.Fatalf("Round tripped disk content differs")
+	}
+}
+
+func streamFixture() []byte {
+	grains := map[int64][]byte{}
+	for i := int64(0); i < 16; i++ {
+		grains[i] = bytes.Repeat([]byte{byte('a' + i)}, 128*SECTOR_SIZE)
+	}
+	return buildStreamOptimized(1024*1024, grains)
+}
+
+func TestDecompressedGrainCache(t *testing.T) {
+	data := streamFixture()
+
+	uncached, err := OpenStreamOptimized(bytes.NewReader(data),
+		WithDecompressedGrainCache(0))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	// Room for two grains.
+	cached, err := OpenStreamOptimized(bytes.NewReader(data),
+		WithDecompressedGrainCache(2*128*SECTOR_SIZE))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	// Sector sized reads inflate each grain once.
+	a := make([]byte, SECTOR_SIZE)
+	b := make([]byte, SECTOR_SIZE)
+	for offset := int64(0); offset < cached.Size(); offset += SECTOR_SIZE {
+		uncached.ReadAt(a, offset)
+		cached.ReadAt(b, offset)
+		if !bytes.Equal(a, b) {
+			t.Fatalf("Cached read at %#x differs", offset)
+		}
+	}
+
+	metrics := cached.Metrics()
+	if metrics.GrainCacheMisses != 16 || metrics.GrainCacheHits != 16*127 {
+		t.Fatalf("Unexpected metrics %+v", metrics)
+	}
+
+	// Going back to the first grain after it was evicted inflates it
+	// again.
+	cached.ReadAt(b, 0)
+	if cached.Metrics().GrainCacheMisses != 17 || b[0] != 'a' {
+		t.Fatalf("Expected the first grain to be evicted")
+	}
+}
+
+func benchmarkStreamCopy(b *testing.B, opts ...Option) {
+	vmdk, err := OpenStreamOptimized(bytes.NewReader(streamFixture()), opts...)
+	if err != nil {
+		b.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	b.SetBytes(vmdk.Size())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		io.CopyBuffer(io.Discard, io.NewSectionReader(vmdk, 0, vmdk.Size()), buf)
+	}
+}
+
+func BenchmarkStreamCopyNoCache(b *testing.B) {
+	benchmarkStreamCopy(b, WithDecompressedGrainCache(0))
+}
+
+func BenchmarkStreamCopyGrainCache(b *testing.B) {
+	benchmarkStreamCopy(b)
+}
+
+// Records the temporary files created.
+type recordingStorage struct {
+	OSTempStorage
+	created int
+}
+
+func (self *recordingStorage) Create() (TempFile, error) {
+	self.created++
+	return self.OSTempStorage.Create()
+}
+
+func TestSpill(t *testing.T) {
+	data := streamFixture()
+	dir := t.TempDir()
+
+	expected := &bytes.Buffer{}
+	memory, err := OpenStreamOptimized(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+	memory.WriteTo(expected)
+
+	// Below the threshold nothing is spilled.
+	storage := &recordingStorage{OSTempStorage: OSTempStorage{Dir: dir}}
+	vmdk, err := OpenStreamOptimized(bytes.NewReader(data),
+		WithSpill(int64(len(data)), storage))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+	vmdk.Close()
+
+	if storage.created != 0 {
+		t.Fatalf("Expected no spill below the threshold")
+	}
+
+	// Each compressed grain is a few hundred bytes, so most of the 16
+	// grains are spilled.
+	vmdk, err = OpenStreamOptimized(bytes.NewReader(data),
+		WithSpill(1024, storage), WithDecompressedGrainCache(0))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if storage.created != 1 || len(files) != 1 {
+		t.Fatalf("Expected one spill file, got %v", len(files))
+	}
+
+	actual := &bytes.Buffer{}
+	_, err = vmdk.WriteTo(actual)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+		t.Fatalf("Spilled disk content differs")
+	}
+
+	// Closing removes the spill file.
+	vmdk.Close()
+	files, _ = os.ReadDir(dir)
+	if len(files) != 0 {
+		t.Fatalf("Spill file was not removed")
+	}
+
+	// So does failing to open the stream.
+	_, err = OpenStreamOptimized(bytes.NewReader(data[:len(data)-SECTOR_SIZE]),
+		WithSpill(1024, storage))
+	files, _ = os.ReadDir(dir)
+	if err == nil || len(files) != 0 {
+		t.Fatalf("Spill file left after a failed open: %v", err)
+	}
+}
+
+func TestOpenStreamOptimizedAt(t *testing.T) {
+	// A 32mb disk with every grain but the last allocated.
+	grains := map[int64][]byte{}
+	for i := int64(0); i < 511; i++ {
+		grains[i] = []byte(fmt.Sprintf("grain %v", i))
+	}
+	data := buildStreamOptimized(32*1024*1024, grains)
+
+	counter := &countingReader{reader: bytes.NewReader(data)}
+	vmdk, err := OpenStreamOptimizedAt(counter)
+	if err != nil {
+		t.Fatalf("OpenStreamOptimizedAt: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.Info().CreateType != "streamOptimized" {
+		t.Fatalf("Unexpected info %+v", vmdk.Info())
+	}
+
+	// Reading the first sector only scans the first marker.
+	buf := make([]byte, SECTOR_SIZE)
+	_, err = vmdk.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+
+	if string(buf[:7]) != "grain 0" {
+		t.Fatalf("Unexpected first sector %q", buf[:16])
+	}
+
+	extent := vmdk.extents[0].(*LazyStreamExtent)
+	if extent.Scanned() != MARKER_HEADER_SIZE {
+		t.Fatalf("Scanned %v bytes for the first grain", extent.Scanned())
+	}
+
+	// The header, descriptor, a marker and one compressed grain.
+	if counter.bytes > 4*SECTOR_SIZE {
+		t.Fatalf("Read %v bytes of a %v byte file", counter.bytes, len(data))
+	}
+
+	// Reading the unallocated last grain scans to the end.
+	_, err = vmdk.ReadAt(buf, 511*128*SECTOR_SIZE)
+	if err != nil || !isZero(buf) {
+		t.Fatalf("Expected the last grain to be a hole: %v", err)
+	}
+
+	expected, err := OpenStreamOptimized(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimized: %v", err)
+	}
+
+	if !reflect.DeepEqual(vmdk.AllocatedRanges(), expected.AllocatedRanges()) {
+		t.Fatalf("Unexpected ranges %v", vmdk.AllocatedRanges())
+	}
+
+	a := &bytes.Buffer{}
+	b := &bytes.Buffer{}
+	vmdk.WriteTo(a)
+	expected.WriteTo(b)
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Fatalf("Disk content differs")
+	}
+
+	// A truncated file fails on reaching the missing part.
+	truncated, err := OpenStreamOptimizedAt(
+		bytes.NewReader(data[:len(data)/2]))
+	if err != nil {
+		t.Fatalf("OpenStreamOptimizedAt: %v", err)
+	}
+
+	_, err = truncated.ReadAt(buf, 510*128*SECTOR_SIZE)
+	if err == nil {
+		t.Fatalf("Expected an error reading past the truncation")
+	}
+}
+
+// Find the metadata marker of the given type in a streamOptimized
+// disk built by buildStreamOptimized.
+func findMarker(t *testing.T, data []byte, marker_type uint32) int {
+	le := binary.LittleEndian
+	for offset := 2 * SECTOR_SIZE; offset < len(data); offset += SECTOR_SIZE {
+		if le.Uint32(data[offset+8:]) == 0 &&
+			le.Uint32(data[offset+12:]) == marker_type {
+			return offset
+		}
+	}
+	t.Fatalf("No marker of type %v", marker_type)
+	return 0
+}
+
+func TestStreamCorruptMarkers(t *testing.T) {
+	le := binary.LittleEndian
+	data := buildStreamOptimized(1024*1024, map[int64][]byte{
+		0: []byte("hello world"),
+	})
+
+	corrupt := func(patch func(data []byte)) []byte {
+		res := append([]byte{}, data...)
+		patch(res)
+		return res
+	}
+
+	for name, corrupted := range map[string][]byte{
+		"huge metadata": corrupt(func(data []byte) {
+			le.PutUint64(data[findMarker(t, data, MARKER_GD):],
+				0xffffffffffffffff)
+		}),
+		"negative metadata": corrupt(func(data []byte) {
+			le.PutUint64(data[findMarker(t, data, MARKER_GD):],
+				0x8000000000000000)
+		}),
+		"huge grain": corrupt(func(data []byte) {
+			le.PutUint32(data[2*SECTOR_SIZE+8:], 0xffffffff)
+		}),
+		"huge descriptor": corrupt(func(data []byte) {
+			le.PutUint64(data[36:], 0xffffffffffffffff)
+		}),
+	} {
+		_, err := OpenStreamOptimized(bytes.NewReader(corrupted))
+		if !errors.Is(err, ErrCorruptStream) {
+			t.Fatalf("%v: Expected ErrCorruptStream, got %v", name, err)
+		}
+	}
+}
+
+// Grain sizes which overflow, or which would need multi-gigabyte
+// buffers to inflate, are refused before any grain is read.
+func TestStreamGrainSizeTooLarge(t *testing.T) {
+	data := buildStreamOptimized(1024*1024, map[int64][]byte{
+		0: []byte("hello world"),
+	})
+
+	for _, sectors := range []uint64{1 << 55, 1 << 30} {
+		corrupted := append([]byte{}, data...)
+		binary.LittleEndian.PutUint64(corrupted[20:], sectors)
+
+		_, err := OpenStreamOptimized(bytes.NewReader(corrupted))
+		if !errors.Is(err, ErrInvalidGrainSize) {
+			t.Fatalf("%v sectors: Expected ErrInvalidGrainSize, got %v",
+				sectors, err)
+		}
+
+		_, err = OpenStreamOptimizedAt(bytes.NewReader(corrupted))
+		if !errors.Is(err, ErrInvalidGrainSize) {
+			t.Fatalf("%v sectors: Expected ErrInvalidGrainSize from "+
+				"OpenStreamOptimizedAt, got %v", sectors, err)
+		}
+	}
+}
+
+func TestStreamLazyCorruptMarkers(t *testing.T) {
+	le := binary.LittleEndian
+	data := buildStreamOptimized(1024*1024, map[int64][]byte{
+		0: []byte("hello world"),
+	})
+
+	for name, value := range map[string]uint64{
+		"negative":       0xffffffffffffffff,
+		"past the end":   uint64(len(data)),
+		"wraps the file": 0x7fffffffffffffff / SECTOR_SIZE,
+	} {
+		corrupted := append([]byte{}, data...)
+		le.PutUint64(corrupted[findMarker(t, corrupted, MARKER_GT):], value)
+
+		vmdk, err := OpenStreamOptimizedAt(bytes.NewReader(corrupted))
+		if err != nil {
+			t.Fatalf("%v: OpenStreamOptimizedAt: %v", name, err)
+		}
+
+		// Reading a hole scans every marker.
+		buf := make([]byte, SECTOR_SIZE)
+		_, err = vmdk.ReadAt(buf, 5*128*SECTOR_SIZE)
+		if !errors.Is(err, ErrCorruptStream) {
+			t.Fatalf("%v: Expected ErrCorruptStream, got %v", name, err)
+		}
+	}
+
+	corrupted := append([]byte{}, data...)
+	le.PutUint64(corrupted[36:], 0xffffffffffffffff)
+	_, err := OpenStreamOptimizedAt(bytes.NewReader(corrupted))
+	if !errors.Is(err, ErrCorruptStream) {
+		t.Fatalf("Expected ErrCorruptStream for the descriptor, got %v", err)
+	}
+}
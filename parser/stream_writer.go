@@ -0,0 +1,198 @@
+package parser
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Tracks the position in the output stream.
+type countingWriter struct {
+	writer io.Writer
+	pos    int64
+}
+
+func (self *countingWriter) Write(buf []byte) (int, error) {
+	n, err := self.writer.Write(buf)
+	self.pos += int64(n)
+	return n, err
+}
+
+// Pad the output to the next sector boundary.
+func (self *countingWriter) pad() error {
+	if self.pos%SECTOR_SIZE == 0 {
+		return nil
+	}
+	_, err := self.Write(make([]byte, SECTOR_SIZE-self.pos%SECTOR_SIZE))
+	return err
+}
+
+func (self *countingWriter) sector() int64 {
+	return self.pos / SECTOR_SIZE
+}
+
+func (self *countingWriter) writeMarker(sectors int64, marker_type uint32) error {
+	marker := make([]byte, SECTOR_SIZE)
+	binary.LittleEndian.PutUint64(marker, uint64(sectors))
+	binary.LittleEndian.PutUint32(marker[12:], marker_type)
+	_, err := self.Write(marker)
+	return err
+}
+
+func streamOptimizedHeader(capacity int64, gd_offset uint64, overhead int64) []byte {
+	le := binary.LittleEndian
+	header := make([]byte, SECTOR_SIZE)
+	le.PutUint32(header[0:], SPARSE_MAGICNUMBER)
+	le.PutUint32(header[4:], 3)
+	le.PutUint32(header[8:], 1|FLAG_COMPRESSED|FLAG_MARKERS)
+	le.PutUint64(header[12:], uint64(capacity))
+	le.PutUint64(header[20:], WRITER_GRAIN_SECTORS)
+	le.PutUint64(header[28:], 1)
+	le.PutUint64(header[36:], WRITER_DESCRIPTOR_SECTORS)
+	le.PutUint32(header[44:], 512)
+	le.PutUint64(header[56:], gd_offset)
+	le.PutUint64(header[64:], uint64(overhead))
+	copy(header[73:], "\n \r\n")
+	le.PutUint16(header[77:], COMPRESSION_DEFLATE)
+	return header
+}
+
+// WriteStreamOptimized encodes the disk as a streamOptimized disk with
+// deflate compressed grains, suitable for OVA packaging. The output is
+// written sequentially: all zero grains are omitted, and the grain
+// tables, grain directory and footer are written at the end of the
+// stream (GD_AT_END).
+func WriteStreamOptimized(vmdk *VMDKContext, out io.Writer) error {
+	grain_size := int64(WRITER_GRAIN_SECTORS * SECTOR_SIZE)
+	capacity := (vmdk.Size() + SECTOR_SIZE - 1) / SECTOR_SIZE
+	num_grains := (capacity + WRITER_GRAIN_SECTORS - 1) / WRITER_GRAIN_SECTORS
+	num_gts := (num_grains + 511) / 512
+	overhead := int64(1 + WRITER_DESCRIPTOR_SECTORS)
+
+	writer := &countingWriter{writer: out}
+	_, err := writer.Write(streamOptimizedHeader(capacity, GD_AT_END, overhead))
+	if err != nil {
+		return err
+	}
+
+	descriptor, err := formatDescriptor("streamOptimized", capacity,
+		[]string{fmt.Sprintf("RW %d SPARSE %q", capacity, "disk.vmdk")},
+		vmdk.config)
+	if err != nil {
+		return err
+	}
+	if len(descriptor) > WRITER_DESCRIPTOR_SECTORS*SECTOR_SIZE {
+		return errors.New("Descriptor too large")
+	}
+
+	descriptor_data := make([]byte, WRITER_DESCRIPTOR_SECTORS*SECTOR_SIZE)
+	copy(descriptor_data, descriptor)
+	_, err = writer.Write(descriptor_data)
+	if err != nil {
+		return err
+	}
+
+	gtes := make([]uint32, num_gts*512)
+	buf := make([]byte, grain_size)
+	compressed := &bytes.Buffer{}
+
+	for grain := int64(0); grain < num_grains; grain++ {
+		n, err := vmdk.ReadAt(buf, grain*grain_size)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// The last grain may be partial.
+		zeroFill(buf[n:])
+
+		if isZero(buf) {
+			continue
+		}
+
+		compressed.Reset()
+		deflater := zlib.NewWriter(compressed)
+		_, err = deflater.Write(buf)
+		if err != nil {
+			return err
+		}
+		err = deflater.Close()
+		if err != nil {
+			return err
+		}
+
+		gtes[grain] = uint32(writer.sector())
+
+		marker := make([]byte, 12)
+		binary.LittleEndian.PutUint64(marker, uint64(grain*WRITER_GRAIN_SECTORS))
+		binary.LittleEndian.PutUint32(marker[8:], uint32(compressed.Len()))
+		_, err = writer.Write(marker)
+		if err != nil {
+			return err
+		}
+
+		_, err = writer.Write(compressed.Bytes())
+		if err != nil {
+			return err
+		}
+
+		err = writer.pad()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write the grain tables that have any allocated grains.
+	gd := make([]byte, (num_gts*4+SECTOR_SIZE-1)/SECTOR_SIZE*SECTOR_SIZE)
+	gt := make([]byte, 512*4)
+	for i := int64(0); i < num_gts; i++ {
+		table := gtes[i*512 : (i+1)*512]
+		empty := true
+		for j, gte := range table {
+			binary.LittleEndian.PutUint32(gt[j*4:], gte)
+			if gte != 0 {
+				empty = false
+			}
+		}
+
+		if empty {
+			continue
+		}
+
+		err = writer.writeMarker(int64(len(gt))/SECTOR_SIZE, MARKER_GT)
+		if err != nil {
+			return err
+		}
+
+		binary.LittleEndian.PutUint32(gd[i*4:], uint32(writer.sector()))
+		_, err = writer.Write(gt)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writer.writeMarker(int64(len(gd))/SECTOR_SIZE, MARKER_GD)
+	if err != nil {
+		return err
+	}
+
+	gd_offset := writer.sector()
+	_, err = writer.Write(gd)
+	if err != nil {
+		return err
+	}
+
+	err = writer.writeMarker(1, MARKER_FOOTER)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(streamOptimizedHeader(capacity, uint64(gd_offset), overhead))
+	if err != nil {
+		return err
+	}
+
+	return writer.writeMarker(0, MARKER_EOS)
+}
@@ -0,0 +1,44 @@
+package parser
+
+import "sort"
+
+var (
+	// The extent types GetVMDKContext can read. Raw device mappings
+	// are recognized but their data can not be read.
+	supportedExtentTypes = map[string]bool{
+		"FLAT":   true,
+		"SPARSE": true,
+	}
+
+	// The create types whose disks can be read. streamOptimized disks
+	// are read with OpenStreamOptimized or OpenStreamOptimizedAt.
+	supportedCreateTypes = map[string]bool{
+		"monolithicFlat":       true,
+		"monolithicSparse":     true,
+		"streamOptimized":      true,
+		"twoGbMaxExtentFlat":   true,
+		"twoGbMaxExtentSparse": true,
+	}
+)
+
+// SupportedExtentTypes returns the extent types, as named in
+// descriptor extent lines, whose data this parser can read.
+func SupportedExtentTypes() []string {
+	return sortedKeys(supportedExtentTypes)
+}
+
+// SupportedCreateTypes returns the descriptor createType values of the
+// disks this parser can read. Other create types, e.g. vmfsSparse or
+// seSparse, use extent formats which are not implemented.
+func SupportedCreateTypes() []string {
+	return sortedKeys(supportedCreateTypes)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var res []string
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,167 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSupportedExtentTypes(t *testing.T) {
+	if !reflect.DeepEqual(SupportedExtentTypes(), []string{"FLAT", "SPARSE"}) {
+		t.Fatalf("Unexpected extent types %v", SupportedExtentTypes())
+	}
+
+	files := makeChainFiles()
+	data := map[string][]byte{
+		"FLAT":   make([]byte, 2048*SECTOR_SIZE),
+		"SPARSE": files["base-data.vmdk"],
+	}
+
+	supported := make(map[string]bool)
+	for _, extent_type := range SupportedExtentTypes() {
+		supported[extent_type] = true
+	}
+
+	// Every extent type in the specification, read both eagerly and
+	// lazily.
+	for _, extent_type := range []string{"FLAT", "SPARSE", "ZERO", "VMFS",
+		"VMFSSPARSE", "SESPARSE", "VMFSRDM", "VMFSPASSTHROUGHRDM"} {
+		for _, opts := range [][]Option{nil, {WithLazyOpen(1)}} {
+			files := testFiles{
+				"disk.vmdk": []byte(fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="custom"
+
+# Extent description
+RW 2048 %v "disk-data.vmdk"
+`, extent_type)),
+				"disk-data.vmdk": data[extent_type],
+			}
+			if files["disk-data.vmdk"] == nil {
+				files["disk-data.vmdk"] = make([]byte, 2048*SECTOR_SIZE)
+			}
+
+			buf := make([]byte, SECTOR_SIZE)
+			vmdk, err := openTestDisk(files, "disk.vmdk", opts...)
+			if err == nil {
+				_, err = vmdk.ReadAt(buf, 0)
+				vmdk.Close()
+			}
+
+			if supported[extent_type] != (err == nil) {
+				t.Fatalf("Reading a %v extent: %v", extent_type, err)
+			}
+			if err != nil && !errors.Is(err, ErrUnsupported) {
+				t.Fatalf("Expected ErrUnsupported for %v, got %v",
+					extent_type, err)
+			}
+		}
+	}
+}
+
+func TestSupportedCreateTypes(t *testing.T) {
+	source, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer source.Close()
+
+	expected := &bytes.Buffer{}
+	source.WriteTo(expected)
+
+	// Write a disk of each supported create type.
+	open := func(create_type string) (*VMDKContext, error) {
+		switch create_type {
+		case "monolithicFlat":
+			descriptor := &bytes.Buffer{}
+			data := &bytes.Buffer{}
+			err := source.WriteMonolithicFlat(context.Background(),
+				descriptor, data, "disk-flat.vmdk", nil)
+			if err != nil {
+				return nil, err
+			}
+			return openTestDisk(testFiles{
+				"disk.vmdk":      descriptor.Bytes(),
+				"disk-flat.vmdk": data.Bytes(),
+			}, "disk.vmdk")
+
+		case "monolithicSparse":
+			out := &memWriterAt{}
+			err := source.WriteMonolithicSparse(
+				context.Background(), out, "disk.vmdk", nil)
+			if err != nil {
+				return nil, err
+			}
+			return openTestDisk(testFiles{"disk.vmdk": out.buf}, "disk.vmdk")
+
+		case "streamOptimized":
+			out := &bytes.Buffer{}
+			err := WriteStreamOptimized(source, out)
+			if err != nil {
+				return nil, err
+			}
+			return OpenStreamOptimized(out)
+
+		case "twoGbMaxExtentFlat", "twoGbMaxExtentSparse":
+			files := testFiles{}
+			extent_type := "FLAT"
+			for i, half := range [][]byte{
+				expected.Bytes()[:512*1024], expected.Bytes()[512*1024:]} {
+				name := fmt.Sprintf("s%03d.vmdk", i+1)
+				files[name] = half
+				if create_type == "twoGbMaxExtentFlat" {
+					continue
+				}
+
+				extent_type = "SPARSE"
+				extent, err := NewTestContext(NewTestFlatExtent(half, 0))
+				if err != nil {
+					return nil, err
+				}
+				out := &memWriterAt{}
+				err = extent.WriteMonolithicSparse(
+					context.Background(), out, name, nil)
+				if err != nil {
+					return nil, err
+				}
+				files[name] = out.buf
+			}
+
+			files["disk.vmdk"] = []byte(fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=33333333
+parentCID=ffffffff
+createType="%v"
+
+# Extent description
+RW 1024 %v "s001.vmdk"
+RW 1024 %v "s002.vmdk"
+`, create_type, extent_type, extent_type))
+			return openTestDisk(files, "disk.vmdk")
+		}
+		return nil, fmt.Errorf("No test for %v", create_type)
+	}
+
+	for _, create_type := range SupportedCreateTypes() {
+		vmdk, err := open(create_type)
+		if err != nil {
+			t.Fatalf("Opening %v: %v", create_type, err)
+		}
+
+		actual := &bytes.Buffer{}
+		_, err = vmdk.WriteTo(actual)
+		vmdk.Close()
+		if err != nil || vmdk.Info().CreateType != create_type {
+			t.Fatalf("Reading %v: %v", create_type, err)
+		}
+
+		if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+			t.Fatalf("%v content differs", create_type)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Grain size of extents built by NewTestSparseExtent (4kb).
+const TEST_GRAIN_SIZE = 8 * SECTOR_SIZE
+
+// NewTestFlatExtent returns an extent holding data at virtualOffset in
+// the logical disk. It is intended for tests which need a synthetic
+// disk.
+func NewTestFlatExtent(data []byte, virtualOffset int64) Extent {
+	return &FlatExtent{
+		reader:     bytes.NewReader(data),
+		total_size: int64(len(data)),
+		offset:     virtualOffset,
+		filename:   "memory",
+	}
+}
+
+// NewTestSparseExtent returns a hosted sparse extent of capacity bytes
+// built in memory. grains maps a grain number to its data; grains are
+// TEST_GRAIN_SIZE bytes and all other grains are unallocated. Data
+// shorter than a grain is padded with zeros.
+func NewTestSparseExtent(grains map[int64][]byte, capacity int64) (
+	Extent, error) {
+	if capacity < 0 || capacity%SECTOR_SIZE != 0 {
+		return nil, fmt.Errorf(
+			"Capacity %v is not a multiple of the sector size", capacity)
+	}
+
+	num_grains := (capacity + TEST_GRAIN_SIZE - 1) / TEST_GRAIN_SIZE
+	for grain, data := range grains {
+		if grain < 0 || grain >= num_grains {
+			return nil, fmt.Errorf("Grain %v is beyond the capacity of %v "+
+				"grains", grain, num_grains)
+		}
+
+		if len(data) > TEST_GRAIN_SIZE {
+			return nil, fmt.Errorf("Grain %v has %v bytes, more than %v",
+				grain, len(data), TEST_GRAIN_SIZE)
+		}
+	}
+
+	extent, err := GetSparseExtent(bytes.NewReader(
+		buildSparseExtent(capacity, grains)))
+	if err != nil {
+		return nil, err
+	}
+	extent.filename = "memory"
+	return extent, nil
+}
+
+// NewTestContext builds a disk from extents. Each extent starts where
+// the previous one ended, or at its own virtual offset if that is
+// further on, in which case the gap reads as zeros.
+func NewTestContext(extents ...Extent) (*VMDKContext, error) {
+	res := &VMDKContext{
+		profile: NewVMDKProfile(),
+		config:  NewVMDKConfig(),
+		options: getOptions(nil),
+	}
+
+	for _, e := range extents {
+		offset := e.VirtualOffset()
+		if offset < res.total_size {
+			offset = res.total_size
+		}
+
+		switch t := e.(type) {
+		case *FlatExtent:
+			if t.offset != 0 && t.offset < res.total_size {
+				return nil, fmt.Errorf(
+					"Extent at %#x overlaps the previous extent", t.offset)
+			}
+			t.offset = offset
+		case *SparseExtent:
+			t.offset = offset
+		default:
+			if offset != e.VirtualOffset() {
+				return nil, fmt.Errorf("Can not place extent %T at %#x",
+					e, offset)
+			}
+		}
+
+		res.extents = append(res.extents, e)
+		res.total_size = offset + e.TotalSize()
+	}
+
+	res.normalizeExtents()
+
+	return res, nil
+}
+
+// buildSparseExtent returns a hosted sparse extent image of capacity
+// bytes using 4kb grains. grains maps a grain number to its data.
+func buildSparseExtent(capacity int64, grains map[int64][]byte) []byte {
+	return buildSparseExtentWithGrainSize(capacity, 8, grains)
+}
+
+// Like buildSparseExtent with grains of grain_sectors sectors.
+func buildSparseExtentWithGrainSize(capacity, grain_sectors int64,
+	grains map[int64][]byte) []byte {
+	coverage := 512 * grain_sectors * SECTOR_SIZE
+	num_gts := (capacity + coverage - 1) / coverage
+
+	gd_sector := int64(1)
+	gd_sectors := (num_gts*4 + SECTOR_SIZE - 1) / SECTOR_SIZE
+	gt_sector := gd_sector + gd_sectors
+
+	// Each grain table is 512 entries of 4 bytes = 4 sectors.
+	overhead := gt_sector + num_gts*4
+
+	var grain_numbers []int64
+	for k := range grains {
+		grain_numbers = append(grain_numbers, k)
+	}
+	sort.Slice(grain_numbers, func(i, j int) bool {
+		return grain_numbers[i] < grain_numbers[j]
+	})
+
+	out := make([]byte, (overhead+int64(len(grains))*grain_sectors)*SECTOR_SIZE)
+	le := binary.LittleEndian
+	le.PutUint32(out[0:], SPARSE_MAGICNUMBER)
+	le.PutUint32(out[4:], 1)
+	le.PutUint32(out[8:], 1)
+	le.PutUint64(out[12:], uint64(capacity/SECTOR_SIZE))
+	le.PutUint64(out[20:], uint64(grain_sectors))
+	le.PutUint32(out[44:], 512)
+	le.PutUint64(out[56:], uint64(gd_sector))
+	le.PutUint64(out[64:], uint64(overhead))
+	copy(out[73:], "\n \r\n")
+
+	for i := int64(0); i < num_gts; i++ {
+		le.PutUint32(out[gd_sector*SECTOR_SIZE+i*4:], uint32(gt_sector+i*4))
+	}
+
+	for idx, grain := range grain_numbers {
+		sector := overhead + int64(idx)*grain_sectors
+		gt := grain / 512
+		le.PutUint32(out[(gt_sector+gt*4)*SECTOR_SIZE+(grain%512)*4:],
+			uint32(sector))
+		copy(out[sector*SECTOR_SIZE:(sector+grain_sectors)*SECTOR_SIZE],
+			grains[grain])
+	}
+
+	return out
+}
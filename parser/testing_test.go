@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTestExtentBuilders(t *testing.T) {
+	sparse, err := NewTestSparseExtent(map[int64][]byte{
+		1: bytes.Repeat([]byte("S"), TEST_GRAIN_SIZE),
+	}, 4*TEST_GRAIN_SIZE)
+	if err != nil {
+		t.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	// The flat extent leaves a one grain gap after the sparse extent.
+	flat := NewTestFlatExtent(
+		bytes.Repeat([]byte("F"), TEST_GRAIN_SIZE), 5*TEST_GRAIN_SIZE)
+	tail := NewTestFlatExtent(bytes.Repeat([]byte("T"), SECTOR_SIZE), 0)
+
+	vmdk, err := NewTestContext(sparse, flat, tail)
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+
+	if vmdk.Size() != 6*TEST_GRAIN_SIZE+SECTOR_SIZE {
+		t.Fatalf("Unexpected size %v", vmdk.Size())
+	}
+
+	data := &bytes.Buffer{}
+	_, err = vmdk.WriteTo(data)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	expected := bytes.Join([][]byte{
+		make([]byte, TEST_GRAIN_SIZE),
+		bytes.Repeat([]byte("S"), TEST_GRAIN_SIZE),
+		make([]byte, 3*TEST_GRAIN_SIZE),
+		bytes.Repeat([]byte("F"), TEST_GRAIN_SIZE),
+		bytes.Repeat([]byte("T"), SECTOR_SIZE),
+	}, nil)
+	if !bytes.Equal(data.Bytes(), expected) {
+		t.Fatalf("Unexpected disk content")
+	}
+
+	ranges := vmdk.allocatedRanges(true)
+	if len(ranges) != 2 ||
+		ranges[0] != (Range{Offset: TEST_GRAIN_SIZE, Length: TEST_GRAIN_SIZE}) ||
+		ranges[1] != (Range{Offset: 5 * TEST_GRAIN_SIZE,
+			Length: TEST_GRAIN_SIZE + SECTOR_SIZE}) {
+		t.Fatalf("Unexpected allocated ranges %+v", ranges)
+	}
+
+	_, err = NewTestContext(
+		NewTestFlatExtent(make([]byte, SECTOR_SIZE), 0),
+		NewTestFlatExtent(make([]byte, SECTOR_SIZE), 1))
+	if err == nil {
+		t.Fatalf("Expected an error for overlapping extents")
+	}
+
+	// Grains must fit in the extent.
+	for name, grains := range map[string]map[int64][]byte{
+		"beyond capacity": {4: []byte("X")},
+		"negative":        {-1: []byte("X")},
+		"too long":        {0: make([]byte, TEST_GRAIN_SIZE+1)},
+	} {
+		_, err = NewTestSparseExtent(grains, 4*TEST_GRAIN_SIZE)
+		if err == nil {
+			t.Fatalf("%v: Expected an error", name)
+		}
+	}
+}
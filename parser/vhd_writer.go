@@ -0,0 +1,209 @@
+package parser
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	VHD_FOOTER_SIZE         = 512
+	VHD_DYNAMIC_HEADER_SIZE = 1024
+	VHD_BLOCK_SIZE          = 2 * 1024 * 1024
+
+	VHD_TYPE_FIXED   = 2
+	VHD_TYPE_DYNAMIC = 3
+
+	// VHD disks can not be larger than 2040gb.
+	VHD_MAX_SIZE = 2040 * 1024 * 1024 * 1024
+
+	// Azure only accepts fixed disks whose size is a whole number of
+	// megabytes.
+	VHD_AZURE_ALIGNMENT = 1024 * 1024
+
+	VHD_UNUSED_BLOCK = 0xffffffff
+)
+
+// VHD timestamps count seconds from the start of 2000.
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// The one's complement of the sum of the bytes, as used by the VHD
+// footer and dynamic header.
+func vhdChecksum(buf []byte) uint32 {
+	var sum uint32
+	for _, b := range buf {
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// The CHS geometry recorded in the footer, as calculated in the VHD
+// specification.
+func vhdGeometry(size int64) (cylinders, heads, sectors int64) {
+	total := size / SECTOR_SIZE
+	if total > 65535*16*255 {
+		total = 65535 * 16 * 255
+	}
+
+	var cylinder_heads int64
+	if total >= 65535*16*63 {
+		sectors, heads = 255, 16
+		cylinder_heads = total / sectors
+	} else {
+		sectors = 17
+		cylinder_heads = total / sectors
+		heads = (cylinder_heads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinder_heads >= heads*1024 || heads > 16 {
+			sectors, heads = 31, 16
+			cylinder_heads = total / sectors
+		}
+		if cylinder_heads >= heads*1024 {
+			sectors, heads = 63, 16
+			cylinder_heads = total / sectors
+		}
+	}
+	return cylinder_heads / heads, heads, sectors
+}
+
+func vhdFooter(size int64, disk_type uint32, data_offset uint64) []byte {
+	be := binary.BigEndian
+	footer := make([]byte, VHD_FOOTER_SIZE)
+	copy(footer, "conectix")
+	be.PutUint32(footer[8:], 2)
+	be.PutUint32(footer[12:], 0x00010000)
+	be.PutUint64(footer[16:], data_offset)
+	be.PutUint32(footer[24:], uint32(time.Since(vhdEpoch)/time.Second))
+	copy(footer[28:], "gvmd")
+	be.PutUint32(footer[32:], 0x00010000)
+	copy(footer[36:], "Wi2k")
+	be.PutUint64(footer[40:], uint64(size))
+	be.PutUint64(footer[48:], uint64(size))
+
+	cylinders, heads, sectors := vhdGeometry(size)
+	be.PutUint16(footer[56:], uint16(cylinders))
+	footer[58] = byte(heads)
+	footer[59] = byte(sectors)
+
+	be.PutUint32(footer[60:], disk_type)
+	rand.Read(footer[68:84])
+	be.PutUint32(footer[64:], vhdChecksum(footer))
+	return footer
+}
+
+// WriteFixedVHD writes the logical disk as a fixed VHD: the raw disk
+// followed by a footer. Only allocated data is written so the output
+// is sparse where the file system allows. With azure_alignment the
+// size is rounded up to a whole megabyte as Azure requires.
+func (self *VMDKContext) WriteFixedVHD(ctx context.Context,
+	out io.WriterAt, azure_alignment bool, progress ProgressFunc) error {
+	size := (self.total_size + SECTOR_SIZE - 1) / SECTOR_SIZE * SECTOR_SIZE
+	if azure_alignment {
+		size = (size + VHD_AZURE_ALIGNMENT - 1) /
+			VHD_AZURE_ALIGNMENT * VHD_AZURE_ALIGNMENT
+	}
+
+	if size > VHD_MAX_SIZE {
+		return fmt.Errorf("%w: VHD disks are limited to %v bytes",
+			ErrUnsupported, int64(VHD_MAX_SIZE))
+	}
+
+	err := self.forEachAllocatedBlock(ctx, VHD_BLOCK_SIZE, progress,
+		func(block int64, data []byte) error {
+			offset := block * VHD_BLOCK_SIZE
+			if offset+int64(len(data)) > size {
+				data = data[:size-offset]
+			}
+			_, err := out.WriteAt(data, offset)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+
+	// Fixed disks have no dynamic header.
+	_, err = out.WriteAt(
+		vhdFooter(size, VHD_TYPE_FIXED, 0xffffffffffffffff), size)
+	return err
+}
+
+// WriteDynamicVHD writes the logical disk as a dynamic VHD with 2mb
+// blocks. Only blocks holding data are stored.
+func (self *VMDKContext) WriteDynamicVHD(ctx context.Context,
+	out io.WriterAt, progress ProgressFunc) error {
+	size := (self.total_size + SECTOR_SIZE - 1) / SECTOR_SIZE * SECTOR_SIZE
+	if size > VHD_MAX_SIZE {
+		return fmt.Errorf("%w: VHD disks are limited to %v bytes",
+			ErrUnsupported, int64(VHD_MAX_SIZE))
+	}
+
+	be := binary.BigEndian
+	blocks := (size + VHD_BLOCK_SIZE - 1) / VHD_BLOCK_SIZE
+	bat := make([]byte, (blocks*4+SECTOR_SIZE-1)/SECTOR_SIZE*SECTOR_SIZE)
+	for i := int64(0); i < int64(len(bat))/4; i++ {
+		be.PutUint32(bat[i*4:], VHD_UNUSED_BLOCK)
+	}
+
+	bat_offset := int64(VHD_FOOTER_SIZE + VHD_DYNAMIC_HEADER_SIZE)
+	next := bat_offset + int64(len(bat))
+
+	// Each block starts with a bitmap of the sectors present, padded
+	// to a sector. Every sector of a stored block is present.
+	bitmap := make([]byte, (VHD_BLOCK_SIZE/SECTOR_SIZE/8+SECTOR_SIZE-1)/
+		SECTOR_SIZE*SECTOR_SIZE)
+	for i := range bitmap {
+		bitmap[i] = 0xff
+	}
+
+	err := self.forEachAllocatedBlock(ctx, VHD_BLOCK_SIZE, progress,
+		func(block int64, data []byte) error {
+			_, err := out.WriteAt(bitmap, next)
+			if err != nil {
+				return err
+			}
+
+			_, err = out.WriteAt(data, next+int64(len(bitmap)))
+			if err != nil {
+				return err
+			}
+
+			be.PutUint32(bat[block*4:], uint32(next/SECTOR_SIZE))
+			next += int64(len(bitmap)) + VHD_BLOCK_SIZE
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, VHD_DYNAMIC_HEADER_SIZE)
+	copy(header, "cxsparse")
+	be.PutUint64(header[8:], 0xffffffffffffffff)
+	be.PutUint64(header[16:], uint64(bat_offset))
+	be.PutUint32(header[24:], 0x00010000)
+	be.PutUint32(header[28:], uint32(blocks))
+	be.PutUint32(header[32:], VHD_BLOCK_SIZE)
+	be.PutUint32(header[36:], vhdChecksum(header))
+
+	// The footer is at the end, with a copy at the start.
+	footer := vhdFooter(size, VHD_TYPE_DYNAMIC, VHD_FOOTER_SIZE)
+	for _, part := range []struct {
+		data   []byte
+		offset int64
+	}{
+		{footer, 0},
+		{header, VHD_FOOTER_SIZE},
+		{bat, bat_offset},
+		{footer, next},
+	} {
+		_, err = out.WriteAt(part.data, part.offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// A 5gb disk with data in the first block, past the first VHDX chunk
+// and in the last sector.
+func vhdTestDisk(t *testing.T) *VMDKContext {
+	capacity := int64(5 * 1024 * 1024 * 1024)
+	sparse, err := NewTestSparseExtent(map[int64][]byte{
+		0:                                        []byte("first block"),
+		4 * 1024 * 1024 * 1024 / TEST_GRAIN_SIZE: []byte("second chunk"),
+		capacity/TEST_GRAIN_SIZE - 1:             bytes.Repeat([]byte("L"), TEST_GRAIN_SIZE),
+	}, capacity)
+	if err != nil {
+		t.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	vmdk, err := NewTestContext(sparse)
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+	return vmdk
+}
+
+// Check the disk reads back as the source through read, which returns
+// the data at an offset or nil for an unallocated block. Returns the
+// number of blocks stored.
+func checkBlocks(t *testing.T, vmdk *VMDKContext, block_size int64,
+	read func(offset int64) []byte) int {
+	// Only blocks overlapping the allocated ranges can hold data.
+	allocated := make(map[int64]bool)
+	for _, r := range vmdk.allocatedRanges(true) {
+		for block := r.Offset / block_size; block*block_size < r.End(); block++ {
+			allocated[block] = true
+		}
+	}
+
+	expected := make([]byte, block_size)
+	stored := 0
+	for offset := int64(0); offset < vmdk.Size(); offset += block_size {
+		actual := read(offset)
+		if !allocated[offset/block_size] {
+			if actual != nil {
+				t.Fatalf("Unallocated block at %#x is stored", offset)
+			}
+			continue
+		}
+
+		n, _ := vmdk.ReadAt(expected, offset)
+		zeroFill(expected[n:])
+		if actual == nil {
+			if !isZero(expected) {
+				t.Fatalf("Block at %#x is missing", offset)
+			}
+			continue
+		}
+
+		stored++
+		if !bytes.Equal(actual, expected) {
+			t.Fatalf("Block at %#x differs", offset)
+		}
+	}
+	return stored
+}
+
+func checkVHDFooter(t *testing.T, footer []byte, size int64,
+	disk_type uint32) {
+	be := binary.BigEndian
+	checksum := be.Uint32(footer[64:])
+	be.PutUint32(footer[64:], 0)
+	if string(footer[:8]) != "conectix" || vhdChecksum(footer) != checksum ||
+		be.Uint64(footer[48:]) != uint64(size) ||
+		be.Uint32(footer[60:]) != disk_type {
+		t.Fatalf("Invalid footer %x", footer[:68])
+	}
+
+	// The geometry covers no more than the disk.
+	cylinders, heads, sectors := be.Uint16(footer[56:]), footer[58], footer[59]
+	if int64(cylinders)*int64(heads)*int64(sectors)*SECTOR_SIZE > size {
+		t.Fatalf("Geometry %v/%v/%v is too large", cylinders, heads, sectors)
+	}
+}
+
+func TestWriteFixedVHD(t *testing.T) {
+	source, err := openTestDisk(makeChainFiles(), "snapshot.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContext: %v", err)
+	}
+	defer source.Close()
+
+	// A disk which is not a whole number of megabytes.
+	data := make([]byte, source.Size()+3*SECTOR_SIZE)
+	source.ReadAt(data, 0)
+	copy(data[len(data)-5:], "tail!")
+	vmdk, err := NewTestContext(NewTestFlatExtent(data, 0))
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+
+	for _, azure := range []bool{false, true} {
+		out := &memWriterAt{}
+		err = vmdk.WriteFixedVHD(context.Background(), out, azure, nil)
+		if err != nil {
+			t.Fatalf("WriteFixedVHD: %v", err)
+		}
+
+		size := vmdk.Size()
+		if azure {
+			size = 2 * 1024 * 1024
+		}
+
+		if int64(len(out.buf)) != size+VHD_FOOTER_SIZE {
+			t.Fatalf("Unexpected file size %v", len(out.buf))
+		}
+		checkVHDFooter(t, out.buf[size:], size, VHD_TYPE_FIXED)
+
+		if !bytes.Equal(out.buf[:vmdk.Size()], data) ||
+			!isZero(out.buf[vmdk.Size():size]) {
+			t.Fatalf("Disk content differs")
+		}
+	}
+}
+
+func TestWriteDynamicVHD(t *testing.T) {
+	vmdk := vhdTestDisk(t)
+	out := &memWriterAt{}
+	err := vmdk.WriteDynamicVHD(context.Background(), out, nil)
+	if err != nil {
+		t.Fatalf("WriteDynamicVHD: %v", err)
+	}
+
+	be := binary.BigEndian
+	image := out.buf
+	checkVHDFooter(t, image[:VHD_FOOTER_SIZE], vmdk.Size(), VHD_TYPE_DYNAMIC)
+	checkVHDFooter(t, image[len(image)-VHD_FOOTER_SIZE:], vmdk.Size(),
+		VHD_TYPE_DYNAMIC)
+
+	header := image[VHD_FOOTER_SIZE : VHD_FOOTER_SIZE+VHD_DYNAMIC_HEADER_SIZE]
+	checksum := be.Uint32(header[36:])
+	be.PutUint32(header[36:], 0)
+	if string(header[:8]) != "cxsparse" || vhdChecksum(header) != checksum ||
+		be.Uint32(header[28:]) != 2560 ||
+		be.Uint32(header[32:]) != VHD_BLOCK_SIZE {
+		t.Fatalf("Invalid dynamic header %x", header[:40])
+	}
+
+	bat := image[be.Uint64(header[16:]):]
+	stored := checkBlocks(t, vmdk, VHD_BLOCK_SIZE, func(offset int64) []byte {
+		sector := be.Uint32(bat[offset/VHD_BLOCK_SIZE*4:])
+		if sector == VHD_UNUSED_BLOCK {
+			return nil
+		}
+
+		bitmap := image[sector*SECTOR_SIZE : sector*SECTOR_SIZE+SECTOR_SIZE]
+		if !bytes.Equal(bitmap, bytes.Repeat([]byte{0xff}, SECTOR_SIZE)) {
+			t.Fatalf("Block at %#x is not fully present", offset)
+		}
+
+		start := int64(sector+1) * SECTOR_SIZE
+		return image[start : start+VHD_BLOCK_SIZE]
+	})
+
+	if stored != 3 {
+		t.Fatalf("Expected 3 stored blocks, got %v", stored)
+	}
+}
+
+func TestWriteVHDX(t *testing.T) {
+	vmdk := vhdTestDisk(t)
+	out := &memWriterAt{}
+	err := vmdk.WriteVHDX(context.Background(), out, nil)
+	if err != nil {
+		t.Fatalf("WriteVHDX: %v", err)
+	}
+
+	le := binary.LittleEndian
+	image := out.buf
+	checkCRC := func(buf []byte, signature string) {
+		checksum := le.Uint32(buf[4:])
+		copy(buf[4:8], make([]byte, 4))
+		if string(buf[:len(signature)]) != signature ||
+			crc32.Checksum(buf, crc32c) != checksum {
+			t.Fatalf("Invalid %v structure", signature)
+		}
+	}
+
+	if string(image[:8]) != "vhdxfile" {
+		t.Fatalf("Invalid file type identifier")
+	}
+	checkCRC(image[VHDX_HEADER_1_OFFSET:VHDX_HEADER_1_OFFSET+VHDX_HEADER_SIZE],
+		"head")
+	checkCRC(image[VHDX_HEADER_2_OFFSET:VHDX_HEADER_2_OFFSET+VHDX_HEADER_SIZE],
+		"head")
+
+	// Find the regions from the region table.
+	table := image[VHDX_REGION_TABLE_1_OFFSET:][:VHDX_REGION_TABLE_SIZE]
+	if !bytes.Equal(table, image[VHDX_REGION_TABLE_2_OFFSET:][:VHDX_REGION_TABLE_SIZE]) {
+		t.Fatalf("Region tables differ")
+	}
+	checkCRC(table, "regi")
+
+	regions := make(map[string][]byte)
+	for i := uint32(0); i < le.Uint32(table[8:]); i++ {
+		entry := table[16+i*32:]
+		offset := le.Uint64(entry[16:])
+		length := uint64(le.Uint32(entry[24:]))
+		if offset%VHDX_ALIGNMENT != 0 || length%VHDX_ALIGNMENT != 0 {
+			t.Fatalf("Region %v is not aligned", formatGUID(entry))
+		}
+		regions[formatGUID(entry)] = image[offset : offset+length]
+	}
+
+	// Read the metadata items.
+	metadata := regions["8B7CA206-4790-4B9A-B8FE-575F050F886E"]
+	if string(metadata[:8]) != "metadata" {
+		t.Fatalf("Invalid metadata table")
+	}
+	items := make(map[string][]byte)
+	for i := uint16(0); i < le.Uint16(metadata[10:]); i++ {
+		entry := metadata[32+i*32:]
+		offset := le.Uint32(entry[16:])
+		items[formatGUID(entry)] = metadata[offset : offset+le.Uint32(entry[20:])]
+	}
+
+	if le.Uint32(items["CAA16737-FA36-4D43-B3B6-33F0AA44E76B"]) != VHDX_BLOCK_SIZE ||
+		le.Uint64(items["2FA54224-CD1B-4876-B211-5DBED83BF4B8"]) != uint64(vmdk.Size()) ||
+		le.Uint32(items["8141BF1D-A96F-4709-BA47-F233A8FAAB5F"]) != SECTOR_SIZE ||
+		len(items["BECA12AB-B2E6-4523-93EF-C309E000C746"]) != 16 {
+		t.Fatalf("Unexpected metadata items %v", items)
+	}
+
+	bat := regions["2DC27766-F623-4200-9D64-115E9BFD4A08"]
+	stored := checkBlocks(t, vmdk, VHDX_BLOCK_SIZE, func(offset int64) []byte {
+		// A sector bitmap entry follows every 2048 payload entries.
+		block := offset / VHDX_BLOCK_SIZE
+		entry := le.Uint64(bat[(block+block/2048)*8:])
+		if entry == 0 {
+			return nil
+		}
+		if entry&7 != VHDX_PAYLOAD_BLOCK_FULLY_PRESENT {
+			t.Fatalf("Unexpected BAT entry %#x", entry)
+		}
+
+		start := entry &^ (VHDX_ALIGNMENT - 1)
+		return image[start : start+VHDX_BLOCK_SIZE]
+	})
+
+	if stored != 3 || le.Uint64(bat[2048*8:]) != 0 {
+		t.Fatalf("Expected 3 stored blocks, got %v", stored)
+	}
+}
@@ -0,0 +1,256 @@
+package parser
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	VHDX_BLOCK_SIZE = 2 * 1024 * 1024
+
+	// Everything in the file is aligned to 1mb.
+	VHDX_ALIGNMENT = 1024 * 1024
+
+	VHDX_HEADER_1_OFFSET       = 64 * 1024
+	VHDX_HEADER_2_OFFSET       = 128 * 1024
+	VHDX_REGION_TABLE_1_OFFSET = 192 * 1024
+	VHDX_REGION_TABLE_2_OFFSET = 256 * 1024
+	VHDX_REGION_TABLE_SIZE     = 64 * 1024
+	VHDX_HEADER_SIZE           = 4 * 1024
+
+	// The file layout we write: the log, metadata and BAT regions each
+	// start on their own megabyte.
+	VHDX_LOG_OFFSET      = 1 * VHDX_ALIGNMENT
+	VHDX_LOG_SIZE        = 1 * VHDX_ALIGNMENT
+	VHDX_METADATA_OFFSET = 2 * VHDX_ALIGNMENT
+	VHDX_METADATA_SIZE   = 1 * VHDX_ALIGNMENT
+	VHDX_BAT_OFFSET      = 3 * VHDX_ALIGNMENT
+
+	// Metadata items start after the 64kb metadata table.
+	VHDX_METADATA_ITEMS_OFFSET = 64 * 1024
+
+	VHDX_MAX_SIZE = 64 * 1024 * 1024 * 1024 * 1024
+
+	VHDX_PAYLOAD_BLOCK_FULLY_PRESENT = 6
+
+	VHDX_METADATA_IS_VIRTUAL_DISK = 1 << 1
+	VHDX_METADATA_IS_REQUIRED     = 1 << 2
+)
+
+var (
+	vhdxBATRegion      = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	vhdxFileParameters     = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize    = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxVirtualDiskID      = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSectorSize  = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSectorSize = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Parse a GUID into its mixed endian on disk form, the reverse of
+// formatGUID.
+func mustParseGUID(guid string) []byte {
+	buf, err := hex.DecodeString(strings.Replace(guid, "-", "", -1))
+	if err != nil || len(buf) != 16 {
+		panic(fmt.Sprintf("Invalid GUID %v", guid))
+	}
+
+	for _, field := range [][]byte{buf[0:4], buf[4:6], buf[6:8]} {
+		for i, j := 0, len(field)-1; i < j; i, j = i+1, j-1 {
+			field[i], field[j] = field[j], field[i]
+		}
+	}
+	return buf
+}
+
+func newGUID() []byte {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+
+	// A version 4 (random) GUID.
+	buf[7] = buf[7]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return buf
+}
+
+// Set the CRC-32C checksum at offset 4 of a VHDX structure.
+func vhdxChecksum(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(buf, crc32c))
+}
+
+// The file type identifier, both headers and both region tables,
+// which fill the first megabyte.
+func vhdxHeaderSection(bat_size int64) []byte {
+	le := binary.LittleEndian
+	res := make([]byte, VHDX_ALIGNMENT)
+
+	copy(res, "vhdxfile")
+	for i, c := range utf16.Encode([]rune("go-vmdk")) {
+		le.PutUint16(res[8+i*2:], c)
+	}
+
+	file_write_guid := newGUID()
+	data_write_guid := newGUID()
+	for i, offset := range []int64{VHDX_HEADER_1_OFFSET, VHDX_HEADER_2_OFFSET} {
+		header := res[offset : offset+VHDX_HEADER_SIZE]
+		copy(header, "head")
+		le.PutUint64(header[8:], uint64(i+1))
+		copy(header[16:], file_write_guid)
+		copy(header[32:], data_write_guid)
+
+		// No log entries, so the log GUID is zero.
+		le.PutUint16(header[64:], 0)
+		le.PutUint16(header[66:], 1)
+		le.PutUint32(header[68:], VHDX_LOG_SIZE)
+		le.PutUint64(header[72:], VHDX_LOG_OFFSET)
+		vhdxChecksum(header)
+	}
+
+	for _, offset := range []int64{
+		VHDX_REGION_TABLE_1_OFFSET, VHDX_REGION_TABLE_2_OFFSET} {
+		table := res[offset : offset+VHDX_REGION_TABLE_SIZE]
+		copy(table, "regi")
+		le.PutUint32(table[8:], 2)
+
+		for i, region := range []struct {
+			guid           []byte
+			offset, length int64
+		}{
+			{vhdxBATRegion, VHDX_BAT_OFFSET, bat_size},
+			{vhdxMetadataRegion, VHDX_METADATA_OFFSET, VHDX_METADATA_SIZE},
+		} {
+			entry := table[16+i*32:]
+			copy(entry, region.guid)
+			le.PutUint64(entry[16:], uint64(region.offset))
+			le.PutUint32(entry[24:], uint32(region.length))
+			le.PutUint32(entry[28:], 1)
+		}
+		vhdxChecksum(table)
+	}
+
+	return res
+}
+
+// The metadata region describing a dynamic disk of size bytes.
+func vhdxMetadata(size int64) []byte {
+	le := binary.LittleEndian
+	res := make([]byte, VHDX_METADATA_SIZE)
+
+	file_parameters := make([]byte, 8)
+	le.PutUint32(file_parameters, VHDX_BLOCK_SIZE)
+
+	virtual_disk_size := make([]byte, 8)
+	le.PutUint64(virtual_disk_size, uint64(size))
+
+	logical_sector_size := make([]byte, 4)
+	le.PutUint32(logical_sector_size, SECTOR_SIZE)
+
+	physical_sector_size := make([]byte, 4)
+	le.PutUint32(physical_sector_size, SECTOR_SIZE)
+
+	items := []struct {
+		guid  []byte
+		data  []byte
+		flags uint32
+	}{
+		{vhdxFileParameters, file_parameters, VHDX_METADATA_IS_REQUIRED},
+		{vhdxVirtualDiskSize, virtual_disk_size,
+			VHDX_METADATA_IS_VIRTUAL_DISK | VHDX_METADATA_IS_REQUIRED},
+		{vhdxVirtualDiskID, newGUID(),
+			VHDX_METADATA_IS_VIRTUAL_DISK | VHDX_METADATA_IS_REQUIRED},
+		{vhdxLogicalSectorSize, logical_sector_size,
+			VHDX_METADATA_IS_VIRTUAL_DISK | VHDX_METADATA_IS_REQUIRED},
+		{vhdxPhysicalSectorSize, physical_sector_size,
+			VHDX_METADATA_IS_VIRTUAL_DISK | VHDX_METADATA_IS_REQUIRED},
+	}
+
+	copy(res, "metadata")
+	le.PutUint16(res[10:], uint16(len(items)))
+
+	offset := int64(VHDX_METADATA_ITEMS_OFFSET)
+	for i, item := range items {
+		entry := res[32+i*32:]
+		copy(entry, item.guid)
+		le.PutUint32(entry[16:], uint32(offset))
+		le.PutUint32(entry[20:], uint32(len(item.data)))
+		le.PutUint32(entry[24:], item.flags)
+
+		copy(res[offset:], item.data)
+		offset += int64(len(item.data))
+	}
+
+	return res
+}
+
+// WriteVHDX writes the logical disk as a dynamic VHDX with 2mb blocks.
+// Only blocks holding data are stored. The log is empty.
+func (self *VMDKContext) WriteVHDX(ctx context.Context,
+	out io.WriterAt, progress ProgressFunc) error {
+	size := (self.total_size + SECTOR_SIZE - 1) / SECTOR_SIZE * SECTOR_SIZE
+	if size > VHDX_MAX_SIZE {
+		return fmt.Errorf("%w: VHDX disks are limited to %v bytes",
+			ErrUnsupported, int64(VHDX_MAX_SIZE))
+	}
+
+	// A sector bitmap entry follows every chunk_ratio payload block
+	// entries in the BAT. Disks without a parent have no sector
+	// bitmaps so those entries stay zero.
+	chunk_ratio := int64(1<<23) * SECTOR_SIZE / VHDX_BLOCK_SIZE
+	blocks := (size + VHDX_BLOCK_SIZE - 1) / VHDX_BLOCK_SIZE
+	entries := blocks
+	if blocks > 0 {
+		entries += (blocks - 1) / chunk_ratio
+	}
+
+	bat := make([]byte, (entries*8+VHDX_ALIGNMENT-1)/
+		VHDX_ALIGNMENT*VHDX_ALIGNMENT)
+	if len(bat) == 0 {
+		bat = make([]byte, VHDX_ALIGNMENT)
+	}
+
+	next := int64(VHDX_BAT_OFFSET + len(bat))
+	err := self.forEachAllocatedBlock(ctx, VHDX_BLOCK_SIZE, progress,
+		func(block int64, data []byte) error {
+			_, err := out.WriteAt(data, next)
+			if err != nil {
+				return err
+			}
+
+			entry := block + block/chunk_ratio
+			binary.LittleEndian.PutUint64(bat[entry*8:],
+				uint64(next)|VHDX_PAYLOAD_BLOCK_FULLY_PRESENT)
+			next += VHDX_BLOCK_SIZE
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	// The log region is written so the file covers it.
+	for _, part := range []struct {
+		data   []byte
+		offset int64
+	}{
+		{vhdxHeaderSection(int64(len(bat))), 0},
+		{make([]byte, VHDX_LOG_SIZE), VHDX_LOG_OFFSET},
+		{vhdxMetadata(size), VHDX_METADATA_OFFSET},
+		{bat, VHDX_BAT_OFFSET},
+	} {
+		_, err = out.WriteAt(part.data, part.offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
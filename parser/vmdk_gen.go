@@ -50,12 +50,13 @@ type VMDKProfile struct {
     Off_SparseExtentHeader_rgdOffset int64
     Off_SparseExtentHeader_gdOffset int64
     Off_SparseExtentHeader_overHead int64
+    Off_SparseExtentHeader_uncleanShutdown int64
     Off_SparseExtentHeader_compressAlgorithm int64
 }
 
 func NewVMDKProfile() *VMDKProfile {
     // Specific offsets can be tweaked to cater for slight version mismatches.
-    self := &VMDKProfile{0,0,4,8,12,20,28,36,44,48,56,64,77}
+    self := &VMDKProfile{0,0,4,8,12,20,28,36,44,48,56,64,72,77}
     return self
 }
 
@@ -140,6 +141,10 @@ func (self *SparseExtentHeader) overHead() uint64 {
     return ParseUint64(self.Reader, self.Profile.Off_SparseExtentHeader_overHead + self.Offset)
 }
 
+func (self *SparseExtentHeader) uncleanShutdown() byte {
+    return ParseUint8(self.Reader, self.Profile.Off_SparseExtentHeader_uncleanShutdown + self.Offset)
+}
+
 func (self *SparseExtentHeader) compressAlgorithm() uint16 {
    return ParseUint16(self.Reader, self.Profile.Off_SparseExtentHeader_compressAlgorithm + self.Offset)
 }
@@ -156,6 +161,7 @@ func (self *SparseExtentHeader) DebugString() string {
     result += fmt.Sprintf("  rgdOffset: %#0x\n", self.rgdOffset())
     result += fmt.Sprintf("  gdOffset: %#0x\n", self.gdOffset())
     result += fmt.Sprintf("  overHead: %#0x\n", self.overHead())
+    result += fmt.Sprintf("  uncleanShutdown: %#0x\n", self.uncleanShutdown())
     result += fmt.Sprintf("  compressAlgorithm: %#0x\n", self.compressAlgorithm())
     return result
 }
@@ -170,6 +176,15 @@ func ParseArray_uint32(profile *VMDKProfile, reader io.ReaderAt, offset int64, c
     return result
 }
 
+func ParseUint8(reader io.ReaderAt, offset int64) byte {
+    result := make([]byte, 1)
+    _, err := reader.ReadAt(result, offset)
+    if err != nil {
+       return 0
+    }
+    return result[0]
+}
+
 func ParseUint16(reader io.ReaderAt, offset int64) uint16 {
 	var buf [2]byte
 	data := buf[:]
@@ -0,0 +1,5 @@
+// Package vmdkfuse mounts a VMDKContext as a read only FUSE filesystem
+// holding the logical disk and its partitions as raw files, so any
+// file based tool can read them. Mounting is only supported on Linux
+// and macOS.
+package vmdkfuse
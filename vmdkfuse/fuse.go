@@ -0,0 +1,204 @@
+//go:build linux || darwin
+
+package vmdkfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"syscall"
+
+	"github.com/Velocidex/go-vmdk/parser"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type options struct {
+	// Shown as the source of the mount, e.g. in /proc/mounts.
+	fs_name string
+
+	// Where failed reads are reported, if anywhere.
+	error_log *log.Logger
+
+	// Called once the filesystem is mounted.
+	on_mount func()
+}
+
+// Option customizes how Mount presents the disk.
+type Option func(self *options)
+
+// WithFsName sets the source shown for the mount. It defaults to
+// "vmdk".
+func WithFsName(name string) Option {
+	return func(self *options) {
+		self.fs_name = name
+	}
+}
+
+// WithErrorLog reports failed reads to logger. By default they are
+// only returned to the reader as EIO.
+func WithErrorLog(logger *log.Logger) Option {
+	return func(self *options) {
+		self.error_log = logger
+	}
+}
+
+// WithOnMount calls cb once the filesystem is mounted and ready to
+// be read.
+func WithOnMount(cb func()) Option {
+	return func(self *options) {
+		self.on_mount = cb
+	}
+}
+
+// A file in the root directory.
+type File struct {
+	Name   string
+	Size   int64
+	reader io.ReaderAt
+}
+
+// Files returns the files Mount presents: disk.raw holding the
+// logical disk, then p1.raw, p2.raw... for each partition found, named
+// after the partition index. Partitions extending past the end of the
+// disk are truncated.
+func Files(vmdk *parser.VMDKContext) ([]File, error) {
+	res := []File{{Name: "disk.raw", Size: vmdk.Size(), reader: vmdk}}
+
+	partitions, err := vmdk.Partitions()
+	if errors.Is(err, parser.ErrNoPartitionTable) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("While reading partitions: %w", err)
+	}
+
+	for _, p := range partitions {
+		if p.Start >= vmdk.Size() {
+			continue
+		}
+
+		size := p.Size
+		if p.Start+size > vmdk.Size() {
+			size = vmdk.Size() - p.Start
+		}
+
+		res = append(res, File{
+			Name:   fmt.Sprintf("p%d.raw", p.Index),
+			Size:   size,
+			reader: io.NewSectionReader(vmdk, p.Start, size),
+		})
+	}
+	return res, nil
+}
+
+// Mount mounts the disk read only at mountpoint (see Files) and blocks
+// until it is unmounted or ctx is done, in which case it is unmounted
+// and ctx.Err() returned. The disk may be closed once Mount returns.
+func Mount(ctx context.Context, mountpoint string,
+	vmdk *parser.VMDKContext, opts ...Option) error {
+	options := &options{fs_name: "vmdk"}
+	for _, o := range opts {
+		o(options)
+	}
+
+	files, err := Files(vmdk)
+	if err != nil {
+		return err
+	}
+
+	server, err := fs.Mount(mountpoint,
+		&root{files: files, options: options}, &fs.Options{
+			MountOptions: fuse.MountOptions{
+				FsName: options.fs_name,
+				Name:   "vmdk",
+
+				// Use the mount syscall when running as root and fall
+				// back to fusermount otherwise.
+				DirectMount: true,
+			},
+		})
+	if err != nil {
+		return fmt.Errorf("While mounting %v: %w", mountpoint, err)
+	}
+
+	if options.on_mount != nil {
+		options.on_mount()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.Unmount()
+		case <-done:
+		}
+	}()
+
+	server.Wait()
+	return ctx.Err()
+}
+
+// The root directory holds a file for the disk and each partition.
+type root struct {
+	fs.Inode
+
+	files   []File
+	options *options
+}
+
+func (self *root) OnAdd(ctx context.Context) {
+	for _, f := range self.files {
+		child := self.NewPersistentInode(ctx,
+			&file{file: f, options: self.options},
+			fs.StableAttr{Mode: fuse.S_IFREG})
+		self.AddChild(f.Name, child, false)
+	}
+}
+
+// A read only file backed by the disk.
+type file struct {
+	fs.Inode
+
+	file    File
+	options *options
+}
+
+func (self *file) Getattr(ctx context.Context,
+	fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0444
+	out.Size = uint64(self.file.Size)
+	return 0
+}
+
+func (self *file) Open(ctx context.Context, flags uint32) (
+	fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (self *file) Read(ctx context.Context, fh fs.FileHandle,
+	dest []byte, offset int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := self.file.reader.ReadAt(dest, offset)
+	if err != nil && err != io.EOF {
+		if self.options.error_log != nil {
+			self.options.error_log.Printf("Read error in %v at %#x: %v",
+				self.file.Name, offset, err)
+		}
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+var (
+	_ = (fs.NodeOnAdder)((*root)(nil))
+	_ = (fs.NodeGetattrer)((*file)(nil))
+	_ = (fs.NodeOpener)((*file)(nil))
+	_ = (fs.NodeReader)((*file)(nil))
+)
@@ -0,0 +1,111 @@
+//go:build linux || darwin
+
+package vmdkfuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+// A 1mb disk with an MBR holding a partition of 256kb at 64kb and one
+// extending past the end of the disk.
+func testDisk(t *testing.T) *parser.VMDKContext {
+	data := make([]byte, 1024*1024)
+	for i, e := range [][2]uint32{{128, 512}, {1536, 1024}} {
+		entry := data[446+i*16:]
+		entry[4] = 0x83
+		binary.LittleEndian.PutUint32(entry[8:], e[0])
+		binary.LittleEndian.PutUint32(entry[12:], e[1])
+	}
+	data[510] = 0x55
+	data[511] = 0xaa
+	copy(data[64*1024:], "partition 1")
+	copy(data[768*1024:], "partition 2")
+
+	vmdk, err := parser.NewTestContext(parser.NewTestFlatExtent(data, 0))
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+	return vmdk
+}
+
+func TestFiles(t *testing.T) {
+	files, err := Files(testDisk(t))
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+
+	if len(files) != 3 ||
+		files[0].Name != "disk.raw" || files[0].Size != 1024*1024 ||
+		files[1].Name != "p1.raw" || files[1].Size != 256*1024 ||
+		files[2].Name != "p2.raw" || files[2].Size != 256*1024 {
+		t.Fatalf("Unexpected files %+v", files)
+	}
+
+	buf := make([]byte, 11)
+	files[2].reader.ReadAt(buf, 0)
+	if string(buf) != "partition 2" {
+		t.Fatalf("Unexpected partition data %q", buf)
+	}
+
+	// Without a partition table there is only the disk.
+	vmdk, err := parser.NewTestContext(
+		parser.NewTestFlatExtent(make([]byte, 4096), 0))
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+
+	files, err = Files(vmdk)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Unexpected files %+v: %v", files, err)
+	}
+}
+
+func TestMount(t *testing.T) {
+	mountpoint := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mounted := make(chan bool)
+	done := make(chan error, 1)
+	go func() {
+		done <- Mount(ctx, mountpoint, testDisk(t),
+			WithOnMount(func() { close(mounted) }))
+	}()
+
+	select {
+	case <-mounted:
+	case err := <-done:
+		t.Skipf("FUSE is not available: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Skipf("Timed out mounting")
+	}
+
+	data, err := os.ReadFile(filepath.Join(mountpoint, "p1.raw"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if len(data) != 256*1024 || !bytes.HasPrefix(data, []byte("partition 1")) {
+		t.Fatalf("Unexpected p1.raw content")
+	}
+
+	// Cancelling unmounts.
+	cancel()
+	err = <-done
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(mountpoint, "disk.raw"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected the filesystem to be unmounted: %v", err)
+	}
+}
@@ -0,0 +1,477 @@
+package vmdknbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+var errAbort = errors.New("Client aborted negotiation")
+
+type connection struct {
+	server *server
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	no_zeroes bool
+
+	// Set once the client negotiated structured replies.
+	structured bool
+
+	// Set once the client selected the base:allocation context.
+	allocation bool
+}
+
+func newConnection(server *server, conn net.Conn) *connection {
+	return &connection{
+		server: server,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+func (self *connection) write(values ...interface{}) error {
+	for _, v := range values {
+		err := binary.Write(self.writer, binary.BigEndian, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *connection) reply(option, reply_type uint32, data []byte) error {
+	err := self.write(uint64(NBD_REPLY_MAGIC), option, reply_type,
+		uint32(len(data)))
+	if err != nil {
+		return err
+	}
+
+	_, err = self.writer.Write(data)
+	if err != nil {
+		return err
+	}
+	return self.writer.Flush()
+}
+
+func (self *connection) exportMatches(name string) bool {
+	export_name := self.server.options.export_name
+	return export_name == "" || name == export_name
+}
+
+func (self *connection) transmissionFlags() uint16 {
+	return NBD_FLAG_HAS_FLAGS | NBD_FLAG_READ_ONLY | NBD_FLAG_SEND_FLUSH |
+		NBD_FLAG_CAN_MULTI_CONN | NBD_FLAG_SEND_CACHE
+}
+
+// Run the option haggling phase. Returns nil when the client is ready
+// to enter the transmission phase.
+func (self *connection) negotiate() error {
+	err := self.write(uint64(NBD_MAGIC), uint64(NBD_IHAVEOPT),
+		uint16(NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES))
+	if err != nil {
+		return err
+	}
+	err = self.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	var client_flags uint32
+	err = binary.Read(self.reader, binary.BigEndian, &client_flags)
+	if err != nil {
+		return err
+	}
+	self.no_zeroes = client_flags&NBD_FLAG_NO_ZEROES != 0
+
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		err := binary.Read(self.reader, binary.BigEndian, &header)
+		if err != nil {
+			return err
+		}
+
+		if header.Magic != NBD_IHAVEOPT {
+			return errors.New("Invalid option magic")
+		}
+
+		if header.Length > 4096 {
+			return errors.New("Option data too long")
+		}
+
+		data := make([]byte, header.Length)
+		_, err = io.ReadFull(self.reader, data)
+		if err != nil {
+			return err
+		}
+
+		switch header.Option {
+		case NBD_OPT_EXPORT_NAME:
+			if !self.exportMatches(string(data)) {
+				return fmt.Errorf("Unknown export %q", data)
+			}
+
+			err := self.write(uint64(self.server.vmdk.Size()),
+				self.transmissionFlags())
+			if err != nil {
+				return err
+			}
+
+			if !self.no_zeroes {
+				_, err = self.writer.Write(make([]byte, 124))
+				if err != nil {
+					return err
+				}
+			}
+			return self.writer.Flush()
+
+		case NBD_OPT_ABORT:
+			self.reply(header.Option, NBD_REP_ACK, nil)
+			return errAbort
+
+		case NBD_OPT_LIST:
+			name := []byte(self.server.options.export_name)
+			reply := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+			err := self.reply(header.Option, NBD_REP_SERVER,
+				append(reply, name...))
+			if err != nil {
+				return err
+			}
+
+			err = self.reply(header.Option, NBD_REP_ACK, nil)
+			if err != nil {
+				return err
+			}
+
+		case NBD_OPT_INFO, NBD_OPT_GO:
+			done, err := self.info(header.Option, data)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+
+		case NBD_OPT_STRUCTURED_REPLY:
+			reply_type := uint32(NBD_REP_ACK)
+			if len(data) > 0 {
+				reply_type = NBD_REP_ERR_INVALID
+			} else {
+				self.structured = true
+			}
+
+			err := self.reply(header.Option, reply_type, nil)
+			if err != nil {
+				return err
+			}
+
+		case NBD_OPT_LIST_META_CONTEXT, NBD_OPT_SET_META_CONTEXT:
+			err := self.metaContext(header.Option, data)
+			if err != nil {
+				return err
+			}
+
+		default:
+			err := self.reply(header.Option, NBD_REP_ERR_UNSUP, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Answer NBD_OPT_INFO and NBD_OPT_GO. Returns true once the client
+// moves on to the transmission phase.
+func (self *connection) info(option uint32, data []byte) (bool, error) {
+	if len(data) < 6 {
+		return false, self.reply(option, NBD_REP_ERR_INVALID, nil)
+	}
+
+	name_len := binary.BigEndian.Uint32(data)
+	if int64(name_len)+6 > int64(len(data)) {
+		return false, self.reply(option, NBD_REP_ERR_INVALID, nil)
+	}
+
+	if !self.exportMatches(string(data[4 : 4+name_len])) {
+		return false, self.reply(option, NBD_REP_ERR_UNKNOWN, nil)
+	}
+
+	info := binary.BigEndian.AppendUint16(nil, NBD_INFO_EXPORT)
+	info = binary.BigEndian.AppendUint64(info, uint64(self.server.vmdk.Size()))
+	info = binary.BigEndian.AppendUint16(info, self.transmissionFlags())
+	err := self.reply(option, NBD_REP_INFO, info)
+	if err != nil {
+		return false, err
+	}
+
+	block_size := binary.BigEndian.AppendUint16(nil, NBD_INFO_BLOCK_SIZE)
+	block_size = binary.BigEndian.AppendUint32(block_size, 1)
+	block_size = binary.BigEndian.AppendUint32(block_size, 4096)
+	block_size = binary.BigEndian.AppendUint32(block_size, NBD_MAX_READ_BYTES)
+	err = self.reply(option, NBD_REP_INFO, block_size)
+	if err != nil {
+		return false, err
+	}
+
+	err = self.reply(option, NBD_REP_ACK, nil)
+	if err != nil {
+		return false, err
+	}
+
+	return option == NBD_OPT_GO, nil
+}
+
+// Answer NBD_OPT_LIST_META_CONTEXT and NBD_OPT_SET_META_CONTEXT. The
+// data is the export name followed by the queries, each prefixed by
+// its length.
+func (self *connection) metaContext(option uint32, data []byte) error {
+	// Selecting a context only makes sense with structured replies.
+	if option == NBD_OPT_SET_META_CONTEXT && !self.structured {
+		return self.reply(option, NBD_REP_ERR_INVALID, nil)
+	}
+
+	name, data, ok := lengthPrefixed(data)
+	if !ok || len(data) < 4 {
+		return self.reply(option, NBD_REP_ERR_INVALID, nil)
+	}
+
+	if !self.exportMatches(name) {
+		return self.reply(option, NBD_REP_ERR_UNKNOWN, nil)
+	}
+
+	count := binary.BigEndian.Uint32(data)
+	data = data[4:]
+
+	// Listing without queries lists every context.
+	matched := option == NBD_OPT_LIST_META_CONTEXT && count == 0
+	for i := uint32(0); i < count; i++ {
+		var query string
+		query, data, ok = lengthPrefixed(data)
+		if !ok {
+			return self.reply(option, NBD_REP_ERR_INVALID, nil)
+		}
+
+		if query == BASE_ALLOCATION ||
+			(option == NBD_OPT_LIST_META_CONTEXT && query == "base:") {
+			matched = true
+		}
+	}
+
+	if option == NBD_OPT_SET_META_CONTEXT {
+		self.allocation = matched
+	}
+
+	if matched {
+		context := binary.BigEndian.AppendUint32(nil, BASE_ALLOCATION_CONTEXT)
+		err := self.reply(option, NBD_REP_META_CONTEXT,
+			append(context, BASE_ALLOCATION...))
+		if err != nil {
+			return err
+		}
+	}
+
+	return self.reply(option, NBD_REP_ACK, nil)
+}
+
+// Split a string prefixed by its 32 bit length off data.
+func lengthPrefixed(data []byte) (string, []byte, bool) {
+	if len(data) < 4 {
+		return "", nil, false
+	}
+
+	length := binary.BigEndian.Uint32(data)
+	if int64(length)+4 > int64(len(data)) {
+		return "", nil, false
+	}
+	return string(data[4 : 4+length]), data[4+length:], true
+}
+
+func (self *connection) simpleReply(
+	handle uint64, errno uint32, data []byte) error {
+	err := self.write(uint32(NBD_SIMPLE_MAGIC), errno, handle)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.writer.Write(data)
+	if err != nil {
+		return err
+	}
+	return self.writer.Flush()
+}
+
+// Send the single, final chunk of a structured reply.
+func (self *connection) structuredReply(handle uint64,
+	reply_type uint16, data ...[]byte) error {
+	length := 0
+	for _, d := range data {
+		length += len(d)
+	}
+
+	err := self.write(uint32(NBD_STRUCTURED_MAGIC),
+		uint16(NBD_REPLY_FLAG_DONE), reply_type, handle, uint32(length))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range data {
+		_, err = self.writer.Write(d)
+		if err != nil {
+			return err
+		}
+	}
+	return self.writer.Flush()
+}
+
+// Report an error for the request, as a structured reply if those were
+// negotiated.
+func (self *connection) errorReply(handle uint64, errno uint32) error {
+	if !self.structured {
+		return self.simpleReply(handle, errno, nil)
+	}
+
+	// The error and an empty message.
+	payload := binary.BigEndian.AppendUint32(nil, errno)
+	payload = binary.BigEndian.AppendUint16(payload, 0)
+	return self.structuredReply(handle, NBD_REPLY_TYPE_ERROR, payload)
+}
+
+// Whether the range lies within the disk.
+func (self *connection) validRange(offset, length uint64) bool {
+	size := uint64(self.server.vmdk.Size())
+	return length > 0 && offset <= size && length <= size-offset
+}
+
+func (self *connection) read(handle uint64, offset, length uint64) error {
+	if length > NBD_MAX_READ_BYTES || !self.validRange(offset, length) {
+		return self.errorReply(handle, NBD_EINVAL)
+	}
+
+	buf := make([]byte, length)
+	n, err := self.server.vmdk.ReadAt(buf, int64(offset))
+	if n < len(buf) {
+		self.server.logf("Read error at %#x: %v", offset, err)
+		return self.errorReply(handle, NBD_EIO)
+	}
+
+	if !self.structured {
+		return self.simpleReply(handle, 0, buf)
+	}
+
+	return self.structuredReply(handle, NBD_REPLY_TYPE_OFFSET_DATA,
+		binary.BigEndian.AppendUint64(nil, offset), buf)
+}
+
+// Describe the range as alternating allocated and unallocated runs.
+// Unallocated runs read as zeros.
+func (self *connection) blockStatus(handle uint64, flags uint16,
+	offset, length uint64) error {
+	if !self.structured || !self.allocation {
+		return self.errorReply(handle, NBD_EINVAL)
+	}
+
+	if length > 1<<32-1 || !self.validRange(offset, length) {
+		return self.errorReply(handle, NBD_EINVAL)
+	}
+
+	payload := binary.BigEndian.AppendUint32(nil, BASE_ALLOCATION_CONTEXT)
+	add := func(length int64, state uint32) {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(length))
+		payload = binary.BigEndian.AppendUint32(payload, state)
+	}
+
+	pos := int64(offset)
+	end := int64(offset + length)
+	for _, r := range self.server.allocatedRanges(pos, end-pos) {
+		if r.Offset > pos {
+			add(r.Offset-pos, NBD_STATE_HOLE|NBD_STATE_ZERO)
+			pos = r.Offset
+		}
+
+		run_end := r.End()
+		if run_end > end {
+			run_end = end
+		}
+		add(run_end-pos, 0)
+		pos = run_end
+	}
+
+	if pos < end {
+		add(end-pos, NBD_STATE_HOLE|NBD_STATE_ZERO)
+	}
+
+	// Only the first run was asked for.
+	if flags&NBD_CMD_FLAG_REQ_ONE != 0 {
+		payload = payload[:12]
+	}
+
+	return self.structuredReply(handle, NBD_REPLY_TYPE_BLOCK_STATUS, payload)
+}
+
+// Serve requests until the client disconnects.
+func (self *connection) transmit() error {
+	for {
+		var request struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		err := binary.Read(self.reader, binary.BigEndian, &request)
+		if err != nil {
+			return err
+		}
+
+		if request.Magic != NBD_REQUEST_MAGIC {
+			return errors.New("Invalid request magic")
+		}
+
+		switch request.Type {
+		case NBD_CMD_READ:
+			err = self.read(request.Handle,
+				request.Offset, uint64(request.Length))
+
+		case NBD_CMD_WRITE:
+			// Discard the payload - the export is read only.
+			_, err = io.CopyN(io.Discard, self.reader, int64(request.Length))
+			if err != nil {
+				return err
+			}
+			err = self.errorReply(request.Handle, NBD_EPERM)
+
+		case NBD_CMD_TRIM, NBD_CMD_WRITE_ZEROES:
+			err = self.errorReply(request.Handle, NBD_EPERM)
+
+		case NBD_CMD_FLUSH:
+			err = self.simpleReply(request.Handle, 0, nil)
+
+		case NBD_CMD_CACHE:
+			self.server.vmdk.Advise(
+				int64(request.Offset), int64(request.Length))
+			err = self.simpleReply(request.Handle, 0, nil)
+
+		case NBD_CMD_BLOCK_STATUS:
+			err = self.blockStatus(request.Handle, request.Flags,
+				request.Offset, uint64(request.Length))
+
+		case NBD_CMD_DISC:
+			return nil
+
+		default:
+			err = self.errorReply(request.Handle, NBD_EINVAL)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package vmdknbd
+
+// Constants from the NBD protocol specification.
+const (
+	NBD_MAGIC            = 0x4e42444d41474943
+	NBD_IHAVEOPT         = 0x49484156454f5054
+	NBD_REPLY_MAGIC      = 0x0003e889045565a9
+	NBD_REQUEST_MAGIC    = 0x25609513
+	NBD_SIMPLE_MAGIC     = 0x67446698
+	NBD_STRUCTURED_MAGIC = 0x668e33ef
+	NBD_MAX_READ_BYTES   = 32 * 1024 * 1024
+
+	NBD_FLAG_FIXED_NEWSTYLE = 1 << 0
+	NBD_FLAG_NO_ZEROES      = 1 << 1
+
+	NBD_FLAG_HAS_FLAGS      = 1 << 0
+	NBD_FLAG_READ_ONLY      = 1 << 1
+	NBD_FLAG_SEND_FLUSH     = 1 << 2
+	NBD_FLAG_CAN_MULTI_CONN = 1 << 8
+	NBD_FLAG_SEND_CACHE     = 1 << 10
+
+	NBD_OPT_EXPORT_NAME       = 1
+	NBD_OPT_ABORT             = 2
+	NBD_OPT_LIST              = 3
+	NBD_OPT_INFO              = 6
+	NBD_OPT_GO                = 7
+	NBD_OPT_STRUCTURED_REPLY  = 8
+	NBD_OPT_LIST_META_CONTEXT = 9
+	NBD_OPT_SET_META_CONTEXT  = 10
+
+	NBD_REP_ACK          = 1
+	NBD_REP_SERVER       = 2
+	NBD_REP_INFO         = 3
+	NBD_REP_META_CONTEXT = 4
+	NBD_REP_ERR_UNSUP    = 1<<31 + 1
+	NBD_REP_ERR_INVALID  = 1<<31 + 3
+	NBD_REP_ERR_UNKNOWN  = 1<<31 + 6
+
+	NBD_INFO_EXPORT     = 0
+	NBD_INFO_BLOCK_SIZE = 3
+
+	NBD_CMD_READ         = 0
+	NBD_CMD_WRITE        = 1
+	NBD_CMD_DISC         = 2
+	NBD_CMD_FLUSH        = 3
+	NBD_CMD_TRIM         = 4
+	NBD_CMD_CACHE        = 5
+	NBD_CMD_WRITE_ZEROES = 6
+	NBD_CMD_BLOCK_STATUS = 7
+
+	NBD_CMD_FLAG_REQ_ONE = 1 << 3
+
+	NBD_REPLY_FLAG_DONE = 1 << 0
+
+	NBD_REPLY_TYPE_OFFSET_DATA  = 1
+	NBD_REPLY_TYPE_BLOCK_STATUS = 5
+	NBD_REPLY_TYPE_ERROR        = 1<<15 + 1
+
+	NBD_STATE_HOLE = 1 << 0
+	NBD_STATE_ZERO = 1 << 1
+
+	NBD_EPERM  = 1
+	NBD_EIO    = 5
+	NBD_EINVAL = 22
+
+	// The only meta context we offer and the id it is given.
+	BASE_ALLOCATION         = "base:allocation"
+	BASE_ALLOCATION_CONTEXT = 1
+)
@@ -0,0 +1,454 @@
+package vmdknbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+// A 1mb disk with data at 0 and 160kb. It is written with 64kb grains
+// so the first and third grains are allocated.
+func testDisk(t *testing.T) *parser.VMDKContext {
+	grain := func(c string) []byte {
+		return bytes.Repeat([]byte(c), parser.TEST_GRAIN_SIZE)
+	}
+
+	sparse, err := parser.NewTestSparseExtent(
+		map[int64][]byte{0: grain("A"), 40: grain("B")}, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewTestSparseExtent: %v", err)
+	}
+
+	src, err := parser.NewTestContext(sparse)
+	if err != nil {
+		t.Fatalf("NewTestContext: %v", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "disk.vmdk")
+	out, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	err = src.WriteMonolithicSparse(context.Background(), out, "disk.vmdk", nil)
+	out.Close()
+	if err != nil {
+		t.Fatalf("WriteMonolithicSparse: %v", err)
+	}
+
+	vmdk, err := parser.GetVMDKContextFromFile(filename,
+		parser.WithHighResolutionRanges())
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromFile: %v", err)
+	}
+	t.Cleanup(vmdk.Close)
+	return vmdk
+}
+
+// Serve the disk on a local port until the test ends.
+func startServer(t *testing.T, vmdk *parser.VMDKContext,
+	opts ...Option) (string, context.CancelFunc, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, listener, vmdk, opts...)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return listener.Addr().String(), cancel, done
+}
+
+// A minimal NBD client.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	handle uint64
+}
+
+type optionReply struct {
+	Type uint32
+	Data []byte
+}
+
+type structuredChunk struct {
+	Flags uint16
+	Type  uint16
+	Data  []byte
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	self := &testClient{t: t, conn: conn}
+
+	var hello struct {
+		Magic    uint64
+		IHaveOpt uint64
+		Flags    uint16
+	}
+	self.read(&hello)
+	if hello.Magic != NBD_MAGIC || hello.IHaveOpt != NBD_IHAVEOPT ||
+		hello.Flags&NBD_FLAG_FIXED_NEWSTYLE == 0 {
+		t.Fatalf("Unexpected greeting %+v", hello)
+	}
+
+	self.write(uint32(NBD_FLAG_FIXED_NEWSTYLE | NBD_FLAG_NO_ZEROES))
+	return self
+}
+
+func (self *testClient) read(values ...interface{}) {
+	for _, v := range values {
+		err := binary.Read(self.conn, binary.BigEndian, v)
+		if err != nil {
+			self.t.Fatalf("Read: %v", err)
+		}
+	}
+}
+
+func (self *testClient) write(values ...interface{}) {
+	for _, v := range values {
+		err := binary.Write(self.conn, binary.BigEndian, v)
+		if err != nil {
+			self.t.Fatalf("Write: %v", err)
+		}
+	}
+}
+
+// Send an option and collect the replies up to the final one.
+func (self *testClient) option(option uint32, data []byte) []optionReply {
+	self.write(uint64(NBD_IHAVEOPT), option, uint32(len(data)), data)
+
+	var res []optionReply
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Type   uint32
+			Length uint32
+		}
+		self.read(&header)
+		if header.Magic != NBD_REPLY_MAGIC || header.Option != option {
+			self.t.Fatalf("Unexpected option reply %+v", header)
+		}
+
+		reply := optionReply{Type: header.Type, Data: make([]byte, header.Length)}
+		self.read(reply.Data)
+		res = append(res, reply)
+
+		if reply.Type == NBD_REP_ACK || reply.Type&(1<<31) != 0 {
+			return res
+		}
+	}
+}
+
+// The data of an export name, or meta context query, option.
+func exportData(name string, queries ...string) []byte {
+	res := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+	res = append(res, name...)
+	if queries == nil {
+		// No info requests.
+		return binary.BigEndian.AppendUint16(res, 0)
+	}
+
+	res = binary.BigEndian.AppendUint32(res, uint32(len(queries)))
+	for _, q := range queries {
+		res = binary.BigEndian.AppendUint32(res, uint32(len(q)))
+		res = append(res, q...)
+	}
+	return res
+}
+
+func (self *testClient) request(command, flags uint16,
+	offset uint64, length uint32) uint64 {
+	self.handle++
+	self.write(uint32(NBD_REQUEST_MAGIC), flags, command, self.handle,
+		offset, length)
+	return self.handle
+}
+
+func (self *testClient) simpleReply(handle uint64, length int) (uint32, []byte) {
+	var header struct {
+		Magic  uint32
+		Errno  uint32
+		Handle uint64
+	}
+	self.read(&header)
+	if header.Magic != NBD_SIMPLE_MAGIC || header.Handle != handle {
+		self.t.Fatalf("Unexpected reply %+v", header)
+	}
+
+	if header.Errno != 0 {
+		return header.Errno, nil
+	}
+
+	data := make([]byte, length)
+	self.read(data)
+	return 0, data
+}
+
+func (self *testClient) structuredReply(handle uint64) structuredChunk {
+	var header struct {
+		Magic  uint32
+		Flags  uint16
+		Type   uint16
+		Handle uint64
+		Length uint32
+	}
+	self.read(&header)
+	if header.Magic != NBD_STRUCTURED_MAGIC || header.Handle != handle {
+		self.t.Fatalf("Unexpected reply %+v", header)
+	}
+
+	res := structuredChunk{Flags: header.Flags, Type: header.Type,
+		Data: make([]byte, header.Length)}
+	self.read(res.Data)
+	return res
+}
+
+func expected(vmdk *parser.VMDKContext, offset, length int64) []byte {
+	res := make([]byte, length)
+	vmdk.ReadAt(res, offset)
+	return res
+}
+
+func TestNegotiation(t *testing.T) {
+	vmdk := testDisk(t)
+	addr, _, _ := startServer(t, vmdk, WithExportName("evidence"))
+	client := dial(t, addr)
+
+	replies := client.option(NBD_OPT_LIST, nil)
+	if len(replies) != 2 || replies[0].Type != NBD_REP_SERVER ||
+		string(replies[0].Data[4:]) != "evidence" {
+		t.Fatalf("Unexpected export list %+v", replies)
+	}
+
+	replies = client.option(NBD_OPT_INFO, exportData("other"))
+	if len(replies) != 1 || replies[0].Type != NBD_REP_ERR_UNKNOWN {
+		t.Fatalf("Expected an unknown export, got %+v", replies)
+	}
+
+	replies = client.option(NBD_OPT_INFO, exportData("evidence"))
+	if len(replies) != 3 || replies[0].Type != NBD_REP_INFO ||
+		binary.BigEndian.Uint64(replies[0].Data[2:]) != uint64(vmdk.Size()) ||
+		binary.BigEndian.Uint16(replies[0].Data[10:])&NBD_FLAG_READ_ONLY == 0 {
+		t.Fatalf("Unexpected export info %+v", replies)
+	}
+
+	replies = client.option(99, nil)
+	if len(replies) != 1 || replies[0].Type != NBD_REP_ERR_UNSUP {
+		t.Fatalf("Expected an unsupported option, got %+v", replies)
+	}
+
+	// Meta contexts can only be selected with structured replies.
+	replies = client.option(NBD_OPT_SET_META_CONTEXT,
+		exportData("evidence", BASE_ALLOCATION))
+	if len(replies) != 1 || replies[0].Type != NBD_REP_ERR_INVALID {
+		t.Fatalf("Expected an invalid option, got %+v", replies)
+	}
+
+	replies = client.option(NBD_OPT_LIST_META_CONTEXT,
+		exportData("evidence", "base:"))
+	if len(replies) != 2 || replies[0].Type != NBD_REP_META_CONTEXT ||
+		string(replies[0].Data[4:]) != BASE_ALLOCATION {
+		t.Fatalf("Unexpected meta contexts %+v", replies)
+	}
+
+	replies = client.option(NBD_OPT_LIST_META_CONTEXT,
+		exportData("evidence", "qemu:dirty-bitmap:x"))
+	if len(replies) != 1 || replies[0].Type != NBD_REP_ACK {
+		t.Fatalf("Unexpected meta contexts %+v", replies)
+	}
+
+	replies = client.option(NBD_OPT_ABORT, nil)
+	if len(replies) != 1 || replies[0].Type != NBD_REP_ACK {
+		t.Fatalf("Unexpected abort reply %+v", replies)
+	}
+}
+
+func TestRead(t *testing.T) {
+	vmdk := testDisk(t)
+	addr, _, _ := startServer(t, vmdk)
+	client := dial(t, addr)
+
+	replies := client.option(NBD_OPT_GO, exportData(""))
+	if replies[len(replies)-1].Type != NBD_REP_ACK {
+		t.Fatalf("Unexpected go reply %+v", replies)
+	}
+
+	// A read spanning allocated data and a hole.
+	handle := client.request(NBD_CMD_READ, 0, 4096-100, 200)
+	errno, data := client.simpleReply(handle, 200)
+	if errno != 0 || !bytes.Equal(data, expected(vmdk, 4096-100, 200)) {
+		t.Fatalf("Unexpected read %v", errno)
+	}
+
+	for _, c := range []struct {
+		offset uint64
+		length uint32
+	}{
+		{uint64(vmdk.Size()) - 10, 20},
+		{uint64(vmdk.Size()), 1},
+		{1 << 63, 512},
+		{0, 0},
+		{0, NBD_MAX_READ_BYTES + 1},
+	} {
+		handle = client.request(NBD_CMD_READ, 0, c.offset, c.length)
+		errno, _ = client.simpleReply(handle, 0)
+		if errno != NBD_EINVAL {
+			t.Fatalf("Expected EINVAL reading %+v, got %v", c, errno)
+		}
+	}
+
+	// Writes are refused and their payload skipped.
+	handle = client.request(NBD_CMD_WRITE, 0, 0, 4)
+	client.write([]byte("XXXX"))
+	errno, _ = client.simpleReply(handle, 0)
+	if errno != NBD_EPERM {
+		t.Fatalf("Expected EPERM, got %v", errno)
+	}
+
+	handle = client.request(NBD_CMD_CACHE, 0, 0, 8192)
+	errno, _ = client.simpleReply(handle, 0)
+	if errno != 0 {
+		t.Fatalf("Cache failed: %v", errno)
+	}
+
+	// Block status needs structured replies.
+	handle = client.request(NBD_CMD_BLOCK_STATUS, 0, 0, 4096)
+	errno, _ = client.simpleReply(handle, 0)
+	if errno != NBD_EINVAL {
+		t.Fatalf("Expected EINVAL, got %v", errno)
+	}
+
+	client.request(NBD_CMD_DISC, 0, 0, 0)
+}
+
+func TestStructuredReplies(t *testing.T) {
+	vmdk := testDisk(t)
+	addr, _, _ := startServer(t, vmdk)
+	client := dial(t, addr)
+
+	for _, option := range []struct {
+		option uint32
+		data   []byte
+	}{
+		{NBD_OPT_STRUCTURED_REPLY, nil},
+		{NBD_OPT_SET_META_CONTEXT, exportData("", BASE_ALLOCATION)},
+		{NBD_OPT_GO, exportData("")},
+	} {
+		replies := client.option(option.option, option.data)
+		if replies[len(replies)-1].Type != NBD_REP_ACK {
+			t.Fatalf("Option %v failed: %+v", option.option, replies)
+		}
+	}
+
+	handle := client.request(NBD_CMD_READ, 0, 160*1024, 100)
+	chunk := client.structuredReply(handle)
+	if chunk.Type != NBD_REPLY_TYPE_OFFSET_DATA ||
+		chunk.Flags&NBD_REPLY_FLAG_DONE == 0 ||
+		binary.BigEndian.Uint64(chunk.Data) != 160*1024 ||
+		!bytes.Equal(chunk.Data[8:], expected(vmdk, 160*1024, 100)) {
+		t.Fatalf("Unexpected read %+v", chunk)
+	}
+
+	handle = client.request(NBD_CMD_READ, 0, uint64(vmdk.Size()), 1)
+	chunk = client.structuredReply(handle)
+	if chunk.Type != NBD_REPLY_TYPE_ERROR ||
+		binary.BigEndian.Uint32(chunk.Data) != NBD_EINVAL {
+		t.Fatalf("Expected an EINVAL error chunk, got %+v", chunk)
+	}
+
+	// Block status over the whole disk as (length, state) pairs.
+	hole := uint32(NBD_STATE_HOLE | NBD_STATE_ZERO)
+	size := uint32(vmdk.Size())
+	for _, c := range []struct {
+		flags    uint16
+		offset   uint64
+		length   uint32
+		expected []uint32
+	}{
+		{0, 0, size, []uint32{
+			64 * 1024, 0,
+			64 * 1024, hole,
+			64 * 1024, 0,
+			size - 192*1024, hole}},
+		{0, 60 * 1024, 8192, []uint32{4096, 0, 4096, hole}},
+		{NBD_CMD_FLAG_REQ_ONE, 72 * 1024, size - 72*1024, []uint32{
+			56 * 1024, hole}},
+	} {
+		handle = client.request(NBD_CMD_BLOCK_STATUS, c.flags,
+			c.offset, c.length)
+		chunk = client.structuredReply(handle)
+		if chunk.Type != NBD_REPLY_TYPE_BLOCK_STATUS ||
+			binary.BigEndian.Uint32(chunk.Data) != BASE_ALLOCATION_CONTEXT {
+			t.Fatalf("Unexpected block status %+v", chunk)
+		}
+
+		var descriptors []uint32
+		for i := 4; i < len(chunk.Data); i += 4 {
+			descriptors = append(descriptors,
+				binary.BigEndian.Uint32(chunk.Data[i:]))
+		}
+		if !equalUint32s(descriptors, c.expected) {
+			t.Fatalf("Unexpected block status of %#x: %v", c.offset, descriptors)
+		}
+	}
+}
+
+func equalUint32s(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServeShutdown(t *testing.T) {
+	vmdk := testDisk(t)
+	addr, cancel, done := startServer(t, vmdk)
+	client := dial(t, addr)
+	client.option(NBD_OPT_GO, exportData(""))
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected Serve to be cancelled, got %v", err)
+		}
+		done <- err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return")
+	}
+
+	// The open connection was closed.
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := client.conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
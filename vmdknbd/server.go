@@ -0,0 +1,193 @@
+// Package vmdknbd serves a VMDKContext read only over the NBD protocol
+// (fixed newstyle negotiation), e.g. to qemu or the kernel nbd client.
+package vmdknbd
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/Velocidex/go-vmdk/parser"
+)
+
+type options struct {
+	// When set, the only export name accepted.
+	export_name string
+
+	// Where connection errors are reported, if anywhere.
+	error_log *log.Logger
+}
+
+// Option customizes how Serve answers clients.
+type Option func(self *options)
+
+// WithExportName only accepts clients asking for the export name.
+// By default any name is accepted and "" is listed.
+func WithExportName(name string) Option {
+	return func(self *options) {
+		self.export_name = name
+	}
+}
+
+// WithErrorLog reports failed reads and connections ending in an error
+// to logger. By default they are not reported.
+func WithErrorLog(logger *log.Logger) Option {
+	return func(self *options) {
+		self.error_log = logger
+	}
+}
+
+type server struct {
+	vmdk    *parser.VMDKContext
+	options *options
+
+	// The allocated ranges of the disk for NBD_CMD_BLOCK_STATUS,
+	// worked out when first asked for.
+	ranges      []parser.Range
+	ranges_once sync.Once
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// Serve answers NBD clients connecting to listener until ctx is done,
+// then closes the listener and the open connections and waits for them
+// to finish, so the disk may be closed once Serve returns. It returns
+// ctx.Err() when cancelled, else the error accepting a connection.
+//
+// Clients negotiating structured replies can ask for the
+// base:allocation meta context, which is backed by AllocatedRanges.
+// Open the disk with parser.WithHighResolutionRanges to report holes
+// within sparse extents.
+func Serve(ctx context.Context, listener net.Listener,
+	vmdk *parser.VMDKContext, opts ...Option) error {
+	self := &server{
+		vmdk:    vmdk,
+		options: &options{},
+		conns:   make(map[net.Conn]bool),
+	}
+	for _, o := range opts {
+		o(self.options)
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		listener.Close()
+		self.closeConnections()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		if !self.track(conn) {
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer self.untrack(conn)
+			self.serveConnection(conn)
+		}()
+	}
+}
+
+// Remember the connection so it can be closed on shutdown. Returns
+// false if we are already shutting down.
+func (self *server) track(conn net.Conn) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.closed {
+		return false
+	}
+	self.conns[conn] = true
+	return true
+}
+
+func (self *server) untrack(conn net.Conn) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	delete(self.conns, conn)
+}
+
+func (self *server) closeConnections() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.closed = true
+	for conn := range self.conns {
+		conn.Close()
+	}
+}
+
+func (self *server) logf(format string, args ...interface{}) {
+	if self.options.error_log != nil {
+		self.options.error_log.Printf(format, args...)
+	}
+}
+
+func (self *server) serveConnection(conn net.Conn) {
+	defer conn.Close()
+
+	c := newConnection(self, conn)
+	err := c.negotiate()
+	if err == nil {
+		err = c.transmit()
+	}
+
+	if err != nil && err != io.EOF && err != errAbort && !self.isClosed() {
+		self.logf("%v: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (self *server) isClosed() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.closed
+}
+
+// The allocated ranges overlapping the range at offset, in order.
+func (self *server) allocatedRanges(offset, length int64) []parser.Range {
+	self.ranges_once.Do(func() {
+		self.ranges = self.vmdk.AllocatedRanges()
+	})
+
+	end := offset + length
+	first := sort.Search(len(self.ranges), func(i int) bool {
+		return self.ranges[i].End() > offset
+	})
+
+	var res []parser.Range
+	for _, r := range self.ranges[first:] {
+		if r.Offset >= end {
+			break
+		}
+		res = append(res, r)
+	}
+	return res
+}
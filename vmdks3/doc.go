@@ -0,0 +1,4 @@
+// Package vmdks3 opens the files of a disk stored in an S3 bucket, or
+// any store speaking the S3 API such as MinIO, with the AWS SDK.
+// Extents are read in place with ranged GetObject calls.
+package vmdks3
@@ -0,0 +1,243 @@
+package vmdks3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Velocidex/go-vmdk/parser"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const testBucket = "evidence"
+
+// An in-process S3 fake serving objects of one bucket with path style
+// addressing. It answers HeadObject and ranged GetObject calls.
+type fakeS3 struct {
+	objects map[string][]byte
+
+	mu       sync.Mutex
+	heads    int
+	ranges   []string
+	unsigned int
+}
+
+func (self *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, found := strings.CutPrefix(r.URL.Path, "/"+testBucket+"/")
+
+	self.mu.Lock()
+	if !strings.Contains(r.Header.Get("Authorization"),
+		"Credential=AKIDTEST/") {
+		self.unsigned++
+	}
+	data, pres := self.objects[key]
+	self.mu.Unlock()
+
+	if !found || !pres {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == http.MethodGet {
+			fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code>`+
+				`<Message>The specified key does not exist.</Message>`+
+				`<Key>%v</Key></Error>`, key)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		self.mu.Lock()
+		self.heads++
+		self.mu.Unlock()
+
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		var start, end int
+		_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		if err != nil || start > end || end >= len(data) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		self.mu.Lock()
+		self.ranges = append(self.ranges, r.Header.Get("Range"))
+		self.mu.Unlock()
+
+		w.Header().Set("Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Point the standard credential chain at the fake.
+func startFake(t *testing.T, fake *fakeS3) {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CONFIG_FILE", os.DevNull)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", os.DevNull)
+}
+
+func pathStyle(o *s3.Options) {
+	o.UsePathStyle = true
+}
+
+// A flat disk of 256kb whose descriptor and extent are under
+// different prefixes.
+func testObjects() map[string][]byte {
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i / 1000)
+	}
+
+	return map[string][]byte{
+		"cases/1/vm/vm.vmdk": []byte(`# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 512 FLAT "../disks/vm-flat.vmdk" 0
+`),
+		"cases/1/disks/vm-flat.vmdk": data,
+	}
+}
+
+func TestS3Opener(t *testing.T) {
+	fake := &fakeS3{objects: testObjects()}
+	startFake(t, fake)
+
+	bucket, prefix, filename, err := ParseURL(
+		"s3://" + testBucket + "/cases/1/vm/vm.vmdk")
+	if err != nil || bucket != testBucket || prefix != "cases/1/vm" ||
+		filename != "vm.vmdk" {
+		t.Fatalf("ParseURL: %v %v %v %v", bucket, prefix, filename, err)
+	}
+
+	opener, err := NewOpener(context.Background(), bucket, prefix, pathStyle)
+	if err != nil {
+		t.Fatalf("NewOpener: %v", err)
+	}
+
+	vmdk, err := parser.GetVMDKContextFromOpener(opener, filename)
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromOpener: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.Size() != 256*1024 {
+		t.Fatalf("Unexpected size %v", vmdk.Size())
+	}
+
+	expected := fake.objects["cases/1/disks/vm-flat.vmdk"]
+	buf := make([]byte, 100000)
+	n, err := vmdk.ReadAt(buf, 12345)
+	if err != nil || n != len(buf) {
+		t.Fatalf("ReadAt: %v %v", n, err)
+	}
+	if !bytes.Equal(buf, expected[12345:12345+len(buf)]) {
+		t.Fatalf("Unexpected data")
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	// Every request was signed with the credentials from the
+	// environment. Each object was sized once and data was read with
+	// ranged requests.
+	if fake.unsigned != 0 {
+		t.Fatalf("%v requests were not signed", fake.unsigned)
+	}
+	if fake.heads != 2 {
+		t.Fatalf("Expected 2 size requests, got %v", fake.heads)
+	}
+	if len(fake.ranges) == 0 {
+		t.Fatalf("Expected ranged reads")
+	}
+	for _, r := range fake.ranges {
+		if !strings.HasPrefix(r, "bytes=") {
+			t.Fatalf("Unexpected range %q", r)
+		}
+	}
+}
+
+func TestS3MissingExtent(t *testing.T) {
+	objects := testObjects()
+	delete(objects, "cases/1/disks/vm-flat.vmdk")
+	startFake(t, &fakeS3{objects: objects})
+
+	opener, err := NewOpener(context.Background(), testBucket, "cases/1/vm",
+		pathStyle)
+	if err != nil {
+		t.Fatalf("NewOpener: %v", err)
+	}
+
+	_, err = parser.GetVMDKContextFromOpener(opener, "vm.vmdk")
+	missing := &parser.MissingExtentError{}
+	if !errors.As(err, &missing) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected a missing extent, got %v", err)
+	}
+	if missing.Filename != "cases/1/disks/vm-flat.vmdk" {
+		t.Fatalf("Unexpected filename %v", missing.Filename)
+	}
+
+	// The missing extent reads as zeros.
+	vmdk, err := parser.GetVMDKContextFromOpener(opener, "vm.vmdk",
+		parser.WithLazyOpen(1), parser.WithZeroFillMissingExtents())
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromOpener: %v", err)
+	}
+	defer vmdk.Close()
+
+	buf := make([]byte, 4096)
+	_, err = vmdk.ReadAt(buf, 0)
+	if err != nil || !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Fatalf("Expected zeros for the missing extent: %v", err)
+	}
+}
+
+func TestS3MissingObjectRead(t *testing.T) {
+	// The object is deleted after it was sized.
+	fake := &fakeS3{objects: testObjects()}
+	startFake(t, fake)
+
+	opener, err := NewOpener(context.Background(), testBucket, "cases/1",
+		pathStyle)
+	if err != nil {
+		t.Fatalf("NewOpener: %v", err)
+	}
+
+	reader, _, err := opener("disks/vm-flat.vmdk")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fake.mu.Lock()
+	delete(fake.objects, "cases/1/disks/vm-flat.vmdk")
+	fake.mu.Unlock()
+
+	_, err = reader.ReadAt(make([]byte, 10), 0)
+	missing := &parser.MissingExtentError{}
+	if !errors.As(err, &missing) {
+		t.Fatalf("Expected a missing extent, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package vmdks3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Velocidex/go-vmdk/parser"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Store is a parser.ObjectStore reading the objects of a bucket. Size
+// is a HeadObject call and ReadRange a GetObject call with a Range
+// header.
+type Store struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+}
+
+// NewStore reads the objects of bucket with client. Requests are made
+// with ctx.
+func NewStore(ctx context.Context, client *s3.Client, bucket string) *Store {
+	return &Store{ctx: ctx, client: client, bucket: bucket}
+}
+
+// NewOpener returns a parser.Opener for the objects below prefix in
+// bucket, usually the directory of the descriptor's key:
+//
+//	opener, err := vmdks3.NewOpener(ctx, "evidence", "cases/1")
+//	...
+//	vmdk, err := parser.GetVMDKContextFromOpener(opener, "vm.vmdk")
+//
+// Credentials and the region come from the standard SDK chain
+// (environment, shared config and credentials files, SSO, container
+// and instance roles). AWS_ENDPOINT_URL points it at another store,
+// which usually needs path style addressing:
+//
+//	vmdks3.NewOpener(ctx, bucket, prefix, func(o *s3.Options) {
+//		o.UsePathStyle = true
+//	})
+func NewOpener(ctx context.Context, bucket, prefix string,
+	opts ...func(*s3.Options)) (parser.Opener, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("While loading AWS config: %w", err)
+	}
+
+	store := NewStore(ctx, s3.NewFromConfig(cfg, opts...), bucket)
+	return parser.ObjectOpener(store, prefix), nil
+}
+
+// ParseURL splits an s3://bucket/key URL into the bucket, the
+// directory of the key and its filename, as NewOpener and
+// parser.GetVMDKContextFromOpener take them.
+func ParseURL(url string) (bucket, prefix, filename string, err error) {
+	if !strings.HasPrefix(url, "s3://") {
+		return "", "", "", fmt.Errorf("Not an s3 URL: %v", url)
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(url, "s3://"), "/")
+	if bucket == "" || key == "" {
+		return "", "", "", fmt.Errorf("Invalid s3 URL: %v", url)
+	}
+
+	prefix, filename = path.Split(key)
+	return bucket, strings.TrimSuffix(prefix, "/"), filename, nil
+}
+
+func (self *Store) Size(key string) (int64, error) {
+	res, err := self.client.HeadObject(self.ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(self.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, mapError(err)
+	}
+	return aws.ToInt64(res.ContentLength), nil
+}
+
+func (self *Store) ReadRange(key string, buf []byte, offset int64) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	res, err := self.client.GetObject(self.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(self.bucket),
+		Key:    aws.String(key),
+		Range: aws.String(fmt.Sprintf("bytes=%d-%d",
+			offset, offset+int64(len(buf))-1)),
+	})
+	if err != nil {
+		return 0, mapError(err)
+	}
+	defer res.Body.Close()
+
+	return io.ReadFull(res.Body, buf)
+}
+
+// Objects deleted, or not yet visible, return 404. These wrap
+// os.ErrNotExist so parser.ObjectOpener reports them as missing
+// extents.
+func mapError(err error) error {
+	var response interface{ HTTPStatusCode() int }
+	if errors.As(err, &response) &&
+		response.HTTPStatusCode() == http.StatusNotFound {
+		return fmt.Errorf("%w: %v", os.ErrNotExist, err)
+	}
+	return err
+}
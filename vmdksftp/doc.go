@@ -0,0 +1,5 @@
+// Package vmdksftp opens the files of a disk over SFTP on an existing
+// SSH connection, e.g. to an ESXi host or a NAS, so large extents can
+// be read in place rather than copied first. Files are read with
+// github.com/pkg/sftp.
+package vmdksftp
@@ -0,0 +1,260 @@
+package vmdksftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/Velocidex/go-vmdk/parser"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ConnectionLostError is returned for reads cut short by the SFTP
+// session ending. Retrying may succeed: files are opened again on a
+// new session as long as the SSH connection is up (see
+// parser.WithResilientReads).
+type ConnectionLostError struct {
+	Err error
+}
+
+func (self *ConnectionLostError) Error() string {
+	return fmt.Sprintf("SFTP connection lost: %v", self.Err)
+}
+
+func (self *ConnectionLostError) Unwrap() error {
+	return self.Err
+}
+
+// Temporary reports that the request may be retried.
+func (self *ConnectionLostError) Temporary() bool {
+	return true
+}
+
+type options struct {
+	client_options []sftp.ClientOption
+}
+
+// Option customizes an Opener.
+type Option func(self *options)
+
+// WithMaxRequests bounds the read requests outstanding at once for
+// each file. Large reads are split into several requests sent
+// together. It defaults to 64.
+func WithMaxRequests(n int) Option {
+	return func(self *options) {
+		self.client_options = append(self.client_options,
+			sftp.MaxConcurrentRequestsPerFile(n))
+	}
+}
+
+// Opener opens the files of a disk over SFTP. Its Open method is a
+// parser.Opener:
+//
+//	opener, err := vmdksftp.NewOpener(client, "/vmfs/volumes/datastore1/vm")
+//	...
+//	vmdk, err := parser.GetVMDKContextFromOpener(opener.Open, "vm.vmdk")
+//
+// Relative filenames are resolved against the real path of the
+// directory on the server, so "../base.vmdk" from a directory reached
+// through a symlink (e.g. a datastore name under /vmfs/volumes
+// standing for its UUID) names the same file the host would use.
+// Absolute filenames, such as UUID paths in parentFileNameHint, are
+// resolved by the server.
+type Opener struct {
+	// Starts a new session.
+	start func() (*sftp.Client, error)
+
+	// The real path of the directory.
+	dir string
+
+	mu      sync.Mutex
+	current *session
+}
+
+// An SFTP session. done is closed when it ends.
+type session struct {
+	client *sftp.Client
+	done   chan struct{}
+}
+
+func (self *session) lost() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewOpener starts an SFTP session on conn for the files in dir.
+// If the session ends, e.g. the server restarts sftp-server, files are
+// opened again on a new one when next read. Close ends the session but
+// not the SSH connection.
+func NewOpener(conn *ssh.Client, dir string, opts ...Option) (*Opener, error) {
+	options := &options{}
+	for _, o := range opts {
+		o(options)
+	}
+
+	self := &Opener{
+		start: func() (*sftp.Client, error) {
+			return sftp.NewClient(conn, options.client_options...)
+		},
+	}
+
+	current, err := self.session()
+	if err != nil {
+		return nil, err
+	}
+
+	self.dir, err = current.client.RealPath(dir)
+	if err != nil {
+		self.Close()
+		return nil, fmt.Errorf("While resolving %v: %w", dir, err)
+	}
+	return self, nil
+}
+
+// The current session, starting a new one if it ended.
+func (self *Opener) session() (*session, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.current != nil && !self.current.lost() {
+		return self.current, nil
+	}
+
+	client, err := self.start()
+	if err != nil {
+		return nil, &ConnectionLostError{Err: err}
+	}
+
+	res := &session{client: client, done: make(chan struct{})}
+	go func() {
+		client.Wait()
+		close(res.done)
+	}()
+
+	self.current = res
+	return res, nil
+}
+
+// Dir returns the real path of the directory on the server.
+func (self *Opener) Dir() string {
+	return self.dir
+}
+
+// Path returns the remote path filename refers to.
+func (self *Opener) Path(filename string) string {
+	if path.IsAbs(filename) {
+		return filename
+	}
+	return path.Join(self.dir, filename)
+}
+
+// Open opens filename for reading. A missing file returns a
+// parser.MissingExtentError. The reader reports the size of the file
+// and is cached as with parser.HTTPOpener.
+func (self *Opener) Open(filename string) (io.ReaderAt, func(), error) {
+	res := &file{opener: self, path: self.Path(filename)}
+	_, _, err := res.handle()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, &parser.MissingExtentError{Filename: res.path, Err: err}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("While opening %v: %w", res.path, err)
+	}
+
+	return parser.NewCachingReaderAt(res, parser.HTTP_PAGE_SIZE,
+		parser.HTTP_PAGE_COUNT), res.close, nil
+}
+
+// Close ends the session.
+func (self *Opener) Close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.current != nil {
+		self.current.client.Close()
+	}
+}
+
+// A remote file.
+type file struct {
+	opener *Opener
+	path   string
+
+	// The session the file is open on, and the file there.
+	mu      sync.Mutex
+	session *session
+	remote  *sftp.File
+	size    int64
+}
+
+func (self *file) Size() int64 {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.size
+}
+
+// The file on the current session, opening it again if the session it
+// was opened on ended.
+func (self *file) handle() (*session, *sftp.File, error) {
+	current, err := self.opener.session()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.session == current {
+		return current, self.remote, nil
+	}
+
+	remote, err := current.client.Open(self.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stat, err := remote.Stat()
+	if err != nil {
+		remote.Close()
+		return nil, nil, err
+	}
+
+	self.session, self.remote, self.size = current, remote, stat.Size()
+	return current, remote, nil
+}
+
+func (self *file) close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.remote != nil && !self.session.lost() {
+		self.remote.Close()
+	}
+	self.session, self.remote = nil, nil
+}
+
+func (self *file) ReadAt(buf []byte, offset int64) (int, error) {
+	current, remote, err := self.handle()
+	if err != nil {
+		return 0, err
+	}
+
+	if offset < 0 || offset >= self.Size() {
+		return 0, io.EOF
+	}
+
+	n, err := remote.ReadAt(buf, offset)
+	if err != nil && err != io.EOF &&
+		(errors.Is(err, sftp.ErrSSHFxConnectionLost) || current.lost()) {
+		return n, &ConnectionLostError{Err: err}
+	}
+	return n, err
+}
@@ -0,0 +1,324 @@
+package vmdksftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Velocidex/go-vmdk/parser"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testUUID = "/vmfs/volumes/5f1e2d3c-aabbccdd-eeff-001122334455"
+	testLink = "/vmfs/volumes/datastore1"
+)
+
+// An SFTP server over files in memory, using the request server of
+// github.com/pkg/sftp. The datastore name is a symlink to its UUID
+// path, as on ESXi.
+type testServer struct {
+	files map[string][]byte
+
+	mu       sync.Mutex
+	sessions int
+	reads    int
+
+	// If set, the session is dropped on this read.
+	drop_at int
+}
+
+func (self *testServer) resolve(name string) string {
+	name = path.Clean("/" + name)
+	if name == testLink || strings.HasPrefix(name, testLink+"/") {
+		name = testUUID + strings.TrimPrefix(name, testLink)
+	}
+	return name
+}
+
+// The handlers of one session, which ch carries.
+type testHandlers struct {
+	server *testServer
+	ch     ssh.Channel
+}
+
+func (self *testHandlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	data, pres := self.server.files[self.server.resolve(r.Filepath)]
+	if !pres {
+		return nil, os.ErrNotExist
+	}
+	return &testReader{handlers: self, data: data}, nil
+}
+
+func (self *testHandlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := self.server.resolve(r.Filepath)
+	data, pres := self.server.files[name]
+	if !pres || r.Method != "Stat" {
+		return nil, os.ErrNotExist
+	}
+	return testLister{&testFileInfo{name: path.Base(name), size: len(data)}}, nil
+}
+
+func (self *testHandlers) RealPath(name string) (string, error) {
+	return self.server.resolve(name), nil
+}
+
+type testReader struct {
+	handlers *testHandlers
+	data     []byte
+}
+
+func (self *testReader) ReadAt(buf []byte, offset int64) (int, error) {
+	server := self.handlers.server
+	server.mu.Lock()
+	server.reads++
+	drop := server.reads == server.drop_at
+	server.mu.Unlock()
+	if drop {
+		self.handlers.ch.Close()
+		return 0, io.ErrClosedPipe
+	}
+
+	return bytes.NewReader(self.data).ReadAt(buf, offset)
+}
+
+type testLister []os.FileInfo
+
+func (self testLister) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(self)) {
+		return 0, io.EOF
+	}
+	n := copy(out, self[offset:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type testFileInfo struct {
+	name string
+	size int
+}
+
+func (self *testFileInfo) Name() string       { return self.name }
+func (self *testFileInfo) Size() int64        { return int64(self.size) }
+func (self *testFileInfo) Mode() os.FileMode  { return 0644 }
+func (self *testFileInfo) ModTime() time.Time { return time.Time{} }
+func (self *testFileInfo) IsDir() bool        { return false }
+func (self *testFileInfo) Sys() interface{}   { return nil }
+
+func (self *testServer) serve(ch ssh.Channel) {
+	defer ch.Close()
+
+	self.mu.Lock()
+	self.sessions++
+	self.mu.Unlock()
+
+	handlers := &testHandlers{server: self, ch: ch}
+	server := sftp.NewRequestServer(ch, sftp.Handlers{
+		FileGet:  handlers,
+		FileList: handlers,
+	})
+	server.Serve()
+	server.Close()
+}
+
+// Connect to an SSH server serving server as its sftp subsystem.
+func startServer(t *testing.T, server *testServer) *ssh.Client {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		_, channels, requests, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+
+		for new_channel := range channels {
+			ch, requests, err := new_channel.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				for req := range requests {
+					ok := req.Type == "subsystem" &&
+						bytes.HasSuffix(req.Payload, []byte("sftp"))
+					req.Reply(ok, nil)
+					if ok {
+						go server.serve(ch)
+					}
+				}
+			}()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// A flat disk of 256kb whose descriptor and extent are in different
+// directories of the datastore.
+func testFiles() map[string][]byte {
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i / 1000)
+	}
+
+	return map[string][]byte{
+		testUUID + "/vm/vm.vmdk": []byte(`# Disk DescriptorFile
+version=1
+CID=11111111
+parentCID=ffffffff
+createType="monolithicFlat"
+
+# Extent description
+RW 512 FLAT "../disks/vm-flat.vmdk" 0
+`),
+		testUUID + "/disks/vm-flat.vmdk": data,
+	}
+}
+
+func TestSFTPOpener(t *testing.T) {
+	server := &testServer{files: testFiles()}
+	opener, err := NewOpener(startServer(t, server), testLink+"/vm",
+		WithMaxRequests(2))
+	if err != nil {
+		t.Fatalf("NewOpener: %v", err)
+	}
+	defer opener.Close()
+
+	// Relative paths resolve on the UUID side of the symlink.
+	if opener.Dir() != testUUID+"/vm" {
+		t.Fatalf("Unexpected dir %v", opener.Dir())
+	}
+
+	vmdk, err := parser.GetVMDKContextFromOpener(opener.Open, "vm.vmdk")
+	if err != nil {
+		t.Fatalf("GetVMDKContextFromOpener: %v", err)
+	}
+	defer vmdk.Close()
+
+	if vmdk.Size() != 256*1024 {
+		t.Fatalf("Unexpected size %v", vmdk.Size())
+	}
+
+	// Spans several read requests.
+	expected := server.files[testUUID+"/disks/vm-flat.vmdk"]
+	buf := make([]byte, 100000)
+	n, err := vmdk.ReadAt(buf, 12345)
+	if err != nil || n != len(buf) {
+		t.Fatalf("ReadAt: %v %v", n, err)
+	}
+	if !bytes.Equal(buf, expected[12345:12345+len(buf)]) {
+		t.Fatalf("Unexpected data")
+	}
+}
+
+func TestSFTPMissingExtent(t *testing.T) {
+	files := testFiles()
+	delete(files, testUUID+"/disks/vm-flat.vmdk")
+
+	opener, err := NewOpener(startServer(t, &testServer{files: files}),
+		testLink+"/vm")
+	if err != nil {
+		t.Fatalf("NewOpener: %v", err)
+	}
+	defer opener.Close()
+
+	_, err = parser.GetVMDKContextFromOpener(opener.Open, "vm.vmdk")
+	missing := &parser.MissingExtentError{}
+	if !errors.As(err, &missing) {
+		t.Fatalf("Expected a missing extent, got %v", err)
+	}
+	if missing.Filename != testUUID+"/disks/vm-flat.vmdk" {
+		t.Fatalf("Unexpected filename %v", missing.Filename)
+	}
+}
+
+func TestSFTPConnectionLost(t *testing.T) {
+	server := &testServer{files: testFiles()}
+	opener, err := NewOpener(startServer(t, server), testLink+"/disks")
+	if err != nil {
+		t.Fatalf("NewOpener: %v", err)
+	}
+	defer opener.Close()
+
+	reader, closer, err := opener.Open("vm-flat.vmdk")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer closer()
+
+	buf := make([]byte, 1000)
+	_, err = reader.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+
+	// Drop the session on the next read, which is past the cached
+	// page.
+	server.mu.Lock()
+	server.drop_at = server.reads + 1
+	server.mu.Unlock()
+
+	_, err = reader.ReadAt(buf, 128*1024)
+	lost := &ConnectionLostError{}
+	if !errors.As(err, &lost) || !lost.Temporary() {
+		t.Fatalf("Expected a lost connection, got %v", err)
+	}
+
+	// The file is opened again on a new session.
+	n, err := reader.ReadAt(buf, 128*1024)
+	if err != nil || n != len(buf) {
+		t.Fatalf("ReadAt: %v %v", n, err)
+	}
+	expected := server.files[testUUID+"/disks/vm-flat.vmdk"]
+	if !bytes.Equal(buf, expected[128*1024:128*1024+len(buf)]) {
+		t.Fatalf("Unexpected data")
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.sessions != 2 {
+		t.Fatalf("Expected 2 sessions, got %v", server.sessions)
+	}
+}